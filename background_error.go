@@ -0,0 +1,238 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The backoff before retrying a failed flush or compaction doubles with each
+// consecutive failure, starting at minBackgroundErrorBackoff, up to
+// maxBackgroundErrorBackoff.
+const (
+	minBackgroundErrorBackoff = 10 * time.Millisecond
+	maxBackgroundErrorBackoff = 10 * time.Second
+)
+
+// BackgroundErrorSeverity classifies the errors encountered by background
+// operations such as flushes and compactions.
+type BackgroundErrorSeverity int
+
+const (
+	// BackgroundErrorRetryable indicates a transient error. The failed
+	// operation is retried after an exponential backoff and writes continue to
+	// be accepted.
+	BackgroundErrorRetryable BackgroundErrorSeverity = iota
+	// BackgroundErrorNoSpace indicates that the DB ran out of disk space.
+	// Flushes and compactions are suspended and writes fail with a
+	// *BackgroundError until DB.Resume is called once space has been freed.
+	BackgroundErrorNoSpace
+	// BackgroundErrorFatal indicates an error after which the in-memory state
+	// of the DB can no longer be reconciled with the state on disk, such as a
+	// failure to write the MANIFEST. The DB falls back to being read-only:
+	// reads continue to be served, but writes fail with a *BackgroundError
+	// until the DB is closed and reopened.
+	BackgroundErrorFatal
+)
+
+func (s BackgroundErrorSeverity) String() string {
+	switch s {
+	case BackgroundErrorRetryable:
+		return "retryable"
+	case BackgroundErrorNoSpace:
+		return "no-space"
+	case BackgroundErrorFatal:
+		return "fatal"
+	default:
+		return fmt.Sprintf("BackgroundErrorSeverity(%d)", int(s))
+	}
+}
+
+// BackgroundError is returned by write operations once writes have been
+// stopped by an error encountered by a background operation.
+type BackgroundError struct {
+	Severity BackgroundErrorSeverity
+	Err      error
+}
+
+func (e *BackgroundError) Error() string {
+	return fmt.Sprintf("pebble: writes stopped by %s background error: %v", e.Severity, e.Err)
+}
+
+// Unwrap returns the error encountered by the background operation.
+func (e *BackgroundError) Unwrap() error {
+	return e.Err
+}
+
+// backgroundErrorSeverity classifies an error encountered by a flush or
+// compaction. The error's chain of wrapped errors is examined, so that e.g. an
+// ENOSPC wrapped in an *os.PathError is classified as BackgroundErrorNoSpace.
+func backgroundErrorSeverity(err error) BackgroundErrorSeverity {
+	for ; err != nil; err = unwrapError(err) {
+		switch e := err.(type) {
+		case *manifestError:
+			return BackgroundErrorFatal
+		case syscall.Errno:
+			if e == syscall.ENOSPC {
+				return BackgroundErrorNoSpace
+			}
+		}
+	}
+	return BackgroundErrorRetryable
+}
+
+// unwrapError returns the error wrapped by err, or nil if err does not wrap
+// another error. It understands the error types in the os package, which do
+// not implement Unwrap prior to Go 1.13.
+func unwrapError(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return e.Err
+	case *os.LinkError:
+		return e.Err
+	case *os.SyscallError:
+		return e.Err
+	case interface{ Unwrap() error }:
+		return e.Unwrap()
+	}
+	return nil
+}
+
+// backgroundErrorBackoff returns the backoff before retrying an operation
+// which has failed the specified number of consecutive times.
+func backgroundErrorBackoff(failures int) time.Duration {
+	backoff := minBackgroundErrorBackoff
+	for i := 1; i < failures && backoff < maxBackgroundErrorBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackgroundErrorBackoff {
+		backoff = maxBackgroundErrorBackoff
+	}
+	return backoff
+}
+
+// handleBackgroundErrorLocked handles the result of a flush or compaction,
+// where failures is the count of consecutive failures of that kind of
+// operation. An error is reported to the EventListener and classified: a
+// retryable error returns the backoff to wait before the operation is
+// retried, while other errors stop writes.
+//
+// d.mu must be held when calling this.
+func (d *DB) handleBackgroundErrorLocked(err error, failures *int) time.Duration {
+	if err == nil {
+		*failures = 0
+		return 0
+	}
+	if err == ErrColumnFamilyDropped {
+		return 0
+	}
+	d.opts.EventListener.BackgroundError(err)
+	if severity := backgroundErrorSeverity(err); severity != BackgroundErrorRetryable {
+		d.stopWritesLocked(severity, err)
+		return 0
+	}
+	*failures++
+	return backgroundErrorBackoff(*failures)
+}
+
+// maybeStopWritesLocked stops writes if a foreground operation encountered a
+// fatal error, such as a failure to write the MANIFEST while ingesting.
+//
+// d.mu must be held when calling this.
+func (d *DB) maybeStopWritesLocked(err error) {
+	if err != nil && backgroundErrorSeverity(err) == BackgroundErrorFatal {
+		d.stopWritesLocked(BackgroundErrorFatal, err)
+	}
+}
+
+// stopWritesLocked stops writes, flushes and compactions due to the specified
+// error. An error of a higher severity replaces the current one.
+//
+// d.mu must be held when calling this.
+func (d *DB) stopWritesLocked(severity BackgroundErrorSeverity, err error) {
+	if cur := d.mu.bgError.err; cur != nil && cur.Severity >= severity {
+		return
+	}
+	if d.mu.bgError.err == nil {
+		close(d.mu.bgError.stopped)
+	}
+	d.mu.bgError.err = &BackgroundError{Severity: severity, Err: err}
+	atomic.StoreInt32(&d.writesStopped, 1)
+	d.opts.Logger.Infof("%s", d.mu.bgError.err)
+	// Fail any pending manual compactions and wake up anyone waiting on a
+	// write stall.
+	d.maybeScheduleCompaction()
+	d.mu.compact.cond.Broadcast()
+}
+
+// writesStoppedErr returns the error which stopped writes, or nil if writes
+// have not been stopped.
+func (d *DB) writesStoppedErr() error {
+	if atomic.LoadInt32(&d.writesStopped) == 0 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mu.bgError.err == nil {
+		return nil
+	}
+	return d.mu.bgError.err
+}
+
+// backoffLocked waits for the specified duration, or until the DB is closed.
+//
+// d.mu must be held when calling this, but it is released while waiting.
+func (d *DB) backoffLocked(backoff time.Duration) {
+	if backoff == 0 {
+		return
+	}
+	deadline := time.Now().Add(backoff)
+	for atomic.LoadInt32(&d.closed) == 0 && time.Now().Before(deadline) {
+		d.waitLocked(time.Until(deadline))
+	}
+}
+
+// Resume resumes writes, flushes and compactions after they were stopped by
+// the DB running out of disk space. Resume should be called once space has
+// been freed. It waits for the flushes of the memtables which accumulated
+// while writes were stopped, and returns an error if writes are stopped
+// again. Resume returns the error which stopped writes if it was fatal, as
+// such a DB must be closed and reopened. Resume returns nil if writes are not
+// stopped.
+func (d *DB) Resume() error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bgErr := d.mu.bgError.err
+	if bgErr == nil {
+		return nil
+	}
+	if bgErr.Severity == BackgroundErrorFatal {
+		return bgErr
+	}
+	d.mu.bgError.err = nil
+	d.mu.bgError.stopped = make(chan struct{})
+	d.mu.bgError.flushFailures = 0
+	d.mu.bgError.compactionFailures = 0
+	atomic.StoreInt32(&d.writesStopped, 0)
+	d.opts.Logger.Infof("resuming writes after %s background error: %v", bgErr.Severity, bgErr.Err)
+
+	d.maybeScheduleFlush()
+	d.maybeScheduleCompaction()
+	for d.flushableLocked() && d.mu.bgError.err == nil && atomic.LoadInt32(&d.closed) == 0 {
+		d.mu.compact.cond.Wait()
+	}
+	if d.mu.bgError.err != nil {
+		return d.mu.bgError.err
+	}
+	return nil
+}
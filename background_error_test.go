@@ -0,0 +1,56 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBackgroundErrorSeverity(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected BackgroundErrorSeverity
+	}{
+		{fmt.Errorf("injected error"), BackgroundErrorRetryable},
+		{syscall.ENOSPC, BackgroundErrorNoSpace},
+		{&os.PathError{Op: "write", Path: "000005.sst", Err: syscall.ENOSPC}, BackgroundErrorNoSpace},
+		{&os.LinkError{Op: "link", Old: "ext", New: "000005.sst", Err: syscall.ENOSPC}, BackgroundErrorNoSpace},
+		{os.NewSyscallError("fallocate", syscall.ENOSPC), BackgroundErrorNoSpace},
+		{&os.PathError{Op: "write", Path: "000005.sst", Err: syscall.EIO}, BackgroundErrorRetryable},
+		{&BackgroundError{Err: &manifestError{op: "sync", err: syscall.EIO}}, BackgroundErrorFatal},
+		{&manifestError{op: "sync", err: syscall.EIO}, BackgroundErrorFatal},
+		{&manifestError{op: "sync", err: syscall.ENOSPC}, BackgroundErrorFatal},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			if severity := backgroundErrorSeverity(c.err); c.expected != severity {
+				t.Fatalf("%v: expected %s, but found %s", c.err, c.expected, severity)
+			}
+		})
+	}
+}
+
+func TestBackgroundErrorBackoff(t *testing.T) {
+	testCases := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{10, 5120 * time.Millisecond},
+		{11, 10 * time.Second},
+		{1000, 10 * time.Second},
+	}
+	for _, c := range testCases {
+		if backoff := backgroundErrorBackoff(c.failures); c.expected != backoff {
+			t.Fatalf("%d: expected %s, but found %s", c.failures, c.expected, backoff)
+		}
+	}
+}
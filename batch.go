@@ -12,6 +12,7 @@ import (
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/cockroachdb/pebble/internal/base"
@@ -55,7 +56,15 @@ type batchStorage struct {
 // Get implements Storage.Get, as documented in the pebble/batchskl package.
 func (s *batchStorage) Get(offset uint32) InternalKey {
 	kind := InternalKeyKind(s.data[offset])
-	_, key, ok := batchDecodeStr(s.data[offset+1:])
+	p := s.data[offset+1:]
+	if k, isCF := columnFamilyKindBase(kind); isCF {
+		_, n := binary.Uvarint(p)
+		if n <= 0 {
+			panic(fmt.Sprintf("corrupted batch entry: %d", offset))
+		}
+		kind, p = k, p[n:]
+	}
+	_, key, ok := batchDecodeStr(p)
 	if !ok {
 		panic(fmt.Sprintf("corrupted batch entry: %d", offset))
 	}
@@ -80,6 +89,61 @@ func (s *batchStorage) Compare(a []byte, b uint32) int {
 	return 1
 }
 
+// columnFamilyBatchStorage is the batchskl.Storage for the index of the
+// records for a non-default column family. The records are stored in the
+// batch's storage, but are ordered using the column family's comparer.
+type columnFamilyBatchStorage struct {
+	*batchStorage
+	cmp            Compare
+	abbreviatedKey AbbreviatedKey
+}
+
+// AbbreviatedKey implements Storage.AbbreviatedKey, as documented in the
+// pebble/batchskl package.
+func (s *columnFamilyBatchStorage) AbbreviatedKey(key []byte) uint64 {
+	return s.abbreviatedKey(key)
+}
+
+// Compare implements Storage.Compare, as documented in the pebble/batchskl
+// package.
+func (s *columnFamilyBatchStorage) Compare(a []byte, b uint32) int {
+	// See batchStorage.Compare.
+	if s.cmp(a, s.Get(b).UserKey) <= 0 {
+		return -1
+	}
+	return 1
+}
+
+// columnFamilyBatchIndex indexes the records of an indexed batch for a
+// non-default column family.
+type columnFamilyBatchIndex struct {
+	cfID          uint32
+	storage       columnFamilyBatchStorage
+	index         *batchskl.Skiplist
+	rangeDelIndex *batchskl.Skiplist
+
+	// Fragmented range deletion tombstones. See Batch.tombstones.
+	tombstones []rangedel.Tombstone
+}
+
+// add adds the record at the specified offset to the index.
+func (i *columnFamilyBatchIndex) add(kind InternalKeyKind, offset uint32) {
+	var err error
+	if kind == InternalKeyKindRangeDelete {
+		i.tombstones = nil
+		if i.rangeDelIndex == nil {
+			i.rangeDelIndex = batchskl.NewSkiplist(&i.storage, 0)
+		}
+		err = i.rangeDelIndex.Add(offset)
+	} else {
+		err = i.index.Add(offset)
+	}
+	if err != nil {
+		// We never add duplicate entries, so an error should never occur.
+		panic(err)
+	}
+}
+
 // DeferredBatchOp represents a batch operation (eg. set, merge, delete) that is
 // being inserted into the batch. Indexing is not performed on the specified key
 // until Finish is called, hence the name deferred. This struct lets the caller
@@ -198,9 +262,26 @@ func (d DeferredBatchOp) Finish() {
 //   InternalKeyKindSet          varstring varstring
 //   InternalKeyKindMerge        varstring varstring
 //   InternalKeyKindRangeDelete  varstring varstring
+//   InternalKeyKindSetWithTTL   varstring varstring
 //
 // The intuitive understanding here are that the arguments to Delete(), Set(),
-// Merge(), and DeleteRange() are encoded into the batch.
+// Merge(), and DeleteRange() are encoded into the batch. The value of an
+// InternalKeyKindSetWithTTL record is prefixed with the 8-byte expiration
+// time of the key (see SetWithTTL).
+//
+// Records for a column family other than the default column family (see
+// Batch.SetCF and friends) use the column family variant of the kind tag,
+// followed by the varint32 column family ID:
+//
+//   InternalKeyKindColumnFamilyDeletion      varint32 varstring
+//   InternalKeyKindColumnFamilySingleDelete  varint32 varstring
+//   InternalKeyKindColumnFamilyValue         varint32 varstring varstring
+//   InternalKeyKindColumnFamilyMerge         varint32 varstring varstring
+//   InternalKeyKindColumnFamilyRangeDelete   varint32 varstring varstring
+//
+// The records for a non-default column family are indexed separately, using
+// the column family's comparer, and are read from an indexed batch using
+// Batch.GetCF and Batch.NewIterCF.
 //
 // The internal batch representation is the on disk format for a batch in the
 // WAL, and thus stable. New record kinds may be added, but the existing ones
@@ -208,7 +289,15 @@ func (d DeferredBatchOp) Finish() {
 type Batch struct {
 	storage batchStorage
 
-	memTableSize uint32
+	// memTableSize is the memtable space needed by the records for the default
+	// column family. The space needed by the records for other column families
+	// is tracked in cfMemTableSizes.
+	memTableSize    uint32
+	cfMemTableSizes []batchMemTableSize
+
+	// The memtables for the non-default column families referenced by the
+	// batch. Set by DB.commitWrite and released by DB.commitApply.
+	cfMemTables []*memTable
 
 	// The db to which the batch will be committed.
 	db *DB
@@ -230,6 +319,10 @@ type Batch struct {
 	// range deletion is added to the batch.
 	tombstones []rangedel.Tombstone
 
+	// The indexes of the records for non-default column families, if the batch
+	// is indexed. Sorted by column family ID.
+	cfIndexes []*columnFamilyBatchIndex
+
 	// The flushableBatch wrapper if the batch is too large to fit in the
 	// memtable.
 	flushable *flushableBatch
@@ -242,6 +335,13 @@ type Batch struct {
 var _ Reader = (*Batch)(nil)
 var _ Writer = (*Batch)(nil)
 
+// batchMemTableSize is the memtable space needed by the records in a batch for
+// a non-default column family.
+type batchMemTableSize struct {
+	cfID uint32
+	size uint32
+}
+
 var batchPool = sync.Pool{
 	New: func() interface{} {
 		return &Batch{}
@@ -283,6 +383,9 @@ func (b *Batch) release() {
 	b.storage.cmp = nil
 	b.storage.abbreviatedKey = nil
 	b.memTableSize = 0
+	b.cfMemTableSizes = b.cfMemTableSizes[:0]
+	b.cfMemTables = nil
+	b.cfIndexes = nil
 
 	b.flushable = nil
 	b.commit = sync.WaitGroup{}
@@ -307,15 +410,46 @@ func (b *Batch) release() {
 
 func (b *Batch) refreshMemTableSize() {
 	b.memTableSize = 0
+	b.cfMemTableSizes = b.cfMemTableSizes[:0]
 	for r := b.Reader(); ; {
-		_, key, value, ok := r.Next()
+		cfID, _, key, value, ok := r.NextColumnFamily()
 		if !ok {
 			break
 		}
-		b.memTableSize += memTableEntrySize(len(key), len(value))
+		b.addMemTableSize(cfID, memTableEntrySize(len(key), len(value)))
 	}
 }
 
+// addMemTableSize adds size to the memtable space needed by the records for
+// the specified column family.
+func (b *Batch) addMemTableSize(cfID uint32, size uint32) {
+	if cfID == 0 {
+		b.memTableSize += size
+		return
+	}
+	for i := range b.cfMemTableSizes {
+		if b.cfMemTableSizes[i].cfID == cfID {
+			b.cfMemTableSizes[i].size += size
+			return
+		}
+	}
+	b.cfMemTableSizes = append(b.cfMemTableSizes, batchMemTableSize{cfID: cfID, size: size})
+}
+
+// columnFamilyMemTableSize returns the memtable space needed by the records
+// for the specified column family.
+func (b *Batch) columnFamilyMemTableSize(cfID uint32) uint32 {
+	if cfID == 0 {
+		return b.memTableSize
+	}
+	for i := range b.cfMemTableSizes {
+		if b.cfMemTableSizes[i].cfID == cfID {
+			return b.cfMemTableSizes[i].size
+		}
+	}
+	return 0
+}
+
 // Apply the operations contained in the batch to the receiver batch.
 //
 // It is safe to modify the contents of the arguments after Apply returns.
@@ -326,6 +460,23 @@ func (b *Batch) Apply(batch *Batch, _ *WriteOptions) error {
 	if len(batch.storage.data) < batchHeaderLen {
 		return errors.New("pebble: invalid batch")
 	}
+	if b.index != nil {
+		// Create the indexes for the column families referenced by the batch
+		// before modifying the receiver so that a dropped column family leaves
+		// it unchanged.
+		for _, s := range batch.cfMemTableSizes {
+			if cfIndex, _ := b.findColumnFamilyIndex(s.cfID); cfIndex != nil {
+				continue
+			}
+			b.db.mu.Lock()
+			cf := b.db.getColumnFamilyLocked(s.cfID)
+			b.db.mu.Unlock()
+			if cf == nil {
+				return ErrColumnFamilyDropped
+			}
+			b.columnFamilyIndex(cf)
+		}
+	}
 
 	offset := len(b.storage.data)
 	if offset == 0 {
@@ -338,11 +489,15 @@ func (b *Batch) Apply(batch *Batch, _ *WriteOptions) error {
 
 	for iter := BatchReader(b.storage.data[offset:]); len(iter) > 0; {
 		offset := uintptr(unsafe.Pointer(&iter[0])) - uintptr(unsafe.Pointer(&b.storage.data[0]))
-		kind, key, value, ok := iter.Next()
+		cfID, kind, key, value, ok := iter.NextColumnFamily()
 		if !ok {
 			break
 		}
-		if b.index != nil {
+		if b.index != nil && cfID != 0 {
+			// The index was created above.
+			cfIndex, _ := b.findColumnFamilyIndex(cfID)
+			cfIndex.add(kind, uint32(offset))
+		} else if b.index != nil {
 			var err error
 			if kind == InternalKeyKindRangeDelete {
 				if b.rangeDelIndex == nil {
@@ -357,7 +512,7 @@ func (b *Batch) Apply(batch *Batch, _ *WriteOptions) error {
 				panic(err)
 			}
 		}
-		b.memTableSize += memTableEntrySize(len(key), len(value))
+		b.addMemTableSize(cfID, memTableEntrySize(len(key), len(value)))
 	}
 	return nil
 }
@@ -371,24 +526,28 @@ func (b *Batch) Get(key []byte) (value []byte, err error) {
 	if b.index == nil {
 		return nil, ErrNotIndexed
 	}
-	return b.db.getInternal(key, b, nil /* snapshot */)
+	return b.db.getInternal(b.db.defaultCF, key, b, nil /* snapshot */)
 }
 
 func (b *Batch) prepareDeferredKeyValueRecord(
-	keyLen, valueLen int, kind InternalKeyKind) error {
+	cfID uint32, keyLen, valueLen int, kind InternalKeyKind) error {
 	if len(b.storage.data) == 0 {
-		b.init(keyLen + valueLen + 2*binary.MaxVarintLen64 + batchHeaderLen)
+		b.init(keyLen + valueLen + 3*binary.MaxVarintLen64 + batchHeaderLen)
 	}
 	if !b.increment() {
 		return ErrInvalidBatch
 	}
-	b.memTableSize += memTableEntrySize(keyLen, valueLen)
+	b.addMemTableSize(cfID, memTableEntrySize(keyLen, valueLen))
 
 	pos := len(b.storage.data)
 	b.deferredOp.offset = uint32(pos)
-	b.grow(1 + 2*maxVarintLen32 + keyLen + valueLen)
-	b.storage.data[pos] = byte(kind)
-	pos++
+	var cfLen int
+	if cfID != 0 {
+		cfLen = maxVarintLen32
+	}
+	b.grow(1 + cfLen + 2*maxVarintLen32 + keyLen + valueLen)
+	n, varlen0 := b.putKind(pos, cfID, kind)
+	pos += n
 
 	varlen1 := putUvarint32(b.storage.data[pos:], uint32(keyLen))
 	pos += varlen1
@@ -401,25 +560,29 @@ func (b *Batch) prepareDeferredKeyValueRecord(
 	pos += valueLen
 	// Shrink data since varints may be shorter than the upper bound.
 	b.storage.data =
-		b.storage.data[:len(b.storage.data)-(2*maxVarintLen32-varlen1-varlen2)]
+		b.storage.data[:len(b.storage.data)-(cfLen+2*maxVarintLen32-varlen0-varlen1-varlen2)]
 	return nil
 }
 
 func (b *Batch) prepareDeferredKeyRecord(
-	keyLen int, kind InternalKeyKind) error {
+	cfID uint32, keyLen int, kind InternalKeyKind) error {
 	if len(b.storage.data) == 0 {
-		b.init(keyLen + binary.MaxVarintLen64 + batchHeaderLen)
+		b.init(keyLen + 2*binary.MaxVarintLen64 + batchHeaderLen)
 	}
 	if !b.increment() {
 		return ErrInvalidBatch
 	}
-	b.memTableSize += memTableEntrySize(keyLen, 0)
+	b.addMemTableSize(cfID, memTableEntrySize(keyLen, 0))
 
 	pos := len(b.storage.data)
 	b.deferredOp.offset = uint32(pos)
-	b.grow(1 + maxVarintLen32 + keyLen)
-	b.storage.data[pos] = byte(kind)
-	pos++
+	var cfLen int
+	if cfID != 0 {
+		cfLen = maxVarintLen32
+	}
+	b.grow(1 + cfLen + maxVarintLen32 + keyLen)
+	n, varlen0 := b.putKind(pos, cfID, kind)
+	pos += n
 
 	varlen1 := putUvarint32(b.storage.data[pos:], uint32(keyLen))
 	pos += varlen1
@@ -427,10 +590,23 @@ func (b *Batch) prepareDeferredKeyRecord(
 	b.deferredOp.Value = nil
 
 	// Shrink data since varint may be shorter than the upper bound.
-	b.storage.data = b.storage.data[:len(b.storage.data)-(maxVarintLen32-varlen1)]
+	b.storage.data = b.storage.data[:len(b.storage.data)-(cfLen+maxVarintLen32-varlen0-varlen1)]
 	return nil
 }
 
+// putKind encodes the kind tag for a record at pos, followed by the column
+// family ID if the record is for a non-default column family. Returns the
+// number of bytes written and the length of the encoded column family ID.
+func (b *Batch) putKind(pos int, cfID uint32, kind InternalKeyKind) (n int, cfVarlen int) {
+	if cfID == 0 {
+		b.storage.data[pos] = byte(kind)
+		return 1, 0
+	}
+	b.storage.data[pos] = byte(columnFamilyKind(kind))
+	cfVarlen = putUvarint32(b.storage.data[pos+1:], cfID)
+	return 1 + cfVarlen, cfVarlen
+}
+
 // Set adds an action to the batch that sets the key to map to the value.
 //
 // It is safe to modify the contents of the arguments after Set returns.
@@ -457,7 +633,7 @@ func (b *Batch) Set(key, value []byte, _ *WriteOptions) error {
 // letting the caller encode into those objects and then call Finish() on the
 // returned object.
 func (b *Batch) SetDeferred(keyLen, valueLen int, _ *WriteOptions) (*DeferredBatchOp, error) {
-	err := b.prepareDeferredKeyValueRecord(keyLen, valueLen, InternalKeyKindSet)
+	err := b.prepareDeferredKeyValueRecord(0 /* cfID */, keyLen, valueLen, InternalKeyKindSet)
 	if err != nil {
 		return nil, err
 	}
@@ -465,6 +641,40 @@ func (b *Batch) SetDeferred(keyLen, valueLen int, _ *WriteOptions) (*DeferredBat
 	return &b.deferredOp, nil
 }
 
+// SetWithTTL adds an action to the batch that sets the key to map to the
+// value until the TTL elapses. Once the TTL has elapsed the key is treated as
+// deleted, and it is eventually removed by compactions. The expiration time is
+// computed using the DB's Options.Clock when the operation is added to the
+// batch.
+//
+// It is safe to modify the contents of the arguments after SetWithTTL
+// returns.
+func (b *Batch) SetWithTTL(key, value []byte, ttl time.Duration, _ *WriteOptions) error {
+	if ttl <= 0 {
+		return fmt.Errorf("pebble: invalid TTL %s", ttl)
+	}
+	now := time.Now
+	if b.db != nil {
+		now = b.db.opts.Clock
+	}
+	expiry := now().Add(ttl).UnixNano()
+
+	err := b.prepareDeferredKeyValueRecord(
+		0 /* cfID */, len(key), ttlExpiryLen+len(value), InternalKeyKindSetWithTTL)
+	if err != nil {
+		return err
+	}
+	copy(b.deferredOp.Key, key)
+	encodeTTLValue(b.deferredOp.Value[:0], expiry, value)
+	if b.index != nil {
+		if err := b.index.Add(b.deferredOp.offset); err != nil {
+			// We never add duplicate entries, so an error should never occur.
+			panic(err)
+		}
+	}
+	return nil
+}
+
 // Merge adds an action to the batch that merges the value at key with the new
 // value. The details of the merge are dependent upon the configured merge
 // operator.
@@ -493,7 +703,7 @@ func (b *Batch) Merge(key, value []byte, _ *WriteOptions) error {
 // letting the caller encode into those objects and then call Finish() on the
 // returned object.
 func (b *Batch) MergeDeferred(keyLen, valueLen int, _ *WriteOptions) (*DeferredBatchOp, error) {
-	err := b.prepareDeferredKeyValueRecord(keyLen, valueLen, InternalKeyKindMerge)
+	err := b.prepareDeferredKeyValueRecord(0 /* cfID */, keyLen, valueLen, InternalKeyKindMerge)
 	if err != nil {
 		return nil, err
 	}
@@ -526,7 +736,7 @@ func (b *Batch) Delete(key []byte, _ *WriteOptions) error {
 // slices, letting the caller encode into those objects and then call Finish()
 // on the returned object.
 func (b *Batch) DeleteDeferred(keyLen int, _ *WriteOptions) (*DeferredBatchOp, error) {
-	err := b.prepareDeferredKeyRecord(keyLen, InternalKeyKindDelete)
+	err := b.prepareDeferredKeyRecord(0 /* cfID */, keyLen, InternalKeyKindDelete)
 	if err != nil {
 		return nil, err
 	}
@@ -560,7 +770,7 @@ func (b *Batch) SingleDelete(key []byte, _ *WriteOptions) error {
 // complete slices, letting the caller encode into those objects and then call
 // Finish() on the returned object.
 func (b *Batch) SingleDeleteDeferred(keyLen int, _ *WriteOptions) (*DeferredBatchOp, error) {
-	err := b.prepareDeferredKeyRecord(keyLen, InternalKeyKindSingleDelete)
+	err := b.prepareDeferredKeyRecord(0 /* cfID */, keyLen, InternalKeyKindSingleDelete)
 	if err != nil {
 		return nil, err
 	}
@@ -598,7 +808,7 @@ func (b *Batch) DeleteRange(start, end []byte, _ *WriteOptions) error {
 // populated with the start key, and DeferredBatchOp.Value should be populated
 // with the end key.
 func (b *Batch) DeleteRangeDeferred(startLen, endLen int, _ *WriteOptions) (*DeferredBatchOp, error) {
-	err := b.prepareDeferredKeyValueRecord(startLen, endLen, InternalKeyKindRangeDelete)
+	err := b.prepareDeferredKeyValueRecord(0 /* cfID */, startLen, endLen, InternalKeyKindRangeDelete)
 	if err != nil {
 		return nil, err
 	}
@@ -613,6 +823,198 @@ func (b *Batch) DeleteRangeDeferred(startLen, endLen int, _ *WriteOptions) (*Def
 	return &b.deferredOp, nil
 }
 
+// GetCF is like Get, but gets the value for the given key from the specified
+// column family. A nil column family refers to the default column family.
+//
+// The caller should not modify the contents of the returned slice, but it is
+// safe to modify the contents of the argument after GetCF returns.
+func (b *Batch) GetCF(cf *ColumnFamily, key []byte) (value []byte, err error) {
+	if b.index == nil {
+		return nil, ErrNotIndexed
+	}
+	if _, err := b.columnFamilyID(cf); err != nil {
+		return nil, err
+	}
+	if cf == nil {
+		cf = b.db.defaultCF
+	}
+	return b.db.getInternal(cf, key, b, nil /* snapshot */)
+}
+
+// findColumnFamilyIndex returns the index of the records for the specified
+// non-default column family, or nil if the batch contains no records for the
+// column family. The second return value is the position of the index in
+// cfIndexes, or the position at which it should be inserted.
+func (b *Batch) findColumnFamilyIndex(cfID uint32) (*columnFamilyBatchIndex, int) {
+	i := sort.Search(len(b.cfIndexes), func(i int) bool {
+		return b.cfIndexes[i].cfID >= cfID
+	})
+	if i < len(b.cfIndexes) && b.cfIndexes[i].cfID == cfID {
+		return b.cfIndexes[i], i
+	}
+	return nil, i
+}
+
+// columnFamilyIndex returns the index of the records for the specified
+// non-default column family, creating it if necessary. Requires the batch is
+// indexed.
+func (b *Batch) columnFamilyIndex(cf *ColumnFamily) *columnFamilyBatchIndex {
+	cfIndex, i := b.findColumnFamilyIndex(cf.id)
+	if cfIndex != nil {
+		return cfIndex
+	}
+	cfIndex = &columnFamilyBatchIndex{
+		cfID: cf.id,
+		storage: columnFamilyBatchStorage{
+			batchStorage:   &b.storage,
+			cmp:            cf.cmp,
+			abbreviatedKey: cf.abbreviatedKey,
+		},
+	}
+	cfIndex.index = batchskl.NewSkiplist(&cfIndex.storage, 0)
+	b.cfIndexes = append(b.cfIndexes, nil)
+	copy(b.cfIndexes[i+1:], b.cfIndexes[i:])
+	b.cfIndexes[i] = cfIndex
+	return cfIndex
+}
+
+// columnFamilyID returns the ID of the specified column family, verifying that
+// the column family belongs to the batch's DB. A nil column family refers to
+// the default column family.
+func (b *Batch) columnFamilyID(cf *ColumnFamily) (uint32, error) {
+	if cf == nil {
+		return 0, nil
+	}
+	if b.db != nil && cf.db != b.db {
+		return 0, fmt.Errorf("pebble: column family %q belongs to a different DB", cf.name)
+	}
+	return cf.id, nil
+}
+
+// SetCF is like Set, but sets the key in the specified column family. A nil
+// column family refers to the default column family.
+//
+// It is safe to modify the contents of the arguments after SetCF returns.
+func (b *Batch) SetCF(cf *ColumnFamily, key, value []byte, _ *WriteOptions) error {
+	cfID, err := b.columnFamilyID(cf)
+	if err != nil {
+		return err
+	}
+	if cfID == 0 {
+		return b.Set(key, value, nil)
+	}
+	if err := b.prepareDeferredKeyValueRecord(cfID, len(key), len(value), InternalKeyKindSet); err != nil {
+		return err
+	}
+	copy(b.deferredOp.Key, key)
+	copy(b.deferredOp.Value, value)
+	if b.index != nil {
+		b.columnFamilyIndex(cf).add(InternalKeyKindSet, b.deferredOp.offset)
+	}
+	return nil
+}
+
+// MergeCF is like Merge, but merges the value at key in the specified column
+// family using that column family's merge operator. A nil column family
+// refers to the default column family.
+//
+// It is safe to modify the contents of the arguments after MergeCF returns.
+func (b *Batch) MergeCF(cf *ColumnFamily, key, value []byte, _ *WriteOptions) error {
+	cfID, err := b.columnFamilyID(cf)
+	if err != nil {
+		return err
+	}
+	if cfID == 0 {
+		return b.Merge(key, value, nil)
+	}
+	if err := b.prepareDeferredKeyValueRecord(cfID, len(key), len(value), InternalKeyKindMerge); err != nil {
+		return err
+	}
+	copy(b.deferredOp.Key, key)
+	copy(b.deferredOp.Value, value)
+	if b.index != nil {
+		b.columnFamilyIndex(cf).add(InternalKeyKindMerge, b.deferredOp.offset)
+	}
+	return nil
+}
+
+// DeleteCF is like Delete, but deletes the key from the specified column
+// family. A nil column family refers to the default column family.
+//
+// It is safe to modify the contents of the arguments after DeleteCF returns.
+func (b *Batch) DeleteCF(cf *ColumnFamily, key []byte, _ *WriteOptions) error {
+	cfID, err := b.columnFamilyID(cf)
+	if err != nil {
+		return err
+	}
+	if cfID == 0 {
+		return b.Delete(key, nil)
+	}
+	if err := b.prepareDeferredKeyRecord(cfID, len(key), InternalKeyKindDelete); err != nil {
+		return err
+	}
+	copy(b.deferredOp.Key, key)
+	if b.index != nil {
+		b.columnFamilyIndex(cf).add(InternalKeyKindDelete, b.deferredOp.offset)
+	}
+	return nil
+}
+
+// SingleDeleteCF is like SingleDelete, but single deletes the key from the
+// specified column family. A nil column family refers to the default column
+// family.
+//
+// It is safe to modify the contents of the arguments after SingleDeleteCF
+// returns.
+func (b *Batch) SingleDeleteCF(cf *ColumnFamily, key []byte, _ *WriteOptions) error {
+	cfID, err := b.columnFamilyID(cf)
+	if err != nil {
+		return err
+	}
+	if cfID == 0 {
+		return b.SingleDelete(key, nil)
+	}
+	if err := b.prepareDeferredKeyRecord(cfID, len(key), InternalKeyKindSingleDelete); err != nil {
+		return err
+	}
+	copy(b.deferredOp.Key, key)
+	if b.index != nil {
+		b.columnFamilyIndex(cf).add(InternalKeyKindSingleDelete, b.deferredOp.offset)
+	}
+	return nil
+}
+
+// DeleteRangeCF is like DeleteRange, but deletes the keys in the range
+// [start,end) from the specified column family. A nil column family refers to
+// the default column family.
+//
+// It is safe to modify the contents of the arguments after DeleteRangeCF
+// returns.
+func (b *Batch) DeleteRangeCF(cf *ColumnFamily, start, end []byte, _ *WriteOptions) error {
+	cfID, err := b.columnFamilyID(cf)
+	if err != nil {
+		return err
+	}
+	if cfID == 0 {
+		return b.DeleteRange(start, end, nil)
+	}
+	if err := b.prepareDeferredKeyValueRecord(cfID, len(start), len(end), InternalKeyKindRangeDelete); err != nil {
+		return err
+	}
+	copy(b.deferredOp.Key, start)
+	copy(b.deferredOp.Value, end)
+	if b.index != nil {
+		b.columnFamilyIndex(cf).add(InternalKeyKindRangeDelete, b.deferredOp.offset)
+	}
+	return nil
+}
+
+// hasColumnFamilyRecords returns true if the batch contains records for a
+// non-default column family.
+func (b *Batch) hasColumnFamilyRecords() bool {
+	return len(b.cfMemTableSizes) > 0
+}
+
 // LogData adds the specified to the batch. The data will be written to the
 // WAL, but not added to memtables or sstables. Log data is never indexed,
 // which makes it useful for testing WAL performance.
@@ -634,6 +1036,25 @@ func (b *Batch) LogData(data []byte, _ *WriteOptions) error {
 	return nil
 }
 
+// ingestSST adds a record of the ingestion of the sstable with the specified
+// file number to the batch. Such batches are only written to the WAL, where
+// they record the sstables ingested as a flushable (see DB.Ingest), and are
+// never applied to memtables. Each record is assigned a sequence number.
+func (b *Batch) ingestSST(fileNum uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], fileNum)
+	if len(b.storage.data) == 0 {
+		b.init(1 + maxVarintLen32 + n + batchHeaderLen)
+	}
+	b.increment()
+
+	pos := len(b.storage.data)
+	b.grow(1 + maxVarintLen32 + n)
+	b.storage.data[pos] = byte(InternalKeyKindIngestSST)
+	_, varlen1 := b.copyStr(pos+1, buf[:n])
+	b.storage.data = b.storage.data[:len(b.storage.data)-(maxVarintLen32-varlen1)]
+}
+
 // Empty returns true if the batch is empty, and false otherwise.
 func (b *Batch) Empty() bool {
 	return len(b.storage.data) <= batchHeaderLen
@@ -670,45 +1091,90 @@ func (b *Batch) NewIter(o *IterOptions) *Iterator {
 	if b.index == nil {
 		return &Iterator{err: ErrNotIndexed}
 	}
-	return b.db.newIterInternal(b.newInternalIter(o),
+	return b.db.newIterInternal(b.db.defaultCF, b.newInternalIter(o),
 		b.newRangeDelIter(o), nil /* snapshot */, o)
 }
 
+// NewIterCF is like NewIter, but returns an iterator over the specified column
+// family. A nil column family refers to the default column family.
+func (b *Batch) NewIterCF(cf *ColumnFamily, o *IterOptions) *Iterator {
+	if b.index == nil {
+		return &Iterator{err: ErrNotIndexed}
+	}
+	if _, err := b.columnFamilyID(cf); err != nil {
+		return &Iterator{err: err}
+	}
+	if cf == nil {
+		cf = b.db.defaultCF
+	}
+	return b.db.newIterInternal(cf, b.newColumnFamilyInternalIter(cf.id, o),
+		b.newColumnFamilyRangeDelIter(cf.id, o), nil /* snapshot */, o)
+}
+
 // newInternalIter creates a new internalIterator that iterates over the
-// contents of the batch.
+// contents of the batch for the default column family.
 func (b *Batch) newInternalIter(o *IterOptions) internalIterator {
+	return b.newColumnFamilyInternalIter(0, o)
+}
+
+// newColumnFamilyInternalIter creates a new internalIterator that iterates
+// over the contents of the batch for the specified column family.
+func (b *Batch) newColumnFamilyInternalIter(cfID uint32, o *IterOptions) internalIterator {
 	if b.index == nil {
 		return newErrorIter(ErrNotIndexed)
 	}
+	if cfID == 0 {
+		return &batchIter{
+			cmp:   b.storage.cmp,
+			batch: b,
+			iter:  b.index.NewIter(o.GetLowerBound(), o.GetUpperBound()),
+		}
+	}
+	cfIndex, _ := b.findColumnFamilyIndex(cfID)
+	if cfIndex == nil {
+		return emptyIter
+	}
 	return &batchIter{
-		cmp:   b.storage.cmp,
+		cmp:   cfIndex.storage.cmp,
 		batch: b,
-		iter:  b.index.NewIter(o.GetLowerBound(), o.GetUpperBound()),
+		iter:  cfIndex.index.NewIter(o.GetLowerBound(), o.GetUpperBound()),
 	}
 }
 
 func (b *Batch) newRangeDelIter(o *IterOptions) internalIterator {
+	return b.newColumnFamilyRangeDelIter(0, o)
+}
+
+func (b *Batch) newColumnFamilyRangeDelIter(cfID uint32, o *IterOptions) internalIterator {
 	if b.index == nil {
 		return newErrorIter(ErrNotIndexed)
 	}
-	if b.rangeDelIndex == nil {
+	cmp, rangeDelIndex, tombstones := b.storage.cmp, b.rangeDelIndex, &b.tombstones
+	if cfID != 0 {
+		cfIndex, _ := b.findColumnFamilyIndex(cfID)
+		if cfIndex == nil {
+			return nil
+		}
+		cmp, rangeDelIndex, tombstones = cfIndex.storage.cmp, cfIndex.rangeDelIndex, &cfIndex.tombstones
+	}
+	if rangeDelIndex == nil {
 		return nil
 	}
 
 	// Fragment the range tombstones the first time a range deletion iterator is
 	// requested. The cached tombstones are invalidated if another range deletion
 	// tombstone is added to the batch.
-	if b.tombstones == nil {
+	if *tombstones == nil {
 		frag := &rangedel.Fragmenter{
-			Cmp: b.storage.cmp,
+			Cmp: cmp,
 			Emit: func(fragmented []rangedel.Tombstone) {
-				b.tombstones = append(b.tombstones, fragmented...)
+				*tombstones = append(*tombstones, fragmented...)
 			},
 		}
 		it := &batchIter{
-			cmp:   b.storage.cmp,
+			cmp:   cmp,
 			batch: b,
-			iter:  b.rangeDelIndex.NewIter(nil, nil),
+			iter:  rangeDelIndex.NewIter(nil, nil),
 		}
 		for {
 			key, val := it.Next()
@@ -720,7 +1186,7 @@ func (b *Batch) newRangeDelIter(o *IterOptions) internalIterator {
 		frag.Finish()
 	}
 
-	return rangedel.NewIter(b.storage.cmp, b.tombstones)
+	return rangedel.NewIter(cmp, *tombstones)
 }
 
 // Commit applies the batch to its parent writer.
@@ -845,6 +1311,9 @@ func (b *Batch) Count() uint32 {
 // Reader returns a BatchReader for the current batch contents. If the batch is
 // mutated, the new entries will not be visible to the reader.
 func (b *Batch) Reader() BatchReader {
+	if len(b.storage.data) == 0 {
+		return nil
+	}
 	return b.storage.data[batchHeaderLen:]
 }
 
@@ -857,12 +1326,20 @@ func batchDecode(data []byte, offset uint32) (kind InternalKeyKind, ukey []byte,
 	if kind > InternalKeyKindMax {
 		return 0, nil, nil, false
 	}
+	if k, isCF := columnFamilyKindBase(kind); isCF {
+		_, n := binary.Uvarint(p)
+		if n <= 0 {
+			return 0, nil, nil, false
+		}
+		kind, p = k, p[n:]
+	}
 	p, ukey, ok = batchDecodeStr(p)
 	if !ok {
 		return 0, nil, nil, false
 	}
 	switch kind {
-	case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete:
+	case InternalKeyKindSet, InternalKeyKindSetWithTTL, InternalKeyKindMerge,
+		InternalKeyKindRangeDelete:
 		_, value, ok = batchDecodeStr(p)
 		if !ok {
 			return 0, nil, nil, false
@@ -893,28 +1370,94 @@ func MakeBatchReader(repr []byte) BatchReader {
 }
 
 // Next returns the next entry in this batch. The final return value is false
-// if the batch is corrupt. The end of batch is reached when len(r)==0.
+// if the batch is corrupt. The end of batch is reached when len(r)==0. Records
+// for a non-default column family are returned with the column family variant
+// of their kind (e.g. InternalKeyKindColumnFamilyValue). Use NextColumnFamily
+// to retrieve the column family ID of such records.
 func (r *BatchReader) Next() (kind InternalKeyKind, ukey []byte, value []byte, ok bool) {
 	p := *r
 	if len(p) == 0 {
 		return 0, nil, nil, false
 	}
+	kind = InternalKeyKind(p[0])
+	_, _, ukey, value, ok = r.NextColumnFamily()
+	if !ok {
+		return 0, nil, nil, false
+	}
+	return kind, ukey, value, true
+}
+
+// NextColumnFamily is like Next, but additionally returns the ID of the
+// column family the entry belongs to. The default column family has ID 0.
+// The returned kind is never a column family variant (e.g. a record of kind
+// InternalKeyKindColumnFamilyValue is returned as InternalKeyKindSet).
+func (r *BatchReader) NextColumnFamily() (
+	cfID uint32, kind InternalKeyKind, ukey []byte, value []byte, ok bool,
+) {
+	p := *r
+	if len(p) == 0 {
+		return 0, 0, nil, nil, false
+	}
 	kind, *r = InternalKeyKind(p[0]), p[1:]
 	if kind > InternalKeyKindMax {
-		return 0, nil, nil, false
+		return 0, 0, nil, nil, false
+	}
+	if k, isCF := columnFamilyKindBase(kind); isCF {
+		p := *r
+		u, numBytes := binary.Uvarint(p)
+		if numBytes <= 0 || u > math.MaxUint32 {
+			return 0, 0, nil, nil, false
+		}
+		cfID, kind, *r = uint32(u), k, p[numBytes:]
 	}
 	ukey, ok = r.nextStr()
 	if !ok {
-		return 0, nil, nil, false
+		return 0, 0, nil, nil, false
 	}
 	switch kind {
-	case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete:
+	case InternalKeyKindSet, InternalKeyKindSetWithTTL, InternalKeyKindMerge,
+		InternalKeyKindRangeDelete:
 		value, ok = r.nextStr()
 		if !ok {
-			return 0, nil, nil, false
+			return 0, 0, nil, nil, false
 		}
 	}
-	return kind, ukey, value, true
+	return cfID, kind, ukey, value, true
+}
+
+// columnFamilyKind returns the column family variant of the specified kind.
+func columnFamilyKind(kind InternalKeyKind) InternalKeyKind {
+	switch kind {
+	case InternalKeyKindDelete:
+		return InternalKeyKindColumnFamilyDeletion
+	case InternalKeyKindSet:
+		return InternalKeyKindColumnFamilyValue
+	case InternalKeyKindMerge:
+		return InternalKeyKindColumnFamilyMerge
+	case InternalKeyKindSingleDelete:
+		return InternalKeyKindColumnFamilySingleDelete
+	case InternalKeyKindRangeDelete:
+		return InternalKeyKindColumnFamilyRangeDelete
+	}
+	panic(fmt.Sprintf("pebble: no column family variant for %s", kind))
+}
+
+// columnFamilyKindBase returns the kind corresponding to the specified column
+// family variant, and false if kind is not a column family variant.
+func columnFamilyKindBase(kind InternalKeyKind) (InternalKeyKind, bool) {
+	switch kind {
+	case InternalKeyKindColumnFamilyDeletion:
+		return InternalKeyKindDelete, true
+	case InternalKeyKindColumnFamilyValue:
+		return InternalKeyKindSet, true
+	case InternalKeyKindColumnFamilyMerge:
+		return InternalKeyKindMerge, true
+	case InternalKeyKindColumnFamilySingleDelete:
+		return InternalKeyKindSingleDelete, true
+	case InternalKeyKindColumnFamilyRangeDelete:
+		return InternalKeyKindRangeDelete, true
+	}
+	return kind, false
 }
 
 func (r *BatchReader) nextStr() (s []byte, ok bool) {
@@ -1373,7 +1916,8 @@ func (i *flushableBatchIter) Value() []byte {
 	var value []byte
 	var ok bool
 	switch kind {
-	case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete:
+	case InternalKeyKindSet, InternalKeyKindSetWithTTL, InternalKeyKindMerge,
+		InternalKeyKindRangeDelete:
 		keyEnd := i.offsets[i.index].keyEnd
 		_, value, ok = batchDecodeStr(i.data[keyEnd:])
 		if !ok {
@@ -1466,7 +2010,8 @@ func (i flushFlushableBatchIter) valueSize() uint64 {
 	}
 	var length uint64
 	switch kind {
-	case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete:
+	case InternalKeyKindSet, InternalKeyKindSetWithTTL, InternalKeyKindMerge,
+		InternalKeyKindRangeDelete:
 		keyEnd := i.offsets[i.index].keyEnd
 		v, n := binary.Uvarint(i.data[keyEnd:])
 		if n <= 0 {
@@ -125,9 +125,81 @@ func TestBatch(t *testing.T) {
 	verifyTestCases(&b, testCases)
 }
 
+func TestBatchColumnFamilyRecords(t *testing.T) {
+	type record struct {
+		cfID       uint32
+		kind       InternalKeyKind
+		key, value string
+	}
+	records := []record{
+		{0, InternalKeyKindSet, "a", "1"},
+		{1, InternalKeyKindSet, "b", "2"},
+		{300, InternalKeyKindMerge, "c", "3"},
+		{1, InternalKeyKindDelete, "d", ""},
+		{2, InternalKeyKindSingleDelete, "e", ""},
+		{2, InternalKeyKindRangeDelete, "f", "g"},
+		{0, InternalKeyKindDelete, "h", ""},
+	}
+
+	var b Batch
+	for _, r := range records {
+		var err error
+		switch r.kind {
+		case InternalKeyKindSet, InternalKeyKindMerge, InternalKeyKindRangeDelete:
+			err = b.prepareDeferredKeyValueRecord(r.cfID, len(r.key), len(r.value), r.kind)
+			copy(b.deferredOp.Value, r.value)
+		default:
+			err = b.prepareDeferredKeyRecord(r.cfID, len(r.key), r.kind)
+		}
+		require.NoError(t, err)
+		copy(b.deferredOp.Key, r.key)
+	}
+
+	var sizes [3]uint32
+	reader := b.Reader()
+	for _, r := range records {
+		cfID, kind, k, v, ok := reader.NextColumnFamily()
+		if !ok {
+			t.Fatalf("next returned !ok: record = %v", r)
+		}
+		if cfID != r.cfID || kind != r.kind || string(k) != r.key || string(v) != r.value {
+			t.Errorf("got (%d, %s, %q, %q), want (%d, %s, %q, %q)",
+				cfID, kind, k, v, r.cfID, r.kind, r.key, r.value)
+		}
+		if r.cfID < uint32(len(sizes)) {
+			sizes[r.cfID] += memTableEntrySize(len(k), len(v))
+		}
+	}
+	if len(reader) != 0 {
+		t.Errorf("reader was not exhausted: remaining bytes = %q", reader)
+	}
+	for cfID, size := range sizes {
+		if got := b.columnFamilyMemTableSize(uint32(cfID)); got != size {
+			t.Errorf("cf %d: expected memtable size %d, but found %d", cfID, size, got)
+		}
+	}
+
+	// Next returns the column family variant of the kind.
+	reader = b.Reader()
+	for _, r := range records {
+		kind, _, _, ok := reader.Next()
+		require.True(t, ok)
+		want := r.kind
+		if r.cfID != 0 {
+			want = columnFamilyKind(r.kind)
+		}
+		if kind != want {
+			t.Errorf("expected %s, but found %s", want, kind)
+		}
+	}
+}
+
 func TestBatchEmpty(t *testing.T) {
 	var b Batch
 	require.True(t, b.Empty())
+	r := b.Reader()
+	_, _, _, ok := r.Next()
+	require.False(t, ok)
 
 	b.Set(nil, nil, nil)
 	require.False(t, b.Empty())
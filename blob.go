@@ -0,0 +1,301 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cockroachdb/pebble/cache"
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/crc"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// Blob files hold the values separated from the LSM by flushes (see
+// Options.ValueSeparationThreshold). A blob file is a sequence of records,
+// each consisting of a value followed by the 4-byte little-endian CRC-32C
+// checksum of the value. A separated value is referenced by an
+// InternalKeyKindBlobHandle entry whose value is an encoded blobHandle.
+//
+// The blob files referenced by a table, and the number of bytes of records
+// referenced in each, are recorded in the table's metadata in the MANIFEST
+// (see manifest.FileMetadata.BlobRefs). A blob file is deleted once it is no
+// longer referenced by any table in any version. The bytes of a blob file
+// which are not referenced by any table are garbage. Once the fraction of
+// garbage exceeds Options.BlobGarbageRatio, compactions of the tables
+// referencing the blob file rewrite its values to new blob files (see
+// compactionPicker.pickBlobRewrite), which eventually leaves the blob file
+// unreferenced.
+const blobRecordTrailerLen = 4
+
+var errCorruptBlobHandle = errors.New("pebble: corrupt blob handle")
+
+// blobHandle is the location of a value within a blob file.
+type blobHandle struct {
+	fileNum uint64
+	offset  uint64
+	length  uint64
+}
+
+// encode appends the encoding of the handle to dst.
+func (h blobHandle) encode(dst []byte) []byte {
+	var buf [3 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], h.fileNum)
+	n += binary.PutUvarint(buf[n:], h.offset)
+	n += binary.PutUvarint(buf[n:], h.length)
+	return append(dst, buf[:n]...)
+}
+
+func decodeBlobHandle(v []byte) (blobHandle, error) {
+	var h blobHandle
+	var n int
+	for _, p := range []*uint64{&h.fileNum, &h.offset, &h.length} {
+		x, m := binary.Uvarint(v[n:])
+		if m <= 0 {
+			return blobHandle{}, errCorruptBlobHandle
+		}
+		*p = x
+		n += m
+	}
+	if n != len(v) {
+		return blobHandle{}, errCorruptBlobHandle
+	}
+	return h, nil
+}
+
+// blobWriter writes values to a new blob file.
+type blobWriter struct {
+	fileNum uint64
+	file    vfs.File
+	offset  uint64
+}
+
+// add appends the value to the blob file, returning its handle.
+func (w *blobWriter) add(value []byte) (blobHandle, error) {
+	if _, err := w.file.Write(value); err != nil {
+		return blobHandle{}, err
+	}
+	var trailer [blobRecordTrailerLen]byte
+	binary.LittleEndian.PutUint32(trailer[:], crc.New(value).Value())
+	if _, err := w.file.Write(trailer[:]); err != nil {
+		return blobHandle{}, err
+	}
+	h := blobHandle{
+		fileNum: w.fileNum,
+		offset:  w.offset,
+		length:  uint64(len(value)),
+	}
+	w.offset += uint64(len(value)) + blobRecordTrailerLen
+	return h, nil
+}
+
+// close syncs and closes the blob file.
+func (w *blobWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Sync()
+	if err1 := w.file.Close(); err == nil {
+		err = err1
+	}
+	w.file = nil
+	return err
+}
+
+// blobFiles provides access to the values stored in blob files. The values are
+// read through the block cache. The blob files are opened on first use and
+// kept open in an LRU of bounded size, in the same manner as the tables of a
+// table cache.
+type blobFiles struct {
+	dbNum   uint64
+	dirname string
+	fs      vfs.FS
+	cache   *cache.Cache
+	size    int
+
+	mu struct {
+		sync.Mutex
+		nodes map[uint64]*blobFileNode
+		lru   blobFileNode
+	}
+}
+
+// blobFileNode is a blob file in the LRU of blobFiles.
+type blobFileNode struct {
+	fileNum uint64
+	file    vfs.File
+	err     error
+	loaded  chan struct{}
+
+	// The number of references to the node: one held by the LRU while the
+	// node is part of it, and one held by each reader of the blob file. The
+	// blob file is closed once the last reference is dropped. Protected by
+	// blobFiles.mu.
+	refCount int32
+
+	// Links in the LRU list. Protected by blobFiles.mu.
+	next, prev *blobFileNode
+}
+
+func (b *blobFiles) init(
+	dbNum uint64, dirname string, fs vfs.FS, cache *cache.Cache, size int,
+) {
+	b.dbNum = dbNum
+	b.dirname = dirname
+	b.fs = fs
+	b.cache = cache
+	b.size = size
+	b.mu.nodes = make(map[uint64]*blobFileNode)
+	b.mu.lru.next = &b.mu.lru
+	b.mu.lru.prev = &b.mu.lru
+}
+
+// findNode returns the node for the specified blob file, opening the blob file
+// if it is not open. The caller is responsible for calling unrefNode.
+func (b *blobFiles) findNode(fileNum uint64) (*blobFileNode, error) {
+	b.mu.Lock()
+	n := b.mu.nodes[fileNum]
+	load := n == nil
+	if load {
+		n = &blobFileNode{
+			fileNum:  fileNum,
+			refCount: 1,
+			loaded:   make(chan struct{}),
+		}
+		b.mu.nodes[fileNum] = n
+		if len(b.mu.nodes) > b.size {
+			// Release the tail node.
+			b.releaseNodeLocked(b.mu.lru.prev)
+		}
+	} else {
+		// Remove n from the doubly-linked list.
+		n.next.prev = n.prev
+		n.prev.next = n.next
+	}
+	// Insert n at the front of the doubly-linked list.
+	n.next = b.mu.lru.next
+	n.prev = &b.mu.lru
+	n.next.prev = n
+	n.prev.next = n
+	n.refCount++
+	b.mu.Unlock()
+
+	if load {
+		n.file, n.err = b.fs.Open(base.MakeFilename(b.fs, b.dirname, fileTypeBlob, fileNum))
+		close(n.loaded)
+	}
+	<-n.loaded
+	if n.err != nil {
+		// Don't cache the error. The error may be transient, so remove the node
+		// in order for the next caller to retry opening the blob file.
+		b.mu.Lock()
+		if b.mu.nodes[fileNum] == n {
+			b.releaseNodeLocked(n)
+		}
+		b.mu.Unlock()
+		b.unrefNode(n)
+		return nil, n.err
+	}
+	return n, nil
+}
+
+// releaseNodeLocked removes the node from the LRU, dropping the reference held
+// by the LRU. b.mu must be held.
+func (b *blobFiles) releaseNodeLocked(n *blobFileNode) error {
+	delete(b.mu.nodes, n.fileNum)
+	n.next.prev = n.prev
+	n.prev.next = n.next
+	n.prev = nil
+	n.next = nil
+	return n.unrefLocked()
+}
+
+func (b *blobFiles) unrefNode(n *blobFileNode) {
+	b.mu.Lock()
+	n.unrefLocked()
+	b.mu.Unlock()
+}
+
+// unrefLocked drops a reference to the node, closing the blob file once the
+// last reference is dropped. blobFiles.mu must be held.
+func (n *blobFileNode) unrefLocked() error {
+	n.refCount--
+	if n.refCount > 0 || n.file == nil {
+		return nil
+	}
+	err := n.file.Close()
+	n.file = nil
+	return err
+}
+
+// get returns a handle to the cached value referenced by the encoded blob
+// handle, reading the value from the blob file if it is not present in the
+// cache. The returned handle must be released.
+func (b *blobFiles) get(encoded []byte) (cache.Handle, error) {
+	h, err := decodeBlobHandle(encoded)
+	if err != nil {
+		return cache.Handle{}, err
+	}
+	if ch := b.cache.Get(b.dbNum, h.fileNum, h.offset); ch.Get() != nil {
+		return ch, nil
+	}
+
+	n, err := b.findNode(h.fileNum)
+	if err != nil {
+		return cache.Handle{}, err
+	}
+	buf := b.cache.Alloc(int(h.length + blobRecordTrailerLen))
+	_, err = n.file.ReadAt(buf, int64(h.offset))
+	b.unrefNode(n)
+	if err != nil {
+		b.cache.Free(buf)
+		return cache.Handle{}, err
+	}
+	value := buf[:h.length]
+	checksum := binary.LittleEndian.Uint32(buf[h.length:])
+	if crc.New(value).Value() != checksum {
+		b.cache.Free(buf)
+		return cache.Handle{}, fmt.Errorf("pebble: blob file %06d: checksum mismatch at offset %d",
+			h.fileNum, h.offset)
+	}
+	return b.cache.Set(b.dbNum, h.fileNum, h.offset, value), nil
+}
+
+// value returns a copy of the value referenced by the encoded blob handle.
+func (b *blobFiles) value(encoded []byte) ([]byte, error) {
+	ch, err := b.get(encoded)
+	if err != nil {
+		return nil, err
+	}
+	v := append([]byte(nil), ch.Get()...)
+	ch.Release()
+	return v, nil
+}
+
+// evict closes the specified blob file, once it is no longer being read, and
+// evicts its values from the cache. The blob file must not be referenced by
+// any version.
+func (b *blobFiles) evict(fileNum uint64) {
+	b.mu.Lock()
+	if n := b.mu.nodes[fileNum]; n != nil {
+		b.releaseNodeLocked(n)
+	}
+	b.mu.Unlock()
+	b.cache.EvictFile(b.dbNum, fileNum)
+}
+
+// close closes all of the open blob files.
+func (b *blobFiles) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for _, n := range b.mu.nodes {
+		err = firstError(err, b.releaseNodeLocked(n))
+	}
+	return err
+}
@@ -0,0 +1,242 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble/cache"
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobHandle(t *testing.T) {
+	h := blobHandle{fileNum: 7, offset: 1 << 20, length: 300}
+	encoded := h.encode(nil)
+	decoded, err := decodeBlobHandle(encoded)
+	require.NoError(t, err)
+	require.Equal(t, h, decoded)
+
+	for _, v := range [][]byte{nil, encoded[:len(encoded)-1], append(encoded, 0)} {
+		_, err := decodeBlobHandle(v)
+		require.Equal(t, errCorruptBlobHandle, err)
+	}
+}
+
+// listBlobFiles returns the file numbers of the blob files in dir.
+func listBlobFiles(t *testing.T, fs vfs.FS, dir string) []uint64 {
+	t.Helper()
+	list, err := fs.List(dir)
+	require.NoError(t, err)
+	var fileNums []uint64
+	for _, filename := range list {
+		if fileType, fileNum, ok := base.ParseFilename(fs, filename); ok && fileType == fileTypeBlob {
+			fileNums = append(fileNums, fileNum)
+		}
+	}
+	sort.Slice(fileNums, func(i, j int) bool {
+		return fileNums[i] < fileNums[j]
+	})
+	return fileNums
+}
+
+func TestValueSeparation(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &Options{
+		FS:                       mem,
+		ValueSeparationThreshold: 10,
+	}
+	d, err := Open("db", opts)
+	require.NoError(t, err)
+
+	large := func(c string) string {
+		return strings.Repeat(c, 20)
+	}
+
+	scan := func(d *DB, reverse bool) string {
+		t.Helper()
+		iter := d.NewIter(nil)
+		var keys []string
+		if reverse {
+			for valid := iter.Last(); valid; valid = iter.Prev() {
+				keys = append(keys, string(iter.Key())+":"+string(iter.Value()))
+			}
+		} else {
+			for valid := iter.First(); valid; valid = iter.Next() {
+				keys = append(keys, string(iter.Key())+":"+string(iter.Value()))
+			}
+		}
+		require.NoError(t, iter.Close())
+		return strings.Join(keys, " ")
+	}
+
+	get := func(d *DB, key string) string {
+		t.Helper()
+		v, err := d.Get([]byte(key))
+		if err == ErrNotFound {
+			return "<not found>"
+		}
+		require.NoError(t, err)
+		return string(v)
+	}
+
+	require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+	require.NoError(t, d.Set([]byte("b"), []byte(large("b")), nil))
+	require.NoError(t, d.Set([]byte("c"), []byte(large("c")), nil))
+	require.NoError(t, d.Set([]byte("d"), []byte(large("d")), nil))
+	require.NoError(t, d.Flush())
+	require.Len(t, listBlobFiles(t, mem, "db"), 1)
+
+	// A merge on top of a separated value.
+	require.NoError(t, d.Merge([]byte("d"), []byte("2"), nil))
+
+	expected := "a:1 b:" + large("b") + " c:" + large("c") + " d:2" + large("d")
+	verify := func(d *DB) {
+		t.Helper()
+		require.Equal(t, "1", get(d, "a"))
+		require.Equal(t, large("b"), get(d, "b"))
+		require.Equal(t, "2"+large("d"), get(d, "d"))
+		require.Equal(t, expected, scan(d, false))
+		fields := strings.Fields(expected)
+		for i, j := 0, len(fields)-1; i < j; i, j = i+1, j-1 {
+			fields[i], fields[j] = fields[j], fields[i]
+		}
+		require.Equal(t, strings.Join(fields, " "), scan(d, true))
+	}
+	verify(d)
+
+	// Compactions copy the blob handles, leaving the blob file in place. The
+	// merged value of "d" is no longer separated.
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+	require.Len(t, listBlobFiles(t, mem, "db"), 1)
+	verify(d)
+
+	// The blob files are included in a checkpoint.
+	require.NoError(t, d.Checkpoint("checkpoint"))
+	require.Equal(t, listBlobFiles(t, mem, "db"), listBlobFiles(t, mem, "checkpoint"))
+	cp, err := Open("checkpoint", opts)
+	require.NoError(t, err)
+	verify(cp)
+	require.NoError(t, cp.Close())
+
+	// The blob files survive reopening the DB.
+	require.NoError(t, d.Close())
+	d, err = Open("db", opts)
+	require.NoError(t, err)
+	verify(d)
+
+	// The blob file is deleted once none of its values are referenced.
+	require.NoError(t, d.Delete([]byte("b"), nil))
+	require.NoError(t, d.Set([]byte("c"), []byte("3"), nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+	require.Len(t, listBlobFiles(t, mem, "db"), 0)
+	require.Equal(t, "a:1 c:3 d:2"+large("d"), scan(d, false))
+	require.NoError(t, d.Close())
+}
+
+func TestBlobRewrite(t *testing.T) {
+	large := func(c string) string {
+		return strings.Repeat(c, 20)
+	}
+
+	for _, ratio := range []float64{0.5, 1} {
+		t.Run(fmt.Sprintf("ratio=%g", ratio), func(t *testing.T) {
+			mem := vfs.NewMem()
+			d, err := Open("", &Options{
+				FS:                       mem,
+				ValueSeparationThreshold: 10,
+				BlobGarbageRatio:         ratio,
+			})
+			require.NoError(t, err)
+
+			for _, k := range []string{"a", "b", "c", "d"} {
+				require.NoError(t, d.Set([]byte(k), []byte(large(k)), nil))
+			}
+			require.NoError(t, d.Flush())
+			before := listBlobFiles(t, mem, "")
+			require.Len(t, before, 1)
+
+			// Overwrite 3 of the 4 separated values. Once the compaction drops
+			// the old values, 3/4 of the blob file is garbage.
+			for _, k := range []string{"b", "c", "d"} {
+				require.NoError(t, d.Set([]byte(k), []byte(k), nil))
+			}
+			require.NoError(t, d.Flush())
+			require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+
+			d.mu.Lock()
+			for d.mu.compact.compactingCount > 0 {
+				d.mu.compact.cond.Wait()
+			}
+			d.mu.Unlock()
+
+			after := listBlobFiles(t, mem, "")
+			require.Len(t, after, 1)
+			if ratio < 1 {
+				// The live value was rewritten to a new blob file.
+				require.NotEqual(t, before, after)
+			} else {
+				require.Equal(t, before, after)
+			}
+
+			for _, k := range []string{"a", "b", "c", "d"} {
+				expected := k
+				if k == "a" {
+					expected = large(k)
+				}
+				v, err := d.Get([]byte(k))
+				require.NoError(t, err)
+				require.Equal(t, expected, string(v))
+			}
+			require.NoError(t, d.Close())
+		})
+	}
+}
+
+func TestBlobFilesLRU(t *testing.T) {
+	mem := vfs.NewMem()
+	var handles [][]byte
+	for fileNum := uint64(1); fileNum <= 4; fileNum++ {
+		f, err := mem.Create(base.MakeFilename(mem, "", fileTypeBlob, fileNum))
+		require.NoError(t, err)
+		w := &blobWriter{fileNum: fileNum, file: f}
+		h, err := w.add([]byte(fmt.Sprint(fileNum)))
+		require.NoError(t, err)
+		require.NoError(t, w.close())
+		handles = append(handles, h.encode(nil))
+	}
+
+	c := cache.New(1 << 20)
+	var b blobFiles
+	b.init(0, "", mem, c, 2)
+
+	for i := 0; i < 2; i++ {
+		for j, h := range handles {
+			v, err := b.value(h)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprint(j+1), string(v))
+			b.mu.Lock()
+			require.True(t, len(b.mu.nodes) <= 2)
+			b.mu.Unlock()
+		}
+		// Read the values from the blob files again.
+		for fileNum := uint64(1); fileNum <= 4; fileNum++ {
+			c.EvictFile(0, fileNum)
+		}
+	}
+
+	b.evict(4)
+	b.mu.Lock()
+	require.Len(t, b.mu.nodes, 1)
+	b.mu.Unlock()
+	require.NoError(t, b.close())
+	require.Len(t, b.mu.nodes, 0)
+}
@@ -132,6 +132,46 @@ func hash(b []byte) uint32 {
 	return h
 }
 
+type blockFilterWriter struct {
+	bitsPerKey int
+	hashes     []uint32
+}
+
+// AddKey implements the base.FilterWriter interface.
+func (w *blockFilterWriter) AddKey(key []byte) {
+	w.hashes = append(w.hashes, hash(key))
+}
+
+// Finish implements the base.FilterWriter interface.
+func (w *blockFilterWriter) Finish(buf []byte) []byte {
+	// The block filter format matches the LevelDB per-block filter format.
+	//
+	// For small len(hashes), we can see a very high false positive rate. Fix
+	// it by enforcing a minimum bloom filter length.
+	nBits := len(w.hashes) * w.bitsPerKey
+	if nBits < 64 {
+		nBits = 64
+	}
+	nBytes := (nBits + 7) / 8
+	nBits = nBytes * 8
+	nProbes := calculateProbes(w.bitsPerKey)
+
+	// +1: 1 byte for num-probes
+	buf, filter := extend(buf, nBytes+1)
+	for _, h := range w.hashes {
+		delta := h>>17 | h<<15 // rotate right 17 bits
+		for i := uint32(0); i < nProbes; i++ {
+			bitPos := h % uint32(nBits)
+			filter[bitPos/8] |= 1 << (bitPos % 8)
+			h += delta
+		}
+	}
+	filter[nBytes] = byte(nProbes)
+
+	w.hashes = w.hashes[:0]
+	return buf
+}
+
 type tableFilterWriter struct {
 	bitsPerKey int
 	hashes     []uint32
@@ -206,6 +246,8 @@ func (p FilterPolicy) MayContain(ftype base.FilterType, f, key []byte) bool {
 	switch ftype {
 	case base.TableFilter:
 		return tableFilter(f).MayContain(key)
+	case base.BlockFilter:
+		return blockFilter(f).MayContain(key)
 	default:
 		panic(fmt.Sprintf("unknown filter type: %v", ftype))
 	}
@@ -218,6 +260,10 @@ func (p FilterPolicy) NewWriter(ftype base.FilterType) base.FilterWriter {
 		return &tableFilterWriter{
 			bitsPerKey: int(p),
 		}
+	case base.BlockFilter:
+		return &blockFilterWriter{
+			bitsPerKey: int(p),
+		}
 	default:
 		panic(fmt.Sprintf("unknown filter type: %v", ftype))
 	}
@@ -0,0 +1,245 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// Checkpoint constructs a snapshot of the DB instance in the specified
+// directory. The WAL, MANIFEST, OPTIONS, sstables and blob files will be
+// copied into the snapshot. Hard links will be used when possible. Beware of
+// the significant space overhead for a checkpoint if hard links are disabled.
+// Also beware that even if hard links are used, the space overhead for the
+// checkpoint will increase over time as the DB performs compactions.
+//
+// The checkpoint directory must not already exist. The checkpoint can be
+// opened as a DB using Open with the same Options (other than WALDir, as the
+// WAL files are copied into the checkpoint directory). If an error occurs, the
+// partially constructed checkpoint directory is removed.
+//
+// The checkpoint contains the mutations committed before Checkpoint was
+// called. Mutations committed concurrently with Checkpoint may be contained
+// in it as well, in which case so are the mutations with smaller sequence
+// numbers.
+func (d *DB) Checkpoint(destDir string) (ckErr error) {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+
+	fs := d.opts.FS
+	if _, err := fs.Stat(destDir); !os.IsNotExist(err) {
+		if err == nil {
+			return &os.PathError{
+				Op:   "checkpoint",
+				Path: destDir,
+				Err:  os.ErrExist,
+			}
+		}
+		return err
+	}
+
+	// Disable file deletions so that none of the files we're about to copy or
+	// link are removed out from under us. Holding commitPipeline.mu prevents
+	// batches from being written to the WAL, and the WAL from being rotated,
+	// while the size of the WAL is captured below.
+	d.commit.mu.Lock()
+	d.mu.Lock()
+	d.disableFileDeletions()
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.enableFileDeletions()
+	}()
+
+	// Wait for any in-progress write to the manifest to complete. The current
+	// version and the size of the manifest need to correspond to each other,
+	// and logAndApply releases d.mu while writing the manifest.
+	for d.mu.versions.writing {
+		d.mu.versions.writerCond.Wait()
+	}
+	// The current version of every column family is referenced. The versions
+	// correspond to the contents of the manifest.
+	current := make([]*version, len(d.mu.columnFamilies))
+	for i, cf := range d.mu.columnFamilies {
+		current[i] = cf.versions.currentVersion()
+		current[i].Ref()
+	}
+	manifestFileNum := d.mu.versions.manifestFileNum
+	manifestSize := int64(-1)
+	if d.mu.versions.manifest != nil {
+		manifestSize = d.mu.versions.manifest.Size()
+	}
+	optionsFileNum := d.optionsFileNum
+	// The WAL files backing the memtables contain the mutations which have not
+	// been flushed to sstables. Note that the WALs may contain newer mutations
+	// than the manifest reflects, which is fine as replaying a WAL on Open is
+	// idempotent. The memtables of all of the column families share the same
+	// WALs.
+	//
+	// The sstables of an ingestion which overlapped a memtable are recorded in
+	// the WAL, but are not part of a version until they are flushed. They are
+	// referenced so that they remain readable, and are linked along with the
+	// sstables of the current versions.
+	var logNums []uint64
+	var ingested []*ingestedFlushable
+	for _, cf := range d.mu.columnFamilies {
+		for _, mem := range cf.mem.queue {
+			if logNum, _ := mem.logInfo(); logNum != 0 {
+				logNums = append(logNums, logNum)
+			}
+			if f, ok := mem.(*ingestedFlushable); ok {
+				f.readerRef()
+				ingested = append(ingested, f)
+			}
+		}
+	}
+	logNums = merge(nil, logNums)
+	// The current WAL is concurrently appended to, so only the prefix
+	// containing the batches which have been written to it so far (i.e. those
+	// with sequence numbers less than logSeqNum) is copied. The copy would
+	// otherwise end in the middle of a record, which is a corruption when the
+	// checkpoint is opened. The prefix is synced first so that it has been
+	// written to the file when copied.
+	var walLogNum uint64
+	var walSize int64
+	var walSyncWG sync.WaitGroup
+	var walSyncErr error
+	if d.mu.log.LogWriter != nil {
+		walLogNum = d.mu.log.queue[len(d.mu.log.queue)-1]
+		walSize = d.mu.log.Size()
+		walSyncWG.Add(1)
+		if err := d.mu.log.Sync(&walSyncWG, &walSyncErr); err != nil {
+			walSyncWG.Done()
+			walSyncErr = err
+		}
+	}
+	d.mu.Unlock()
+	d.commit.mu.Unlock()
+	defer func() {
+		for _, v := range current {
+			v.Unref()
+		}
+		for _, f := range ingested {
+			f.readerUnref()
+		}
+	}()
+
+	walSyncWG.Wait()
+	if walSyncErr != nil {
+		return walSyncErr
+	}
+
+	if err := fs.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if ckErr != nil {
+			// Remove the partially constructed checkpoint. The checkpoint
+			// directory did not exist before, so all of its files were created
+			// above. Errors are ignored as the checkpoint has already failed.
+			if names, err := fs.List(destDir); err == nil {
+				for _, name := range names {
+					_ = fs.Remove(fs.PathJoin(destDir, name))
+				}
+			}
+			_ = fs.Remove(destDir)
+		}
+	}()
+	dir, err := fs.OpenDir(destDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := dir.Close(); ckErr == nil {
+			ckErr = err
+		}
+	}()
+
+	// Copy the OPTIONS file.
+	if optionsFileNum != 0 {
+		srcPath := base.MakeFilename(fs, d.dirname, fileTypeOptions, optionsFileNum)
+		destPath := fs.PathJoin(destDir, fs.PathBase(srcPath))
+		if err := vfs.Copy(fs, srcPath, destPath); err != nil {
+			return err
+		}
+	}
+
+	// Link or copy the sstables and blob files.
+	for _, v := range current {
+		for l := range v.Files {
+			level := v.Files[l]
+			for i := range level {
+				srcPath := base.MakeFilename(fs, d.dirname, fileTypeTable, level[i].FileNum)
+				destPath := fs.PathJoin(destDir, fs.PathBase(srcPath))
+				if err := vfs.LinkOrCopy(fs, srcPath, destPath); err != nil {
+					return err
+				}
+			}
+		}
+		for i := range v.BlobFiles {
+			srcPath := base.MakeFilename(fs, d.dirname, fileTypeBlob, v.BlobFiles[i].FileNum)
+			destPath := fs.PathJoin(destDir, fs.PathBase(srcPath))
+			if err := vfs.LinkOrCopy(fs, srcPath, destPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Link or copy the sstables of ingestions which have not been flushed. An
+	// sstable may also be part of a current version once the ingestion has
+	// been flushed, in which case it has already been linked.
+	for _, f := range ingested {
+		for i := range f.files {
+			srcPath := base.MakeFilename(fs, d.dirname, fileTypeTable, f.files[i].FileNum)
+			destPath := fs.PathJoin(destDir, fs.PathBase(srcPath))
+			if _, err := fs.Stat(destPath); err == nil {
+				continue
+			}
+			if err := vfs.LinkOrCopy(fs, srcPath, destPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Copy the MANIFEST, truncating it to the size it had when we grabbed the
+	// current version, and point the CURRENT file at it.
+	{
+		srcPath := base.MakeFilename(fs, d.dirname, fileTypeManifest, manifestFileNum)
+		destPath := fs.PathJoin(destDir, fs.PathBase(srcPath))
+		if err := vfs.LimitedCopy(fs, srcPath, destPath, manifestSize); err != nil {
+			return err
+		}
+		if err := setCurrentFile(destDir, fs, manifestFileNum); err != nil {
+			return err
+		}
+	}
+
+	// Copy the WAL files, truncating the current WAL to the size it had when we
+	// grabbed the current versions. We copy rather than link because WAL file
+	// recycling would otherwise overwrite the contents of the checkpoint's WAL
+	// files. The previous WALs were closed when the WAL was rotated, so they
+	// are copied whole.
+	for _, logNum := range logNums {
+		srcPath := base.MakeFilename(fs, d.walDirname, fileTypeLog, logNum)
+		destPath := fs.PathJoin(destDir, fs.PathBase(srcPath))
+		size := int64(-1)
+		if logNum == walLogNum {
+			size = walSize
+		}
+		if err := vfs.LimitedCopy(fs, srcPath, destPath, size); err != nil {
+			return fmt.Errorf("pebble: unable to copy WAL %q: %v", srcPath, err)
+		}
+	}
+
+	// Sync the checkpoint directory so the new files are durable.
+	return dir.Sync()
+}
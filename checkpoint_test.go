@@ -0,0 +1,306 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/errorfs"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &Options{FS: mem}
+	d, err := Open("db", opts)
+	require.NoError(t, err)
+
+	// Write some keys which are flushed to sstables and some which are only
+	// present in the WAL.
+	require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+	require.NoError(t, d.Set([]byte("b"), []byte("2"), nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Set([]byte("c"), []byte("3"), nil))
+	require.NoError(t, d.Delete([]byte("a"), nil))
+
+	require.NoError(t, d.Checkpoint("checkpoint"))
+
+	// Checkpointing into an existing directory is an error.
+	if err := d.Checkpoint("checkpoint"); !os.IsExist(err) {
+		t.Fatalf("expected already exists error, but found %v", err)
+	}
+
+	// Mutations made after the checkpoint should not be visible in it.
+	require.NoError(t, d.Set([]byte("d"), []byte("4"), nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+	require.NoError(t, d.Close())
+
+	ls, err := mem.List("checkpoint")
+	require.NoError(t, err)
+	var types []string
+	for _, filename := range ls {
+		fileType, _, ok := base.ParseFilename(mem, filename)
+		if !ok {
+			t.Fatalf("unexpected file in checkpoint: %s", filename)
+		}
+		switch fileType {
+		case fileTypeLog:
+			types = append(types, "log")
+		case fileTypeTable:
+			types = append(types, "table")
+		case fileTypeManifest:
+			types = append(types, "manifest")
+		case fileTypeCurrent:
+			types = append(types, "current")
+		case fileTypeOptions:
+			types = append(types, "options")
+		default:
+			t.Fatalf("unexpected file in checkpoint: %s", filename)
+		}
+	}
+	sort.Strings(types)
+	require.EqualValues(t, []string{"current", "log", "manifest", "options", "table"}, types)
+
+	d, err = Open("checkpoint", opts)
+	require.NoError(t, err)
+	for _, c := range []struct {
+		key, value string
+	}{
+		{"a", ""},
+		{"b", "2"},
+		{"c", "3"},
+		{"d", ""},
+	} {
+		v, err := d.Get([]byte(c.key))
+		if c.value == "" {
+			if err != ErrNotFound {
+				t.Fatalf("%s: expected not found, but found %q (%v)", c.key, v, err)
+			}
+			continue
+		}
+		require.NoError(t, err)
+		require.EqualValues(t, c.value, string(v))
+	}
+	require.NoError(t, d.Close())
+}
+
+func TestCheckpointRemovedOnError(t *testing.T) {
+	mem := vfs.NewMem()
+	var fail int32
+	pred := errorfs.And(
+		errorfs.OpTypes(errorfs.OpLink, errorfs.OpCreate),
+		errorfs.PathMatch("*.sst"),
+		func(op errorfs.Op) bool { return atomic.LoadInt32(&fail) != 0 },
+	)
+	fs := errorfs.Wrap(mem, errorfs.OnMatch(pred))
+	d, err := Open("db", &Options{FS: fs})
+	require.NoError(t, err)
+	require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+	require.NoError(t, d.Flush())
+
+	// Linking or copying the sstable into the checkpoint fails after the
+	// OPTIONS file has been copied into it.
+	atomic.StoreInt32(&fail, 1)
+	if err := d.Checkpoint("checkpoint"); err != errorfs.ErrInjected {
+		t.Fatalf("expected %v, but found %v", errorfs.ErrInjected, err)
+	}
+	if _, err := mem.Stat("checkpoint"); !os.IsNotExist(err) {
+		t.Fatalf("expected checkpoint to be removed: %v", err)
+	}
+
+	// The checkpoint can be retried once the error clears.
+	atomic.StoreInt32(&fail, 0)
+	require.NoError(t, d.Checkpoint("checkpoint"))
+	require.NoError(t, d.Close())
+}
+
+func TestCheckpointIngestedFlushable(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &Options{FS: mem}
+	d, err := Open("db", opts)
+	require.NoError(t, err)
+
+	// Prevent flushes so that the ingested sstable, which overlaps the
+	// memtable, remains in the queue of memtables.
+	d.mu.Lock()
+	d.mu.compact.flushing = true
+	d.mu.Unlock()
+
+	require.NoError(t, d.Set([]byte("b"), []byte("1"), nil))
+	f, err := mem.Create("ext")
+	require.NoError(t, err)
+	w := sstable.NewWriter(f, nil, LevelOptions{})
+	require.NoError(t, w.Set([]byte("b"), []byte("2")))
+	require.NoError(t, w.Set([]byte("c"), []byte("2")))
+	require.NoError(t, w.Close())
+	require.NoError(t, d.Ingest([]string{"ext"}))
+
+	require.NoError(t, d.Checkpoint("checkpoint"))
+
+	d.mu.Lock()
+	d.mu.compact.flushing = false
+	d.mu.Unlock()
+	require.NoError(t, d.Close())
+
+	c, err := Open("checkpoint", opts)
+	require.NoError(t, err)
+	for _, key := range []string{"b", "c"} {
+		v, err := c.Get([]byte(key))
+		require.NoError(t, err)
+		if string(v) != "2" {
+			t.Fatalf("%s: expected 2, but found %s", key, v)
+		}
+	}
+	require.NoError(t, c.Close())
+}
+
+func TestCheckpointDefersDeletions(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{FS: mem})
+	require.NoError(t, err)
+
+	require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Set([]byte("a"), []byte("2"), nil))
+	require.NoError(t, d.Flush())
+	d.mu.Lock()
+	tableNum := d.mu.versions.currentVersion().Files[0][0].FileNum
+	d.disableFileDeletions()
+	d.mu.Unlock()
+
+	// Compacting the L0 tables makes them obsolete, but they must not be deleted
+	// while file deletions are disabled.
+	require.NoError(t, d.Compact([]byte("a"), []byte("b")))
+	tablePath := base.MakeFilename(mem, "", fileTypeTable, tableNum)
+	if _, err := mem.Stat(tablePath); err != nil {
+		t.Fatalf("expected %s to exist: %v", tablePath, err)
+	}
+
+	d.mu.Lock()
+	d.enableFileDeletions()
+	d.mu.Unlock()
+	if _, err := mem.Stat(tablePath); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be deleted: %v", tablePath, err)
+	}
+	require.NoError(t, d.Close())
+}
+
+func TestCheckpointConcurrentWrites(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &Options{
+		FS:                    mem,
+		L0CompactionThreshold: 2,
+		MemTableSize:          64 << 10,
+	}
+	d, err := Open("db", opts)
+	require.NoError(t, err)
+
+	const numKeys = 2000
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("%06d", i))
+			if err := d.Set(key, key, nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	const numCheckpoints = 5
+	for i := 0; i < numCheckpoints; i++ {
+		require.NoError(t, d.Checkpoint(fmt.Sprintf("checkpoint%d", i)))
+	}
+	wg.Wait()
+	require.NoError(t, d.Close())
+
+	// Each checkpoint must contain a prefix of the keys written as the keys
+	// were written sequentially.
+	for i := 0; i < numCheckpoints; i++ {
+		c, err := Open(fmt.Sprintf("checkpoint%d", i), opts)
+		require.NoError(t, err)
+		iter := c.NewIter(nil)
+		n := 0
+		for iter.First(); iter.Valid(); iter.Next() {
+			expected := fmt.Sprintf("%06d", n)
+			if string(iter.Key()) != expected {
+				t.Fatalf("checkpoint%d: expected %s, but found %s", i, expected, iter.Key())
+			}
+			n++
+		}
+		require.NoError(t, iter.Close())
+		require.NoError(t, c.Close())
+	}
+}
+
+func TestCheckpointTornWAL(t *testing.T) {
+	mem := vfs.NewMem()
+	// Slow down the writes to the WAL so that a checkpoint is likely to be
+	// taken while a record spanning multiple blocks is partially written.
+	isLog := errorfs.FileTypes(fileTypeLog)
+	fs := errorfs.Wrap(mem, errorfs.InjectorFunc(func(op errorfs.Op) error {
+		if op.Type == errorfs.OpWrite && strings.HasPrefix(op.Path, "db") && isLog(op) {
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	}))
+	d, err := Open("db", &Options{FS: fs})
+	require.NoError(t, err)
+
+	// The values are large enough for each record to span multiple WAL
+	// blocks, and are synced so that partial blocks are written to the WAL. A
+	// checkpoint must not contain a partially written record.
+	const numKeys = 100
+	value := make([]byte, 80<<10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("%06d", i))
+			if err := d.Set(key, value, Sync); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	const numCheckpoints = 10
+	for i := 0; i < numCheckpoints; i++ {
+		time.Sleep(5 * time.Millisecond)
+		require.NoError(t, d.Checkpoint(fmt.Sprintf("checkpoint%d", i)))
+	}
+	wg.Wait()
+	require.NoError(t, d.Close())
+
+	for i := 0; i < numCheckpoints; i++ {
+		c, err := Open(fmt.Sprintf("checkpoint%d", i), &Options{FS: mem})
+		require.NoError(t, err)
+		iter := c.NewIter(nil)
+		n := 0
+		for iter.First(); iter.Valid(); iter.Next() {
+			expected := fmt.Sprintf("%06d", n)
+			if string(iter.Key()) != expected {
+				t.Fatalf("checkpoint%d: expected %s, but found %s", i, expected, iter.Key())
+			}
+			n++
+		}
+		require.NoError(t, iter.Close())
+		require.NoError(t, c.Close())
+	}
+}
@@ -33,6 +33,17 @@ var mvccComparer = &pebble.Comparer{
 		return append(dst, a...)
 	},
 
+	Split: func(k []byte) int {
+		key, _, ok := mvccSplitKey(k)
+		if !ok {
+			return len(k)
+		}
+		// This matches the behavior of libroach/KeyPrefix. RocksDB requires that
+		// keys generated via a SliceTransform be a comparable prefix of the
+		// original key: the user key including the sentinel byte.
+		return len(key) + 1
+	},
+
 	Name: "cockroach_comparator",
 }
 
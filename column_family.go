@@ -0,0 +1,458 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultColumnFamilyName is the name of the default column family. Every DB
+// has a default column family which uses the options the DB was opened with,
+// and which is the target of the DB's (and Batch's) non-column family
+// operations.
+const DefaultColumnFamilyName = "default"
+
+// ErrColumnFamilyDropped is returned when an operation is performed on a
+// column family that has been dropped.
+var ErrColumnFamilyDropped = errors.New("pebble: column family dropped")
+
+// memTables holds the memtables of a column family.
+type memTables struct {
+	// The current mutable memTable.
+	mutable *memTable
+	// Queue of flushables (the mutable memtable is at end). Elements are
+	// added to the end of the slice and removed from the beginning. Once an
+	// index is set it is never modified making a fixed slice immutable and
+	// safe for concurrent reads.
+	queue []flushable
+}
+
+// A ColumnFamily is a named keyspace within a DB. Each column family has its
+// own memtables and LSM, and its own options (e.g. Comparer, Merger and
+// Levels). All of the column families in a DB share the commit pipeline and
+// the WAL, which allows a single Batch to atomically mutate multiple column
+// families (see Batch.SetCF). Sequence numbers are shared as well, so a
+// Snapshot provides a consistent view across column families.
+//
+// Column families are created with DB.CreateColumnFamily, or by listing them
+// in Options.ColumnFamilies when opening the DB. The options for every column
+// family must be specified in Options.ColumnFamilies when an existing DB is
+// opened.
+//
+// The memtables of all of the column families are rotated together along with
+// the WAL, and are flushed independently. Each column family uses a separate
+// table cache sized according to Options.MaxOpenFiles.
+type ColumnFamily struct {
+	db             *DB
+	id             uint32
+	name           string
+	opts           *Options
+	cmp            Compare
+	equal          Equal
+	merge          Merge
+	split          Split
+	abbreviatedKey AbbreviatedKey
+
+	tableCache *tableCache
+	newIters   tableNewIters
+
+	largeBatchThreshold int
+
+	// readState provides access to the state needed for reading without needing
+	// to acquire DB.mu. The readState is nil once the column family has been
+	// dropped.
+	readState struct {
+		sync.RWMutex
+		val *readState
+	}
+
+	// mem and versions are protected by DB.mu.
+	mem      *memTables
+	versions *columnFamilyVersions
+
+	dropped int32 // updated atomically
+}
+
+// columnFamilyOptions returns the options for a column family, taking the
+// DB-wide options from dbOpts.
+func columnFamilyOptions(dbOpts, cfOpts *Options) *Options {
+	o := cfOpts.Clone()
+	o.BytesPerSync = dbOpts.BytesPerSync
+	o.Cache = dbOpts.Cache
+	o.Clock = dbOpts.Clock
+	o.ColumnFamilies = nil
+	o.DisableWAL = dbOpts.DisableWAL
+	o.DiskSpaceReservation = dbOpts.DiskSpaceReservation
+	o.ErrorIfDBExists = false
+	o.EventListener = dbOpts.EventListener
+	o.FS = dbOpts.FS
+	o.FreeDiskSpaceStopWritesThreshold = dbOpts.FreeDiskSpaceStopWritesThreshold
+	o.Logger = dbOpts.Logger
+	o.MaxConcurrentCompactions = dbOpts.MaxConcurrentCompactions
+	o.MaxManifestFileSize = dbOpts.MaxManifestFileSize
+	o.MaxOpenFiles = dbOpts.MaxOpenFiles
+	o.MaxSubcompactions = dbOpts.MaxSubcompactions
+	o.MemTableStopWritesThreshold = dbOpts.MemTableStopWritesThreshold
+	o.MinCompactionRate = dbOpts.MinCompactionRate
+	o.MinDeletionRate = dbOpts.MinDeletionRate
+	o.MinFlushRate = dbOpts.MinFlushRate
+	o.Pacer = dbOpts.Pacer
+	o.ReadOnly = dbOpts.ReadOnly
+	o.WALDir = dbOpts.WALDir
+	return o.EnsureDefaults()
+}
+
+// tableCacheSize returns the number of tables a table cache may hold open.
+func tableCacheSize(maxOpenFiles int) int {
+	size := maxOpenFiles - numNonTableCacheFiles
+	if size < minTableCacheSize {
+		size = minTableCacheSize
+	}
+	return size
+}
+
+// newColumnFamily returns a handle for a non-default column family. The
+// mutable memtable of the column family is associated with the specified WAL.
+func (d *DB) newColumnFamily(cfv *columnFamilyVersions, logNum uint64) *ColumnFamily {
+	opts := cfv.opts
+	cf := &ColumnFamily{
+		db:             d,
+		id:             cfv.id,
+		name:           cfv.name,
+		opts:           opts,
+		cmp:            opts.Comparer.Compare,
+		equal:          opts.Comparer.Equal,
+		merge:          opts.Merger.Merge,
+		split:          opts.Comparer.Split,
+		abbreviatedKey: opts.Comparer.AbbreviatedKey,
+		tableCache:     &tableCache{},
+		mem:            &memTables{},
+		versions:       cfv,
+	}
+	if cf.equal == nil {
+		cf.equal = bytes.Equal
+	}
+	cf.tableCache.init(d.dbNum, d.dirname, opts.FS, opts,
+		tableCacheSize(opts.MaxOpenFiles), defaultTableCacheHitBuffer)
+	cf.newIters = cf.tableCache.newIters
+	cf.mem.mutable = cf.newMemTable(logNum)
+	cf.mem.queue = append(cf.mem.queue, cf.mem.mutable)
+	cf.largeBatchThreshold = (opts.MemTableSize - int(cf.mem.mutable.emptySize)) / 2
+	return cf
+}
+
+// newMemTable returns a new memtable for the column family, associated with
+// the specified WAL.
+func (cf *ColumnFamily) newMemTable(logNum uint64) *memTable {
+	m := newMemTable(cf.opts)
+	m.cfID = cf.id
+	m.logNum = logNum
+	return m
+}
+
+// flushableCount returns the number of memtables at the head of the queue
+// that are ready to be flushed. The mutable memtable of a live column family
+// is never flushable. Requires DB.mu is held.
+func (cf *ColumnFamily) flushableCount() int {
+	n := len(cf.mem.queue)
+	if !cf.isDropped() {
+		n--
+	}
+	for i := 0; i < n; i++ {
+		if !cf.mem.queue[i].readyForFlush() {
+			return i
+		}
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+func (cf *ColumnFamily) isDropped() bool {
+	return atomic.LoadInt32(&cf.dropped) != 0
+}
+
+// Name returns the name of the column family.
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// ID returns the ID of the column family. The default column family has ID
+// 0. IDs are assigned in increasing order and are never reused.
+func (cf *ColumnFamily) ID() uint32 {
+	return cf.id
+}
+
+// Get gets the value for the given key in the column family. It returns
+// ErrNotFound if the column family does not contain the key.
+//
+// The caller should not modify the contents of the returned slice, but it is
+// safe to modify the contents of the argument after Get returns.
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	return cf.db.getInternal(cf, key, nil /* batch */, nil /* snapshot */)
+}
+
+// NewIter returns an iterator over the column family that is unpositioned
+// (Iterator.Valid() will return false). See DB.NewIter.
+func (cf *ColumnFamily) NewIter(o *IterOptions) *Iterator {
+	return cf.db.newIterInternal(cf, nil, /* batchIter */
+		nil /* batchRangeDelIter */, nil /* snapshot */, o)
+}
+
+// Set sets the value for the given key in the column family.
+//
+// It is safe to modify the contents of the arguments after Set returns.
+func (cf *ColumnFamily) Set(key, value []byte, opts *WriteOptions) error {
+	b := newBatch(cf.db)
+	defer b.release()
+	if err := b.SetCF(cf, key, value, opts); err != nil {
+		return err
+	}
+	return cf.db.Apply(b, opts)
+}
+
+// Delete deletes the value for the given key in the column family.
+//
+// It is safe to modify the contents of the arguments after Delete returns.
+func (cf *ColumnFamily) Delete(key []byte, opts *WriteOptions) error {
+	b := newBatch(cf.db)
+	defer b.release()
+	if err := b.DeleteCF(cf, key, opts); err != nil {
+		return err
+	}
+	return cf.db.Apply(b, opts)
+}
+
+// SingleDelete single deletes the value for the given key in the column
+// family. See Writer.SingleDelete for more details on the semantics of
+// SingleDelete.
+//
+// It is safe to modify the contents of the arguments after SingleDelete
+// returns.
+func (cf *ColumnFamily) SingleDelete(key []byte, opts *WriteOptions) error {
+	b := newBatch(cf.db)
+	defer b.release()
+	if err := b.SingleDeleteCF(cf, key, opts); err != nil {
+		return err
+	}
+	return cf.db.Apply(b, opts)
+}
+
+// DeleteRange deletes all of the keys (and values) in the range [start,end)
+// (inclusive on start, exclusive on end) in the column family.
+//
+// It is safe to modify the contents of the arguments after DeleteRange
+// returns.
+func (cf *ColumnFamily) DeleteRange(start, end []byte, opts *WriteOptions) error {
+	b := newBatch(cf.db)
+	defer b.release()
+	if err := b.DeleteRangeCF(cf, start, end, opts); err != nil {
+		return err
+	}
+	return cf.db.Apply(b, opts)
+}
+
+// Merge merges the value for the given key in the column family using the
+// column family's merge operator.
+//
+// It is safe to modify the contents of the arguments after Merge returns.
+func (cf *ColumnFamily) Merge(key, value []byte, opts *WriteOptions) error {
+	b := newBatch(cf.db)
+	defer b.release()
+	if err := b.MergeCF(cf, key, value, opts); err != nil {
+		return err
+	}
+	return cf.db.Apply(b, opts)
+}
+
+// Flush flushes the memtable of the column family to stable storage. Note
+// that the memtables of all of the column families are rotated together, but
+// Flush only waits for the column family's memtable to be flushed.
+func (cf *ColumnFamily) Flush() error {
+	d := cf.db
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if cf.isDropped() {
+		return ErrColumnFamilyDropped
+	}
+	if err := d.writesStoppedErr(); err != nil {
+		return err
+	}
+
+	d.commit.mu.Lock()
+	d.mu.Lock()
+	mem := cf.mem.mutable
+	err := d.makeRoomForWrite(nil)
+	d.mu.Unlock()
+	d.commit.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return d.waitFlushed(mem.flushed())
+}
+
+// Compact the specified range of keys in the column family.
+func (cf *ColumnFamily) Compact(start, end []byte) error {
+	return cf.db.compactRange(cf, start, end)
+}
+
+// DeleteFilesInRange deletes the sstables of the column family whose keys all
+// lie within the range [start,end). See DB.DeleteFilesInRange.
+func (cf *ColumnFamily) DeleteFilesInRange(start, end []byte) error {
+	return cf.db.deleteFilesInRange(cf, start, end)
+}
+
+// EstimateDiskUsage returns the estimated number of bytes used to store the
+// keys of the column family in the range [start, end). See
+// DB.EstimateDiskUsage.
+func (cf *ColumnFamily) EstimateDiskUsage(start, end []byte) (uint64, error) {
+	return cf.db.estimateDiskUsage(cf, start, end)
+}
+
+// ApproximateMidKey returns a key which divides the keys of the column family
+// in the range [start, end) roughly in half by size. See
+// DB.ApproximateMidKey.
+func (cf *ColumnFamily) ApproximateMidKey(start, end []byte) ([]byte, error) {
+	return cf.db.approximateMidKey(cf, start, end)
+}
+
+// ColumnFamily returns the handle for the column family with the specified
+// name, or nil if the DB does not contain such a column family. The handle
+// for the default column family is returned for DefaultColumnFamilyName.
+func (d *DB) ColumnFamily(name string) *ColumnFamily {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, cf := range d.mu.columnFamilies {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// CreateColumnFamily creates a new column family with the specified name and
+// options. The DB-wide options (see Options.ColumnFamilies) are taken from the
+// DB's options. The options must also be specified in Options.ColumnFamilies
+// whenever the DB is subsequently opened.
+func (d *DB) CreateColumnFamily(name string, opts *Options) (*ColumnFamily, error) {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if name == "" {
+		return nil, fmt.Errorf("pebble: empty column family name")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	return d.createColumnFamilyLocked(jobID, name, opts)
+}
+
+// createColumnFamilyLocked creates a new column family. d.mu must be held when
+// calling this, but the mutex may be dropped and re-acquired during the course
+// of this method.
+func (d *DB) createColumnFamilyLocked(jobID int, name string, opts *Options) (*ColumnFamily, error) {
+	opts = columnFamilyOptions(d.opts, opts)
+	cfv, err := d.mu.versions.createColumnFamily(
+		jobID, name, opts, d.mu.mem.mutable.logNum, d.dataDir)
+	if err != nil {
+		d.maybeStopWritesLocked(err)
+		return nil, err
+	}
+	// NB: the WAL may have been rotated while the manifest was being written.
+	// Associate the memtable with the current WAL.
+	cf := d.newColumnFamily(cfv, d.mu.mem.mutable.logNum)
+	d.mu.columnFamilies = append(d.mu.columnFamilies, cf)
+	cf.updateReadStateLocked()
+	return cf, nil
+}
+
+// DropColumnFamily drops the specified column family, deleting all of its
+// data. The default column family cannot be dropped. Subsequent operations
+// using the column family return ErrColumnFamilyDropped, though iterators
+// that were created before the column family was dropped remain usable.
+func (d *DB) DropColumnFamily(cf *ColumnFamily) error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if cf.db != d {
+		return fmt.Errorf("pebble: column family %q belongs to a different DB", cf.name)
+	}
+	if cf.id == 0 {
+		return fmt.Errorf("pebble: cannot drop the default column family")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if cf.isDropped() {
+		return ErrColumnFamilyDropped
+	}
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	ve := &versionEdit{
+		ColumnFamily:     cf.id,
+		ColumnFamilyDrop: true,
+	}
+	if err := d.mu.versions.logAndApply(jobID, ve, nil, d.dataDir); err != nil {
+		d.maybeStopWritesLocked(err)
+		return err
+	}
+	atomic.StoreInt32(&cf.dropped, 1)
+
+	for i := range d.mu.columnFamilies {
+		if d.mu.columnFamilies[i] == cf {
+			d.mu.columnFamilies = append(d.mu.columnFamilies[:i:i], d.mu.columnFamilies[i+1:]...)
+			break
+		}
+	}
+	// The dropped column family's table cache is retained until the DB is
+	// closed as existing iterators may still be using it.
+	d.mu.droppedColumnFamilies = append(d.mu.droppedColumnFamilies, cf)
+
+	// Release the readState, which releases the memtables and the current
+	// version once existing iterators are closed. The memtables are discarded
+	// by the flush loop once the in-progress writes to them complete.
+	cf.readState.Lock()
+	old := cf.readState.val
+	cf.readState.val = nil
+	cf.readState.Unlock()
+	if old != nil {
+		old.unrefLocked()
+	}
+	if cf.mem.mutable.unref() {
+		d.maybeScheduleFlush()
+	}
+	d.deleteObsoleteFiles(jobID)
+	return nil
+}
+
+// getColumnFamilyLocked returns the live column family with the specified ID,
+// or nil if there is no such column family. Requires DB.mu is held.
+func (d *DB) getColumnFamilyLocked(id uint32) *ColumnFamily {
+	i := sort.Search(len(d.mu.columnFamilies), func(i int) bool {
+		return d.mu.columnFamilies[i].id >= id
+	})
+	if i < len(d.mu.columnFamilies) && d.mu.columnFamilies[i].id == id {
+		return d.mu.columnFamilies[i]
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+var testReverseComparer = func() *Comparer {
+	c := *DefaultComparer
+	c.Name = "pebble.test.reverse"
+	c.Compare = func(a, b []byte) int {
+		return DefaultComparer.Compare(b, a)
+	}
+	c.AbbreviatedKey = func(key []byte) uint64 {
+		return ^DefaultComparer.AbbreviatedKey(key)
+	}
+	c.Separator = func(dst, a, b []byte) []byte {
+		return append(dst, a...)
+	}
+	c.Successor = func(dst, a []byte) []byte {
+		return append(dst, a...)
+	}
+	return &c
+}()
+
+func scanColumnFamily(t *testing.T, cf *ColumnFamily) string {
+	t.Helper()
+	iter := cf.NewIter(nil)
+	var buf bytes.Buffer
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if buf.Len() > 0 {
+			buf.WriteString(" ")
+		}
+		buf.WriteString(string(iter.Key()) + ":" + string(iter.Value()))
+	}
+	require.NoError(t, iter.Close())
+	return buf.String()
+}
+
+func TestColumnFamily(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &Options{
+		FS: mem,
+		ColumnFamilies: map[string]*Options{
+			"reverse": &Options{Comparer: testReverseComparer},
+		},
+	}
+	d, err := Open("", opts)
+	require.NoError(t, err)
+
+	cf := d.ColumnFamily("reverse")
+	require.NotNil(t, cf)
+	require.Equal(t, "reverse", cf.Name())
+	require.Equal(t, uint32(1), cf.ID())
+	require.Equal(t, d.ColumnFamily(DefaultColumnFamilyName).ID(), uint32(0))
+
+	// A single batch atomically writes to both column families.
+	b := d.NewBatch()
+	require.NoError(t, b.Set([]byte("a"), []byte("1"), nil))
+	require.NoError(t, b.SetCF(cf, []byte("a"), []byte("2"), nil))
+	require.NoError(t, b.SetCF(cf, []byte("b"), []byte("3"), nil))
+	require.NoError(t, b.MergeCF(cf, []byte("c"), []byte("4"), nil))
+	require.NoError(t, b.MergeCF(cf, []byte("c"), []byte("4"), nil))
+	require.NoError(t, b.SetCF(cf, []byte("d"), []byte("6"), nil))
+	require.NoError(t, b.DeleteCF(cf, []byte("d"), nil))
+	require.NoError(t, b.Commit(nil))
+
+	verify := func() {
+		t.Helper()
+		require.Equal(t, "a:1", scanColumnFamily(t, d.defaultCF))
+		require.Equal(t, "c:44 b:3 a:2", scanColumnFamily(t, cf))
+		v, err := cf.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, "2", string(v))
+		if _, err := d.Get([]byte("b")); err != ErrNotFound {
+			t.Fatalf("expected not found, but found %v", err)
+		}
+	}
+	verify()
+
+	// The column families are recovered from the WAL.
+	require.NoError(t, d.Close())
+	d, err = Open("", opts)
+	require.NoError(t, err)
+	cf = d.ColumnFamily("reverse")
+	verify()
+
+	// Flushing and compacting a column family does not affect the other.
+	require.NoError(t, cf.Flush())
+	require.NoError(t, cf.Compact([]byte("z"), []byte("a")))
+	verify()
+	require.NoError(t, d.Close())
+
+	d, err = Open("", opts)
+	require.NoError(t, err)
+	cf = d.ColumnFamily("reverse")
+	verify()
+	require.NoError(t, d.Close())
+
+	// The column family options must be specified when the DB is opened.
+	_, err = Open("", &Options{FS: mem})
+	require.Regexp(t, `no options specified for column family "reverse"`, err)
+
+	// The comparer of a column family cannot change.
+	_, err = Open("", &Options{
+		FS: mem,
+		ColumnFamilies: map[string]*Options{
+			"reverse": &Options{},
+		},
+	})
+	require.Regexp(t, `comparer name from file.*!=.*`, err)
+}
+
+func TestColumnFamilyCreateDrop(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{FS: mem})
+	require.NoError(t, err)
+
+	cf, err := d.CreateColumnFamily("foo", &Options{})
+	require.NoError(t, err)
+	_, err = d.CreateColumnFamily("foo", &Options{})
+	require.Regexp(t, `column family "foo" already exists`, err)
+	_, err = d.CreateColumnFamily(DefaultColumnFamilyName, &Options{})
+	require.Regexp(t, `column family "default" already exists`, err)
+
+	require.NoError(t, cf.Set([]byte("a"), []byte("1"), nil))
+	require.NoError(t, cf.Flush())
+	require.NoError(t, cf.Set([]byte("b"), []byte("2"), nil))
+
+	// An iterator created before the column family is dropped remains usable.
+	iter := cf.NewIter(nil)
+
+	require.Regexp(t, `cannot drop the default column family`,
+		d.DropColumnFamily(d.ColumnFamily(DefaultColumnFamilyName)))
+	require.NoError(t, d.DropColumnFamily(cf))
+	require.Equal(t, ErrColumnFamilyDropped, d.DropColumnFamily(cf))
+	require.Nil(t, d.ColumnFamily("foo"))
+
+	if _, err := cf.Get([]byte("a")); err != ErrColumnFamilyDropped {
+		t.Fatalf("expected %v, but found %v", ErrColumnFamilyDropped, err)
+	}
+	require.Equal(t, ErrColumnFamilyDropped, cf.NewIter(nil).Close())
+	require.Equal(t, ErrColumnFamilyDropped, cf.Set([]byte("c"), []byte("3"), nil))
+	require.Equal(t, ErrColumnFamilyDropped, cf.Flush())
+	require.Equal(t, ErrColumnFamilyDropped, cf.Compact([]byte("a"), []byte("z")))
+
+	var keys []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, "a b", strings.Join(keys, " "))
+
+	// A column family with the same name can be created again, and is empty.
+	cf2, err := d.CreateColumnFamily("foo", &Options{})
+	require.NoError(t, err)
+	require.NotEqual(t, cf.ID(), cf2.ID())
+	require.Equal(t, "", scanColumnFamily(t, cf2))
+	require.NoError(t, cf2.Set([]byte("c"), []byte("3"), nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Close())
+
+	opts := &Options{
+		FS: mem,
+		ColumnFamilies: map[string]*Options{
+			"foo": &Options{},
+		},
+	}
+	d, err = Open("", opts)
+	require.NoError(t, err)
+	cf2 = d.ColumnFamily("foo")
+	require.Equal(t, "c:3", scanColumnFamily(t, cf2))
+
+	// The sstable of the dropped column family has been deleted, leaving the
+	// sstable of the new column family.
+	ls, err := mem.List("")
+	require.NoError(t, err)
+	var tables int
+	for _, filename := range ls {
+		if fileType, _, ok := base.ParseFilename(mem, filename); ok && fileType == fileTypeTable {
+			tables++
+		}
+	}
+	require.Equal(t, 1, tables)
+	require.NoError(t, d.Close())
+}
+
+func TestColumnFamilyIndexedBatch(t *testing.T) {
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+		ColumnFamilies: map[string]*Options{
+			"reverse": &Options{Comparer: testReverseComparer},
+		},
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+	cf := d.ColumnFamily("reverse")
+	require.NoError(t, cf.Set([]byte("e"), []byte("db"), nil))
+
+	scan := func(iter *Iterator) string {
+		t.Helper()
+		var buf bytes.Buffer
+		for valid := iter.First(); valid; valid = iter.Next() {
+			if buf.Len() > 0 {
+				buf.WriteString(" ")
+			}
+			buf.WriteString(string(iter.Key()) + ":" + string(iter.Value()))
+		}
+		require.NoError(t, iter.Close())
+		return buf.String()
+	}
+
+	b := d.NewIndexedBatch()
+	require.NoError(t, b.Set([]byte("a"), []byte("0"), nil))
+	require.NoError(t, b.SetCF(cf, []byte("a"), []byte("1"), nil))
+	require.NoError(t, b.SetCF(cf, []byte("c"), []byte("2"), nil))
+	require.NoError(t, b.MergeCF(cf, []byte("c"), []byte("3"), nil))
+	require.NoError(t, b.SetCF(cf, []byte("d"), []byte("4"), nil))
+	require.NoError(t, b.DeleteCF(cf, []byte("d"), nil))
+	// The range [b,a) of the reverse column family contains "b" but not "a".
+	require.NoError(t, b.SetCF(cf, []byte("b"), []byte("5"), nil))
+	require.NoError(t, b.DeleteRangeCF(cf, []byte("b"), []byte("a"), nil))
+
+	// Records written to another batch are indexed when applied.
+	b2 := d.NewBatch()
+	require.NoError(t, b2.SetCF(cf, []byte("f"), []byte("6"), nil))
+	require.NoError(t, b.Apply(b2, nil))
+	require.NoError(t, b2.Close())
+
+	verify := func() {
+		t.Helper()
+		require.Equal(t, "a:0", scan(b.NewIter(nil)))
+		require.Equal(t, "a:0", scan(b.NewIterCF(nil, nil)))
+		require.Equal(t, "f:6 e:db c:32 a:1", scan(b.NewIterCF(cf, nil)))
+
+		v, err := b.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, "0", string(v))
+		v, err = b.GetCF(cf, []byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, "1", string(v))
+		v, err = b.GetCF(cf, []byte("e"))
+		require.NoError(t, err)
+		require.Equal(t, "db", string(v))
+		for _, key := range []string{"b", "d"} {
+			if _, err := b.GetCF(cf, []byte(key)); err != ErrNotFound {
+				t.Fatalf("%s: expected not found, but found %v", key, err)
+			}
+		}
+	}
+	verify()
+
+	require.NoError(t, b.Commit(nil))
+	require.Equal(t, "f:6 e:db c:32 a:1", scanColumnFamily(t, cf))
+}
+
+func TestColumnFamilyFlushEmptyMemTable(t *testing.T) {
+	mem := vfs.NewMem()
+	var flushes int
+	d, err := Open("", &Options{
+		FS: mem,
+		ColumnFamilies: map[string]*Options{
+			"foo": &Options{},
+		},
+		EventListener: EventListener{
+			FlushEnd: func(info FlushInfo) {
+				flushes++
+			},
+		},
+	})
+	require.NoError(t, err)
+	cf := d.ColumnFamily("foo")
+
+	// Flushing the default column family rotates the empty memtable of the
+	// other column family, which is discarded rather than flushed.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+		require.NoError(t, d.Flush())
+	}
+	require.NoError(t, cf.Flush())
+	require.Equal(t, 3, flushes)
+
+	var cfFiles int
+	for _, files := range cf.versions.currentVersion().Files {
+		cfFiles += len(files)
+	}
+	require.Equal(t, 0, cfFiles)
+
+	// The WALs are not retained for the column family.
+	d.mu.Lock()
+	require.Equal(t, cf.mem.mutable.logNum, d.mu.versions.minLogNumToKeep())
+	d.mu.Unlock()
+
+	require.NoError(t, cf.Set([]byte("b"), []byte("2"), nil))
+	require.NoError(t, d.Close())
+
+	d, err = Open("", &Options{
+		FS: mem,
+		ColumnFamilies: map[string]*Options{
+			"foo": &Options{},
+		},
+	})
+	require.NoError(t, err)
+	cf = d.ColumnFamily("foo")
+	require.Equal(t, "b:2", scanColumnFamily(t, cf))
+	require.NoError(t, d.Close())
+}
@@ -220,6 +220,15 @@ type commitPipeline struct {
 	mu sync.Mutex
 	// Queue of pending batches to commit.
 	pending commitQueue
+	// published is used by CommitIf to wait for the visible sequence number to
+	// advance. publish only signals cond when waiters is non-zero, so that
+	// commits without a check callback never lock the mutex.
+	published struct {
+		sync.Mutex
+		cond sync.Cond
+		// The number of goroutines waiting on cond. Updated atomically.
+		waiters int32
+	}
 }
 
 func newCommitPipeline(env commitEnv) *commitPipeline {
@@ -227,6 +236,7 @@ func newCommitPipeline(env commitEnv) *commitPipeline {
 		env: env,
 		sem: make(chan struct{}, commitConcurrency),
 	}
+	p.published.cond.L = &p.published.Mutex
 	return p
 }
 
@@ -237,12 +247,34 @@ func (p *commitPipeline) Close() {
 // WAL, and applying the batch to the memtable. Upon successful return the
 // batch's mutations will be visible for reading.
 func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
+	return p.CommitIf(b, syncWAL, nil)
+}
+
+// CommitIf is like Commit, but only commits the batch if the check callback
+// succeeds. The check callback is invoked with commitPipeline.mu held after
+// all of the previously committed batches have been published, so the
+// callback observes every batch which precedes the batch in sequence number
+// order and no other batch can be committed between the check and the
+// batch. If check returns an error the batch is not committed and the error
+// is returned. A nil check callback always succeeds. Other commits are blocked
+// while check runs, so it should not perform I/O.
+func (p *commitPipeline) CommitIf(b *Batch, syncWAL bool, check func() error) error {
 	if b.Empty() {
 		return nil
 	}
 
 	p.sem <- struct{}{}
 
+	p.mu.Lock()
+	if check != nil {
+		p.waitPublished()
+		if err := check(); err != nil {
+			p.mu.Unlock()
+			<-p.sem
+			return err
+		}
+	}
+
 	// Prepare the batch for committing: enqueuing the batch in the pending
 	// queue, determining the batch sequence number and writing the data to the
 	// WAL.
@@ -273,14 +305,37 @@ func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
 	return nil
 }
 
+// waitPublished blocks until the batches which have been assigned sequence
+// numbers have been published. It must be called with commitPipeline.mu held,
+// which prevents further batches from being assigned sequence numbers.
+func (p *commitPipeline) waitPublished() {
+	logSeqNum := atomic.LoadUint64(p.env.logSeqNum)
+	if atomic.LoadUint64(p.env.visibleSeqNum) >= logSeqNum {
+		return
+	}
+
+	p.published.Lock()
+	// Register as a waiter before re-checking the visible sequence number. A
+	// publish which ratchets the visible sequence number after the check is
+	// then guaranteed to observe the waiter and signal the condition variable.
+	atomic.AddInt32(&p.published.waiters, 1)
+	for atomic.LoadUint64(p.env.visibleSeqNum) < logSeqNum {
+		p.published.cond.Wait()
+	}
+	atomic.AddInt32(&p.published.waiters, -1)
+	p.published.Unlock()
+}
+
 // AllocateSeqNum allocates count sequence numbers, invokes the prepare
 // callback, then the apply callback, and then publishes the sequence
 // numbers. AllocateSeqNum does not write to the WAL or add entries to the
-// memtable. AllocateSeqNum can be used to sequence an operation such as
-// sstable ingestion within the commit pipeline. The prepare callback is
-// invoked with commitPipeline.mu held, but note that DB.mu is not held and
-// must be locked if necessary.
-func (p *commitPipeline) AllocateSeqNum(count int, prepare func(), apply func(seqNum uint64)) {
+// memtable, though the prepare callback may do so. AllocateSeqNum can be used
+// to sequence an operation such as sstable ingestion within the commit
+// pipeline. The prepare callback is invoked with commitPipeline.mu held, but
+// note that DB.mu is not held and must be locked if necessary.
+func (p *commitPipeline) AllocateSeqNum(
+	count int, prepare func(seqNum uint64), apply func(seqNum uint64),
+) {
 	// This method is similar to Commit and prepare. Be careful about trying to
 	// share additional code with those methods because Commit and prepare are
 	// performance critical code paths.
@@ -319,7 +374,7 @@ func (p *commitPipeline) AllocateSeqNum(count int, prepare func(), apply func(se
 	// Invoke the prepare callback. Note the lack of error reporting. Even if the
 	// callback internally fails, the sequence number needs to be published in
 	// order to allow the commit pipeline to proceed.
-	prepare()
+	prepare(b.SeqNum())
 
 	p.mu.Unlock()
 
@@ -332,9 +387,11 @@ func (p *commitPipeline) AllocateSeqNum(count int, prepare func(), apply func(se
 	<-p.sem
 }
 
+// prepare must be called with commitPipeline.mu held, which it releases.
 func (p *commitPipeline) prepare(b *Batch, syncWAL bool) (*memTable, error) {
 	n := uint64(b.Count())
 	if n == invalidBatchCount {
+		p.mu.Unlock()
 		return nil, ErrInvalidBatch
 	}
 	count := 1
@@ -349,8 +406,6 @@ func (p *commitPipeline) prepare(b *Batch, syncWAL bool) (*memTable, error) {
 		syncWG, syncErr = &b.commit, &b.commitErr
 	}
 
-	p.mu.Lock()
-
 	// Enqueue the batch in the pending queue. Note that while the pending queue
 	// is lock-free, we want the order of batches to be the same as the sequence
 	// number order.
@@ -404,7 +459,13 @@ func (p *commitPipeline) publish(b *Batch) {
 				break
 			}
 			if atomic.CompareAndSwapUint64(p.env.visibleSeqNum, curSeqNum, newSeqNum) {
-				// We successfully published t's sequence number.
+				// We successfully published t's sequence number. Wake up any
+				// CommitIf waiting for the visible sequence number to advance.
+				if atomic.LoadInt32(&p.published.waiters) != 0 {
+					p.published.Lock()
+					p.published.cond.Broadcast()
+					p.published.Unlock()
+				}
 				break
 			}
 		}
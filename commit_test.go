@@ -128,7 +128,7 @@ func TestCommitPipelineAllocateSeqNum(t *testing.T) {
 	for i := 1; i <= n; i++ {
 		go func(i int) {
 			defer wg.Done()
-			p.AllocateSeqNum(i, func() {
+			p.AllocateSeqNum(i, func(seqNum uint64) {
 				atomic.AddUint64(&prepareCount, uint64(1))
 			}, func(seqNum uint64) {
 				atomic.AddUint64(&applyCount, uint64(1))
@@ -154,6 +154,77 @@ func TestCommitPipelineAllocateSeqNum(t *testing.T) {
 	}
 }
 
+func TestCommitPipelineCommitIf(t *testing.T) {
+	// Start at a non-zero sequence number, as a DB does.
+	e := testCommitEnv{logSeqNum: 1, visibleSeqNum: 1}
+	p := newCommitPipeline(e.env())
+
+	// Block the publication of an earlier batch.
+	applying := make(chan struct{})
+	release := make(chan struct{})
+	go p.AllocateSeqNum(1, func(seqNum uint64) {}, func(seqNum uint64) {
+		close(applying)
+		<-release
+	})
+	<-applying
+
+	checked := make(chan uint64, 1)
+	done := make(chan error, 1)
+	go func() {
+		var b Batch
+		_ = b.Set([]byte("a"), nil, nil)
+		done <- p.CommitIf(&b, false, func() error {
+			checked <- atomic.LoadUint64(&e.visibleSeqNum)
+			return nil
+		})
+	}()
+
+	select {
+	case <-checked:
+		t.Fatalf("check invoked before the earlier batch was published")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	if s := <-checked; s != 2 {
+		t.Fatalf("expected visible sequence number 2, but found %d", s)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent commits with and without a check.
+	const n = 100
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			var b Batch
+			_ = b.Set([]byte(fmt.Sprint(i)), nil, nil)
+			if i%2 == 0 {
+				_ = p.Commit(&b, false)
+				return
+			}
+			err := p.CommitIf(&b, false, func() error {
+				visible := atomic.LoadUint64(&e.visibleSeqNum)
+				if log := atomic.LoadUint64(&e.logSeqNum); visible != log {
+					return fmt.Errorf("visible sequence number %d != log sequence number %d", visible, log)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if s, expected := atomic.LoadUint64(&e.visibleSeqNum), uint64(n+3); s != expected {
+		t.Fatalf("expected %d, but found %d", expected, s)
+	}
+}
+
 func BenchmarkCommitPipeline(b *testing.B) {
 	for _, parallelism := range []int{1, 2, 4, 8, 16, 32, 64, 128} {
 		b.Run(fmt.Sprintf("parallel=%d", parallelism), func(b *testing.B) {
@@ -11,6 +11,7 @@ import (
 	"math"
 	"os"
 	"sort"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 
@@ -53,6 +54,10 @@ type compaction struct {
 	logger  base.Logger
 	version *version
 
+	// cfID is the ID of the column family the compaction is operating on. The
+	// version and inputs belong to that column family.
+	cfID uint32
+
 	// startLevel is the level that is being compacted. Inputs from startLevel
 	// and outputLevel will be merged to produce a set of outputLevel files.
 	startLevel int
@@ -75,7 +80,10 @@ type compaction struct {
 	// tests to allow range tombstones to be added to tables where they would
 	// otherwise be elided.
 	disableRangeTombstoneElision bool
-
+	// deleteOnly indicates a delete-only compaction, which removes the tables
+	// in inputs[0] from startLevel without reading them or producing any output
+	// (see compactionPicker.pickDeleteOnly).
+	deleteOnly bool
 	// flushing contains the flushables (aka memtables) that are being flushed.
 	flushing []flushable
 	// bytesIterated contains the number of bytes that have been flushed/compacted.
@@ -88,6 +96,15 @@ type compaction struct {
 	atomicBytesIterated *uint64
 	// inputs are the tables to be compacted.
 	inputs [2][]fileMetadata
+	// lower and upper bound the user keys [lower, upper) output by a
+	// subcompaction (see compaction.subcompactions). A nil bound leaves the
+	// compaction unbounded in that direction.
+	lower, upper []byte
+	// smallest and largest are the bounds of the compaction inputs. They are
+	// used to determine whether the compaction overlaps with other in-progress
+	// compactions.
+	smallest InternalKey
+	largest  InternalKey
 
 	// grandparents are the tables in level+2 that overlap with the files being
 	// compacted. Used to determine output table boundaries.
@@ -96,6 +113,14 @@ type compaction struct {
 	seenKey         bool   // some output key has been seen
 
 	metrics map[int]*LevelMetrics
+	// deletionHints are the hints for the range tombstones written to the
+	// output tables. They are added to the column family once the compaction
+	// has been logged to the MANIFEST.
+	deletionHints []deletionHint
+	// rewriteBlobs holds the blob files whose values referenced by the inputs
+	// are rewritten to a new blob file rather than copied by handle (see
+	// compactionPicker.garbageBlobs).
+	rewriteBlobs map[uint64]struct{}
 }
 
 func newCompaction(
@@ -136,6 +161,27 @@ func newCompaction(
 	}
 }
 
+func newDeleteOnlyCompaction(
+	opts *Options,
+	cur *version,
+	level int,
+	inputs []fileMetadata,
+) *compaction {
+	c := &compaction{
+		cmp:         opts.Comparer.Compare,
+		format:      opts.Comparer.Format,
+		logger:      opts.Logger,
+		version:     cur,
+		startLevel:  level,
+		outputLevel: level,
+		deleteOnly:  true,
+		metrics:     map[int]*LevelMetrics{},
+	}
+	c.inputs[0] = inputs
+	c.smallest, c.largest = manifest.KeyRange(c.cmp, inputs, nil)
+	return c
+}
+
 func newFlush(
 	opts *Options,
 	cur *version,
@@ -223,12 +269,44 @@ func (c *compaction) setupOtherInputs() {
 		smallest01, largest01 = manifest.KeyRange(c.cmp, c.inputs[0], c.inputs[1])
 	}
 
+	c.smallest, c.largest = smallest01, largest01
+
 	// Compute the set of outputLevel+1 files that overlap this compaction.
 	if c.outputLevel+1 < numLevels {
 		c.grandparents = c.version.Overlaps(c.outputLevel+1, c.cmp, smallest01.UserKey, largest01.UserKey)
 	}
 }
 
+// conflicts returns true if the compaction cannot run concurrently with one of
+// the inProgress compactions. Two compactions conflict if they share an input
+// table, or if they produce output tables in the same level with overlapping
+// key ranges. Note that a compaction whose inputs overlap the key range of
+// another compaction's inputs at the same level will share an input table, as
+// the inputs of a compaction at a level include every table in that level
+// which overlaps the compaction's key range.
+func (c *compaction) conflicts(inProgress []*compaction) bool {
+	for _, o := range inProgress {
+		if c.outputLevel == o.outputLevel &&
+			c.cmp(c.smallest.UserKey, o.largest.UserKey) <= 0 &&
+			c.cmp(o.smallest.UserKey, c.largest.UserKey) <= 0 {
+			return true
+		}
+		for i := range c.inputs {
+			for j := range c.inputs[i] {
+				fileNum := c.inputs[i][j].FileNum
+				for k := range o.inputs {
+					for l := range o.inputs[k] {
+						if fileNum == o.inputs[k][l].FileNum {
+							return true
+						}
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
 // expandInputs expands the files in inputs[0] in order to maintain the
 // invariant that the versions of keys at level+1 are older than the versions
 // of keys at level. This is achieved by adding tables to the right of the
@@ -300,9 +378,16 @@ func (c *compaction) grow(sm, la InternalKey) bool {
 }
 
 func (c *compaction) trivialMove() bool {
-	if len(c.flushing) != 0 {
+	if len(c.flushing) != 0 || c.deleteOnly {
 		return false
 	}
+	// A table referencing a blob file whose values are to be rewritten must be
+	// rewritten as well.
+	for i := range c.inputs[0] {
+		if referencesBlobs(&c.inputs[0][i], c.rewriteBlobs) {
+			return false
+		}
+	}
 	// Check for a trivial move of one table from one level to the next. We avoid
 	// such a move if there is lots of overlapping grandparent data. Otherwise,
 	// the move could create a parent file that will require a very expensive
@@ -314,6 +399,16 @@ func (c *compaction) trivialMove() bool {
 	return false
 }
 
+// estimatedOutputSize returns the estimated size of the tables written by the
+// compaction, which is the size of its inputs. Move and delete-only
+// compactions do not write any tables.
+func (c *compaction) estimatedOutputSize() uint64 {
+	if c.trivialMove() || c.deleteOnly {
+		return 0
+	}
+	return totalSize(c.inputs[0]) + totalSize(c.inputs[1])
+}
+
 // shouldStopBefore returns true if the output to the current table should be
 // finished and a new table started before adding the specified key. This is
 // done in order to prevent a table at level N from overlapping too much data
@@ -362,11 +457,36 @@ func (c *compaction) allowZeroSeqNum(iter internalIterator) bool {
 			return false
 		}
 		lower, _ := iter.First()
+		if lower == nil {
+			return false
+		}
+		// The key returned by First is only valid until the iterator is
+		// repositioned.
+		lowerKey := append([]byte(nil), lower.UserKey...)
 		upper, _ := iter.Last()
-		if lower == nil || upper == nil {
+		if upper == nil {
 			return false
 		}
-		return c.elideRangeTombstone(lower.UserKey, upper.UserKey)
+		// The range tombstones being flushed may extend past the largest point
+		// key. Zeroing the seqnum of a key covered by a range tombstone which is
+		// retained in the output would cause the tombstone to delete the key, so
+		// the bounds must include the tombstone end keys.
+		upperKey := upper.UserKey
+		for i := range c.flushing {
+			rangeDelIter := c.flushing[i].newRangeDelIter(nil)
+			if rangeDelIter == nil {
+				continue
+			}
+			for key, end := rangeDelIter.First(); key != nil; key, end = rangeDelIter.Next() {
+				if c.cmp(upperKey, end) < 0 {
+					upperKey = append(upperKey[:0:0], end...)
+				}
+			}
+			if err := rangeDelIter.Close(); err != nil {
+				return false
+			}
+		}
+		return c.elideRangeTombstone(lowerKey, upperKey)
 	}
 
 	var lower, upper []byte
@@ -496,6 +616,143 @@ func (c *compaction) atomicUnitBounds(f *fileMetadata) (lower, upper []byte) {
 	return nil, nil
 }
 
+// subcompactions splits the compaction into at most n subcompactions over
+// disjoint key ranges which can be run concurrently. The boundaries between
+// the subcompactions are chosen from the smallest user keys of the input
+// tables such that each subcompaction reads roughly the same number of bytes.
+// A compaction which is not split is returned as its only subcompaction.
+func (c *compaction) subcompactions(n int) []*compaction {
+	if n <= 1 || len(c.flushing) != 0 {
+		return []*compaction{c}
+	}
+	// Don't split a compaction into subcompactions which would each produce
+	// less than a full output table.
+	total := totalSize(c.inputs[0]) + totalSize(c.inputs[1])
+	if c.maxOutputFileSize > 0 && total/c.maxOutputFileSize < uint64(n) {
+		n = int(total / c.maxOutputFileSize)
+	}
+	if n <= 1 {
+		return []*compaction{c}
+	}
+
+	var candidates [][]byte
+	for i := range c.inputs {
+		for j := range c.inputs[i] {
+			candidates = append(candidates, c.inputs[i][j].Smallest.UserKey)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return c.cmp(candidates[i], candidates[j]) < 0
+	})
+
+	// bytesBefore estimates the number of input bytes preceding the specified
+	// key, assuming that half of the bytes of a table straddling the key
+	// precede it.
+	bytesBefore := func(key []byte) (size uint64) {
+		for i := range c.inputs {
+			for j := range c.inputs[i] {
+				f := &c.inputs[i][j]
+				if c.cmp(f.Largest.UserKey, key) < 0 {
+					size += f.Size
+				} else if c.cmp(f.Smallest.UserKey, key) < 0 {
+					size += f.Size / 2
+				}
+			}
+		}
+		return size
+	}
+
+	var splits [][]byte
+	for _, key := range candidates {
+		if len(splits) == n-1 {
+			break
+		}
+		// The smallest key would produce an empty subcompaction, and each split
+		// must be larger than the previous one.
+		if c.cmp(key, candidates[0]) == 0 ||
+			(len(splits) > 0 && c.cmp(key, splits[len(splits)-1]) == 0) {
+			continue
+		}
+		if bytesBefore(key) >= uint64(len(splits)+1)*total/uint64(n) {
+			splits = append(splits, key)
+		}
+	}
+	if len(splits) == 0 {
+		return []*compaction{c}
+	}
+
+	subs := make([]*compaction, 0, len(splits)+1)
+	for i := 0; i <= len(splits); i++ {
+		var lower, upper []byte
+		if i > 0 {
+			lower = splits[i-1]
+		}
+		if i < len(splits) {
+			upper = splits[i]
+		}
+		subs = append(subs, c.newSubcompaction(lower, upper))
+	}
+	return subs
+}
+
+// newSubcompaction returns a subcompaction of the compaction which outputs
+// the user keys in the range [lower, upper). The inputs of the subcompaction
+// are restricted to the tables overlapping that range.
+func (c *compaction) newSubcompaction(lower, upper []byte) *compaction {
+	sub := *c
+	sub.lower, sub.upper = lower, upper
+	sub.bytesIterated = 0
+	sub.atomicBytesIterated = nil
+	sub.overlappedBytes = 0
+	sub.seenKey = false
+	sub.metrics = nil
+	sub.deletionHints = nil
+	for i := range sub.inputs {
+		sub.inputs[i] = sub.overlappingInputs(sub.inputs[i], i == 0 && c.startLevel == 0)
+	}
+	return &sub
+}
+
+// overlappingInputs returns the files which overlap the bounds of the
+// (sub)compaction. The files of a level other than L0 are sorted and
+// non-overlapping, so the overlapping files are returned as a subslice of
+// files: atomicUnitBounds identifies a table by the address of its metadata.
+func (c *compaction) overlappingInputs(files []fileMetadata, l0 bool) []fileMetadata {
+	overlaps := func(f *fileMetadata) bool {
+		return (c.lower == nil || c.cmp(f.Largest.UserKey, c.lower) >= 0) &&
+			(c.upper == nil || c.cmp(f.Smallest.UserKey, c.upper) < 0)
+	}
+	if l0 {
+		var res []fileMetadata
+		for i := range files {
+			if overlaps(&files[i]) {
+				res = append(res, files[i])
+			}
+		}
+		return res
+	}
+	start, end := 0, len(files)
+	for start < end && !overlaps(&files[start]) {
+		start++
+	}
+	for end > start && !overlaps(&files[end-1]) {
+		end--
+	}
+	return files[start:end]
+}
+
+// boundedInputIter is the input iterator of a subcompaction with a lower
+// bound. The compactionIter positions its input with First, which is
+// translated into a seek to the lower bound.
+type boundedInputIter struct {
+	internalIterator
+	lower []byte
+}
+
+func (i *boundedInputIter) First() (*InternalKey, []byte) {
+	return i.internalIterator.SeekGE(i.lower)
+}
+
 // newInputIter returns an iterator over all the input tables in a compaction.
 func (c *compaction) newInputIter(
 	newIters tableNewIters,
@@ -567,6 +824,14 @@ func (c *compaction) newInputIter(
 			// Truncate the range tombstones returned by the iterator to the upper
 			// bound of the atomic compaction unit.
 			lowerBound, upperBound := c.atomicUnitBounds(f)
+			// The tombstones of a subcompaction are further truncated to its
+			// bounds.
+			if c.lower != nil && (lowerBound == nil || c.cmp(lowerBound, c.lower) < 0) {
+				lowerBound = c.lower
+			}
+			if c.upper != nil && (upperBound == nil || c.cmp(upperBound, c.upper) > 0) {
+				upperBound = c.upper
+			}
 			if lowerBound != nil || upperBound != nil {
 				rangeDelIter = rangedel.Truncate(c.cmp, rangeDelIter, lowerBound, upperBound)
 			}
@@ -586,6 +851,9 @@ func (c *compaction) newInputIter(
 			}
 			iters = append(iters, iter)
 			if rangeDelIter != nil {
+				if c.lower != nil || c.upper != nil {
+					rangeDelIter = rangedel.Truncate(c.cmp, rangeDelIter, c.lower, c.upper)
+				}
 				iters = append(iters, rangeDelIter)
 			}
 		}
@@ -593,7 +861,11 @@ func (c *compaction) newInputIter(
 
 	iters = append(iters, newLevelIter(nil, c.cmp, newIters, c.inputs[1], &c.bytesIterated))
 	iters = append(iters, newLevelIter(nil, c.cmp, newRangeDelIter, c.inputs[1], &c.bytesIterated))
-	return newMergingIter(c.cmp, iters...), nil
+	var iter internalIterator = newMergingIter(c.cmp, iters...)
+	if c.lower != nil {
+		iter = &boundedInputIter{internalIterator: iter, lower: c.lower}
+	}
+	return iter, nil
 }
 
 func (c *compaction) String() string {
@@ -617,6 +889,7 @@ func (c *compaction) String() string {
 }
 
 type manualCompaction struct {
+	cfID        uint32
 	level       int
 	outputLevel int
 	done        chan error
@@ -644,8 +917,10 @@ func (d *DB) getCompactionPacerInfo() compactionPacerInfo {
 func (d *DB) getFlushPacerInfo() flushPacerInfo {
 	var pacerInfo flushPacerInfo
 	d.mu.Lock()
-	for _, m := range d.mu.mem.queue {
-		pacerInfo.totalBytes += m.totalBytes()
+	for _, cf := range d.mu.columnFamilies {
+		for _, m := range cf.mem.queue {
+			pacerInfo.totalBytes += m.totalBytes()
+		}
 	}
 	d.mu.Unlock()
 	return pacerInfo
@@ -655,13 +930,11 @@ func (d *DB) getFlushPacerInfo() flushPacerInfo {
 //
 // d.mu must be held when calling this.
 func (d *DB) maybeScheduleFlush() {
-	if d.mu.compact.flushing || atomic.LoadInt32(&d.closed) != 0 || d.opts.ReadOnly {
+	if d.mu.compact.flushing || atomic.LoadInt32(&d.closed) != 0 || d.opts.ReadOnly ||
+		d.mu.bgError.err != nil {
 		return
 	}
-	if len(d.mu.mem.queue) <= 1 {
-		return
-	}
-	if !d.mu.mem.queue[0].readyForFlush() {
+	if !d.flushableLocked() {
 		return
 	}
 
@@ -669,13 +942,31 @@ func (d *DB) maybeScheduleFlush() {
 	go d.flush()
 }
 
+// flushableLocked returns true if any of the column families, live or
+// dropped, has a memtable which is ready to be flushed (or discarded).
+//
+// d.mu must be held when calling this.
+func (d *DB) flushableLocked() bool {
+	for _, cf := range d.mu.columnFamilies {
+		if cf.flushableCount() > 0 {
+			return true
+		}
+	}
+	for _, cf := range d.mu.droppedColumnFamilies {
+		if cf.flushableCount() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *DB) flush() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if err := d.flush1(); err != nil {
-		// TODO(peter): count consecutive flush errors and backoff.
-		d.opts.EventListener.BackgroundError(err)
-	}
+	err := d.flush1()
+	// A failed flush is retried after a backoff. No other flush can start while
+	// this one is backing off.
+	d.backoffLocked(d.handleBackgroundErrorLocked(err, &d.mu.bgError.flushFailures))
 	d.mu.compact.flushing = false
 	// More flush work may have arrived while we were flushing, so schedule
 	// another flush if needed.
@@ -686,35 +977,85 @@ func (d *DB) flush() {
 	d.mu.compact.cond.Broadcast()
 }
 
-// flush runs a compaction that copies the immutable memtables from memory to
-// disk.
+// flush1 discards the memtables of dropped column families and then runs a
+// compaction that copies the immutable memtables of a column family from
+// memory to disk.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
 func (d *DB) flush1() error {
-	var n int
-	for ; n < len(d.mu.mem.queue)-1; n++ {
-		if !d.mu.mem.queue[n].readyForFlush() {
-			break
+	// The memtables of dropped column families are never flushed. Once the
+	// writes to them have completed they are simply discarded.
+	for _, cf := range d.mu.droppedColumnFamilies {
+		n := cf.flushableCount()
+		flushed := cf.mem.queue[:n]
+		cf.mem.queue = cf.mem.queue[n:]
+		for i := range flushed {
+			close(flushed[i].flushed())
 		}
 	}
-	if n == 0 {
-		// None of the immutable memtables are ready for flushing.
-		return nil
+
+	for _, cf := range d.mu.columnFamilies {
+		if n := cf.flushableCount(); n > 0 {
+			return d.flushColumnFamily(cf, n)
+		}
+	}
+	// None of the immutable memtables are ready for flushing.
+	return nil
+}
+
+// flushColumnFamily flushes the first n memtables of the column family.
+//
+// d.mu must be held when calling this, but the mutex may be dropped and
+// re-acquired during the course of this method.
+func (d *DB) flushColumnFamily(cf *ColumnFamily, n int) error {
+	// Ingested sstables are flushed on their own, and the memtables above them
+	// can only be flushed once they have been added to L0.
+	if ingested, ok := cf.mem.queue[0].(*ingestedFlushable); ok {
+		return d.flushIngested(cf, ingested)
+	}
+	for i := 1; i < n; i++ {
+		if _, ok := cf.mem.queue[i].(*ingestedFlushable); ok {
+			n = i
+			break
+		}
 	}
 
 	// Require that every memtable being flushed has a log number less than the
 	// new minimum unflushed log number.
-	minUnflushedLogNum, _ := d.mu.mem.queue[n].logInfo()
+	minUnflushedLogNum, _ := cf.mem.queue[n].logInfo()
 	for i := 0; i < n; i++ {
-		logNum, _ := d.mu.mem.queue[i].logInfo()
+		logNum, _ := cf.mem.queue[i].logInfo()
 		if logNum >= minUnflushedLogNum {
 			return errFlushInvariant
 		}
 	}
 
-	c := newFlush(d.opts, d.mu.versions.currentVersion(),
-		d.mu.versions.picker.baseLevel, d.mu.mem.queue[:n], &d.bytesFlushed)
+	// Empty memtables have nothing to write to an sstable, so they are
+	// discarded without running a flush or logging a version edit. Only the
+	// in-memory minimum unflushed log number is advanced, allowing the WALs
+	// associated with the memtables to be deleted. The MANIFEST continues to
+	// record the previous minimum, which is harmless: those WALs contain no
+	// mutations for the column family.
+	if flushablesEmpty(cf.mem.queue[:n]) {
+		cf.versions.minUnflushedLogNum = minUnflushedLogNum
+		flushed := cf.mem.queue[:n]
+		cf.mem.queue = cf.mem.queue[n:]
+		cf.updateReadStateLocked()
+
+		jobID := d.mu.nextJobID
+		d.mu.nextJobID++
+		d.deleteObsoleteFiles(jobID)
+
+		for i := range flushed {
+			close(flushed[i].flushed())
+		}
+		return nil
+	}
+
+	c := newFlush(cf.opts, cf.versions.currentVersion(),
+		cf.versions.picker.baseLevel, cf.mem.queue[:n], &d.bytesFlushed)
+	c.cfID = cf.id
 
 	jobID := d.mu.nextJobID
 	d.mu.nextJobID++
@@ -722,12 +1063,18 @@ func (d *DB) flush1() error {
 		JobID: jobID,
 	})
 
-	flushPacer := newFlushPacer(flushPacerEnv{
-		limiter:      d.flushLimiter,
-		memTableSize: uint64(d.opts.MemTableSize),
-		getInfo:      d.getFlushPacerInfo,
-	})
-	ve, pendingOutputs, err := d.runCompaction(jobID, c, flushPacer)
+	var flushPacer pacer
+	if d.opts.Pacer != nil {
+		flushPacer = &userPacer{pacer: d.opts.Pacer, op: PacerFlush}
+	} else {
+		flushPacer = newFlushPacer(flushPacerEnv{
+			limiter:      d.flushLimiter,
+			memTableSize: uint64(d.opts.MemTableSize),
+			getInfo:      d.getFlushPacerInfo,
+		})
+	}
+	ve, pendingOutputs, err := d.runCompaction(jobID, c,
+		&statsPacer{pacer: flushPacer, stats: &d.flushPacingStats})
 
 	info := FlushInfo{
 		JobID: jobID,
@@ -746,24 +1093,16 @@ func (d *DB) flush1() error {
 		// The flush succeeded or it produced an empty sstable. In either case we
 		// want to bump the minimum unflushed log number to the log number of the
 		// oldest unflushed memtable.
-		ve.MinUnflushedLogNum, _ = d.mu.mem.queue[n].logInfo()
+		ve.ColumnFamily = cf.id
+		ve.MinUnflushedLogNum, _ = cf.mem.queue[n].logInfo()
 		metrics := c.metrics[0]
 		for i := 0; i < n; i++ {
-			_, size := d.mu.mem.queue[i].logInfo()
+			_, size := cf.mem.queue[i].logInfo()
 			metrics.BytesIn += size
 		}
 
 		err = d.mu.versions.logAndApply(jobID, ve, c.metrics, d.dataDir)
-		for _, fileNum := range pendingOutputs {
-			if _, ok := d.mu.compact.pendingOutputs[fileNum]; !ok {
-				panic("pebble: expected pending output not present")
-			}
-			delete(d.mu.compact.pendingOutputs, fileNum)
-			if err != nil {
-				// TODO(peter): untested.
-				d.mu.versions.obsoleteTables = append(d.mu.versions.obsoleteTables, fileNum)
-			}
-		}
+		d.releasePendingOutputsLocked(pendingOutputs, err)
 	}
 
 	d.opts.EventListener.FlushEnd(info)
@@ -773,9 +1112,15 @@ func (d *DB) flush1() error {
 
 	var flushed []flushable
 	if err == nil {
-		flushed = d.mu.mem.queue[:n]
-		d.mu.mem.queue = d.mu.mem.queue[n:]
-		d.updateReadStateLocked()
+		flushed = cf.mem.queue[:n]
+		cf.mem.queue = cf.mem.queue[n:]
+		cf.versions.deletionHints = append(cf.versions.deletionHints, c.deletionHints...)
+		cf.updateReadStateLocked()
+	} else if err == ErrColumnFamilyDropped {
+		// The column family was dropped while it was being flushed. The flushed
+		// memtables are discarded.
+		flushed = cf.mem.queue[:n]
+		cf.mem.queue = cf.mem.queue[n:]
 	}
 
 	d.deleteObsoleteFiles(jobID)
@@ -792,62 +1137,325 @@ func (d *DB) flush1() error {
 	return err
 }
 
-// maybeScheduleCompaction schedules a compaction if necessary.
+// flushablesEmpty returns true if all of the flushables are empty memtables.
+func flushablesEmpty(flushables []flushable) bool {
+	for i := range flushables {
+		if m, ok := flushables[i].(*memTable); !ok || !m.empty() {
+			return false
+		}
+	}
+	return true
+}
+
+// flushIngested flushes the ingested sstables at the head of the queue of
+// memtables of the column family. The sstables are added to L0 as is: they
+// were assigned sequence numbers larger than any in the memtables below them,
+// and any sstables in L0 were flushed from those memtables or earlier.
+//
+// d.mu must be held when calling this, but the mutex may be dropped and
+// re-acquired during the course of this method.
+func (d *DB) flushIngested(cf *ColumnFamily, ingested *ingestedFlushable) error {
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	d.opts.EventListener.FlushBegin(FlushInfo{
+		JobID: jobID,
+	})
+
+	ve := &versionEdit{
+		ColumnFamily: cf.id,
+		NewFiles:     make([]newFileEntry, len(ingested.files)),
+	}
+	ve.MinUnflushedLogNum, _ = cf.mem.queue[1].logInfo()
+
+	d.mu.Unlock()
+	hints := cf.loadDeletionHints(ingested.files)
+	d.mu.Lock()
+
+	metrics := &LevelMetrics{}
+	fileNums := make([]uint64, len(ingested.files))
+	for i := range ingested.files {
+		ve.NewFiles[i].Level = 0
+		ve.NewFiles[i].Meta = ingested.files[i]
+		metrics.BytesIngested += ingested.files[i].Size
+		fileNums[i] = ingested.files[i].FileNum
+	}
+	err := d.mu.versions.logAndApply(jobID, ve, map[int]*LevelMetrics{0: metrics}, d.dataDir)
+	d.releasePendingOutputsLocked(fileNums, err)
+
+	info := FlushInfo{
+		JobID: jobID,
+		Done:  true,
+		Err:   err,
+	}
+	if err == nil {
+		for i := range ve.NewFiles {
+			info.Output = append(info.Output, ve.NewFiles[i].Meta.TableInfo(d.opts.FS, d.dirname))
+		}
+	}
+	d.opts.EventListener.FlushEnd(info)
+
+	if err == nil {
+		// Readers which loaded the flushable may still be reading its sstables,
+		// which are now kept from being deleted by the current version.
+		ingested.version = cf.versions.currentVersion()
+		ingested.version.Ref()
+		cf.versions.deletionHints = append(cf.versions.deletionHints, hints...)
+		cf.mem.queue = cf.mem.queue[1:]
+		cf.updateReadStateLocked()
+		ingested.readerUnrefLocked()
+	}
+
+	d.deleteObsoleteFiles(jobID)
+
+	if err == nil {
+		close(ingested.flushed())
+	}
+	return err
+}
+
+// loadDeletionHints returns the deletion hints for the range tombstones in the
+// specified tables of the column family. Deletion hints are not persisted, so
+// they are rebuilt when the DB is opened, and for ingested tables, from the
+// range deletion blocks of the tables. Tables whose properties record no range
+// deletions are not read. The hints are an optimization: a table which cannot
+// be read is logged and skipped.
+func (cf *ColumnFamily) loadDeletionHints(files []fileMetadata) []deletionHint {
+	var hints []deletionHint
+	for i := range files {
+		f := &files[i]
+		err := cf.tableCache.withReader(f, func(r *sstable.Reader) error {
+			if r.Properties.NumRangeDeletions == 0 {
+				return nil
+			}
+			iter := r.NewRangeDelIter()
+			if iter == nil {
+				return nil
+			}
+			for key, end := iter.First(); key != nil; key, end = iter.Next() {
+				// Truncate the tombstone to the bounds of the table. Truncating the
+				// end to the largest user key is conservative if the largest key is a
+				// point key, which the hint then does not cover.
+				start := key.UserKey
+				if cf.cmp(start, f.Smallest.UserKey) < 0 {
+					start = f.Smallest.UserKey
+				}
+				if cf.cmp(end, f.Largest.UserKey) > 0 {
+					end = f.Largest.UserKey
+				}
+				if cf.cmp(start, end) >= 0 {
+					continue
+				}
+				seqNum := key.SeqNum()
+				// Coalesce the fragments of a tombstone, as for the hints recorded by
+				// flushes and compactions.
+				if n := len(hints); n > 0 && hints[n-1].fileNum == f.FileNum &&
+					hints[n-1].seqNum == seqNum && cf.cmp(hints[n-1].end, start) == 0 {
+					hints[n-1].end = append(hints[n-1].end[:0:0], end...)
+					continue
+				}
+				hints = append(hints, deletionHint{
+					fileNum: f.FileNum,
+					start:   append([]byte(nil), start...),
+					end:     append([]byte(nil), end...),
+					seqNum:  seqNum,
+				})
+			}
+			return iter.Close()
+		})
+		if err != nil {
+			cf.db.opts.Logger.Infof("unable to load deletion hints for %s: %v",
+				base.MakeFilename(cf.db.opts.FS, cf.db.dirname, fileTypeTable, f.FileNum), err)
+		}
+	}
+	return hints
+}
+
+// releasePendingOutputsLocked releases the pending outputs of a flush or
+// compaction once the result of the job has been logged to the MANIFEST. The
+// outputs are obsolete if logging failed, unless the failure was a
+// manifestError: the MANIFEST may contain the version edit, in which case the
+// outputs are referenced by the version recovered when the DB is reopened.
+//
+// d.mu must be held when calling this.
+func (d *DB) releasePendingOutputsLocked(pendingOutputs []uint64, err error) {
+	_, manifestFailed := err.(*manifestError)
+	for _, fileNum := range pendingOutputs {
+		if _, ok := d.mu.compact.pendingOutputs[fileNum]; !ok {
+			panic("pebble: expected pending output not present")
+		}
+		if manifestFailed {
+			// Leave the output pending so that it is never deleted.
+			continue
+		}
+		delete(d.mu.compact.pendingOutputs, fileNum)
+		if err != nil {
+			d.mu.versions.obsoleteTables = append(d.mu.versions.obsoleteTables, fileNum)
+		}
+	}
+}
+
+// maybeScheduleCompaction schedules compactions until either there is no more
+// compaction work to be done, or Options.MaxConcurrentCompactions compactions
+// are running. Pending manual compactions take priority over automatic
+// compactions: no new automatic compactions are started while a manual
+// compaction is waiting for a conflicting compaction to complete.
 //
 // d.mu must be held when calling this.
 func (d *DB) maybeScheduleCompaction() {
-	if d.mu.compact.compacting || atomic.LoadInt32(&d.closed) != 0 || d.opts.ReadOnly {
+	if atomic.LoadInt32(&d.closed) != 0 || d.opts.ReadOnly {
+		return
+	}
+	if d.mu.bgError.err != nil {
+		// Compactions are suspended while writes are stopped.
+		for _, manual := range d.mu.compact.manual {
+			manual.done <- d.mu.bgError.err
+		}
+		d.mu.compact.manual = nil
 		return
 	}
 
+	for len(d.mu.compact.manual) > 0 &&
+		d.mu.compact.compactingCount < d.opts.MaxConcurrentCompactions {
+		manual := d.mu.compact.manual[0]
+		cf := d.getColumnFamilyLocked(manual.cfID)
+		if cf == nil {
+			d.mu.compact.manual = d.mu.compact.manual[1:]
+			manual.done <- ErrColumnFamilyDropped
+			continue
+		}
+		c, retryLater := cf.versions.picker.pickManual(
+			cf.opts, manual, &d.bytesCompacted, d.getInProgressCompactions(cf.id))
+		if retryLater {
+			// The manual compaction conflicts with an in-progress compaction. It
+			// will be retried when the in-progress compaction completes.
+			return
+		}
+		d.mu.compact.manual = d.mu.compact.manual[1:]
+		if c == nil {
+			manual.done <- nil
+			continue
+		}
+		c.cfID = cf.id
+		d.addInProgressCompaction(c)
+		go d.compact(c, manual.done)
+	}
 	if len(d.mu.compact.manual) > 0 {
-		d.mu.compact.compacting = true
-		go d.compact()
 		return
 	}
 
-	if !d.mu.versions.picker.compactionNeeded() {
-		// There is no work to be done.
-		return
+	for _, cf := range d.mu.columnFamilies {
+		// Delete-only compactions are cheap and reclaim disk space, so they are
+		// scheduled ahead of other automatic compactions.
+		for d.mu.compact.compactingCount < d.opts.MaxConcurrentCompactions {
+			var c *compaction
+			c, cf.versions.deletionHints = cf.versions.picker.pickDeleteOnly(
+				cf.opts, cf.versions.deletionHints, d.mu.snapshots.toSlice(),
+				d.getInProgressCompactions(cf.id))
+			if c == nil {
+				break
+			}
+			c.cfID = cf.id
+			d.addInProgressCompaction(c)
+			go d.compact(c, nil)
+		}
+		for d.mu.compact.compactingCount < d.opts.MaxConcurrentCompactions {
+			c := cf.versions.picker.pickAuto(
+				cf.opts, &d.bytesCompacted, d.getInProgressCompactions(cf.id))
+			if c == nil {
+				// Blob files with too much garbage are rewritten when there is
+				// no other compaction to run.
+				c = cf.versions.picker.pickBlobRewrite(
+					cf.opts, &d.bytesCompacted, d.getInProgressCompactions(cf.id))
+			}
+			if c == nil {
+				// There is no work to be done for this column family.
+				break
+			}
+			if d.deferCompactionLocked(c) {
+				// The compaction is retried the next time compactions are
+				// scheduled, such as after a flush.
+				break
+			}
+			c.cfID = cf.id
+			d.addInProgressCompaction(c)
+			go d.compact(c, nil)
+		}
 	}
+}
 
-	d.mu.compact.compacting = true
-	go d.compact()
+// deferCompactionLocked returns true if the compaction must be deferred
+// because its output, along with the output of the in-progress compactions,
+// is estimated to reduce the free disk space below
+// Options.DiskSpaceReservation. The output of a compaction is estimated to be
+// the size of its inputs.
+//
+// d.mu must be held when calling this.
+func (d *DB) deferCompactionLocked(c *compaction) bool {
+	if d.opts.DiskSpaceReservation <= 0 || c.estimatedOutputSize() == 0 {
+		return false
+	}
+	avail, ok := d.availableDiskSpace()
+	if !ok {
+		return false
+	}
+	required := c.estimatedOutputSize() + uint64(d.opts.DiskSpaceReservation)
+	for ip := range d.mu.compact.inProgress {
+		required += ip.estimatedOutputSize()
+	}
+	return avail < required
 }
 
-// compact runs one compaction and maybe schedules another call to compact.
-func (d *DB) compact() {
+// addInProgressCompaction marks the specified compaction as in-progress.
+//
+// d.mu must be held when calling this.
+func (d *DB) addInProgressCompaction(c *compaction) {
+	d.mu.compact.compactingCount++
+	d.mu.compact.inProgress[c] = struct{}{}
+}
+
+// getInProgressCompactions returns the compactions of the specified column
+// family which are currently running.
+//
+// d.mu must be held when calling this.
+func (d *DB) getInProgressCompactions(cfID uint32) []*compaction {
+	if len(d.mu.compact.inProgress) == 0 {
+		return nil
+	}
+	inProgress := make([]*compaction, 0, len(d.mu.compact.inProgress))
+	for c := range d.mu.compact.inProgress {
+		if c.cfID == cfID {
+			inProgress = append(inProgress, c)
+		}
+	}
+	return inProgress
+}
+
+// compact runs one compaction and maybe schedules more compactions.
+func (d *DB) compact(c *compaction, errChannel chan error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if err := d.compact1(); err != nil {
-		// TODO(peter): count consecutive compaction errors and backoff.
-		d.opts.EventListener.BackgroundError(err)
-	}
-	d.mu.compact.compacting = false
+	err := d.compact1(c, errChannel)
+	delete(d.mu.compact.inProgress, c)
+	// A failed compaction continues to occupy a compaction slot while backing
+	// off, delaying the compactions which would be scheduled in its place.
+	d.backoffLocked(d.handleBackgroundErrorLocked(err, &d.mu.bgError.compactionFailures))
+	d.mu.compact.compactingCount--
 	// The previous compaction may have produced too many files in a
 	// level, so reschedule another compaction if needed.
 	d.maybeScheduleCompaction()
 	d.mu.compact.cond.Broadcast()
 }
 
-// compact1 runs one compaction.
+// compact1 runs one compaction. If errChannel is non-nil, the result of the
+// compaction is sent on it once the compaction completes.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
-func (d *DB) compact1() (err error) {
-	var c *compaction
-	if len(d.mu.compact.manual) > 0 {
-		manual := d.mu.compact.manual[0]
-		d.mu.compact.manual = d.mu.compact.manual[1:]
-		c = d.mu.versions.picker.pickManual(d.opts, manual, &d.bytesCompacted)
+func (d *DB) compact1(c *compaction, errChannel chan error) (err error) {
+	if errChannel != nil {
 		defer func() {
-			manual.done <- err
+			errChannel <- err
 		}()
-	} else {
-		c = d.mu.versions.picker.pickAuto(d.opts, &d.bytesCompacted)
-	}
-	if c == nil {
-		return nil
 	}
 
 	jobID := d.mu.nextJobID
@@ -855,6 +1463,9 @@ func (d *DB) compact1() (err error) {
 	info := CompactionInfo{
 		JobID: jobID,
 	}
+	if c.deleteOnly {
+		info.Reason = "delete-only"
+	}
 	info.Input.Level = c.startLevel
 	info.Output.Level = c.outputLevel
 	for i := range c.inputs {
@@ -865,25 +1476,23 @@ func (d *DB) compact1() (err error) {
 	}
 	d.opts.EventListener.CompactionBegin(info)
 
-	compactionPacer := newCompactionPacer(compactionPacerEnv{
-		limiter:      d.compactionLimiter,
-		memTableSize: uint64(d.opts.MemTableSize),
-		getInfo:      d.getCompactionPacerInfo,
-	})
-	ve, pendingOutputs, err := d.runCompaction(jobID, c, compactionPacer)
+	var compactionPacer pacer
+	if d.opts.Pacer != nil {
+		compactionPacer = &userPacer{pacer: d.opts.Pacer, op: PacerCompaction}
+	} else {
+		compactionPacer = newCompactionPacer(compactionPacerEnv{
+			limiter:      d.compactionLimiter,
+			memTableSize: uint64(d.opts.MemTableSize),
+			getInfo:      d.getCompactionPacerInfo,
+		})
+	}
+	ve, pendingOutputs, err := d.runCompaction(jobID, c,
+		&statsPacer{pacer: compactionPacer, stats: &d.compactionPacingStats})
 
 	if err == nil {
+		ve.ColumnFamily = c.cfID
 		err = d.mu.versions.logAndApply(jobID, ve, c.metrics, d.dataDir)
-		for _, fileNum := range pendingOutputs {
-			if _, ok := d.mu.compact.pendingOutputs[fileNum]; !ok {
-				panic("pebble: expected pending output not present")
-			}
-			delete(d.mu.compact.pendingOutputs, fileNum)
-			if err != nil {
-				// TODO(peter): untested.
-				d.mu.versions.obsoleteTables = append(d.mu.versions.obsoleteTables, fileNum)
-			}
-		}
+		d.releasePendingOutputsLocked(pendingOutputs, err)
 	}
 
 	info.Done = true
@@ -901,7 +1510,10 @@ func (d *DB) compact1() (err error) {
 	// there are no references obsolete tables will be added to the obsolete
 	// table list.
 	if err == nil {
-		d.updateReadStateLocked()
+		if cf := d.getColumnFamilyLocked(c.cfID); cf != nil {
+			cf.versions.deletionHints = append(cf.versions.deletionHints, c.deletionHints...)
+			cf.updateReadStateLocked()
+		}
 	}
 	d.deleteObsoleteFiles(jobID)
 
@@ -916,6 +1528,25 @@ func (d *DB) compact1() (err error) {
 func (d *DB) runCompaction(jobID int, c *compaction, pacer pacer) (
 	ve *versionEdit, pendingOutputs []uint64, retErr error,
 ) {
+	cf := d.getColumnFamilyLocked(c.cfID)
+	if cf == nil {
+		return nil, nil, ErrColumnFamilyDropped
+	}
+
+	if c.deleteOnly {
+		// A delete-only compaction removes its inputs without reading them.
+		ve := &versionEdit{
+			DeletedFiles: map[deletedFileEntry]bool{},
+		}
+		for _, f := range c.inputs[0] {
+			ve.DeletedFiles[deletedFileEntry{
+				Level:   c.startLevel,
+				FileNum: f.FileNum,
+			}] = true
+		}
+		return ve, nil, nil
+	}
+
 	// Check for a trivial move of one table from one level to the next. We avoid
 	// such a move if there is lots of overlapping grandparent data. Otherwise,
 	// the move could create a parent file that will require a very expensive
@@ -948,22 +1579,134 @@ func (d *DB) runCompaction(jobID int, c *compaction, pacer pacer) (
 	}()
 
 	snapshots := d.mu.snapshots.toSlice()
+	subcompactions := c.subcompactions(cf.opts.MaxSubcompactions)
 
 	// Release the d.mu lock while doing I/O.
 	// Note the unusual order: Unlock and then Lock.
 	d.mu.Unlock()
 	defer d.mu.Lock()
 
-	iiter, err := c.newInputIter(d.newIters)
-	if err != nil {
+	ve = &versionEdit{
+		DeletedFiles: map[deletedFileEntry]bool{},
+	}
+
+	metrics := &LevelMetrics{
+		BytesIn:   totalSize(c.inputs[0]),
+		BytesRead: totalSize(c.inputs[1]),
+	}
+	metrics.BytesRead += metrics.BytesIn
+	c.metrics = map[int]*LevelMetrics{
+		c.outputLevel: metrics,
+	}
+
+	outputs := make([]subcompactionOutput, len(subcompactions))
+	if len(subcompactions) == 1 {
+		outputs[0], retErr = d.runSubcompaction(jobID, cf, subcompactions[0], snapshots, pacer)
+	} else {
+		// The subcompactions are run concurrently, sharing the pacer of the
+		// compaction.
+		shared := newSharedPacer(pacer, c.atomicBytesIterated)
+		errs := make([]error, len(subcompactions))
+		var wg sync.WaitGroup
+		for i := range subcompactions {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				outputs[i], errs[i] = d.runSubcompaction(
+					jobID, cf, subcompactions[i], snapshots, shared.newSubcompactionPacer())
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			retErr = firstError(retErr, err)
+		}
+	}
+
+	// The outputs of the subcompactions are in key order.
+	c.deletionHints = nil
+	for i := range outputs {
+		out := &outputs[i]
+		pendingOutputs = append(pendingOutputs, out.pendingOutputs...)
+		ve.NewFiles = append(ve.NewFiles, out.newFiles...)
+		ve.NewBlobFiles = append(ve.NewBlobFiles, out.newBlobFiles...)
+		c.deletionHints = append(c.deletionHints, out.deletionHints...)
+		metrics.BytesWritten += out.bytesWritten
+	}
+	if retErr != nil {
+		for i := range outputs {
+			for _, filename := range outputs[i].filenames {
+				d.opts.FS.Remove(filename)
+			}
+		}
+		return nil, pendingOutputs, retErr
+	}
+
+	for i := range c.inputs {
+		level := c.startLevel
+		if i == 1 {
+			level = c.outputLevel
+		}
+		for _, f := range c.inputs[i] {
+			ve.DeletedFiles[deletedFileEntry{
+				Level:   level,
+				FileNum: f.FileNum,
+			}] = true
+		}
+	}
+
+	if err := d.dataDir.Sync(); err != nil {
 		return nil, pendingOutputs, err
 	}
-	iter := newCompactionIter(c.cmp, d.merge, iiter, snapshots,
-		c.allowZeroSeqNum(iiter), c.elideTombstone, c.elideRangeTombstone)
+	return ve, pendingOutputs, nil
+}
+
+// subcompactionOutput holds the tables and blob files written by a
+// subcompaction.
+type subcompactionOutput struct {
+	newFiles       []newFileEntry
+	newBlobFiles   []blobFileMetadata
+	pendingOutputs []uint64
+	filenames      []string
+	deletionHints  []deletionHint
+	bytesWritten   uint64
+}
+
+// runSubcompaction runs a (sub)compaction, writing the tables (and blob
+// files) containing the keys within its bounds. The returned output records
+// the files created even if an error is returned so that the caller can
+// remove them. d.mu must not be held when calling this.
+func (d *DB) runSubcompaction(
+	jobID int, cf *ColumnFamily, c *compaction, snapshots []uint64, pacer pacer,
+) (out subcompactionOutput, retErr error) {
+	iiter, err := c.newInputIter(cf.newIters)
+	if err != nil {
+		return out, err
+	}
+	// The compaction filter is not applied during flushes.
+	var filter func(key, value []byte) (CompactionFilterDecision, []byte)
+	if f := cf.opts.CompactionFilter; f != nil && len(c.flushing) == 0 {
+		filter = func(key, value []byte) (CompactionFilterDecision, []byte) {
+			return f.Filter(c.outputLevel, key, value)
+		}
+	}
+	iter := newCompactionIter(c.cmp, cf.merge, iiter, snapshots,
+		c.allowZeroSeqNum(iiter), c.elideTombstone, c.elideRangeTombstone,
+		cf.opts.Clock().UnixNano(), filter, d.blobFiles.value)
+
+	// Flushes separate values larger than the value separation threshold into
+	// a blob file. Compactions copy the blob handles of separated values,
+	// except for the values in the blob files being rewritten, which are
+	// written to a new blob file.
+	var separateThreshold int
+	if len(c.flushing) > 0 {
+		separateThreshold = cf.opts.ValueSeparationThreshold
+	}
 
 	var (
-		filenames []string
 		tw        *sstable.Writer
+		bw        *blobWriter
+		blobRefs  map[uint64]uint64
+		handleBuf []byte
 	)
 	defer func() {
 		if iter != nil {
@@ -972,31 +1715,16 @@ func (d *DB) runCompaction(jobID int, c *compaction, pacer pacer) (
 		if tw != nil {
 			retErr = firstError(retErr, tw.Close())
 		}
-		if retErr != nil {
-			for _, filename := range filenames {
-				d.opts.FS.Remove(filename)
-			}
+		if bw != nil {
+			retErr = firstError(retErr, bw.close())
 		}
 	}()
 
-	ve = &versionEdit{
-		DeletedFiles: map[deletedFileEntry]bool{},
-	}
-
-	metrics := &LevelMetrics{
-		BytesIn:   totalSize(c.inputs[0]),
-		BytesRead: totalSize(c.inputs[1]),
-	}
-	metrics.BytesRead += metrics.BytesIn
-	c.metrics = map[int]*LevelMetrics{
-		c.outputLevel: metrics,
-	}
-
 	newOutput := func() error {
 		d.mu.Lock()
 		fileNum := d.mu.versions.getNextFileNum()
 		d.mu.compact.pendingOutputs[fileNum] = struct{}{}
-		pendingOutputs = append(pendingOutputs, fileNum)
+		out.pendingOutputs = append(out.pendingOutputs, fileNum)
 		d.mu.Unlock()
 
 		filename := base.MakeFilename(d.opts.FS, d.dirname, fileTypeTable, fileNum)
@@ -1017,10 +1745,10 @@ func (d *DB) runCompaction(jobID int, c *compaction, pacer pacer) (
 		file = vfs.NewSyncingFile(file, vfs.SyncingFileOptions{
 			BytesPerSync: d.opts.BytesPerSync,
 		})
-		filenames = append(filenames, filename)
-		tw = sstable.NewWriter(file, d.opts, d.opts.Level(c.outputLevel))
+		out.filenames = append(out.filenames, filename)
+		tw = sstable.NewWriter(file, cf.opts, cf.opts.Level(c.outputLevel))
 
-		ve.NewFiles = append(ve.NewFiles, newFileEntry{
+		out.newFiles = append(out.newFiles, newFileEntry{
 			Level: c.outputLevel,
 			Meta: fileMetadata{
 				FileNum: fileNum,
@@ -1029,6 +1757,67 @@ func (d *DB) runCompaction(jobID int, c *compaction, pacer pacer) (
 		return nil
 	}
 
+	newBlobOutput := func() error {
+		d.mu.Lock()
+		fileNum := d.mu.versions.getNextFileNum()
+		d.mu.compact.pendingOutputs[fileNum] = struct{}{}
+		out.pendingOutputs = append(out.pendingOutputs, fileNum)
+		d.mu.Unlock()
+
+		filename := base.MakeFilename(d.opts.FS, d.dirname, fileTypeBlob, fileNum)
+		file, err := d.opts.FS.Create(filename)
+		if err != nil {
+			return err
+		}
+		file = vfs.NewSyncingFile(file, vfs.SyncingFileOptions{
+			BytesPerSync: d.opts.BytesPerSync,
+		})
+		out.filenames = append(out.filenames, filename)
+		bw = &blobWriter{fileNum: fileNum, file: file}
+		return nil
+	}
+
+	// separateValue writes the value to the blob file, returning the key and
+	// value to add to the sstable in its place.
+	separateValue := func(key *InternalKey, val []byte) (*InternalKey, []byte, error) {
+		if bw == nil {
+			if err := newBlobOutput(); err != nil {
+				return nil, nil, err
+			}
+		}
+		h, err := bw.add(val)
+		if err != nil {
+			return nil, nil, err
+		}
+		handleBuf = h.encode(handleBuf[:0])
+		k := *key
+		k.SetKind(InternalKeyKindBlobHandle)
+		return &k, handleBuf, nil
+	}
+
+	// addDeletionHint records a hint for a range tombstone written to the
+	// current output. The fragments of a tombstone are coalesced so that the
+	// hint covers the tombstone's entire span within the output.
+	addDeletionHint := func(start, end []byte, seqNum uint64) {
+		fileNum := out.newFiles[len(out.newFiles)-1].Meta.FileNum
+		for i := len(out.deletionHints) - 1; i >= 0; i-- {
+			h := &out.deletionHints[i]
+			if h.fileNum != fileNum {
+				break
+			}
+			if h.seqNum == seqNum && c.cmp(h.end, start) == 0 {
+				h.end = append(h.end[:0:0], end...)
+				return
+			}
+		}
+		out.deletionHints = append(out.deletionHints, deletionHint{
+			fileNum: fileNum,
+			start:   append([]byte(nil), start...),
+			end:     append([]byte(nil), end...),
+			seqNum:  seqNum,
+		})
+	}
+
 	finishOutput := func(key InternalKey) error {
 		// NB: clone the key because the data can be held on to by the call to
 		// compactionIter.Tombstones via rangedel.Fragmenter.FlushTo.
@@ -1042,6 +1831,7 @@ func (d *DB) runCompaction(jobID int, c *compaction, pacer pacer) (
 			if err := tw.Add(v.Start, v.End); err != nil {
 				return err
 			}
+			addDeletionHint(v.Start.UserKey, v.End, v.Start.SeqNum())
 		}
 
 		if tw == nil {
@@ -1058,20 +1848,33 @@ func (d *DB) runCompaction(jobID int, c *compaction, pacer pacer) (
 			return err
 		}
 		tw = nil
-		meta := &ve.NewFiles[len(ve.NewFiles)-1].Meta
+		meta := &out.newFiles[len(out.newFiles)-1].Meta
 		meta.Size = writerMeta.Size
 		meta.SmallestSeqNum = writerMeta.SmallestSeqNum
 		meta.LargestSeqNum = writerMeta.LargestSeqNum
+		if len(blobRefs) > 0 {
+			meta.BlobRefs = make([]manifest.BlobReference, 0, len(blobRefs))
+			for fileNum, bytes := range blobRefs {
+				meta.BlobRefs = append(meta.BlobRefs, manifest.BlobReference{
+					FileNum: fileNum,
+					Bytes:   bytes,
+				})
+			}
+			sort.Slice(meta.BlobRefs, func(i, j int) bool {
+				return meta.BlobRefs[i].FileNum < meta.BlobRefs[j].FileNum
+			})
+			blobRefs = nil
+		}
 
-		metrics.BytesWritten += meta.Size
+		out.bytesWritten += meta.Size
 
 		// The handling of range boundaries is a bit complicated.
-		if n := len(ve.NewFiles); n > 1 {
+		if n := len(out.newFiles); n > 1 {
 			// This is not the first output. Bound the smallest range key by the
 			// previous tables largest key.
-			prevMeta := &ve.NewFiles[n-2].Meta
+			prevMeta := &out.newFiles[n-2].Meta
 			if writerMeta.SmallestRange.UserKey != nil &&
-				d.cmp(writerMeta.SmallestRange.UserKey, prevMeta.Largest.UserKey) <= 0 {
+				c.cmp(writerMeta.SmallestRange.UserKey, prevMeta.Largest.UserKey) <= 0 {
 				// The range boundary user key is less than or equal to the previous
 				// table's largest key. We need the tables to be key-space partitioned,
 				// so force the boundary to a key that we know is larger than the
@@ -1090,64 +1893,97 @@ func (d *DB) runCompaction(jobID int, c *compaction, pacer pacer) (
 		}
 
 		if key.UserKey != nil && writerMeta.LargestRange.UserKey != nil {
-			if d.cmp(writerMeta.LargestRange.UserKey, key.UserKey) >= 0 {
+			if c.cmp(writerMeta.LargestRange.UserKey, key.UserKey) >= 0 {
 				writerMeta.LargestRange = key
 				writerMeta.LargestRange.Trailer = InternalKeyRangeDeleteSentinel
 			}
 		}
 
-		meta.Smallest = writerMeta.Smallest(d.cmp)
-		meta.Largest = writerMeta.Largest(d.cmp)
+		meta.Smallest = writerMeta.Smallest(c.cmp)
+		meta.Largest = writerMeta.Largest(c.cmp)
 		return nil
 	}
 
 	for key, val := iter.First(); key != nil; key, val = iter.Next() {
-		atomic.StoreUint64(c.atomicBytesIterated, c.bytesIterated)
+		if c.upper != nil && c.cmp(key.UserKey, c.upper) >= 0 {
+			// The remaining keys belong to the next subcompaction.
+			break
+		}
+
+		if c.atomicBytesIterated != nil {
+			atomic.StoreUint64(c.atomicBytesIterated, c.bytesIterated)
+		}
 
 		if err := pacer.maybeThrottle(c.bytesIterated); err != nil {
-			return nil, pendingOutputs, err
+			return out, err
 		}
 
 		// TODO(peter,rangedel): Need to incorporate the range tombstones in the
 		// shouldStopBefore decision.
 		if tw != nil && (tw.EstimatedSize() >= c.maxOutputFileSize || c.shouldStopBefore(*key)) {
 			if err := finishOutput(*key); err != nil {
-				return nil, pendingOutputs, err
+				return out, err
 			}
 		}
 
 		if tw == nil {
 			if err := newOutput(); err != nil {
-				return nil, pendingOutputs, err
+				return out, err
 			}
 		}
 
+		if separateThreshold > 0 && key.Kind() == InternalKeyKindSet && len(val) > separateThreshold {
+			if key, val, err = separateValue(key, val); err != nil {
+				return out, err
+			}
+		}
+		if key.Kind() == InternalKeyKindBlobHandle {
+			h, err := decodeBlobHandle(val)
+			if err != nil {
+				return out, err
+			}
+			if _, ok := c.rewriteBlobs[h.fileNum]; ok {
+				ch, err := d.blobFiles.get(val)
+				if err != nil {
+					return out, err
+				}
+				key, val, err = separateValue(key, ch.Get())
+				ch.Release()
+				if err != nil {
+					return out, err
+				}
+				h.fileNum = bw.fileNum
+			}
+			if blobRefs == nil {
+				blobRefs = make(map[uint64]uint64)
+			}
+			blobRefs[h.fileNum] += h.length + blobRecordTrailerLen
+		}
+
 		if err := tw.Add(*key, val); err != nil {
-			return nil, pendingOutputs, err
+			return out, err
 		}
 	}
 
 	if err := finishOutput(InternalKey{}); err != nil {
-		return nil, pendingOutputs, err
+		return out, err
 	}
 
-	for i := range c.inputs {
-		level := c.startLevel
-		if i == 1 {
-			level = c.outputLevel
-		}
-		for _, f := range c.inputs[i] {
-			ve.DeletedFiles[deletedFileEntry{
-				Level:   level,
-				FileNum: f.FileNum,
-			}] = true
+	if bw != nil {
+		fileNum, size := bw.fileNum, bw.offset
+		err := bw.close()
+		bw = nil
+		if err != nil {
+			return out, err
 		}
+		out.newBlobFiles = append(out.newBlobFiles, blobFileMetadata{
+			FileNum: fileNum,
+			Size:    size,
+		})
+		out.bytesWritten += size
 	}
+	return out, nil
 
-	if err := d.dataDir.Sync(); err != nil {
-		return nil, pendingOutputs, err
-	}
-	return ve, pendingOutputs, nil
 }
 
 // scanObsoleteFiles scans the filesystem for files that are no longer needed
@@ -1160,11 +1996,12 @@ func (d *DB) scanObsoleteFiles(list []string) {
 		liveFileNums[fileNum] = struct{}{}
 	}
 	d.mu.versions.addLiveFileNums(liveFileNums)
-	minUnflushedLogNum := d.mu.versions.minUnflushedLogNum
+	minUnflushedLogNum := d.mu.versions.minLogNumToKeep()
 	manifestFileNum := d.mu.versions.manifestFileNum
 
 	var obsoleteLogs []uint64
 	var obsoleteTables []uint64
+	var obsoleteBlobFiles []uint64
 	var obsoleteManifests []uint64
 	var obsoleteOptions []uint64
 
@@ -1194,6 +2031,11 @@ func (d *DB) scanObsoleteFiles(list []string) {
 				continue
 			}
 			obsoleteTables = append(obsoleteTables, fileNum)
+		case fileTypeBlob:
+			if _, ok := liveFileNums[fileNum]; ok {
+				continue
+			}
+			obsoleteBlobFiles = append(obsoleteBlobFiles, fileNum)
 		default:
 			// Don't delete files we don't know about.
 			continue
@@ -1203,6 +2045,7 @@ func (d *DB) scanObsoleteFiles(list []string) {
 	d.mu.log.queue = merge(d.mu.log.queue, obsoleteLogs)
 	d.mu.versions.metrics.WAL.Files += int64(len(obsoleteLogs))
 	d.mu.versions.obsoleteTables = merge(d.mu.versions.obsoleteTables, obsoleteTables)
+	d.mu.versions.obsoleteBlobFiles = merge(d.mu.versions.obsoleteBlobFiles, obsoleteBlobFiles)
 	d.mu.versions.obsoleteManifests = merge(d.mu.versions.obsoleteManifests, obsoleteManifests)
 	d.mu.versions.obsoleteOptions = merge(d.mu.versions.obsoleteOptions, obsoleteOptions)
 }
@@ -1216,46 +2059,83 @@ func (d *DB) deleteObsoleteFiles(jobID int) {
 	for d.mu.cleaner.cleaning {
 		d.mu.cleaner.cond.Wait()
 	}
+	if d.mu.cleaner.disabled > 0 {
+		// File deletions are currently disabled. The obsolete files will be
+		// deleted when file deletions are re-enabled.
+		return
+	}
 	d.mu.cleaner.cleaning = true
 	defer func() {
 		d.mu.cleaner.cleaning = false
-		d.mu.cleaner.cond.Signal()
+		d.mu.cleaner.cond.Broadcast()
 	}()
 
 	var obsoleteLogs []uint64
-	for i := range d.mu.log.queue {
-		// NB: d.mu.versions.minUnflushedLogNum is the log number of the earliest
-		// log that has not had its contents flushed to an sstable. We can recycle
-		// the prefix of d.mu.log.queue with log numbers less than
-		// minUnflushedLogNum.
-		if d.mu.log.queue[i] >= d.mu.versions.minUnflushedLogNum {
+	minUnflushedLogNum := d.mu.versions.minLogNumToKeep()
+	for i, logNum := range d.mu.log.queue {
+		// NB: minUnflushedLogNum is the log number of the earliest log that has
+		// not had its contents flushed to an sstable by every column family. We
+		// can recycle the prefix of d.mu.log.queue with log numbers less than
+		// minUnflushedLogNum, unless WAL retention is enabled and the log
+		// contains updates which have not been acknowledged.
+		if logNum >= minUnflushedLogNum ||
+			(d.opts.RetainWALs && d.mu.log.endSeqNums[logNum] > d.mu.log.ackedSeqNum) {
 			obsoleteLogs = d.mu.log.queue[:i]
 			d.mu.log.queue = d.mu.log.queue[i:]
 			d.mu.versions.metrics.WAL.Files -= int64(len(obsoleteLogs))
 			break
 		}
 	}
+	for _, logNum := range obsoleteLogs {
+		if endSeqNum := d.mu.log.endSeqNums[logNum]; d.mu.log.availableSeqNum < endSeqNum {
+			d.mu.log.availableSeqNum = endSeqNum
+		}
+		delete(d.mu.log.endSeqNums, logNum)
+	}
 
 	obsoleteTables := d.mu.versions.obsoleteTables
 	d.mu.versions.obsoleteTables = nil
 
+	obsoleteBlobFiles := d.mu.versions.obsoleteBlobFiles
+	d.mu.versions.obsoleteBlobFiles = nil
+
 	obsoleteManifests := d.mu.versions.obsoleteManifests
 	d.mu.versions.obsoleteManifests = nil
 
 	obsoleteOptions := d.mu.versions.obsoleteOptions
 	d.mu.versions.obsoleteOptions = nil
 
+	// An obsolete table may be present in the table cache of any of the column
+	// families, including those which have been dropped.
+	tableCaches := make([]*tableCache, 0,
+		len(d.mu.columnFamilies)+len(d.mu.droppedColumnFamilies))
+	for _, cf := range d.mu.columnFamilies {
+		tableCaches = append(tableCaches, cf.tableCache)
+	}
+	for _, cf := range d.mu.droppedColumnFamilies {
+		tableCaches = append(tableCaches, cf.tableCache)
+	}
+
+	// When deletion pacing is enabled, obsolete sstables are deleted in the
+	// background at a limited rate.
+	var pacedTables []uint64
+	if d.deletionLimiter != nil && len(obsoleteTables) > 0 {
+		pacedTables, obsoleteTables = obsoleteTables, nil
+		d.mu.cleaner.pacing++
+	}
+
 	// Release d.mu while doing I/O
 	// Note the unusual order: Unlock and then Lock.
 	d.mu.Unlock()
 	defer d.mu.Lock()
 
-	files := [4]struct {
+	files := [5]struct {
 		fileType fileType
 		obsolete []uint64
 	}{
 		{fileTypeLog, obsoleteLogs},
 		{fileTypeTable, obsoleteTables},
+		{fileTypeBlob, obsoleteBlobFiles},
 		{fileTypeManifest, obsoleteManifests},
 		{fileTypeOptions, obsoleteOptions},
 	}
@@ -1266,49 +2146,164 @@ func (d *DB) deleteObsoleteFiles(jobID int) {
 			return f.obsolete[i] < f.obsolete[j]
 		})
 		for _, fileNum := range f.obsolete {
-			switch f.fileType {
-			case fileTypeLog:
-				if d.logRecycler.add(fileNum) {
-					continue
-				}
-			case fileTypeTable:
-				d.tableCache.evict(fileNum)
-			}
+			d.deleteObsoleteFile(jobID, f.fileType, fileNum, tableCaches)
+		}
+	}
 
-			path := base.MakeFilename(d.opts.FS, d.dirname, f.fileType, fileNum)
-			err := d.opts.FS.Remove(path)
-			if err == os.ErrNotExist {
-				continue
-			}
+	if pacedTables != nil {
+		sort.Slice(pacedTables, func(i, j int) bool {
+			return pacedTables[i] < pacedTables[j]
+		})
+		go d.paceAndDeleteObsoleteTables(jobID, pacedTables, tableCaches)
+	}
+}
 
-			// TODO(peter): need to handle this errror, probably by re-adding the
-			// file that couldn't be deleted to one of the obsolete slices map.
+// paceAndDeleteObsoleteTables deletes the specified obsolete sstables, using
+// a deletionPacer to limit the rate of deletion. It is run in a separate
+// goroutine and the caller must have incremented d.mu.cleaner.pacing.
+//
+// d.mu must not be held when calling this method.
+func (d *DB) paceAndDeleteObsoleteTables(jobID int, tables []uint64, tableCaches []*tableCache) {
+	sizes := make([]uint64, len(tables))
+	var totalSize uint64
+	for i, fileNum := range tables {
+		path := base.MakeFilename(d.opts.FS, d.dirname, fileTypeTable, fileNum)
+		if info, err := d.opts.FS.Stat(path); err == nil {
+			sizes[i] = uint64(info.Size())
+			totalSize += sizes[i]
+		}
+	}
 
-			switch f.fileType {
-			case fileTypeLog:
-				d.opts.EventListener.WALDeleted(WALDeleteInfo{
-					JobID:   jobID,
-					Path:    path,
-					FileNum: fileNum,
-					Err:     err,
-				})
-			case fileTypeManifest:
-				d.opts.EventListener.ManifestDeleted(ManifestDeleteInfo{
-					JobID:   jobID,
-					Path:    path,
-					FileNum: fileNum,
-					Err:     err,
-				})
-			case fileTypeTable:
-				d.opts.EventListener.TableDeleted(TableDeleteInfo{
-					JobID:   jobID,
-					Path:    path,
-					FileNum: fileNum,
-					Err:     err,
-				})
-			}
+	d.mu.Lock()
+	d.mu.cleaner.queuedTables += int64(len(tables))
+	d.mu.cleaner.queuedBytes += totalSize
+	d.mu.Unlock()
+
+	pacer := newDeletionPacer(deletionPacerEnv{
+		limiter: d.deletionLimiter,
+		ctx:     d.deletionCtx,
+		getInfo: d.getDeletionPacerInfo,
+	})
+	for i, fileNum := range tables {
+		// Deletions are not paced once the DB is closed so that Close does not
+		// have to wait for the backlog of obsolete sstables to be deleted. An
+		// error from the pacer (e.g. due to the DB being closed) only means that
+		// the rate limit was not applied. The deletion proceeds regardless.
+		if atomic.LoadInt32(&d.closed) == 0 {
+			_ = pacer.maybeThrottle(sizes[i])
+		}
+		d.deleteObsoleteFile(jobID, fileTypeTable, fileNum, tableCaches)
+
+		d.mu.Lock()
+		d.mu.cleaner.queuedTables--
+		d.mu.cleaner.queuedBytes -= sizes[i]
+		d.mu.Unlock()
+	}
+
+	d.mu.Lock()
+	d.mu.cleaner.pacing--
+	d.mu.cleaner.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// getDeletionPacerInfo returns the information used by the deletion pacer.
+func (d *DB) getDeletionPacerInfo() deletionPacerInfo {
+	var pacerInfo deletionPacerInfo
+	d.mu.Lock()
+	pacerInfo.obsoleteBytes = d.mu.cleaner.queuedBytes
+	for _, cf := range d.mu.columnFamilies {
+		for i := range cf.versions.levelMetrics {
+			pacerInfo.liveBytes += cf.versions.levelMetrics[i].Size
 		}
 	}
+	d.mu.Unlock()
+	return pacerInfo
+}
+
+// deleteObsoleteFile deletes the specified obsolete file, or recycles it if it
+// is a WAL which can be reused. An obsolete sstable is evicted from the table
+// caches, and an obsolete blob file from the block cache, before being
+// deleted.
+//
+// d.mu must not be held when calling this method.
+func (d *DB) deleteObsoleteFile(
+	jobID int, fileType fileType, fileNum uint64, tableCaches []*tableCache,
+) {
+	switch fileType {
+	case fileTypeLog:
+		if d.logRecycler.add(fileNum) {
+			return
+		}
+	case fileTypeTable:
+		for _, c := range tableCaches {
+			c.evict(fileNum)
+		}
+	case fileTypeBlob:
+		d.blobFiles.evict(fileNum)
+	}
+
+	path := base.MakeFilename(d.opts.FS, d.dirname, fileType, fileNum)
+	err := d.opts.FS.Remove(path)
+	if err == os.ErrNotExist {
+		return
+	}
+
+	// TODO(peter): need to handle this errror, probably by re-adding the
+	// file that couldn't be deleted to one of the obsolete slices map.
+
+	switch fileType {
+	case fileTypeLog:
+		d.opts.EventListener.WALDeleted(WALDeleteInfo{
+			JobID:   jobID,
+			Path:    path,
+			FileNum: fileNum,
+			Err:     err,
+		})
+	case fileTypeManifest:
+		d.opts.EventListener.ManifestDeleted(ManifestDeleteInfo{
+			JobID:   jobID,
+			Path:    path,
+			FileNum: fileNum,
+			Err:     err,
+		})
+	case fileTypeTable:
+		d.opts.EventListener.TableDeleted(TableDeleteInfo{
+			JobID:   jobID,
+			Path:    path,
+			FileNum: fileNum,
+			Err:     err,
+		})
+	}
+}
+
+// disableFileDeletions disables the deletion of obsolete files, waiting for
+// any in-progress deletion of obsolete files to complete. Calls to
+// disableFileDeletions must be paired with calls to enableFileDeletions.
+//
+// d.mu must be held when calling this method.
+func (d *DB) disableFileDeletions() {
+	d.mu.cleaner.disabled++
+	for d.mu.cleaner.cleaning {
+		d.mu.cleaner.cond.Wait()
+	}
+}
+
+// enableFileDeletions re-enables the deletion of obsolete files, deleting any
+// files which became obsolete while deletions were disabled.
+//
+// d.mu must be held when calling this, but the mutex may be dropped and
+// re-acquired during the course of this method.
+func (d *DB) enableFileDeletions() {
+	if d.mu.cleaner.disabled <= 0 {
+		panic("pebble: file deletion disablement invariant violated")
+	}
+	d.mu.cleaner.disabled--
+	if d.mu.cleaner.disabled > 0 {
+		return
+	}
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	d.deleteObsoleteFiles(jobID)
 }
 
 func merge(a, b []uint64) []uint64 {
@@ -120,6 +120,35 @@ import (
 // to take the range tombstones into consideration when outputting normal
 // keys. Just as with point deletions, a range deletion covering an entry can
 // cause the entry to be elided.
+//
+// 5. Expired Keys
+//
+// An entry written with a TTL (InternalKeyKindSetWithTTL) that has expired is
+// logically a deletion: reads treat it as deleted regardless of the snapshot
+// they are reading from. compactionIter converts such an entry into a
+// deletion tombstone, which is subject to the rules for eliding deletion
+// tombstones described above. For example, the keys a.SETTTL.2 (expired) and
+// a.SET.1 collapse to a.DEL.2, which is elided entirely when compacting to
+// the base-level.
+//
+// 6. Compaction Filters
+//
+// A user-supplied CompactionFilter may remove or rewrite values. Only values
+// in the newest snapshot stripe (i.e. values which are not visible to any
+// snapshot) are passed to the filter. A removed value is converted into a
+// deletion tombstone so that it continues to shadow older entries for the
+// key, again subject to the rules for eliding deletion tombstones. For
+// example, if the filter removes a.SET.9 in the scenario above, the stripe
+// containing a.SET.9 collapses to a.DEL.9 while a.DEL.6 is retained for the
+// snapshot.
+//
+// 7. Separated Values
+//
+// An entry whose value has been separated into a blob file
+// (InternalKeyKindBlobHandle) is treated like a Set. The blob handle is
+// passed through unmodified unless the value is needed: a Merge on top of a
+// separated value is merged with the value retrieved from the blob file,
+// producing a Set, as does a value rewritten by the compaction filter.
 type compactionIter struct {
 	cmp   Compare
 	merge Merge
@@ -157,6 +186,19 @@ type compactionIter struct {
 	allowZeroSeqNum     bool
 	elideTombstone      func(key []byte) bool
 	elideRangeTombstone func(start, end []byte) bool
+	// The Unix time in nanoseconds at which the compaction started. Entries
+	// written with a TTL which expired at or before now are deleted.
+	now int64
+	// The compaction filter, or nil if there is no filter. See
+	// CompactionFilter.Filter.
+	filter func(key, value []byte) (CompactionFilterDecision, []byte)
+	// Temporary buffer used for storing values rewritten by the filter.
+	filterBuf []byte
+	// blobValue returns the value referenced by the blob handle of an
+	// InternalKeyKindBlobHandle entry. Separated values are only retrieved
+	// when they are merged or passed to the compaction filter. Otherwise the
+	// blob handle is copied to the output.
+	blobValue func(handle []byte) ([]byte, error)
 }
 
 func newCompactionIter(
@@ -167,6 +209,9 @@ func newCompactionIter(
 	allowZeroSeqNum bool,
 	elideTombstone func(key []byte) bool,
 	elideRangeTombstone func(start, end []byte) bool,
+	now int64,
+	filter func(key, value []byte) (CompactionFilterDecision, []byte),
+	blobValue func(handle []byte) ([]byte, error),
 ) *compactionIter {
 	i := &compactionIter{
 		cmp:                 cmp,
@@ -176,6 +221,9 @@ func newCompactionIter(
 		allowZeroSeqNum:     allowZeroSeqNum,
 		elideTombstone:      elideTombstone,
 		elideRangeTombstone: elideRangeTombstone,
+		now:                 now,
+		filter:              filter,
+		blobValue:           blobValue,
 	}
 	i.rangeDelFrag.Cmp = cmp
 	i.rangeDelFrag.Emit = i.emitRangeDelChunk
@@ -217,6 +265,31 @@ func (i *compactionIter) Next() (*InternalKey, []byte) {
 			continue
 		}
 
+		if i.key.Kind() == InternalKeyKindSetWithTTL {
+			expired, err := i.ttlExpired(i.iterValue)
+			if err != nil {
+				i.err = err
+				return nil, nil
+			}
+			if expired {
+				// An expired key is converted into a deletion tombstone so that it
+				// continues to shadow older entries for the key.
+				i.key.SetKind(InternalKeyKindDelete)
+				i.iterValue = nil
+			}
+		}
+
+		if i.filter != nil && i.curSnapshotIdx == len(i.snapshots) {
+			switch i.key.Kind() {
+			case InternalKeyKindSet, InternalKeyKindSetWithTTL, InternalKeyKindBlobHandle:
+				var ok bool
+				i.iterValue, ok = i.applyFilter(i.iterValue)
+				if !ok {
+					return nil, nil
+				}
+			}
+		}
+
 		switch i.key.Kind() {
 		case InternalKeyKindDelete, InternalKeyKindSingleDelete:
 			// If we're at the last snapshot stripe and the tombstone can be elided
@@ -243,7 +316,7 @@ func (i *compactionIter) Next() (*InternalKey, []byte) {
 				continue
 			}
 
-		case InternalKeyKindSet:
+		case InternalKeyKindSet, InternalKeyKindSetWithTTL, InternalKeyKindBlobHandle:
 			i.saveKey()
 			i.value = i.iterValue
 			i.valid = true
@@ -255,9 +328,37 @@ func (i *compactionIter) Next() (*InternalKey, []byte) {
 			// NB: it is important to call maybeZeroSeqnum before mergeNext as
 			// merging advances the iterator, adjusting curSnapshotIdx and thus
 			// invalidating the state that maybeZeroSeqnum uses to make its
-			// determination.
+			// determination. The same applies to the stripe checks for the
+			// compaction filter.
+			snapshotIdx := i.curSnapshotIdx
 			i.maybeZeroSeqnum()
-			return i.mergeNext()
+			key, value := i.mergeNext()
+			if key == nil || i.filter == nil || snapshotIdx != len(i.snapshots) {
+				return key, value
+			}
+			switch key.Kind() {
+			case InternalKeyKindSet, InternalKeyKindSetWithTTL:
+			default:
+				// Partial merge results are not passed to the filter.
+				return key, value
+			}
+			var ok bool
+			i.value, ok = i.applyFilter(i.value)
+			if !ok {
+				return nil, nil
+			}
+			if i.key.Kind() == InternalKeyKindDelete &&
+				snapshotIdx == 0 && i.elideTombstone(i.key.UserKey) {
+				// The filter removed the merged value and the resulting tombstone can
+				// be elided. The remainder of the stripe may still need to be skipped.
+				if i.skip {
+					i.skip = false
+					i.skipStripe()
+				}
+				i.valid = false
+				continue
+			}
+			return &i.key, i.value
 
 		case InternalKeyKindRangeDelete:
 			i.nextInStripe()
@@ -356,8 +457,11 @@ func (i *compactionIter) mergeNext() (*InternalKey, []byte) {
 		switch key.Kind() {
 		case InternalKeyKindDelete:
 			// We've hit a deletion tombstone. Return everything up to this point and
-			// then skip entries until the next snapshot stripe.
+			// then skip entries until the next snapshot stripe. We change the kind
+			// of the resulting key to a Set so that it shadows keys in lower levels
+			// in place of the tombstone. That is, MERGE+MERGE+DEL -> SET.
 			i.valueBuf = i.value[:0]
+			i.key.SetKind(InternalKeyKindSet)
 			i.skip = true
 			return &i.key, i.value
 
@@ -382,6 +486,56 @@ func (i *compactionIter) mergeNext() (*InternalKey, []byte) {
 			i.skip = true
 			return &i.key, i.value
 
+		case InternalKeyKindBlobHandle:
+			if i.rangeDelFrag.Deleted(*key, i.curSnapshotSeqNum) {
+				i.skip = true
+				return &i.key, i.value
+			}
+
+			// We've hit a separated Set value. Merge with the value retrieved from
+			// the blob file and return. The merged value is not separated. That is,
+			// MERGE+MERGE+BLOBHANDLE -> SET.
+			value, err := i.blobValue(i.iterValue)
+			if err != nil {
+				i.err = err
+				return nil, nil
+			}
+			i.value = i.merge(i.key.UserKey, i.value, value, nil)
+			i.valueBuf = i.value[:0]
+			i.key.SetKind(InternalKeyKindSet)
+			i.skip = true
+			return &i.key, i.value
+
+		case InternalKeyKindSetWithTTL:
+			if i.rangeDelFrag.Deleted(*key, i.curSnapshotSeqNum) {
+				i.skip = true
+				return &i.key, i.value
+			}
+
+			expiry, value, err := decodeTTLValue(i.iterValue)
+			if err != nil {
+				i.err = err
+				return nil, nil
+			}
+			if ttlExpired(expiry, i.now) {
+				// We've hit an expired key, which is a deletion tombstone. Return
+				// everything up to this point as a Set and then skip entries until
+				// the next snapshot stripe.
+				i.valueBuf = i.value[:0]
+				i.key.SetKind(InternalKeyKindSet)
+				i.skip = true
+				return &i.key, i.value
+			}
+
+			// We've hit a Set value with a TTL. Merge with the existing value and
+			// return, retaining the expiration time of the Set. That is,
+			// MERGE+MERGE+SETTTL -> SETTTL.
+			i.value = encodeTTLValue(nil, expiry, i.merge(i.key.UserKey, i.value, value, nil))
+			i.valueBuf = i.value[:0]
+			i.key.SetKind(InternalKeyKindSetWithTTL)
+			i.skip = true
+			return &i.key, i.value
+
 		case InternalKeyKindMerge:
 			if i.rangeDelFrag.Deleted(*key, i.curSnapshotSeqNum) {
 				i.skip = true
@@ -420,7 +574,7 @@ func (i *compactionIter) singleDeleteNext() bool {
 			i.skip = true
 			return true
 
-		case InternalKeyKindSet:
+		case InternalKeyKindSet, InternalKeyKindSetWithTTL, InternalKeyKindBlobHandle:
 			i.nextInStripe()
 			i.valid = false
 			return false
@@ -439,6 +593,68 @@ func (i *compactionIter) singleDeleteNext() bool {
 	}
 }
 
+// applyFilter passes the value of the current key, which must be a Set,
+// SetWithTTL or BlobHandle, to the compaction filter. It returns the value to
+// use for the key. If the filter removes the key, the kind of the current key
+// is changed to a deletion and the returned value is nil. If the filter
+// changes a separated value, the kind of the current key is changed to a Set.
+// Returns false if an error occurred.
+func (i *compactionIter) applyFilter(v []byte) ([]byte, bool) {
+	var expiry int64
+	value := v
+	switch i.key.Kind() {
+	case InternalKeyKindSetWithTTL:
+		var err error
+		expiry, value, err = decodeTTLValue(v)
+		if err != nil {
+			i.err = err
+			return nil, false
+		}
+	case InternalKeyKindBlobHandle:
+		var err error
+		value, err = i.blobValue(v)
+		if err != nil {
+			i.err = err
+			return nil, false
+		}
+	}
+
+	decision, newValue := i.filter(i.key.UserKey, value)
+	switch decision {
+	case CompactionFilterKeep:
+		return v, true
+
+	case CompactionFilterRemove:
+		i.key.SetKind(InternalKeyKindDelete)
+		return nil, true
+
+	case CompactionFilterChangeValue:
+		// The new value is copied as it may alias the value passed to the filter.
+		if i.key.Kind() == InternalKeyKindSetWithTTL {
+			// The expiration time of the key is retained.
+			i.filterBuf = encodeTTLValue(i.filterBuf[:0], expiry, newValue)
+		} else {
+			i.key.SetKind(InternalKeyKindSet)
+			i.filterBuf = append(i.filterBuf[:0], newValue...)
+		}
+		return i.filterBuf, true
+
+	default:
+		i.err = fmt.Errorf("pebble: invalid compaction filter decision: %d", decision)
+		return nil, false
+	}
+}
+
+// ttlExpired returns true if the InternalKeyKindSetWithTTL entry with the
+// specified value has expired.
+func (i *compactionIter) ttlExpired(v []byte) (bool, error) {
+	expiry, _, err := decodeTTLValue(v)
+	if err != nil {
+		return false, err
+	}
+	return ttlExpired(expiry, i.now), nil
+}
+
 func (i *compactionIter) saveKey() {
 	i.keyBuf = append(i.keyBuf[:0], i.iterKey.UserKey...)
 	i.key.UserKey = i.keyBuf
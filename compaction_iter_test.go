@@ -51,6 +51,8 @@ func TestCompactionIter(t *testing.T) {
 	var vals [][]byte
 	var snapshots []uint64
 	var elideTombstones bool
+	var now int64
+	var filterRemove, filterChange map[string]bool
 
 	newIter := func() *compactionIter {
 		return newCompactionIter(
@@ -65,6 +67,21 @@ func TestCompactionIter(t *testing.T) {
 			func(_, _ []byte) bool {
 				return elideTombstones
 			},
+			now,
+			func(key, value []byte) (CompactionFilterDecision, []byte) {
+				if filterRemove[string(key)] {
+					return CompactionFilterRemove, nil
+				}
+				if filterChange[string(key)] {
+					return CompactionFilterChangeValue, bytes.ToUpper(value)
+				}
+				return CompactionFilterKeep, nil
+			},
+			func(handle []byte) ([]byte, error) {
+				// The value referenced by a blob handle is the handle enclosed in
+				// brackets.
+				return []byte("[" + string(handle) + "]"), nil
+			},
 		)
 	}
 
@@ -75,14 +92,28 @@ func TestCompactionIter(t *testing.T) {
 			vals = vals[:0]
 			for _, key := range strings.Split(d.Input, "\n") {
 				j := strings.Index(key, ":")
-				keys = append(keys, base.ParseInternalKey(key[:j]))
-				vals = append(vals, []byte(key[j+1:]))
+				ikey := base.ParseInternalKey(key[:j])
+				value := []byte(key[j+1:])
+				if ikey.Kind() == InternalKeyKindSetWithTTL {
+					// The value of a SETTTL key is specified as <expiry>/<value>.
+					parts := strings.SplitN(string(value), "/", 2)
+					expiry, err := strconv.ParseInt(parts[0], 10, 64)
+					if err != nil {
+						return err.Error()
+					}
+					value = encodeTTLValue(nil, expiry, []byte(parts[1]))
+				}
+				keys = append(keys, ikey)
+				vals = append(vals, value)
 			}
 			return ""
 
 		case "iter":
 			snapshots = snapshots[:0]
 			elideTombstones = false
+			now = 0
+			filterRemove = map[string]bool{}
+			filterChange = map[string]bool{}
 			for _, arg := range d.CmdArgs {
 				switch arg.Key {
 				case "snapshots":
@@ -99,6 +130,20 @@ func TestCompactionIter(t *testing.T) {
 					if err != nil {
 						return err.Error()
 					}
+				case "now":
+					var err error
+					now, err = strconv.ParseInt(arg.Vals[0], 10, 64)
+					if err != nil {
+						return err.Error()
+					}
+				case "filter-remove":
+					for _, val := range arg.Vals {
+						filterRemove[val] = true
+					}
+				case "filter-change":
+					for _, val := range arg.Vals {
+						filterChange[val] = true
+					}
 				default:
 					return fmt.Sprintf("%s: unknown arg: %s", d.Cmd, arg.Key)
 				}
@@ -133,7 +178,13 @@ func TestCompactionIter(t *testing.T) {
 				default:
 					return fmt.Sprintf("unknown op: %s", parts[0])
 				}
-				if iter.Valid() {
+				if iter.Valid() && iter.Key().Kind() == InternalKeyKindSetWithTTL {
+					expiry, value, err := decodeTTLValue(iter.Value())
+					if err != nil {
+						return err.Error()
+					}
+					fmt.Fprintf(&b, "%s:%d/%s\n", iter.Key(), expiry, value)
+				} else if iter.Valid() {
 					fmt.Fprintf(&b, "%s:%s\n", iter.Key(), iter.Value())
 				} else if err := iter.Error(); err != nil {
 					fmt.Fprintf(&b, "err=%v\n", err)
@@ -6,6 +6,7 @@ package pebble
 
 import (
 	"math"
+	"sort"
 
 	"github.com/cockroachdb/pebble/internal/manifest"
 )
@@ -32,12 +33,21 @@ type compactionPicker struct {
 	// level.
 	levelMaxBytes [numLevels]int64
 
+	// scores holds the compaction score for each level. A score < 1 means that
+	// compaction of the level is not strictly needed.
+	scores [numLevels]float64
+
 	// These fields are the level that should be compacted next and its
 	// compaction score. A score < 1 means that compaction is not strictly
 	// needed.
 	score float64
 	level int
 	file  int
+
+	// garbageBlobs holds the blob files whose fraction of garbage exceeds
+	// Options.BlobGarbageRatio. The compactions picked rewrite the values of
+	// these blob files (see compaction.rewriteBlobs).
+	garbageBlobs map[uint64]struct{}
 }
 
 func newCompactionPicker(v *version, opts *Options) *compactionPicker {
@@ -47,6 +57,7 @@ func newCompactionPicker(v *version, opts *Options) *compactionPicker {
 	}
 	p.initLevelMaxBytes(v, opts)
 	p.initTarget(v, opts)
+	p.initGarbageBlobs(v, opts)
 	return p
 }
 
@@ -187,13 +198,14 @@ func (p *compactionPicker) initTarget(v *version, opts *Options) {
 	// wish to avoid too many files when the individual file size is small
 	// (perhaps because of a small write-buffer setting, or very high
 	// compression ratios, or lots of overwrites/deletions).
-	p.score = float64(len(v.Files[0])) / float64(opts.L0CompactionThreshold)
+	p.scores[0] = float64(len(v.Files[0])) / float64(opts.L0CompactionThreshold)
+	p.score = p.scores[0]
 	p.level = 0
 
 	for level := 1; level < numLevels-1; level++ {
-		score := float64(totalSize(v.Files[level])) / float64(p.levelMaxBytes[level])
-		if p.score < score {
-			p.score = score
+		p.scores[level] = float64(totalSize(v.Files[level])) / float64(p.levelMaxBytes[level])
+		if p.score < p.scores[level] {
+			p.score = p.scores[level]
 			p.level = level
 		}
 	}
@@ -252,18 +264,98 @@ func (p *compactionPicker) initTarget(v *version, opts *Options) {
 	// snapshot.
 }
 
-// pickAuto picks the best compaction, if any.
+// initGarbageBlobs initializes the set of blob files whose values are to be
+// rewritten by compactions.
+func (p *compactionPicker) initGarbageBlobs(v *version, opts *Options) {
+	for i := range v.BlobFiles {
+		f := &v.BlobFiles[i]
+		if float64(f.Size-f.LiveBytes) <= opts.BlobGarbageRatio*float64(f.Size) {
+			continue
+		}
+		if p.garbageBlobs == nil {
+			p.garbageBlobs = make(map[uint64]struct{})
+		}
+		p.garbageBlobs[f.FileNum] = struct{}{}
+	}
+}
+
+// pickAuto picks the best compaction, if any. The picked compaction is
+// guaranteed not to conflict with any of the inProgress compactions (see
+// compaction.conflicts). If the best compaction conflicts with an in-progress
+// compaction, the remaining levels which need compaction are considered in
+// order of decreasing score, and the files within each level in the same order
+// that initTarget uses to select a file.
 func (p *compactionPicker) pickAuto(
 	opts *Options,
 	bytesCompacted *uint64,
+	inProgress []*compaction,
 ) (c *compaction) {
 	if !p.compactionNeeded() {
 		return nil
 	}
 
+	c = p.pickFile(opts, p.level, p.file, bytesCompacted)
+	if !c.conflicts(inProgress) {
+		return c
+	}
+
+	// The best compaction conflicts with an in-progress compaction. Look for
+	// another compaction which can run concurrently.
+	levels := make([]int, 0, numLevels)
+	for level := 0; level < numLevels-1; level++ {
+		if p.scores[level] >= 1 {
+			levels = append(levels, level)
+		}
+	}
+	sort.SliceStable(levels, func(i, j int) bool {
+		return p.scores[levels[i]] > p.scores[levels[j]]
+	})
+
+	compacting := make(map[uint64]struct{})
+	for _, o := range inProgress {
+		for i := range o.inputs {
+			for j := range o.inputs[i] {
+				compacting[o.inputs[i][j].FileNum] = struct{}{}
+			}
+		}
+	}
+
+	for _, level := range levels {
+		files := p.vers.Files[level]
+		order := make([]int, len(files))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return files[order[i]].SmallestSeqNum < files[order[j]].SmallestSeqNum
+		})
+		for _, i := range order {
+			if level == p.level && i == p.file {
+				// Already tried above.
+				continue
+			}
+			if _, ok := compacting[files[i].FileNum]; ok {
+				continue
+			}
+			c = p.pickFile(opts, level, i, bytesCompacted)
+			if !c.conflicts(inProgress) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// pickFile constructs a compaction of the specified file within level,
+// expanding the inputs as required.
+func (p *compactionPicker) pickFile(
+	opts *Options,
+	level, file int,
+	bytesCompacted *uint64,
+) (c *compaction) {
 	vers := p.vers
-	c = newCompaction(opts, vers, p.level, p.baseLevel, bytesCompacted)
-	c.inputs[0] = vers.Files[c.startLevel][p.file : p.file+1]
+	c = newCompaction(opts, vers, level, p.baseLevel, bytesCompacted)
+	c.inputs[0] = vers.Files[c.startLevel][file : file+1]
 
 	// Files in level 0 may overlap each other, so pick up all overlapping ones.
 	if c.startLevel == 0 {
@@ -276,16 +368,83 @@ func (p *compactionPicker) pickAuto(
 	}
 
 	c.setupOtherInputs()
+	c.rewriteBlobs = p.garbageBlobs
 	return c
 }
 
+// pickBlobRewrite picks a compaction of a table which references a blob file
+// whose fraction of garbage exceeds Options.BlobGarbageRatio, if any. The
+// compaction rewrites the live values of the blob file, so that the blob file
+// is deleted once every table referencing it has been compacted. A table in
+// the bottom level is rewritten in place; a table in any other level is
+// compacted into the next level, as pickFile does. The picked compaction is
+// guaranteed not to conflict with any of the inProgress compactions.
+func (p *compactionPicker) pickBlobRewrite(
+	opts *Options,
+	bytesCompacted *uint64,
+	inProgress []*compaction,
+) (c *compaction) {
+	if p == nil || len(p.garbageBlobs) == 0 {
+		return nil
+	}
+
+	compacting := make(map[uint64]struct{})
+	for _, o := range inProgress {
+		for i := range o.inputs {
+			for j := range o.inputs[i] {
+				compacting[o.inputs[i][j].FileNum] = struct{}{}
+			}
+		}
+	}
+
+	for level := range p.vers.Files {
+		files := p.vers.Files[level]
+		for i := range files {
+			f := &files[i]
+			if _, ok := compacting[f.FileNum]; ok {
+				continue
+			}
+			if !referencesBlobs(f, p.garbageBlobs) {
+				continue
+			}
+			if level < numLevels-1 {
+				c = p.pickFile(opts, level, i, bytesCompacted)
+			} else {
+				c = newCompaction(opts, p.vers, level, p.baseLevel, bytesCompacted)
+				c.inputs[0] = c.expandInputs(files[i : i+1])
+				c.smallest, c.largest = manifest.KeyRange(c.cmp, c.inputs[0], nil)
+				c.rewriteBlobs = p.garbageBlobs
+			}
+			if !c.conflicts(inProgress) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// referencesBlobs returns true if the table references any of the blob files.
+func referencesBlobs(f *fileMetadata, blobs map[uint64]struct{}) bool {
+	for _, ref := range f.BlobRefs {
+		if _, ok := blobs[ref.FileNum]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pickManual picks the compaction for the specified manual compaction. If the
+// manual compaction conflicts with one of the inProgress compactions, nil is
+// returned along with retryLater=true, indicating the manual compaction should
+// be retried when an in-progress compaction completes.
 func (p *compactionPicker) pickManual(
 	opts *Options,
 	manual *manualCompaction,
 	bytesCompacted *uint64,
-) (c *compaction) {
+	inProgress []*compaction,
+) (c *compaction, retryLater bool) {
 	if p == nil {
-		return nil
+		return nil, false
 	}
 
 	// TODO(peter): The logic here is untested and possibly incomplete.
@@ -295,8 +454,127 @@ func (p *compactionPicker) pickManual(
 	cmp := opts.Comparer.Compare
 	c.inputs[0] = cur.Overlaps(manual.level, cmp, manual.start.UserKey, manual.end.UserKey)
 	if len(c.inputs[0]) == 0 {
-		return nil
+		return nil, false
 	}
 	c.setupOtherInputs()
-	return c
+	c.rewriteBlobs = p.garbageBlobs
+	if c.conflicts(inProgress) {
+		return nil, true
+	}
+	return c, false
+}
+
+// deletionHint records a range tombstone in a table written by a flush or
+// compaction, or ingested. Tables in the levels at or below the tombstone's
+// table which are wholly covered by the tombstone can be deleted without being
+// read (see pickDeleteOnly). The hint remains valid while the table containing the
+// tombstone is part of the version: a compaction of that table records new
+// hints for the tombstones in its outputs.
+type deletionHint struct {
+	// fileNum is the table containing the tombstone.
+	fileNum uint64
+	// start and end are the bounds of the tombstone, truncated to the bounds
+	// of the table.
+	start, end []byte
+	// seqNum is the sequence number of the tombstone.
+	seqNum uint64
+}
+
+// liveDeletionHints returns the hints whose tombstone tables are part of the
+// version, along with the level of each hint's table.
+func (p *compactionPicker) liveDeletionHints(
+	hints []deletionHint,
+) (live []deletionHint, levels []int) {
+	if len(hints) == 0 {
+		return nil, nil
+	}
+	fileLevels := make(map[uint64]int)
+	for level := range p.vers.Files {
+		for i := range p.vers.Files[level] {
+			fileLevels[p.vers.Files[level][i].FileNum] = level
+		}
+	}
+	live = hints[:0]
+	for _, h := range hints {
+		if level, ok := fileLevels[h.fileNum]; ok {
+			live = append(live, h)
+			levels = append(levels, level)
+		}
+	}
+	return live, levels
+}
+
+// pickDeleteOnly picks a delete-only compaction, if any. A delete-only
+// compaction removes the tables of a level which are wholly covered by the
+// range tombstone of a deletion hint, without reading them or producing any
+// output. A table is covered if it lies at or below the level of the hint's
+// table, all of its keys are older than the tombstone and no snapshot can see
+// its keys without also seeing the tombstone. The tables of the picked
+// compaction do not overlap the inputs of any of the inProgress compactions.
+// The hints are pruned to those which remain valid for the version.
+func (p *compactionPicker) pickDeleteOnly(
+	opts *Options,
+	hints []deletionHint,
+	snapshots []uint64,
+	inProgress []*compaction,
+) (c *compaction, live []deletionHint) {
+	if p == nil {
+		return nil, hints
+	}
+	live, levels := p.liveDeletionHints(hints)
+	if len(live) == 0 {
+		return nil, live
+	}
+
+	compacting := make(map[uint64]struct{})
+	for _, o := range inProgress {
+		for i := range o.inputs {
+			for j := range o.inputs[i] {
+				compacting[o.inputs[i][j].FileNum] = struct{}{}
+			}
+		}
+	}
+
+	cmp := opts.Comparer.Compare
+	covered := func(h *deletionHint, f *fileMetadata) bool {
+		if f.FileNum == h.fileNum || f.LargestSeqNum >= h.seqNum {
+			return false
+		}
+		if cmp(f.Smallest.UserKey, h.start) < 0 {
+			return false
+		}
+		if v := cmp(f.Largest.UserKey, h.end); v > 0 ||
+			(v == 0 && f.Largest.Trailer != InternalKeyRangeDeleteSentinel) {
+			return false
+		}
+		// A snapshot which can see keys in the table but not the tombstone
+		// prevents the deletion of the table. Snapshots are sorted in increasing
+		// order.
+		i := sort.Search(len(snapshots), func(i int) bool {
+			return snapshots[i] > f.SmallestSeqNum
+		})
+		return i == len(snapshots) || snapshots[i] > h.seqNum
+	}
+
+	for level := 0; level < numLevels; level++ {
+		files := p.vers.Files[level]
+		var inputs []fileMetadata
+		for i := range files {
+			f := &files[i]
+			if _, ok := compacting[f.FileNum]; ok {
+				continue
+			}
+			for j := range live {
+				if levels[j] <= level && covered(&live[j], f) {
+					inputs = append(inputs, *f)
+					break
+				}
+			}
+		}
+		if len(inputs) > 0 {
+			c = newDeleteOnlyCompaction(opts, p.vers, level, inputs)
+			return c, live
+		}
+	}
+	return nil, live
 }
@@ -13,6 +13,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,6 +22,7 @@ import (
 	"github.com/cockroachdb/pebble/internal/manifest"
 	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
+	"golang.org/x/exp/rand"
 )
 
 func TestPickCompaction(t *testing.T) {
@@ -435,7 +437,7 @@ func TestPickCompaction(t *testing.T) {
 		vs.picker = &tc.picker
 		vs.picker.vers = &tc.version
 
-		c, got := vs.picker.pickAuto(opts, new(uint64)), ""
+		c, got := vs.picker.pickAuto(opts, new(uint64), nil), ""
 		if c != nil {
 			got0 := fileNums(c.inputs[0])
 			got1 := fileNums(c.inputs[1])
@@ -448,6 +450,112 @@ func TestPickCompaction(t *testing.T) {
 	}
 }
 
+func TestPickCompactionInProgress(t *testing.T) {
+	opts := (*Options)(nil).EnsureDefaults()
+	cmp := DefaultComparer.Compare
+
+	vers := &version{
+		Files: [numLevels][]fileMetadata{
+			1: []fileMetadata{
+				{
+					FileNum:        200,
+					Size:           1,
+					Smallest:       base.ParseInternalKey("a.SET.201"),
+					Largest:        base.ParseInternalKey("b.SET.202"),
+					SmallestSeqNum: 201,
+					LargestSeqNum:  202,
+				},
+				{
+					FileNum:        210,
+					Size:           1,
+					Smallest:       base.ParseInternalKey("m.SET.211"),
+					Largest:        base.ParseInternalKey("n.SET.212"),
+					SmallestSeqNum: 211,
+					LargestSeqNum:  212,
+				},
+				{
+					FileNum:        220,
+					Size:           1,
+					Smallest:       base.ParseInternalKey("y.SET.221"),
+					Largest:        base.ParseInternalKey("z.SET.222"),
+					SmallestSeqNum: 221,
+					LargestSeqNum:  222,
+				},
+			},
+			2: []fileMetadata{
+				{
+					FileNum:  300,
+					Size:     1,
+					Smallest: base.ParseInternalKey("b.SET.301"),
+					Largest:  base.ParseInternalKey("m.SET.302"),
+				},
+			},
+		},
+	}
+	picker := &compactionPicker{
+		vers:      vers,
+		baseLevel: 1,
+		score:     99,
+		level:     1,
+		file:      0,
+	}
+	picker.scores[1] = 99
+
+	// inProgress returns a compaction of the specified L1 files which is
+	// treated as running.
+	inProgress := func(fileNums ...uint64) *compaction {
+		c := newCompaction(opts, vers, 1, 1, new(uint64))
+		for _, fileNum := range fileNums {
+			for i := range vers.Files[1] {
+				if vers.Files[1][i].FileNum == fileNum {
+					c.inputs[0] = append(c.inputs[0], vers.Files[1][i])
+				}
+			}
+		}
+		c.inputs[1] = vers.Overlaps(2, cmp, c.inputs[0][0].Smallest.UserKey,
+			c.inputs[0][len(c.inputs[0])-1].Largest.UserKey)
+		c.smallest, c.largest = manifest.KeyRange(cmp, c.inputs[0], c.inputs[1])
+		return c
+	}
+
+	fileNums := func(c *compaction) string {
+		if c == nil {
+			return ""
+		}
+		var buf bytes.Buffer
+		for i := range c.inputs {
+			if i > 0 {
+				buf.WriteString(" ")
+			}
+			for j := range c.inputs[i] {
+				if j > 0 {
+					buf.WriteString(",")
+				}
+				fmt.Fprintf(&buf, "%d", c.inputs[i][j].FileNum)
+			}
+		}
+		return buf.String()
+	}
+
+	testCases := []struct {
+		inProgress []*compaction
+		want       string
+	}{
+		// Files 200 and 210 both overlap file 300 in L2, so the compaction of
+		// file 200 is grown to include file 210.
+		{nil, "200,210 300"},
+		{[]*compaction{inProgress(210)}, "220 "},
+		{[]*compaction{inProgress(220)}, "200,210 300"},
+		{[]*compaction{inProgress(200), inProgress(220)}, ""},
+	}
+	for _, tc := range testCases {
+		c := picker.pickAuto(opts, new(uint64), tc.inProgress)
+		if got := fileNums(c); got != tc.want {
+			t.Fatalf("got %q, want %q", got, tc.want)
+		}
+	}
+}
+
 func TestElideTombstone(t *testing.T) {
 	testCases := []struct {
 		desc    string
@@ -711,6 +819,365 @@ func TestCompaction(t *testing.T) {
 	}
 }
 
+// blockingPacer blocks compactions while it is blocked.
+type blockingPacer struct {
+	mu      sync.Mutex
+	blocked chan struct{}
+}
+
+func (p *blockingPacer) block() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.blocked == nil {
+		p.blocked = make(chan struct{})
+	}
+}
+
+func (p *blockingPacer) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.blocked != nil {
+		close(p.blocked)
+		p.blocked = nil
+	}
+}
+
+func (p *blockingPacer) Throttle(op PacerOperation, n uint64) error {
+	if op != PacerCompaction {
+		return nil
+	}
+	p.mu.Lock()
+	blocked := p.blocked
+	p.mu.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+	return nil
+}
+
+func TestConcurrentCompactions(t *testing.T) {
+	const maxConcurrentCompactions = 3
+
+	pacer := &blockingPacer{}
+	var mu sync.Mutex
+	var running, maxRunning int
+	d, err := Open("", &Options{
+		FS:                       vfs.NewMem(),
+		MemTableSize:             32 << 10,
+		L0CompactionThreshold:    2,
+		LBaseMaxBytes:            64 << 10,
+		MaxConcurrentCompactions: maxConcurrentCompactions,
+		Levels: []LevelOptions{{
+			TargetFileSize: 16 << 10,
+		}},
+		Pacer: pacer,
+		EventListener: EventListener{
+			CompactionBegin: func(info CompactionInfo) {
+				mu.Lock()
+				running++
+				if maxRunning < running {
+					maxRunning = running
+				}
+				if running > 1 {
+					pacer.release()
+				}
+				mu.Unlock()
+			},
+			CompactionEnd: func(info CompactionInfo) {
+				mu.Lock()
+				running--
+				mu.Unlock()
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	value := bytes.Repeat([]byte("x"), 100)
+	expected := make(map[string]bool)
+	set := func(key string) {
+		if err := d.Set([]byte(key), value, nil); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = true
+	}
+	writePrefix := func(prefix string) {
+		for i := 0; i < 100; i++ {
+			set(fmt.Sprintf("%s%08d", prefix, rng.Intn(100000)))
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Populate the bottom level with a table for each of the disjoint key
+	// ranges "a" and "b".
+	for _, prefix := range []string{"a", "b"} {
+		writePrefix(prefix)
+		if err := d.Compact([]byte(prefix), []byte(prefix+"\xff")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Block compactions until a second compaction begins, and flush a table
+	// for each of the key ranges. The compactions of the tables do not
+	// conflict, so the second compaction runs while the first is blocked. If
+	// compactions cannot run concurrently, the first compaction stays blocked
+	// until the deadline below.
+	d.mu.Lock()
+	for d.mu.compact.compactingCount > 0 {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.Unlock()
+	mu.Lock()
+	maxRunning = 0
+	mu.Unlock()
+	pacer.block()
+	writePrefix("a")
+	writePrefix("b")
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		mu.Lock()
+		n := maxRunning
+		mu.Unlock()
+		if n > 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	pacer.release()
+
+	for i := 0; i < 5000; i++ {
+		set(fmt.Sprintf("%08d", rng.Intn(100000)))
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for key := range expected {
+		if _, err := d.Get([]byte(key)); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+	}
+
+	d.mu.Lock()
+	for d.mu.compact.compactingCount > 0 {
+		d.mu.compact.cond.Wait()
+	}
+	if err := d.mu.versions.currentVersion().CheckOrdering(d.cmp, d.opts.Comparer.Format); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Unlock()
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxRunning < 2 || maxRunning > maxConcurrentCompactions {
+		t.Fatalf("expected between 2 and %d concurrent compactions, but found %d",
+			maxConcurrentCompactions, maxRunning)
+	}
+}
+
+// testCompactionFilter removes keys with the prefix "gc-" and upper-cases the
+// values of keys with the prefix "up-". It records the levels it was invoked
+// for.
+type testCompactionFilter struct {
+	mu     sync.Mutex
+	levels map[int]bool
+}
+
+func (f *testCompactionFilter) Name() string {
+	return "pebble.test"
+}
+
+func (f *testCompactionFilter) Filter(
+	level int, key, value []byte,
+) (CompactionFilterDecision, []byte) {
+	f.mu.Lock()
+	f.levels[level] = true
+	f.mu.Unlock()
+
+	switch {
+	case bytes.HasPrefix(key, []byte("gc-")):
+		return CompactionFilterRemove, nil
+	case bytes.HasPrefix(key, []byte("up-")):
+		return CompactionFilterChangeValue, bytes.ToUpper(value)
+	}
+	return CompactionFilterKeep, nil
+}
+
+func TestCompactionFilter(t *testing.T) {
+	filter := &testCompactionFilter{levels: make(map[int]bool)}
+	d, err := Open("", &Options{
+		CompactionFilter: filter,
+		FS:               vfs.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(key string) string {
+		v, err := d.Get([]byte(key))
+		if err == ErrNotFound {
+			return "<not found>"
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return string(v)
+	}
+
+	for _, key := range []string{"a", "gc-b", "up-c"} {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Merge([]byte("up-d"), []byte("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The filter is not applied during flushes.
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if v := get("gc-b"); v != "gc-b" {
+		t.Fatalf("expected gc-b, but found %s", v)
+	}
+
+	// A snapshot prevents the filter from being applied to the keys it can
+	// see.
+	snap := d.NewSnapshot()
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	if v := get("gc-b"); v != "gc-b" {
+		t.Fatalf("expected gc-b, but found %s", v)
+	}
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write a new key so that the next compaction rewrites the existing table.
+	if err := d.Set([]byte("gc-e"), []byte("gc-e"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"a":    "a",
+		"gc-e": "<not found>",
+		"gc-b": "<not found>",
+		"up-c": "UP-C",
+		// The merge operand was never combined with a value, so it is not
+		// passed to the filter.
+		"up-d": "x",
+	}
+	for key, value := range expected {
+		if v := get(key); v != value {
+			t.Fatalf("%s: expected %s, but found %s", key, value, v)
+		}
+	}
+
+	filter.mu.Lock()
+	if !filter.levels[numLevels-1] || len(filter.levels) != 1 {
+		t.Fatalf("expected filter to be invoked for L%d, but found %v",
+			numLevels-1, filter.levels)
+	}
+	filter.mu.Unlock()
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeletionPacing(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{
+		FS: mem,
+		// Pace deletions at 1 byte/sec so that any paced deletion is still queued
+		// when the DB is closed.
+		MinDeletionRate: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countTables := func() int {
+		ls, err := mem.List("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for _, f := range ls {
+			if strings.HasSuffix(f, ".sst") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Create a large table containing the live data. The obsolete tables
+	// created below are small in comparison, and are thus paced.
+	value := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < 1000; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("a%04d", i)), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := d.Set([]byte("z"), []byte("z"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Compact([]byte("z"), []byte("zz")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The two tables obsoleted by the compaction are queued for deletion.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		m := d.Metrics()
+		if m.Table.ObsoleteCount == 2 {
+			if m.Table.ObsoleteSize == 0 {
+				t.Fatalf("expected non-zero obsolete size")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 queued tables, but found %d", m.Table.ObsoleteCount)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := countTables(); n != 4 {
+		t.Fatalf("expected 4 tables, but found %d", n)
+	}
+
+	// Closing the DB stops pacing and deletes the queued tables.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countTables(); n != 2 {
+		t.Fatalf("expected 2 tables, but found %d", n)
+	}
+}
+
 func TestManualCompaction(t *testing.T) {
 	mem := vfs.NewMem()
 	err := mem.MkdirAll("ext", 0755)
@@ -1095,6 +1562,46 @@ func TestCompactionAllowZeroSeqNum(t *testing.T) {
 		})
 }
 
+// Verify that a flush does not zero seqnums when a key in a lower level lies
+// between the smallest and largest keys being flushed.
+func TestFlushAllowZeroSeqNum(t *testing.T) {
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Set([]byte("m"), []byte("m"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("z"), []byte("z"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	s := d.mu.versions.currentVersion().DebugString(base.DefaultFormatter)
+	d.mu.Unlock()
+	expected := `0:
+  7:[a#1,1-z#2,1]
+6:
+  5:[m#0,1-m#0,1]
+`
+	if expected != s {
+		t.Fatalf("expected\n%sbut found\n%s", expected, s)
+	}
+}
+
 func TestCompactionCheckOrdering(t *testing.T) {
 	parseMeta := func(s string) fileMetadata {
 		parts := strings.Split(s, "-")
@@ -1227,3 +1734,386 @@ func TestFlushInvariant(t *testing.T) {
 		})
 	}
 }
+
+func TestCompactionDiskSpaceReservation(t *testing.T) {
+	mem := vfs.NewMem().(*vfs.MemFS)
+	d, err := Open("", &Options{
+		DiskSpaceReservation:  1 << 20,
+		FS:                    mem,
+		L0CompactionThreshold: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	numL0Files := func() int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for d.mu.compact.compactingCount > 0 {
+			d.mu.compact.cond.Wait()
+		}
+		return len(d.mu.versions.currentVersion().Files[0])
+	}
+
+	// The free space is less than the reservation, so the compaction of the
+	// overlapping L0 files is deferred.
+	mem.SetDiskCapacity(1 << 20)
+	for i := 0; i < 2; i++ {
+		if err := d.Set([]byte("a"), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := numL0Files(); n != 2 {
+		t.Fatalf("expected 2 L0 files, but found %d", n)
+	}
+
+	// The deferred compaction runs once there is sufficient free space and
+	// compactions are next scheduled.
+	mem.SetDiskCapacity(0)
+	d.mu.Lock()
+	d.maybeScheduleCompaction()
+	d.mu.Unlock()
+	if n := numL0Files(); n != 0 {
+		t.Fatalf("expected 0 L0 files, but found %d", n)
+	}
+}
+
+func TestDeleteFilesInRange(t *testing.T) {
+	var d *DB
+	datadriven.RunTest(t, "testdata/delete_files_in_range", func(td *datadriven.TestData) string {
+		switch td.Cmd {
+		case "define":
+			var err error
+			if d, err = runDBDefineCmd(td, nil /* options */); err != nil {
+				return err.Error()
+			}
+
+			d.mu.Lock()
+			s := d.mu.versions.currentVersion().String()
+			d.mu.Unlock()
+			return s
+
+		case "delete-files-in-range":
+			parts := strings.Split(td.CmdArgs[0].Key, "-")
+			if len(parts) != 2 {
+				return fmt.Sprintf("expected <start>-<end>: %s", td.CmdArgs[0].Key)
+			}
+			if err := d.DeleteFilesInRange([]byte(parts[0]), []byte(parts[1])); err != nil {
+				return err.Error()
+			}
+
+			d.mu.Lock()
+			s := d.mu.versions.currentVersion().String()
+			d.mu.Unlock()
+			return s
+
+		case "iter":
+			snap := Snapshot{
+				db:     d,
+				seqNum: InternalKeySeqNumMax,
+			}
+			iter := snap.NewIter(nil)
+			defer iter.Close()
+			return runIterCmd(td, iter)
+
+		default:
+			return fmt.Sprintf("unknown command: %s", td.Cmd)
+		}
+	})
+}
+
+func TestDeleteOnlyCompaction(t *testing.T) {
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	waitForCompactions := func() string {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for d.mu.compact.compactingCount > 0 {
+			d.mu.compact.cond.Wait()
+		}
+		return d.mu.versions.currentVersion().String()
+	}
+
+	// Create two L6 tables: [a-e] and [x-y].
+	for _, keys := range []string{"abcde", "xy"} {
+		for i := range keys {
+			if err := d.Set([]byte(keys[i:i+1]), []byte("v"), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Compact([]byte(keys[:1]), []byte(keys[len(keys)-1:])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := waitForCompactions(); s != "6:\n  5:[a-e]\n  7:[x-y]\n" {
+		t.Fatalf("unexpected version:\n%s", s)
+	}
+
+	// The flush of a tombstone which covers [a-e] records a deletion hint, but
+	// the open snapshot can see the keys in [a-e] and not the tombstone.
+	snap := d.NewSnapshot()
+	if err := d.DeleteRange([]byte("a"), []byte("f"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if s := waitForCompactions(); s != "0:\n  9:[a-f]\n6:\n  5:[a-e]\n  7:[x-y]\n" {
+		t.Fatalf("unexpected version:\n%s", s)
+	}
+
+	// Once the snapshot is closed, a delete-only compaction removes [a-e].
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	d.maybeScheduleCompaction()
+	d.mu.Unlock()
+	if s := waitForCompactions(); s != "0:\n  9:[a-f]\n6:\n  7:[x-y]\n" {
+		t.Fatalf("unexpected version:\n%s", s)
+	}
+	if _, err := d.Get([]byte("c")); err != ErrNotFound {
+		t.Fatalf("expected %v, but found %v", ErrNotFound, err)
+	}
+}
+
+func TestDeleteOnlyCompactionHintsRebuilt(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &Options{FS: mem}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForCompactions := func() string {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for d.mu.compact.compactingCount > 0 {
+			d.mu.compact.cond.Wait()
+		}
+		return d.mu.versions.currentVersion().String()
+	}
+
+	// Create two L6 tables: [a-e] and [x-y].
+	for _, keys := range []string{"abcde", "xy"} {
+		for i := range keys {
+			if err := d.Set([]byte(keys[i:i+1]), []byte("v"), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Compact([]byte(keys[:1]), []byte(keys[len(keys)-1:])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The deletion hint for the flushed tombstone covering [a-e] cannot be
+	// used while the snapshot is open, and is lost when the DB is closed.
+	snap := d.NewSnapshot()
+	if err := d.DeleteRange([]byte("a"), []byte("f"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if s := waitForCompactions(); s != "0:\n  9:[a-f]\n6:\n  5:[a-e]\n  7:[x-y]\n" {
+		t.Fatalf("unexpected version:\n%s", s)
+	}
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hint is rebuilt from the table's tombstones when the DB is opened.
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if s := waitForCompactions(); s != "0:\n  9:[a-f]\n6:\n  7:[x-y]\n" {
+		t.Fatalf("unexpected version:\n%s", s)
+	}
+
+	// An ingested tombstone covering [x-y] records a hint as well.
+	f, err := mem.Create("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, LevelOptions{})
+	if err := w.DeleteRange([]byte("w"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ingest([]string{"ext"}); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	d.maybeScheduleCompaction()
+	d.mu.Unlock()
+	if s := waitForCompactions(); s != "0:\n  9:[a-f]\n5:\n  13:[w-z]\n" {
+		t.Fatalf("unexpected version:\n%s", s)
+	}
+	if _, err := d.Get([]byte("x")); err != ErrNotFound {
+		t.Fatalf("expected %v, but found %v", ErrNotFound, err)
+	}
+}
+
+func TestCompactionSubcompactions(t *testing.T) {
+	cmp := DefaultComparer.Compare
+	parseMeta := func(fileNum uint64, s string, size uint64) fileMetadata {
+		parts := strings.Split(s, "-")
+		return fileMetadata{
+			FileNum:  fileNum,
+			Size:     size,
+			Smallest: base.MakeInternalKey([]byte(parts[0]), 1, InternalKeyKindSet),
+			Largest:  base.MakeInternalKey([]byte(parts[1]), 1, InternalKeyKindSet),
+		}
+	}
+	newCompaction := func() *compaction {
+		c := &compaction{
+			cmp:               cmp,
+			startLevel:        1,
+			outputLevel:       2,
+			maxOutputFileSize: 100,
+		}
+		c.inputs[0] = []fileMetadata{
+			parseMeta(1, "a-c", 100),
+			parseMeta(2, "d-f", 100),
+		}
+		c.inputs[1] = []fileMetadata{
+			parseMeta(3, "a-b", 100),
+			parseMeta(4, "c-e", 100),
+			parseMeta(5, "f-g", 100),
+		}
+		return c
+	}
+	format := func(subs []*compaction) string {
+		var buf bytes.Buffer
+		for _, c := range subs {
+			fmt.Fprintf(&buf, "[%s,%s):", c.lower, c.upper)
+			for i := range c.inputs {
+				for _, f := range c.inputs[i] {
+					fmt.Fprintf(&buf, " %d", f.FileNum)
+				}
+			}
+			buf.WriteString("\n")
+		}
+		return buf.String()
+	}
+
+	testCases := []struct {
+		n        int
+		expected string
+	}{
+		{1, "[,): 1 2 3 4 5\n"},
+		{2, "[,d): 1 3 4\n[d,): 2 4 5\n"},
+		{4, "[,c): 1 3\n[c,d): 1 4\n[d,): 2 4 5\n"},
+		// The number of subcompactions is limited by the number of output
+		// tables the compaction is expected to produce.
+		{10, "[,c): 1 3\n[c,d): 1 4\n[d,f): 2 4\n[f,): 2 5\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprint(tc.n), func(t *testing.T) {
+			c := newCompaction()
+			if s := format(c.subcompactions(tc.n)); s != tc.expected {
+				t.Fatalf("expected\n%s\nbut found\n%s", tc.expected, s)
+			}
+		})
+	}
+}
+
+func TestSubcompactions(t *testing.T) {
+	// run writes a sequence of overlapping tables containing point and range
+	// deletions, compacts them and returns the contents of the DB.
+	run := func(maxSubcompactions int) string {
+		d, err := Open("", &Options{
+			FS:                    vfs.NewMem(),
+			L0CompactionThreshold: 100,
+			L0StopWritesThreshold: 100,
+			Levels:                []LevelOptions{{TargetFileSize: 4 << 10}},
+			MaxSubcompactions:     maxSubcompactions,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		key := func(i int) []byte {
+			return []byte(fmt.Sprintf("%05d", i))
+		}
+		const numKeys = 5000
+		for j := 0; j < 4; j++ {
+			b := d.NewBatch()
+			for i := j; i < numKeys; i += j + 1 {
+				if err := b.Set(key(i), []byte(fmt.Sprintf("%d-%d", i, j)), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if j == 2 {
+				if err := b.DeleteRange(key(1000), key(3000), nil); err != nil {
+					t.Fatal(err)
+				}
+				if err := b.Delete(key(3500), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.Apply(b, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			// The tables produced by compacting the first two batches provide
+			// the boundaries for the subcompactions of the later compaction.
+			if j == 1 {
+				if err := d.Compact(key(0), key(numKeys)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := d.Compact(key(0), key(numKeys)); err != nil {
+			t.Fatal(err)
+		}
+
+		d.mu.Lock()
+		v := d.mu.versions.currentVersion()
+		if err := v.CheckOrdering(d.cmp, d.opts.Comparer.Format); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(v.Files[0]); n != 0 {
+			t.Fatalf("expected 0 L0 tables, but found %d", n)
+		}
+		d.mu.Unlock()
+
+		var buf bytes.Buffer
+		iter := d.NewIter(nil)
+		for valid := iter.First(); valid; valid = iter.Next() {
+			fmt.Fprintf(&buf, "%s:%s\n", iter.Key(), iter.Value())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	expected := run(1)
+	if expected == "" {
+		t.Fatal("expected keys")
+	}
+	if s := run(4); s != expected {
+		t.Fatalf("subcompactions produced different results")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+// crash simulates a crash of the process running the DB by closing the DB
+// without syncing any further data, and discarding the data which has not
+// been synced.
+func crash(t *testing.T, fs *vfs.MemFS, d *DB) {
+	t.Helper()
+	fs.SetIgnoreSyncs(true)
+	require.NoError(t, d.Close())
+	fs.ResetToSyncedState()
+	fs.SetIgnoreSyncs(false)
+}
+
+func TestCrashRecovery(t *testing.T) {
+	get := func(d *DB, key string) string {
+		t.Helper()
+		v, err := d.Get([]byte(key))
+		if err == ErrNotFound {
+			return "<not found>"
+		}
+		require.NoError(t, err)
+		return string(v)
+	}
+
+	t.Run("open", func(t *testing.T) {
+		fs := vfs.NewStrictMem()
+		require.NoError(t, fs.MkdirAll("db", 0755))
+		d, err := Open("db", &Options{FS: fs})
+		require.NoError(t, err)
+		crash(t, fs, d)
+
+		// The DB's CURRENT file and the MANIFEST it refers to were synced.
+		_, err = fs.Stat("db/CURRENT")
+		require.NoError(t, err)
+		d, err = Open("db", &Options{FS: fs})
+		require.NoError(t, err)
+		require.NoError(t, d.Close())
+	})
+
+	t.Run("wal", func(t *testing.T) {
+		fs := vfs.NewStrictMem()
+		d, err := Open("", &Options{FS: fs})
+		require.NoError(t, err)
+		require.NoError(t, d.Set([]byte("a"), []byte("1"), Sync))
+		require.NoError(t, d.Set([]byte("b"), []byte("2"), NoSync))
+		require.NoError(t, d.Set([]byte("c"), []byte("3"), Sync))
+		require.NoError(t, d.Set([]byte("d"), []byte("4"), NoSync))
+		crash(t, fs, d)
+
+		// The synced writes, and the unsynced writes which preceded them, are
+		// replayed from the WAL. The trailing unsynced write is lost.
+		d, err = Open("", &Options{FS: fs})
+		require.NoError(t, err)
+		require.Equal(t, "1", get(d, "a"))
+		require.Equal(t, "2", get(d, "b"))
+		require.Equal(t, "3", get(d, "c"))
+		require.Equal(t, "<not found>", get(d, "d"))
+		require.NoError(t, d.Close())
+	})
+
+	t.Run("manifest-rotation", func(t *testing.T) {
+		fs := vfs.NewStrictMem()
+		opts := &Options{
+			FS:                  fs,
+			MaxManifestFileSize: 1,
+		}
+		d, err := Open("", opts)
+		require.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprint(i)
+			require.NoError(t, d.Set([]byte(key), []byte(key), NoSync))
+			require.NoError(t, d.Flush())
+		}
+		require.NoError(t, d.Compact([]byte("0"), []byte("9")))
+		crash(t, fs, d)
+
+		// The flushed and compacted data survives.
+		d, err = Open("", opts)
+		require.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprint(i)
+			require.Equal(t, key, get(d, key))
+		}
+		require.NoError(t, d.Close())
+	})
+
+	t.Run("ingest", func(t *testing.T) {
+		fs := vfs.NewStrictMem()
+		d, err := Open("", &Options{FS: fs})
+		require.NoError(t, err)
+
+		f, err := fs.Create("ext")
+		require.NoError(t, err)
+		w := sstable.NewWriter(f, nil, LevelOptions{})
+		require.NoError(t, w.Add(base.MakeInternalKey([]byte("a"), 0, InternalKeyKindSet), []byte("1")))
+		require.NoError(t, w.Add(base.MakeInternalKey([]byte("b"), 0, InternalKeyKindSet), []byte("2")))
+		require.NoError(t, w.Close())
+		require.NoError(t, d.Ingest([]string{"ext"}))
+		crash(t, fs, d)
+
+		d, err = Open("", &Options{FS: fs})
+		require.NoError(t, err)
+		require.Equal(t, "1", get(d, "a"))
+		require.Equal(t, "2", get(d, "b"))
+		require.NoError(t, d.Close())
+	})
+}
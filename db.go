@@ -6,15 +6,20 @@
 package pebble // import "github.com/cockroachdb/pebble"
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cockroachdb/pebble/internal/arenaskl"
 	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/rate"
 	"github.com/cockroachdb/pebble/internal/record"
+	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
 )
 
@@ -178,22 +183,32 @@ type DB struct {
 	tableCache tableCache
 	newIters   tableNewIters
 
+	// blobFiles provides access to the values stored in blob files. Blob files
+	// are shared by all of the column families.
+	blobFiles blobFiles
+
 	commit   *commitPipeline
 	fileLock io.Closer
 
 	largeBatchThreshold int
-	optionsFileNum      uint64
+	// optionsFileNum is the file number of the current OPTIONS file. It is
+	// protected by d.mu once the DB is open.
+	optionsFileNum uint64
 
-	// readState provides access to the state needed for reading without needing
-	// to acquire DB.mu.
-	readState struct {
-		sync.RWMutex
-		val *readState
-	}
+	// secondary is the state of a secondary instance of the DB (see
+	// OpenSecondary), and is nil otherwise. It is protected by d.mu.
+	secondary *secondaryState
+
+	// defaultCF is the handle for the default column family. Its memtables are
+	// d.mu.mem and its versions are embedded in d.mu.versions.
+	defaultCF *ColumnFamily
 
 	logRecycler logRecycler
 
 	closed int32 // updated atomically
+	// writesStopped is non-zero while writes are stopped by a background error
+	// (see d.mu.bgError). Updated atomically.
+	writesStopped int32
 
 	compactionLimiter limiter
 
@@ -208,6 +223,17 @@ type DB struct {
 
 	flushLimiter limiter
 
+	// The pacing statistics for flushes and compactions. See VersionMetrics.
+	flushPacingStats      pacingStats
+	compactionPacingStats pacingStats
+
+	// deletionLimiter limits the rate at which obsolete sstables are deleted. It
+	// is nil if deletion pacing is disabled (see Options.MinDeletionRate).
+	deletionLimiter limiter
+	// deletionCtx is cancelled by Close in order to stop pacing deletions.
+	deletionCtx    context.Context
+	cancelDeletion context.CancelFunc
+
 	// TODO(peter): describe exactly what this mutex protects. So far: every
 	// field in the struct.
 	mu struct {
@@ -221,6 +247,18 @@ type DB struct {
 			queue   []uint64
 			size    uint64
 			bytesIn uint64
+			// endSeqNums maps the log number of each WAL in queue, other than the
+			// current WAL, to the upper bound (exclusive) on the sequence numbers
+			// of the batches it contains.
+			endSeqNums map[uint64]uint64
+			// availableSeqNum is the smallest sequence number whose batch is
+			// guaranteed to be contained in the WALs in queue. The batches with
+			// smaller sequence numbers were contained in WALs which have been
+			// deleted or recycled.
+			availableSeqNum uint64
+			// ackedSeqNum is the sequence number below which updates have been
+			// acknowledged. See DB.AcknowledgeUpdates.
+			ackedSeqNum uint64
 			// The LogWriter is protected by commitPipeline.mu. This allows log
 			// writes to be performed without holding DB.mu, but requires both
 			// commitPipeline.mu and DB.mu to be held when rotating the WAL/memtable
@@ -230,29 +268,69 @@ type DB struct {
 
 		mem struct {
 			cond sync.Cond
-			// The current mutable memTable.
-			mutable *memTable
-			// Queue of flushables (the mutable memtable is at end). Elements are
-			// added to the end of the slice and removed from the beginning. Once an
-			// index is set it is never modified making a fixed slice immutable and
-			// safe for concurrent reads.
-			queue []flushable
+			// The memtables of the default column family.
+			memTables
 			// True when the memtable is actively been switched. Both mem.mutable and
-			// log.LogWriter are invalid while switching is true.
+			// log.LogWriter are invalid while switching is true. The mutable
+			// memtables of the other column families are switched at the same
+			// time.
 			switching bool
 		}
 
+		// The live column families in increasing order of ID. The default column
+		// family is always first.
+		columnFamilies []*ColumnFamily
+		// The dropped column families. These are retained until the DB is closed
+		// so that their table caches can be closed, and until then their
+		// remaining memtables are discarded by the flush loop.
+		droppedColumnFamilies []*ColumnFamily
+
 		compact struct {
-			cond           sync.Cond
-			flushing       bool
-			compacting     bool
-			pendingOutputs map[uint64]struct{}
-			manual         []*manualCompaction
+			cond            sync.Cond
+			flushing        bool
+			compactingCount int
+			inProgress      map[*compaction]struct{}
+			pendingOutputs  map[uint64]struct{}
+			manual          []*manualCompaction
+		}
+
+		// bgError tracks the errors encountered by flushes and compactions. See
+		// handleBackgroundErrorLocked.
+		bgError struct {
+			// err is the error which stopped writes, flushes and compactions, or
+			// nil if they are not stopped.
+			err *BackgroundError
+			// stopped is closed when writes are stopped, waking up callers
+			// waiting for a flush to complete.
+			stopped chan struct{}
+			// The number of consecutive failures of flushes and compactions,
+			// which determines the backoff before they are retried.
+			flushFailures      int
+			compactionFailures int
 		}
 
 		cleaner struct {
 			cond     sync.Cond
 			cleaning bool
+			// disabled is a count of the number of outstanding requests to disable
+			// the deletion of obsolete files (e.g. by an in-progress checkpoint).
+			// While disabled is non-zero, obsolete files are accumulated but not
+			// deleted.
+			disabled int
+			// pacing is the number of goroutines deleting obsolete sstables at the
+			// rate specified by Options.MinDeletionRate.
+			pacing int
+			// The number and total size of the obsolete sstables queued for paced
+			// deletion.
+			queuedTables int64
+			queuedBytes  uint64
+		}
+
+		// optionsFile serializes the writing of OPTIONS files, which is done
+		// with d.mu released (see writeOptionsFileLocked).
+		optionsFile struct {
+			cond    sync.Cond
+			writing bool
 		}
 
 		// The list of active snapshots.
@@ -269,18 +347,26 @@ var _ Writer = (*DB)(nil)
 // The caller should not modify the contents of the returned slice, but it is
 // safe to modify the contents of the argument after Get returns.
 func (d *DB) Get(key []byte) ([]byte, error) {
-	return d.getInternal(key, nil /* batch */, nil /* snapshot */)
+	return d.getInternal(d.defaultCF, key, nil /* batch */, nil /* snapshot */)
 }
 
-func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, error) {
+// getInternal reads the key from the specified column family. The batch, if
+// non-nil, is read from as well.
+func (d *DB) getInternal(cf *ColumnFamily, key []byte, b *Batch, s *Snapshot) ([]byte, error) {
 	if atomic.LoadInt32(&d.closed) != 0 {
 		panic(ErrClosed)
 	}
+	if cf.db != d {
+		return nil, fmt.Errorf("pebble: column family %q belongs to a different DB", cf.name)
+	}
 
 	// Grab and reference the current readState. This prevents the underlying
 	// files in the associated version from being deleted if there is a current
 	// compaction. The readState is unref'd by Iterator.Close().
-	readState := d.loadReadState()
+	readState := cf.loadReadState()
+	if readState == nil {
+		return nil, ErrColumnFamilyDropped
+	}
 
 	// Determine the seqnum to read at after grabbing the read state (current and
 	// memtables) above.
@@ -297,23 +383,31 @@ func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, error) {
 	}
 
 	get := &buf.get
-	get.cmp = d.cmp
-	get.equal = d.equal
-	get.newIters = d.newIters
+	get.cmp = cf.cmp
+	get.equal = cf.equal
+	get.newIters = cf.newIters
 	get.snapshot = seqNum
 	get.key = key
+	if cf.split != nil {
+		get.prefix = key[:cf.split(key)]
+	} else {
+		get.prefix = key
+	}
 	get.batch = b
+	get.cfID = cf.id
 	get.mem = readState.memtables
 	get.l0 = readState.current.Files[0]
 	get.version = readState.current
 
 	i := &buf.dbi
-	i.cmp = d.cmp
-	i.equal = d.equal
-	i.merge = d.merge
-	i.split = d.split
+	i.cmp = cf.cmp
+	i.equal = cf.equal
+	i.merge = cf.merge
+	i.split = cf.split
+	i.now = d.opts.Clock().UnixNano()
 	i.iter = get
 	i.readState = readState
+	i.blobs = &d.blobFiles
 
 	defer i.Close()
 	if !i.First() {
@@ -323,7 +417,14 @@ func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, error) {
 		}
 		return nil, ErrNotFound
 	}
-	return i.Value(), nil
+	value := i.Value()
+	if i.blobValue.Get() != nil {
+		// The separated value is released when the iterator is closed.
+		value = append([]byte(nil), value...)
+	} else if err := i.Error(); err != nil {
+		return nil, err
+	}
+	return value, nil
 }
 
 // Set sets the value for the given key. It overwrites any previous value
@@ -337,6 +438,22 @@ func (d *DB) Set(key, value []byte, opts *WriteOptions) error {
 	return d.Apply(b, opts)
 }
 
+// SetWithTTL sets the value for the given key until the TTL elapses. Once
+// expired, the key is no longer visible to reads (including reads from
+// snapshots) and it is dropped by subsequent compactions. Expiration is
+// determined using Options.Clock.
+//
+// It is safe to modify the contents of the arguments after SetWithTTL
+// returns.
+func (d *DB) SetWithTTL(key, value []byte, ttl time.Duration, opts *WriteOptions) error {
+	b := newBatch(d)
+	defer b.release()
+	if err := b.SetWithTTL(key, value, ttl, opts); err != nil {
+		return err
+	}
+	return d.Apply(b, opts)
+}
+
 // Delete deletes the value for the given key. Deletes are blind all will
 // succeed even if the given key does not exist.
 //
@@ -404,22 +521,37 @@ func (d *DB) LogData(data []byte, opts *WriteOptions) error {
 //
 // It is safe to modify the contents of the arguments after Apply returns.
 func (d *DB) Apply(batch *Batch, opts *WriteOptions) error {
+	return d.applyInternal(batch, opts, nil /* check */)
+}
+
+// applyInternal applies the batch to the DB. If check is non-nil the batch is
+// only committed if check succeeds. See commitPipeline.CommitIf.
+func (d *DB) applyInternal(batch *Batch, opts *WriteOptions, check func() error) error {
 	if atomic.LoadInt32(&d.closed) != 0 {
 		panic(ErrClosed)
 	}
 	if d.opts.ReadOnly {
 		return ErrReadOnly
 	}
+	if err := d.writesStoppedErr(); err != nil {
+		return err
+	}
 
 	sync := opts.GetSync()
 	if sync && d.opts.DisableWAL {
 		return errors.New("pebble: WAL disabled")
 	}
 
-	if int(batch.memTableSize) >= d.largeBatchThreshold {
+	if batch.hasColumnFamilyRecords() {
+		// Batches containing records for non-default column families are always
+		// applied to the memtables.
+		if err := d.checkColumnFamilyBatch(batch); err != nil {
+			return err
+		}
+	} else if int(batch.memTableSize) >= d.largeBatchThreshold {
 		batch.flushable = newFlushableBatch(batch, d.opts.Comparer)
 	}
-	err := d.commit.Commit(batch, sync)
+	err := d.commit.CommitIf(batch, sync, check)
 	if err == nil {
 		// If this is a large batch, we need to clear the batch contents as the
 		// flushable batch may still be present in the flushables queue.
@@ -435,6 +567,26 @@ func (d *DB) Apply(batch *Batch, opts *WriteOptions) error {
 	return err
 }
 
+// checkColumnFamilyBatch verifies that the column families referenced by the
+// batch exist and that the batch fits in each column family's memtable.
+func (d *DB) checkColumnFamilyBatch(b *Batch) error {
+	if int(b.memTableSize) >= d.largeBatchThreshold {
+		return fmt.Errorf("pebble: batch too large for column family %q", DefaultColumnFamilyName)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range b.cfMemTableSizes {
+		cf := d.getColumnFamilyLocked(s.cfID)
+		if cf == nil {
+			return ErrColumnFamilyDropped
+		}
+		if int(s.size) >= cf.largeBatchThreshold {
+			return fmt.Errorf("pebble: batch too large for column family %q", cf.name)
+		}
+	}
+	return nil
+}
+
 func (d *DB) commitApply(b *Batch, mem *memTable) error {
 	if b.flushable != nil {
 		// This is a large batch which was already added to the immutable queue.
@@ -444,7 +596,18 @@ func (d *DB) commitApply(b *Batch, mem *memTable) error {
 	if err != nil {
 		return err
 	}
-	if mem.unref() {
+	for _, m := range b.cfMemTables {
+		if err := m.apply(b, b.SeqNum()); err != nil {
+			return err
+		}
+	}
+	flush := mem.unref()
+	for _, m := range b.cfMemTables {
+		if m.unref() {
+			flush = true
+		}
+	}
+	if flush {
 		d.mu.Lock()
 		d.maybeScheduleFlush()
 		d.mu.Unlock()
@@ -485,7 +648,9 @@ func (d *DB) commitWrite(b *Batch, syncWG *sync.WaitGroup, syncErr *error) (*mem
 	// Grab a reference to the memtable while holding DB.mu. Note that for
 	// non-flushable batches (b.flushable == nil) makeRoomForWrite() added a
 	// reference to the memtable which will prevent it from being flushed until
-	// we unreference it. This reference is dropped in DB.commitApply().
+	// we unreference it. This reference is dropped in DB.commitApply(). The
+	// same is true of the memtables for other column families referenced by
+	// the batch, which makeRoomForWrite() stored in b.cfMemTables.
 	mem := d.mu.mem.mutable
 
 	d.mu.Unlock()
@@ -521,9 +686,10 @@ var iterAllocPool = sync.Pool{
 	},
 }
 
-// newIterInternal constructs a new iterator, merging in batchIter as an extra
-// level.
+// newIterInternal constructs a new iterator over the specified column family,
+// merging in batchIter as an extra level.
 func (d *DB) newIterInternal(
+	cf *ColumnFamily,
 	batchIter internalIterator,
 	batchRangeDelIter internalIterator,
 	s *Snapshot,
@@ -532,11 +698,22 @@ func (d *DB) newIterInternal(
 	if atomic.LoadInt32(&d.closed) != 0 {
 		panic(ErrClosed)
 	}
+	if cf.db != d {
+		err := fmt.Errorf("pebble: column family %q belongs to a different DB", cf.name)
+		return &Iterator{err: err, iter: newErrorIter(err)}
+	}
+	if o != nil && o.PrefixSameAsStart && cf.split == nil {
+		err := errors.New("pebble: PrefixSameAsStart requires a Comparer.Split function")
+		return &Iterator{err: err, iter: newErrorIter(err)}
+	}
 
 	// Grab and reference the current readState. This prevents the underlying
 	// files in the associated version from being deleted if there is a current
 	// compaction. The readState is unref'd by Iterator.Close().
-	readState := d.loadReadState()
+	readState := cf.loadReadState()
+	if readState == nil {
+		return &Iterator{err: ErrColumnFamilyDropped, iter: newErrorIter(ErrColumnFamilyDropped)}
+	}
 
 	// Determine the seqnum to read at after grabbing the read state (current and
 	// memtables) above.
@@ -552,11 +729,13 @@ func (d *DB) newIterInternal(
 	buf := iterAllocPool.Get().(*iterAlloc)
 	dbi := &buf.dbi
 	dbi.alloc = buf
-	dbi.cmp = d.cmp
-	dbi.equal = d.equal
-	dbi.merge = d.merge
-	dbi.split = d.split
+	dbi.cmp = cf.cmp
+	dbi.equal = cf.equal
+	dbi.merge = cf.merge
+	dbi.split = cf.split
+	dbi.now = d.opts.Clock().UnixNano()
 	dbi.readState = readState
+	dbi.blobs = &d.blobFiles
 	if o != nil {
 		dbi.opts = *o
 	}
@@ -585,7 +764,7 @@ func (d *DB) newIterInternal(
 	current := readState.current
 	for i := len(current.Files[0]) - 1; i >= 0; i-- {
 		f := &current.Files[0][i]
-		iter, rangeDelIter, err := d.newIters(f, &dbi.opts, nil)
+		iter, rangeDelIter, err := cf.newIters(f, &dbi.opts, nil)
 		if err != nil {
 			dbi.err = err
 			return dbi
@@ -624,14 +803,14 @@ func (d *DB) newIterInternal(
 			li = &levelIter{}
 		}
 
-		li.init(&dbi.opts, d.cmp, d.newIters, current.Files[level], nil)
+		li.init(&dbi.opts, cf.cmp, cf.newIters, current.Files[level], nil)
 		li.initRangeDel(&mlevels[0].rangeDelIter)
 		li.initLargestUserKey(&mlevels[0].largestUserKey)
 		mlevels[0].iter = li
 		mlevels = mlevels[1:]
 	}
 
-	buf.merging.init(d.cmp, finalMLevels...)
+	buf.merging.init(cf.cmp, finalMLevels...)
 	buf.merging.snapshot = seqNum
 	dbi.iter = &buf.merging
 	return dbi
@@ -661,7 +840,7 @@ func (d *DB) NewIndexedBatch() *Batch {
 // apparent memory and disk usage leak. Use snapshots (see NewSnapshot) for
 // point-in-time snapshots which avoids these problems.
 func (d *DB) NewIter(o *IterOptions) *Iterator {
-	return d.newIterInternal(nil, /* batchIter */
+	return d.newIterInternal(d.defaultCF, nil, /* batchIter */
 		nil /* batchRangeDelIter */, nil /* snapshot */, o)
 }
 
@@ -700,16 +879,35 @@ func (d *DB) Close() error {
 		panic(ErrClosed)
 	}
 	atomic.StoreInt32(&d.closed, 1)
-	for d.mu.compact.compacting || d.mu.compact.flushing {
+	// Wake up any flushes or compactions backing off after an error.
+	d.mu.compact.cond.Broadcast()
+	for d.mu.compact.compactingCount > 0 || d.mu.compact.flushing {
 		d.mu.compact.cond.Wait()
 	}
-	err := d.tableCache.Close()
+	// Wait for the paced deletion of obsolete sstables to finish. Pacing is
+	// disabled once the DB is closed, so this does not take long.
+	if d.cancelDeletion != nil {
+		d.cancelDeletion()
+	}
+	for d.mu.cleaner.pacing > 0 {
+		d.mu.cleaner.cond.Wait()
+	}
+	var err error
+	for _, cf := range d.mu.columnFamilies {
+		err = firstError(err, cf.tableCache.Close())
+	}
+	for _, cf := range d.mu.droppedColumnFamilies {
+		err = firstError(err, cf.tableCache.Close())
+	}
+	err = firstError(err, d.blobFiles.close())
 	if !d.opts.ReadOnly {
 		err = firstError(err, d.mu.log.Close())
 	} else if d.mu.log.LogWriter != nil {
 		panic("pebble: log-writer should be nil in read-only mode")
 	}
-	err = firstError(err, d.fileLock.Close())
+	if d.fileLock != nil {
+		err = firstError(err, d.fileLock.Close())
+	}
 	d.commit.Close()
 
 	err = firstError(err, d.dataDir.Close())
@@ -718,19 +916,21 @@ func (d *DB) Close() error {
 	}
 
 	if err == nil {
-		d.readState.val.unrefLocked()
-
-		current := d.mu.versions.currentVersion()
-		for v := d.mu.versions.versions.Front(); true; v = v.Next() {
-			refs := v.Refs()
-			if v == current {
-				if refs != 1 {
-					return fmt.Errorf("leaked iterators: current\n%s", v)
+		for _, cf := range d.mu.columnFamilies {
+			cf.readState.val.unrefLocked()
+
+			current := cf.versions.currentVersion()
+			for v := cf.versions.versions.Front(); true; v = v.Next() {
+				refs := v.Refs()
+				if v == current {
+					if refs != 1 {
+						return fmt.Errorf("leaked iterators: current\n%s", v)
+					}
+					break
+				}
+				if refs != 0 {
+					return fmt.Errorf("leaked iterators:\n%s", v)
 				}
-				break
-			}
-			if refs != 0 {
-				return fmt.Errorf("leaked iterators:\n%s", v)
 			}
 		}
 	}
@@ -739,22 +939,34 @@ func (d *DB) Close() error {
 
 // Compact the specified range of keys in the database.
 func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
+	return d.compactRange(d.defaultCF, start, end)
+}
+
+// compactRange compacts the specified range of keys in the column family.
+func (d *DB) compactRange(cf *ColumnFamily, start, end []byte) error {
 	if atomic.LoadInt32(&d.closed) != 0 {
 		panic(ErrClosed)
 	}
 	if d.opts.ReadOnly {
 		return ErrReadOnly
 	}
+	if err := d.writesStoppedErr(); err != nil {
+		return err
+	}
 
 	iStart := base.MakeInternalKey(start, InternalKeySeqNumMax, InternalKeyKindMax)
 	iEnd := base.MakeInternalKey(end, 0, 0)
 	meta := []*fileMetadata{&fileMetadata{Smallest: iStart, Largest: iEnd}}
 
 	d.mu.Lock()
+	if cf.isDropped() {
+		d.mu.Unlock()
+		return ErrColumnFamilyDropped
+	}
 	maxLevelWithFiles := 1
-	cur := d.mu.versions.currentVersion()
+	cur := cf.versions.currentVersion()
 	for level := 0; level < numLevels; level++ {
-		if len(cur.Overlaps(level, d.cmp, start, end)) > 0 {
+		if len(cur.Overlaps(level, cf.cmp, start, end)) > 0 {
 			maxLevelWithFiles = level + 1
 		}
 	}
@@ -762,8 +974,8 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 	// Determine if any memtable overlaps with the compaction range. We wait for
 	// any such overlap to flush (initiating a flush if necessary).
 	mem, err := func() (flushable, error) {
-		if ingestMemtableOverlaps(d.cmp, d.mu.mem.mutable, meta) {
-			mem := d.mu.mem.mutable
+		if ingestMemtableOverlaps(cf.cmp, cf.mem.mutable, meta) {
+			mem := cf.mem.mutable
 
 			// We have to hold both commitPipeline.mu and DB.mu when calling
 			// makeRoomForWrite(). Lock order requirements elsewhere force us to
@@ -772,7 +984,7 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 			d.commit.mu.Lock()
 			d.mu.Lock()
 			defer d.commit.mu.Unlock()
-			if mem == d.mu.mem.mutable {
+			if mem == cf.mem.mutable {
 				// Only flush if the active memtable is unchanged.
 				return mem, d.makeRoomForWrite(nil)
 			}
@@ -781,9 +993,9 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 		// Check to see if any files overlap with any of the immutable
 		// memtables. The queue is ordered from oldest to newest. We want to wait
 		// for the newest table that overlaps.
-		for i := len(d.mu.mem.queue) - 1; i >= 0; i-- {
-			mem := d.mu.mem.queue[i]
-			if ingestMemtableOverlaps(d.cmp, mem, meta) {
+		for i := len(cf.mem.queue) - 1; i >= 0; i-- {
+			mem := cf.mem.queue[i]
+			if ingestMemtableOverlaps(cf.cmp, mem, meta) {
 				return mem, nil
 			}
 		}
@@ -796,11 +1008,14 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 		return err
 	}
 	if mem != nil {
-		<-mem.flushed()
+		if err := d.waitFlushed(mem.flushed()); err != nil {
+			return err
+		}
 	}
 
 	for level := 0; level < maxLevelWithFiles; {
 		manual := &manualCompaction{
+			cfID:  cf.id,
 			done:  make(chan error, 1),
 			level: level,
 			start: iStart,
@@ -827,14 +1042,320 @@ func (d *DB) manualCompact(manual *manualCompaction) error {
 	return <-manual.done
 }
 
-// Flush the memtable to stable storage.
+// DeleteFilesInRange deletes the sstables whose keys all lie within the range
+// [start,end), from every level, with a single version edit. The disk space
+// used by the sstables is reclaimed immediately, without reading or rewriting
+// any data.
+//
+// DeleteFilesInRange is not a substitute for DeleteRange: the keys in the
+// memtables and in the sstables which only partially overlap the range are
+// not deleted, sstables which are being compacted are skipped, and snapshots
+// are not respected. Deleting an sstable can also expose older versions of
+// its keys in lower levels whose sstables extend beyond the range. In order to
+// delete all of the keys in the range, DeleteRange should be called first and
+// DeleteFilesInRange used to reclaim the space used by the deleted keys.
+func (d *DB) DeleteFilesInRange(start, end []byte) error {
+	return d.deleteFilesInRange(d.defaultCF, start, end)
+}
+
+// deleteFilesInRange deletes the sstables of the column family whose keys all
+// lie within the range [start,end).
+func (d *DB) deleteFilesInRange(cf *ColumnFamily, start, end []byte) error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := d.writesStoppedErr(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if cf.isDropped() {
+		return ErrColumnFamilyDropped
+	}
+
+	compacting := make(map[uint64]struct{})
+	for _, c := range d.getInProgressCompactions(cf.id) {
+		for i := range c.inputs {
+			for j := range c.inputs[i] {
+				compacting[c.inputs[i][j].FileNum] = struct{}{}
+			}
+		}
+	}
+
+	ve := &versionEdit{
+		ColumnFamily: cf.id,
+		DeletedFiles: map[deletedFileEntry]bool{},
+	}
+	cur := cf.versions.currentVersion()
+	for level := range cur.Files {
+		for i := range cur.Files[level] {
+			f := &cur.Files[level][i]
+			if _, ok := compacting[f.FileNum]; ok {
+				continue
+			}
+			if cf.cmp(f.Smallest.UserKey, start) < 0 {
+				continue
+			}
+			// A largest key which is the range deletion sentinel for end does not
+			// actually exist in the sstable.
+			if v := cf.cmp(f.Largest.UserKey, end); v > 0 ||
+				(v == 0 && f.Largest.Trailer != InternalKeyRangeDeleteSentinel) {
+				continue
+			}
+			ve.DeletedFiles[deletedFileEntry{Level: level, FileNum: f.FileNum}] = true
+		}
+	}
+	if len(ve.DeletedFiles) == 0 {
+		return nil
+	}
+
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	err := d.mu.versions.logAndApply(jobID, ve, nil, d.dataDir)
+	d.maybeStopWritesLocked(err)
+	if err != nil {
+		return err
+	}
+	// Update the read state before deleting obsolete files so that the
+	// previous version is unref'd.
+	cf.updateReadStateLocked()
+	d.deleteObsoleteFiles(jobID)
+	d.maybeScheduleCompaction()
+	return nil
+}
+
+// EstimateDiskUsage returns the estimated number of bytes used to store the
+// keys in the range [start, end). The sstables wholly within the range
+// contribute their size, while the contribution of the sstables partially
+// overlapping the range is estimated from their index blocks. The values
+// stored in blob files are attributed to the sstables referencing them. The
+// estimate also includes an approximation of the memory used by the keys in
+// the memtables, which are yet to be flushed.
+func (d *DB) EstimateDiskUsage(start, end []byte) (uint64, error) {
+	return d.estimateDiskUsage(d.defaultCF, start, end)
+}
+
+// estimateDiskUsage returns the estimated number of bytes used to store the
+// keys of the column family in the range [start, end).
+func (d *DB) estimateDiskUsage(cf *ColumnFamily, start, end []byte) (uint64, error) {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	readState := cf.loadReadState()
+	if readState == nil {
+		return 0, ErrColumnFamilyDropped
+	}
+	defer readState.unref()
+
+	var size uint64
+	err := forEachOverlappingFile(cf.cmp, readState.current, start, end, func(f *fileMetadata) error {
+		if cf.cmp(start, f.Smallest.UserKey) <= 0 && cf.cmp(f.Largest.UserKey, end) < 0 {
+			size += blobAdjustedSize(f, f.Size)
+			return nil
+		}
+		return cf.tableCache.withReader(f, func(r *sstable.Reader) error {
+			n, err := r.EstimateDiskUsage(start, end)
+			size += blobAdjustedSize(f, n)
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// The contribution of the memtables is approximated without iterating over
+	// their entries. The sstables ingested as flushables contribute their
+	// sizes.
+	for _, mem := range readState.memtables {
+		switch m := mem.(type) {
+		case *memTable:
+			size += m.approximateBytes(start, end)
+		case *ingestedFlushable:
+			for i := range m.files {
+				f := &m.files[i]
+				if cf.cmp(f.Largest.UserKey, start) >= 0 && cf.cmp(f.Smallest.UserKey, end) < 0 {
+					size += f.Size
+				}
+			}
+		}
+	}
+	return size, nil
+}
+
+// ApproximateMidKey returns a key which divides the range [start, end) into
+// two ranges containing a roughly equal number of bytes, as estimated from
+// the index blocks of the sstables overlapping the range. The returned key is
+// not necessarily present in the DB. ApproximateMidKey returns nil if the
+// sstables do not contain enough data within the range to be divided. Note
+// that the keys in the memtables are not considered.
+func (d *DB) ApproximateMidKey(start, end []byte) ([]byte, error) {
+	return d.approximateMidKey(d.defaultCF, start, end)
+}
+
+// approximateMidKey returns a key which divides the keys of the column family
+// in the range [start, end) in half by size.
+func (d *DB) approximateMidKey(cf *ColumnFamily, start, end []byte) ([]byte, error) {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	readState := cf.loadReadState()
+	if readState == nil {
+		return nil, ErrColumnFamilyDropped
+	}
+	defer readState.unref()
+
+	// Each entry is the size of the keys in the range up to its key. An
+	// sstable wholly within the range is represented by a single entry, which
+	// is expanded into entries for its data blocks if the midpoint falls within
+	// the sstable. A partially overlapping sstable is represented by entries for
+	// its data blocks which overlap the range.
+	type entry struct {
+		key  []byte
+		size uint64
+		file *fileMetadata
+	}
+	var entries []entry
+	addBlocks := func(f *fileMetadata) error {
+		return cf.tableCache.withReader(f, func(r *sstable.Reader) error {
+			return r.DataBlockSizes(start, end, func(separator []byte, size uint64) {
+				entries = append(entries, entry{
+					key:  append([]byte(nil), separator...),
+					size: blobAdjustedSize(f, size),
+				})
+			})
+		})
+	}
+	err := forEachOverlappingFile(cf.cmp, readState.current, start, end, func(f *fileMetadata) error {
+		if cf.cmp(start, f.Smallest.UserKey) <= 0 && cf.cmp(f.Largest.UserKey, end) < 0 {
+			entries = append(entries, entry{
+				key:  f.Largest.UserKey,
+				size: blobAdjustedSize(f, f.Size),
+				file: f,
+			})
+			return nil
+		}
+		return addBlocks(f)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		sort.Slice(entries, func(i, j int) bool {
+			return cf.cmp(entries[i].key, entries[j].key) < 0
+		})
+		var total uint64
+		for i := range entries {
+			total += entries[i].size
+		}
+		var cumulative uint64
+		mid := -1
+		for i := range entries {
+			cumulative += entries[i].size
+			if 2*cumulative >= total {
+				mid = i
+				break
+			}
+		}
+		if mid < 0 {
+			return nil, nil
+		}
+		if f := entries[mid].file; f != nil {
+			// The midpoint falls within an sstable wholly within the range.
+			entries = append(entries[:mid], entries[mid+1:]...)
+			if err := addBlocks(f); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// The separator of the last data block overlapping the range may lie
+		// beyond the range, in which case the closest preceding key is used.
+		inRange := func(key []byte) bool {
+			return cf.cmp(start, key) < 0 && cf.cmp(key, end) < 0
+		}
+		for i := mid; i >= 0; i-- {
+			if inRange(entries[i].key) {
+				return entries[i].key, nil
+			}
+		}
+		for i := mid + 1; i < len(entries); i++ {
+			if inRange(entries[i].key) {
+				return entries[i].key, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+// forEachOverlappingFile calls fn for each of the sstables in the version
+// which overlap the range [start, end).
+func forEachOverlappingFile(
+	cmp Compare, v *version, start, end []byte, fn func(f *fileMetadata) error,
+) error {
+	for level := range v.Files {
+		files := v.Files[level]
+		if level > 0 {
+			files = v.Overlaps(level, cmp, start, end)
+		}
+		for i := range files {
+			f := &files[i]
+			if cmp(f.Largest.UserKey, start) < 0 || cmp(f.Smallest.UserKey, end) >= 0 {
+				continue
+			}
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// blobAdjustedSize returns the specified portion of the size of an sstable,
+// adjusted to include the same portion of the values the sstable references
+// in blob files.
+func blobAdjustedSize(f *fileMetadata, size uint64) uint64 {
+	if len(f.BlobRefs) == 0 || f.Size == 0 {
+		return size
+	}
+	var blobBytes uint64
+	for _, ref := range f.BlobRefs {
+		blobBytes += ref.Bytes
+	}
+	return size + uint64(float64(blobBytes)*float64(size)/float64(f.Size))
+}
+
+// Flush the memtable to stable storage. Flush returns an error if writes are
+// stopped by a background error before the flush completes.
 func (d *DB) Flush() error {
 	flushDone, err := d.AsyncFlush()
 	if err != nil {
 		return err
 	}
-	<-flushDone
-	return nil
+	return d.waitFlushed(flushDone)
+}
+
+// waitFlushed waits for a memtable to be flushed, returning an error if writes
+// are stopped by a background error first.
+func (d *DB) waitFlushed(flushDone <-chan struct{}) error {
+	d.mu.Lock()
+	stopped := d.mu.bgError.stopped
+	d.mu.Unlock()
+	select {
+	case <-flushDone:
+		return nil
+	case <-stopped:
+		select {
+		case <-flushDone:
+			return nil
+		default:
+			return d.writesStoppedErr()
+		}
+	}
 }
 
 // AsyncFlush asynchronously flushes the memtable to stable storage.
@@ -848,6 +1369,9 @@ func (d *DB) AsyncFlush() (<-chan struct{}, error) {
 	if d.opts.ReadOnly {
 		return nil, ErrReadOnly
 	}
+	if err := d.writesStoppedErr(); err != nil {
+		return nil, err
+	}
 
 	d.commit.mu.Lock()
 	d.mu.Lock()
@@ -875,6 +1399,10 @@ func (d *DB) Metrics() *VersionMetrics {
 		metrics.WAL.Size += size
 	}
 	metrics.WAL.BytesWritten = metrics.Levels[0].BytesIn + metrics.WAL.Size
+	metrics.Pacing.Flush = d.flushPacingStats.metrics(d.flushLimiter, d.opts.Pacer)
+	metrics.Pacing.Compaction = d.compactionPacingStats.metrics(d.compactionLimiter, d.opts.Pacer)
+	metrics.Table.ObsoleteCount = d.mu.cleaner.queuedTables
+	metrics.Table.ObsoleteSize = d.mu.cleaner.queuedBytes
 	metrics.Levels[0].Score = float64(metrics.Levels[0].NumFiles) / float64(d.opts.L0CompactionThreshold)
 	if p := d.mu.versions.picker; p != nil {
 		for level := 1; level < numLevels; level++ {
@@ -885,6 +1413,60 @@ func (d *DB) Metrics() *VersionMetrics {
 	return metrics
 }
 
+// SetMinCompactionRate changes the rate, in bytes per second, to which
+// compactions are limited when they are paced (see Options.MinCompactionRate).
+// The new rate takes effect immediately, including for in-progress
+// compactions. It has no effect if a custom Options.Pacer is in use. The new
+// rate is recorded in the OPTIONS file.
+func (d *DB) SetMinCompactionRate(bytesPerSec int) error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if bytesPerSec <= 0 {
+		return fmt.Errorf("pebble: invalid compaction rate %d", bytesPerSec)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.compactionLimiter.SetLimit(rate.Limit(bytesPerSec))
+	return d.updateOptionsFileLocked()
+}
+
+// SetMinFlushRate changes the rate, in bytes per second, to which flushes are
+// limited when they are paced (see Options.MinFlushRate). The new rate takes
+// effect immediately, including for an in-progress flush. It has no effect if
+// a custom Options.Pacer is in use. The new rate is recorded in the OPTIONS
+// file.
+func (d *DB) SetMinFlushRate(bytesPerSec int) error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if bytesPerSec <= 0 {
+		return fmt.Errorf("pebble: invalid flush rate %d", bytesPerSec)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.flushLimiter.SetLimit(rate.Limit(bytesPerSec))
+	return d.updateOptionsFileLocked()
+}
+
+// updateOptionsFileLocked records a change to the options in a new OPTIONS
+// file and deletes the previous OPTIONS file.
+//
+// d.mu must be held when calling this, but the mutex may be dropped and
+// re-acquired during the course of this method.
+func (d *DB) updateOptionsFileLocked() error {
+	if d.opts.ReadOnly {
+		return nil
+	}
+	if err := d.writeOptionsFileLocked(); err != nil {
+		return err
+	}
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	d.deleteObsoleteFiles(jobID)
+	return nil
+}
+
 func (d *DB) walPreallocateSize() int {
 	// Set the WAL preallocate size to 110% of the memtable size. Note that there
 	// is a bit of apples and oranges in units here as the memtabls size
@@ -909,6 +1491,21 @@ func (d *DB) walPreallocateSize() int {
 // Both DB.mu and commitPipeline.mu must be held by the caller. Note that DB.mu
 // may be released and reacquired.
 func (d *DB) makeRoomForWrite(b *Batch) error {
+	return d.makeRoom(b, nil /* ingested */)
+}
+
+// makeRoomForIngest rotates the memtable, adding the ingested sstables to the
+// queue of memtables above the rotated memtable. The record of the ingestion
+// must already have been written to the current WAL.
+//
+// Both DB.mu and commitPipeline.mu must be held by the caller. Note that DB.mu
+// may be released and reacquired.
+func (d *DB) makeRoomForIngest(ingested *ingestedFlushable) error {
+	return d.makeRoom(nil /* batch */, ingested)
+}
+
+// makeRoom implements makeRoomForWrite and makeRoomForIngest.
+func (d *DB) makeRoom(b *Batch, ingested *ingestedFlushable) error {
 	force := b == nil || b.flushable != nil
 	stalled := false
 	for {
@@ -917,7 +1514,7 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 			continue
 		}
 		if b != nil && b.flushable == nil {
-			err := d.mu.mem.mutable.prepare(b)
+			err := d.prepareMemTables(b)
 			if err != arenaskl.ErrArenaFull {
 				if stalled {
 					stalled = false
@@ -933,27 +1530,21 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 			return nil
 		}
 		// force || err == ErrArenaFull, so we need to rotate the current memtable.
-		if len(d.mu.mem.queue) >= d.opts.MemTableStopWritesThreshold {
+		if reason := d.writeStallReasonLocked(); reason != "" {
 			// We have filled up the current memtable, but the previous one is still
-			// being compacted, so we wait.
+			// being compacted, there are too many level-0 files, or the disk is
+			// running out of space, so we wait.
 			if !stalled {
 				stalled = true
 				d.opts.EventListener.WriteStallBegin(WriteStallBeginInfo{
-					Reason: "memtable count limit reached",
+					Reason: reason,
 				})
 			}
-			d.mu.compact.cond.Wait()
-			continue
-		}
-		if len(d.mu.versions.currentVersion().Files[0]) > d.opts.L0StopWritesThreshold {
-			// There are too many level-0 files, so we wait.
-			if !stalled {
-				stalled = true
-				d.opts.EventListener.WriteStallBegin(WriteStallBeginInfo{
-					Reason: "L0 file count limit exceeded",
-				})
+			if reason == writeStallReasonDiskSpace {
+				d.waitLocked(diskSpacePollInterval)
+			} else {
+				d.mu.compact.cond.Wait()
 			}
-			d.mu.compact.cond.Wait()
 			continue
 		}
 
@@ -1035,6 +1626,16 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		}
 
 		if !d.opts.DisableWAL {
+			// The previous WAL contains the batches with sequence numbers below
+			// those of the current batch, except for a large batch which was
+			// written to the previous WAL (see DB.commitWrite).
+			endSeqNum := atomic.LoadUint64(&d.mu.versions.logSeqNum)
+			if b != nil && b.flushable == nil {
+				endSeqNum = b.SeqNum()
+			}
+			if n := len(d.mu.log.queue); n > 0 {
+				d.mu.log.endSeqNums[d.mu.log.queue[n-1]] = endSeqNum
+			}
 			d.mu.log.queue = append(d.mu.log.queue, newLogNum)
 			d.mu.log.LogWriter = record.NewLogWriter(newLogFile, newLogNum)
 		}
@@ -1056,6 +1657,11 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 			// imm.logNum.
 			b.flushable.logNum, imm.logNum = imm.logNum, 0
 			d.mu.mem.queue = append(d.mu.mem.queue, b.flushable)
+		} else if ingested != nil {
+			// Like a large batch, the ingestion was recorded in the WAL of the
+			// immutable memtable, and logically occurs after it in seqnum space.
+			ingested.logNum, imm.logNum = imm.logNum, 0
+			d.mu.mem.queue = append(d.mu.mem.queue, ingested)
 		}
 
 		// Create a new memtable, scheduling the previous one for flushing. We do
@@ -1065,22 +1671,119 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		// also have to wait for all previous immutable tables to
 		// flush. Additionally, the memtable is tied to particular WAL file and we
 		// want to go through the flush path in order to recycle that WAL file.
-		d.mu.mem.mutable = newMemTable(d.opts)
+		//
 		// NB: newLogNum corresponds to the WAL that contains mutations that are
 		// present in the new memtable. When immutable memtables are flushed to
 		// disk, a VersionEdit will be created telling the manifest the minimum
 		// unflushed log number (which will be the next one in d.mu.mem.mutable
 		// that was not flushed).
-		d.mu.mem.mutable.logNum = newLogNum
+		d.mu.mem.mutable = d.defaultCF.newMemTable(newLogNum)
 		d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
+		flush := imm.unref()
+
+		// The memtables of the other column families are rotated at the same
+		// time so that every memtable is associated with a single WAL.
+		for _, cf := range d.mu.columnFamilies[1:] {
+			imm := cf.mem.mutable
+			cf.mem.mutable = cf.newMemTable(newLogNum)
+			cf.mem.queue = append(cf.mem.queue, cf.mem.mutable)
+			if imm.unref() {
+				flush = true
+			}
+		}
 		d.updateReadStateLocked()
-		if imm.unref() {
+		if flush {
 			d.maybeScheduleFlush()
 		}
 		force = false
 	}
 }
 
+// prepareMemTables prepares the mutable memtables of the column families
+// referenced by the batch for the application of the batch, storing the
+// non-default memtables in b.cfMemTables. On error, none of the memtables
+// remain prepared. Requires DB.mu is held.
+func (d *DB) prepareMemTables(b *Batch) error {
+	if err := d.mu.mem.mutable.prepare(b); err != nil {
+		return err
+	}
+	b.cfMemTables = b.cfMemTables[:0]
+	for _, s := range b.cfMemTableSizes {
+		cf := d.getColumnFamilyLocked(s.cfID)
+		if cf == nil {
+			// The column family was dropped after the batch was checked. The
+			// records for the column family are skipped when the batch is
+			// applied.
+			continue
+		}
+		if err := cf.mem.mutable.prepare(b); err != nil {
+			d.mu.mem.mutable.unref()
+			for _, m := range b.cfMemTables {
+				m.unref()
+			}
+			b.cfMemTables = b.cfMemTables[:0]
+			return err
+		}
+		b.cfMemTables = append(b.cfMemTables, cf.mem.mutable)
+	}
+	return nil
+}
+
+// writeStallReasonLocked returns the reason writes must be stalled before the
+// memtables can be rotated, or an empty string if there is no need to
+// stall. Requires DB.mu is held.
+func (d *DB) writeStallReasonLocked() string {
+	for _, cf := range d.mu.columnFamilies {
+		if len(cf.mem.queue) >= cf.opts.MemTableStopWritesThreshold {
+			return "memtable count limit reached"
+		}
+	}
+	for _, cf := range d.mu.columnFamilies {
+		if len(cf.versions.currentVersion().Files[0]) > cf.opts.L0StopWritesThreshold {
+			return "L0 file count limit exceeded"
+		}
+	}
+	if t := d.opts.FreeDiskSpaceStopWritesThreshold; t > 0 {
+		if avail, ok := d.availableDiskSpace(); ok && avail < uint64(t) {
+			return writeStallReasonDiskSpace
+		}
+	}
+	return ""
+}
+
+// writeStallReasonDiskSpace is the reason for a write stall due to the free
+// disk space falling below Options.FreeDiskSpaceStopWritesThreshold. Such a
+// stall ends when space is freed by a process other than the DB, which is not
+// signalled, so the free space is polled every diskSpacePollInterval.
+const writeStallReasonDiskSpace = "free disk space limit reached"
+
+// diskSpacePollInterval is a var so that it can be lowered by tests.
+var diskSpacePollInterval = time.Second
+
+// availableDiskSpace returns the free disk space available in the DB's
+// directory. It returns false if the disk usage cannot be determined, such as
+// on platforms where it is not implemented.
+func (d *DB) availableDiskSpace() (uint64, bool) {
+	usage, err := d.opts.FS.GetDiskUsage(d.dirname)
+	if err != nil {
+		return 0, false
+	}
+	return usage.AvailBytes, true
+}
+
+// waitLocked waits on d.mu.compact.cond for at most the specified duration.
+//
+// d.mu must be held when calling this, but it is released while waiting.
+func (d *DB) waitLocked(timeout time.Duration) {
+	t := time.AfterFunc(timeout, func() {
+		d.mu.Lock()
+		d.mu.compact.cond.Broadcast()
+		d.mu.Unlock()
+	})
+	d.mu.compact.cond.Wait()
+	t.Stop()
+}
+
 // firstError returns the first non-nil error of err0 and err1, or nil if both
 // are nil.
 func firstError(err0, err1 error) error {
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -15,8 +16,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/pebble/bloom"
 	"github.com/cockroachdb/pebble/cache"
 	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/record"
+	"github.com/cockroachdb/pebble/sstable"
 	"github.com/cockroachdb/pebble/vfs"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/rand"
@@ -468,6 +472,111 @@ func TestGetMerge(t *testing.T) {
 	}
 }
 
+type countingFilterPolicy struct {
+	FilterPolicy
+	negatives int
+}
+
+func (c *countingFilterPolicy) MayContain(ftype FilterType, filter, key []byte) bool {
+	if !c.FilterPolicy.MayContain(ftype, filter, key) {
+		c.negatives++
+		return false
+	}
+	return true
+}
+
+func TestPrefixBloomFilter(t *testing.T) {
+	comparer := *DefaultComparer
+	comparer.Name = "prefix-comparer"
+	comparer.Split = func(k []byte) int {
+		if i := bytes.IndexByte(k, '@'); i >= 0 {
+			return i
+		}
+		return len(k)
+	}
+
+	for _, ftype := range []FilterType{TableFilter, BlockFilter} {
+		t.Run(ftype.String(), func(t *testing.T) {
+			fp := &countingFilterPolicy{FilterPolicy: bloom.FilterPolicy(10)}
+			d, err := Open("", &Options{
+				Comparer: &comparer,
+				FS:       vfs.NewMem(),
+				Levels: []LevelOptions{{
+					FilterPolicy: fp,
+					FilterType:   ftype,
+				}},
+				// Prevent the L0 tables from being compacted.
+				L0CompactionThreshold: 100,
+				L0StopWritesThreshold: 100,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Create an sstable for each of the prefixes a-e.
+			for _, prefix := range []string{"a", "b", "c", "d", "e"} {
+				for _, suffix := range []string{"@1", "@2", "@3"} {
+					if err := d.Set([]byte(prefix+suffix), []byte(prefix), nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := d.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// A Get of a key in the oldest sstable should be rejected by the filters
+			// of the newer sstables.
+			fp.negatives = 0
+			if v, err := d.Get([]byte("a@2")); err != nil {
+				t.Fatal(err)
+			} else if string(v) != "a" {
+				t.Fatalf("expected a, but found %s", v)
+			}
+			if fp.negatives != 4 {
+				t.Fatalf("expected 4 filter negatives, but found %d", fp.negatives)
+			}
+
+			// Same for a prefix iteration.
+			fp.negatives = 0
+			iter := d.NewIter(&IterOptions{PrefixSameAsStart: true})
+			var keys []string
+			for valid := iter.SeekGE([]byte("a@1")); valid; valid = iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			require.EqualValues(t, []string{"a@1", "a@2", "a@3"}, keys)
+			if fp.negatives != 4 {
+				t.Fatalf("expected 4 filter negatives, but found %d", fp.negatives)
+			}
+
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPrefixSameAsStartWithoutSplit(t *testing.T) {
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	iter := d.NewIter(&IterOptions{PrefixSameAsStart: true})
+	if iter.SeekGE([]byte("a")) {
+		t.Fatalf("expected invalid iterator, but found %q", iter.Key())
+	}
+	if err := iter.Close(); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+}
+
 func TestSingleDeleteGet(t *testing.T) {
 	d, err := Open("", &Options{
 		FS: vfs.NewMem(),
@@ -757,6 +866,64 @@ func TestRollManifest(t *testing.T) {
 	}
 }
 
+func TestRollManifestMinUnflushedLogNum(t *testing.T) {
+	d, err := Open("", &Options{
+		MaxManifestFileSize: 1,
+		FS:                  vfs.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// The compaction's version edit does not carry MinUnflushedLogNum, so the
+	// new manifest must record it in its snapshot.
+	if err := d.Compact([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	manifestFileNum := d.mu.versions.manifestFileNum
+	expected := d.mu.versions.minUnflushedLogNum
+	d.mu.Unlock()
+
+	f, err := d.opts.FS.Open(base.MakeFilename(d.opts.FS, "", fileTypeManifest, manifestFileNum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var minUnflushedLogNum uint64
+	rr := record.NewReader(f, 0 /* logNum */)
+	for {
+		r, err := rr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var ve versionEdit
+		if err := ve.Decode(r); err != nil {
+			t.Fatal(err)
+		}
+		if ve.ColumnFamily == 0 && ve.MinUnflushedLogNum != 0 {
+			minUnflushedLogNum = ve.MinUnflushedLogNum
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected == 0 || minUnflushedLogNum != expected {
+		t.Fatalf("expected MinUnflushedLogNum %d, but found %d", expected, minUnflushedLogNum)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestDBClosed(t *testing.T) {
 	d, err := Open("", &Options{
 		FS: vfs.NewMem(),
@@ -921,3 +1088,175 @@ func verifyGetSnapshot(t *testing.T, ss *Snapshot, key, expected []byte) {
 		t.Fatalf("expected %s, but got %s", expected, val)
 	}
 }
+
+// openEstimateTestDB opens a DB containing 1000 keys in multiple L6 tables.
+func openEstimateTestDB(t *testing.T) *DB {
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+		Levels: []LevelOptions{{
+			BlockSize:      1024,
+			Compression:    NoCompression,
+			TargetFileSize: 16 << 10,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys are written twice so that the compaction merges the two L0
+	// tables, rather than moving a single table to L6.
+	value := bytes.Repeat([]byte("v"), 100)
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 1000; i++ {
+			if err := d.Set(estimateTestKey(i), value, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Compact(estimateTestKey(0), estimateTestKey(1000)); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	n := len(d.mu.versions.currentVersion().Files[numLevels-1])
+	d.mu.Unlock()
+	if n < 2 {
+		t.Fatalf("expected multiple L6 tables, but found %d", n)
+	}
+	return d
+}
+
+func estimateTestKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%04d", i))
+}
+
+func TestEstimateDiskUsage(t *testing.T) {
+	d := openEstimateTestDB(t)
+	defer d.Close()
+	key := estimateTestKey
+
+	estimate := func(start, end []byte) uint64 {
+		size, err := d.EstimateDiskUsage(start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return size
+	}
+	var tableSize uint64
+	for _, l := range d.Metrics().Levels {
+		tableSize += l.Size
+	}
+	if size := estimate(key(0), key(1000)); size != tableSize {
+		t.Fatalf("expected %d, but found %d", tableSize, size)
+	}
+	if half := estimate(key(0), key(500)); half < tableSize*4/10 || half > tableSize*6/10 {
+		t.Fatalf("expected approximately %d, but found %d", tableSize/2, half)
+	}
+	if size := estimate([]byte("a"), []byte("b")); size != 0 {
+		t.Fatalf("expected 0, but found %d", size)
+	}
+
+	// The keys in the memtable are included in the estimate, which is
+	// approximated from the memory used by the memtable.
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 1000; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("z%04d", i)), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.mu.Lock()
+	memSize := d.mu.mem.mutable.totalBytes()
+	d.mu.Unlock()
+	if size := estimate([]byte("z"), []byte("zz")); size != memSize {
+		t.Fatalf("expected %d, but found %d", memSize, size)
+	}
+	if half := estimate([]byte("z"), []byte("z0500")); half < memSize*3/10 || half > memSize*7/10 {
+		t.Fatalf("expected approximately %d, but found %d", memSize/2, half)
+	}
+	if size := estimate([]byte("a"), []byte("b")); size != 0 {
+		t.Fatalf("expected 0, but found %d", size)
+	}
+
+	// An sstable ingested as a flushable contributes its size. Prevent
+	// flushes so that the sstable, which overlaps the memtable, remains in
+	// the queue of memtables.
+	d.mu.Lock()
+	d.mu.compact.flushing = true
+	d.mu.Unlock()
+	f, err := d.opts.FS.Create("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, LevelOptions{})
+	if err := w.Set([]byte("z0000"), value); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := d.opts.FS.Stat("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ingest([]string{"ext"}); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	memSize = 0
+	var ingested int
+	for _, m := range d.mu.mem.queue {
+		switch m := m.(type) {
+		case *memTable:
+			memSize += m.totalBytes()
+		case *ingestedFlushable:
+			ingested++
+		}
+	}
+	d.mu.compact.flushing = false
+	d.mu.Unlock()
+	if ingested != 1 {
+		t.Fatalf("expected 1 ingested flushable, but found %d", ingested)
+	}
+	if size, expected := estimate([]byte("z"), []byte("zz")), memSize+uint64(info.Size()); size != expected {
+		t.Fatalf("expected %d, but found %d", expected, size)
+	}
+}
+
+func TestApproximateMidKey(t *testing.T) {
+	d := openEstimateTestDB(t)
+	defer d.Close()
+	key := estimateTestKey
+
+	midKey := func(start, end []byte) []byte {
+		mid, err := d.ApproximateMidKey(start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mid
+	}
+
+	if mid := midKey([]byte("a"), []byte("b")); mid != nil {
+		t.Fatalf("expected no mid key, but found %s", mid)
+	}
+
+	testCases := []struct {
+		start, end int
+	}{
+		// The range contains whole sstables.
+		{0, 1000},
+		// The range partially overlaps sstables.
+		{100, 900},
+		{250, 350},
+	}
+	for _, c := range testCases {
+		mid := midKey(key(c.start), key(c.end))
+		expected := (c.start + c.end) / 2
+		slack := (c.end - c.start) / 10
+		if bytes.Compare(mid, key(expected-slack)) < 0 || bytes.Compare(mid, key(expected+slack)) > 0 {
+			t.Fatalf("%d-%d: expected approximately %s, but found %s",
+				c.start, c.end, key(expected), mid)
+		}
+	}
+}
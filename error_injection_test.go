@@ -0,0 +1,309 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/datadriven"
+	"github.com/cockroachdb/pebble/internal/errorfs"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// errorInjector is an errorfs.Injector whose injector can be changed while the
+// DB is running.
+type errorInjector struct {
+	sync.Mutex
+	inj errorfs.Injector
+}
+
+func (e *errorInjector) set(inj errorfs.Injector) {
+	e.Lock()
+	defer e.Unlock()
+	e.inj = inj
+}
+
+func (e *errorInjector) MaybeError(op errorfs.Op) error {
+	e.Lock()
+	defer e.Unlock()
+	if e.inj == nil {
+		return nil
+	}
+	return e.inj.MaybeError(op)
+}
+
+var fileTypeNames = map[string]base.FileType{
+	"log":      fileTypeLog,
+	"table":    fileTypeTable,
+	"manifest": fileTypeManifest,
+	"current":  fileTypeCurrent,
+	"options":  fileTypeOptions,
+	"blob":     fileTypeBlob,
+}
+
+// parseInjector parses the arguments of an inject command into an
+// errorfs.Injector which fails the index'th operation matching the op, file
+// and path arguments, or every matching operation if there is no index
+// argument. The error=enospc argument injects an out of disk space error
+// rather than errorfs.ErrInjected.
+func parseInjector(td *datadriven.TestData) (errorfs.Injector, error) {
+	var preds []errorfs.Predicate
+	index := int32(-1)
+	var noSpace bool
+	for _, arg := range td.CmdArgs {
+		switch arg.Key {
+		case "error":
+			if arg.Vals[0] != "enospc" {
+				return nil, fmt.Errorf("unknown error %q", arg.Vals[0])
+			}
+			noSpace = true
+		case "op":
+			var types []errorfs.OpType
+			for _, v := range arg.Vals {
+				t, err := errorfs.ParseOpType(v)
+				if err != nil {
+					return nil, err
+				}
+				types = append(types, t)
+			}
+			preds = append(preds, errorfs.OpTypes(types...))
+		case "file":
+			var types []base.FileType
+			for _, v := range arg.Vals {
+				t, ok := fileTypeNames[v]
+				if !ok {
+					return nil, fmt.Errorf("unknown file type %q", v)
+				}
+				types = append(types, t)
+			}
+			preds = append(preds, errorfs.FileTypes(types...))
+		case "path":
+			preds = append(preds, errorfs.PathMatch(arg.Vals[0]))
+		case "index":
+			v, err := strconv.ParseInt(arg.Vals[0], 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			index = int32(v)
+		default:
+			return nil, fmt.Errorf("%s: unknown arg: %s", td.Cmd, arg.Key)
+		}
+	}
+	var inj errorfs.Injector
+	if index >= 0 {
+		inj = errorfs.OnIndex(index, errorfs.And(preds...))
+	} else {
+		inj = errorfs.OnMatch(errorfs.And(preds...))
+	}
+	if noSpace {
+		inner := inj
+		inj = errorfs.InjectorFunc(func(op errorfs.Op) error {
+			if err := inner.MaybeError(op); err != nil {
+				return &os.PathError{Op: op.Type.String(), Path: op.Path, Err: syscall.ENOSPC}
+			}
+			return nil
+		})
+	}
+	return inj, nil
+}
+
+// checkManifestFiles verifies that every file referenced by the current
+// version exists.
+func checkManifestFiles(d *DB) error {
+	list, err := d.opts.FS.List(d.dirname)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(list))
+	for _, name := range list {
+		exists[name] = true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v := d.mu.versions.currentVersion()
+	for _, files := range v.Files {
+		for _, f := range files {
+			name := d.opts.FS.PathBase(base.MakeFilename(d.opts.FS, d.dirname, fileTypeTable, f.FileNum))
+			if !exists[name] {
+				return fmt.Errorf("missing table %s", name)
+			}
+		}
+	}
+	for _, b := range v.BlobFiles {
+		name := d.opts.FS.PathBase(base.MakeFilename(d.opts.FS, d.dirname, fileTypeBlob, b.FileNum))
+		if !exists[name] {
+			return fmt.Errorf("missing blob file %s", name)
+		}
+	}
+	return nil
+}
+
+func TestErrorInjection(t *testing.T) {
+	var injector errorInjector
+	var d *DB
+	var opts *Options
+	var mu sync.Mutex
+	var bgErrors []string
+
+	defer func() {
+		if d != nil {
+			injector.set(nil)
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}()
+
+	// describe returns the background errors which have occurred since the
+	// last call, the result of the operation and the LSM, verifying that the
+	// files it references exist.
+	describe := func(err error) string {
+		var buf strings.Builder
+		mu.Lock()
+		for _, e := range bgErrors {
+			fmt.Fprintf(&buf, "background error: %s\n", e)
+		}
+		bgErrors = nil
+		mu.Unlock()
+		if err != nil {
+			fmt.Fprintf(&buf, "error: %v\n", err)
+		}
+		if err := checkManifestFiles(d); err != nil {
+			fmt.Fprintf(&buf, "inconsistent: %v\n", err)
+		}
+		d.mu.Lock()
+		buf.WriteString(d.mu.versions.currentVersion().DebugString(base.DefaultFormatter))
+		d.mu.Unlock()
+		return buf.String()
+	}
+
+	datadriven.RunTest(t, "testdata/error_injection", func(td *datadriven.TestData) string {
+		switch td.Cmd {
+		case "open":
+			if d != nil {
+				injector.set(nil)
+				if err := d.Close(); err != nil {
+					return err.Error()
+				}
+			}
+			opts = &Options{
+				FS: errorfs.Wrap(vfs.NewMem(), &injector),
+				EventListener: EventListener{
+					BackgroundError: func(err error) {
+						mu.Lock()
+						defer mu.Unlock()
+						bgErrors = append(bgErrors, err.Error())
+					},
+				},
+			}
+			for _, arg := range td.CmdArgs {
+				switch arg.Key {
+				case "max-manifest-file-size":
+					v, err := strconv.ParseInt(arg.Vals[0], 10, 64)
+					if err != nil {
+						return err.Error()
+					}
+					opts.MaxManifestFileSize = v
+				case "value-separation-threshold":
+					v, err := strconv.Atoi(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
+					opts.ValueSeparationThreshold = v
+				default:
+					return fmt.Sprintf("%s: unknown arg: %s", td.Cmd, arg.Key)
+				}
+			}
+			var err error
+			d, err = Open("", opts)
+			if err != nil {
+				return err.Error()
+			}
+			return ""
+
+		case "reopen":
+			injector.set(nil)
+			if err := d.Close(); err != nil {
+				return err.Error()
+			}
+			var err error
+			d, err = Open("", opts)
+			if err != nil {
+				return err.Error()
+			}
+			return describe(nil)
+
+		case "inject":
+			if len(td.CmdArgs) == 0 {
+				injector.set(nil)
+				return ""
+			}
+			inj, err := parseInjector(td)
+			if err != nil {
+				return err.Error()
+			}
+			injector.set(inj)
+			return ""
+
+		case "batch":
+			b := d.NewBatch()
+			if err := runBatchDefineCmd(td, b); err != nil {
+				return err.Error()
+			}
+			if err := b.Commit(nil); err != nil {
+				return err.Error()
+			}
+			return ""
+
+		case "flush":
+			return describe(d.Flush())
+
+		case "resume":
+			return describe(d.Resume())
+
+		case "compact":
+			return describe(runCompactCommand(td, d))
+
+		case "get":
+			var buf strings.Builder
+			for _, key := range strings.Fields(td.Input) {
+				v, err := d.Get([]byte(key))
+				if err != nil {
+					fmt.Fprintf(&buf, "%s: %v\n", key, err)
+				} else {
+					fmt.Fprintf(&buf, "%s:%s\n", key, v)
+				}
+			}
+			return buf.String()
+
+		case "files":
+			list, err := opts.FS.List("")
+			if err != nil {
+				return err.Error()
+			}
+			sort.Strings(list)
+			var buf strings.Builder
+			for _, name := range list {
+				if fileType, _, ok := base.ParseFilename(opts.FS, name); ok &&
+					(fileType == fileTypeTable || fileType == fileTypeBlob) {
+					fmt.Fprintf(&buf, "%s\n", name)
+				}
+			}
+			return buf.String()
+
+		default:
+			return fmt.Sprintf("unknown command: %s", td.Cmd)
+		}
+	})
+}
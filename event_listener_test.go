@@ -13,6 +13,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/datadriven"
@@ -281,3 +282,57 @@ func TestWriteStallEvents(t *testing.T) {
 		})
 	}
 }
+
+func TestFreeDiskSpaceWriteStall(t *testing.T) {
+	defer func(v time.Duration) { diskSpacePollInterval = v }(diskSpacePollInterval)
+	diskSpacePollInterval = time.Millisecond
+
+	stallBegan := make(chan string, 1)
+	stallEnded := make(chan struct{}, 1)
+	mem := vfs.NewMem().(*vfs.MemFS)
+	d, err := Open("db", &Options{
+		EventListener: EventListener{
+			WriteStallBegin: func(info WriteStallBeginInfo) {
+				stallBegan <- info.Reason
+			},
+			WriteStallEnd: func() {
+				stallEnded <- struct{}{}
+			},
+		},
+		FS:                               mem,
+		FreeDiskSpaceStopWritesThreshold: 1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Reduce the free space below the threshold. Rotating the memtable stalls
+	// until space is freed.
+	usage, err := mem.GetDiskUsage("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.SetDiskCapacity(usage.UsedBytes + 1<<10)
+	if err := d.Set([]byte("a"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	flushErr := make(chan error, 1)
+	go func() {
+		flushErr <- d.Flush()
+	}()
+	if reason := <-stallBegan; reason != writeStallReasonDiskSpace {
+		t.Fatalf("expected %q, but found %q", writeStallReasonDiskSpace, reason)
+	}
+	select {
+	case <-stallEnded:
+		t.Fatal("write stall ended before space was freed")
+	case <-time.After(10 * diskSpacePollInterval):
+	}
+
+	mem.SetDiskCapacity(0)
+	<-stallEnded
+	if err := <-flushErr; err != nil {
+		t.Fatal(err)
+	}
+}
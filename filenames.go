@@ -20,6 +20,7 @@ const (
 	fileTypeManifest = base.FileTypeManifest
 	fileTypeCurrent  = base.FileTypeCurrent
 	fileTypeOptions  = base.FileTypeOptions
+	fileTypeBlob     = base.FileTypeBlob
 )
 
 func setCurrentFile(dirname string, fs vfs.FS, fileNum uint64) error {
@@ -13,17 +13,22 @@ import (
 // internalIterator, but specialized for Get operations so that it loads data
 // lazily.
 type getIter struct {
-	cmp          Compare
-	equal        Equal
-	newIters     tableNewIters
-	snapshot     uint64
-	key          []byte
+	cmp      Compare
+	equal    Equal
+	newIters tableNewIters
+	snapshot uint64
+	key      []byte
+	// prefix is the prefix of key as determined by Comparer.Split, or key
+	// itself if there is no Split function. It is used to consult the bloom
+	// filters of the sstables.
+	prefix       []byte
 	iter         internalIterator
 	rangeDelIter internalIterator
 	tombstone    rangedel.Tombstone
 	levelIter    levelIter
 	level        int
 	batch        *Batch
+	cfID         uint32
 	mem          []flushable
 	l0           []fileMetadata
 	version      *version
@@ -105,8 +110,8 @@ func (g *getIter) Next() (*InternalKey, []byte) {
 
 		// Create an iterator from the batch.
 		if g.batch != nil {
-			g.iter = g.batch.newInternalIter(nil)
-			g.rangeDelIter = g.batch.newRangeDelIter(nil)
+			g.iter = g.batch.newColumnFamilyInternalIter(g.cfID, nil)
+			g.rangeDelIter = g.batch.newColumnFamilyRangeDelIter(g.cfID, nil)
 			g.batch = nil
 			g.iterKey, g.iterValue = g.iter.SeekGE(g.key)
 			continue
@@ -140,7 +145,7 @@ func (g *getIter) Next() (*InternalKey, []byte) {
 					return nil, nil
 				}
 				g.l0 = g.l0[:n-1]
-				g.iterKey, g.iterValue = g.iter.SeekGE(g.key)
+				g.iterKey, g.iterValue = g.iter.SeekPrefixGE(g.prefix, g.key)
 				continue
 			}
 			g.level++
@@ -158,7 +163,7 @@ func (g *getIter) Next() (*InternalKey, []byte) {
 		g.levelIter.initRangeDel(&g.rangeDelIter)
 		g.level++
 		g.iter = &g.levelIter
-		g.iterKey, g.iterValue = g.iter.SeekGE(g.key)
+		g.iterKey, g.iterValue = g.iter.SeekPrefixGE(g.prefix, g.key)
 	}
 }
 
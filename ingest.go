@@ -5,8 +5,11 @@
 package pebble
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"sort"
+	"sync"
 	"sync/atomic"
 
 	"github.com/cockroachdb/pebble/internal/base"
@@ -14,6 +17,8 @@ import (
 	"github.com/cockroachdb/pebble/vfs"
 )
 
+var errCorruptIngestRecord = errors.New("pebble: corrupt ingestion record in WAL")
+
 func sstableKeyCompare(userCmp Compare, a, b InternalKey) int {
 	c := userCmp(a.UserKey, b.UserKey)
 	if c != 0 {
@@ -251,15 +256,16 @@ func ingestTargetLevel(cmp Compare, v *version, meta *fileMetadata) int {
 
 // Ingest ingests a set of sstables into the DB. Ingestion of the files is
 // atomic and semantically equivalent to creating a single batch containing all
-// of the mutations in the sstables. Ingestion may require the memtable to be
-// flushed. The ingested sstable files are moved into the DB and must reside on
-// the same filesystem as the DB. Sstables can be created for ingestion using
-// sstable.Writer.
+// of the mutations in the sstables. The ingested sstable files are moved into
+// the DB and must reside on the same filesystem as the DB. Sstables can be
+// created for ingestion using sstable.Writer.
 //
 // Ingestion loads each sstable into the lowest level of the LSM which it
 // doesn't overlap (see ingestTargetLevel). If an sstable overlaps a memtable,
-// ingestion forces the memtable to flush, and then waits for the flush to
-// occur.
+// the sstables are instead added to the queue of memtables, above the
+// memtables they overlap, in the same way as a large batch. The ingestion is
+// recorded in the WAL and the sstables are added to L0 when they are flushed,
+// without being rewritten.
 //
 // The steps for ingestion are:
 //
@@ -269,27 +275,29 @@ func ingestTargetLevel(cmp Compare, v *version, meta *fileMetadata) int {
 //   4. Hard link the sstables into the DB directory.
 //   5. Allocate a sequence number to use for all of the entries in the
 //      sstables. This is the step where overlap with memtables is
-//      determined. If there is overlap, we remember the most recent memtable
-//      that overlaps.
+//      determined. If there is overlap, the sequence numbers of the sstables
+//      are updated, the ingestion is recorded in the WAL and the sstables are
+//      added to the queue of memtables.
 //   6. Update the sequence number in the ingested sstables.
-//   7. Wait for the most recent memtable that overlaps to flush (if any).
-//   8. Add the ingested sstables to the version (DB.ingestApply).
-//   9. Publish the ingestion sequence number.
+//   7. Add the ingested sstables to the version (DB.ingestApply).
+//   8. Publish the ingestion sequence number.
 //
-// Note that if the mutable memtable overlaps with ingestion, a flush of the
-// memtable is forced equivalent to DB.Flush. Additionally, subsequent
+// If the WAL is disabled, the ingestion cannot be recovered from the queue of
+// memtables. Instead, ingestion forces the flush of the memtables the
+// sstables overlap, and then waits for the flush to occur. Subsequent
 // mutations that get sequence numbers larger than the ingestion sequence
-// number get queued up behind the ingestion waiting for it to complete. This
-// can produce a noticeable hiccup in performance. See
-// https://github.com/cockroachdb/pebble/issues/25 for an idea for how to fix
-// this hiccup.
-func (d *DB) Ingest(paths []string) error {
+// number get queued up behind the ingestion waiting for it to complete, which
+// can produce a noticeable hiccup in performance.
+func (d *DB) Ingest(paths []string) (err error) {
 	if atomic.LoadInt32(&d.closed) != 0 {
 		panic(ErrClosed)
 	}
 	if d.opts.ReadOnly {
 		return ErrReadOnly
 	}
+	if err := d.writesStoppedErr(); err != nil {
+		return err
+	}
 
 	// Allocate file numbers for all of the files being ingested and mark them as
 	// pending in order to prevent them from being deleted. Note that this causes
@@ -308,7 +316,18 @@ func (d *DB) Ingest(paths []string) error {
 	d.mu.nextJobID++
 	d.mu.Unlock()
 
+	var asFlushable bool
 	defer func() {
+		if _, ok := err.(*manifestError); ok {
+			// The MANIFEST may reference the ingested sstables, so they remain
+			// pending in order to prevent them from being deleted.
+			return
+		}
+		if asFlushable {
+			// The ingested sstables were added to the queue of memtables, and
+			// remain pending until they are flushed (see DB.flushIngested).
+			return
+		}
 		d.mu.Lock()
 		for _, fileNum := range pendingOutputs {
 			delete(d.mu.compact.pendingOutputs, fileNum)
@@ -348,28 +367,33 @@ func (d *DB) Ingest(paths []string) error {
 	}
 
 	var mem flushable
-	prepare := func() {
+	var syncWG sync.WaitGroup
+	var syncErr error
+	prepare := func(seqNum uint64) {
 		d.mu.Lock()
 		defer d.mu.Unlock()
 
-		// If the mutable memtable contains keys which overlap any of the sstables
-		// then flush the memtable. Note that apply will wait for the flushing to
-		// finish.
-		if ingestMemtableOverlaps(d.cmp, d.mu.mem.mutable, meta) {
-			mem = d.mu.mem.mutable
-			err = d.makeRoomForWrite(nil)
-			return
-		}
-
-		// Check to see if any files overlap with any of the immutable
-		// memtables. The queue is ordered from oldest to newest. We want to wait
-		// for the newest table that overlaps.
+		// Check to see if any files overlap with any of the memtables. The queue
+		// is ordered from oldest to newest, with the mutable memtable last. We
+		// want the newest memtable that overlaps.
 		for i := len(d.mu.mem.queue) - 1; i >= 0; i-- {
 			m := d.mu.mem.queue[i]
-			if ingestMemtableOverlaps(d.cmp, m, meta) {
-				mem = m
+			if !ingestMemtableOverlaps(d.cmp, m, meta) {
+				continue
+			}
+			if !d.opts.DisableWAL {
+				if err = d.ingestAsFlushable(meta, seqNum, &syncWG, &syncErr); err == nil {
+					asFlushable = true
+				}
 				return
 			}
+			// If the mutable memtable overlaps the sstables then flush the
+			// memtable. Note that apply will wait for the flushing to finish.
+			mem = m
+			if mem == d.mu.mem.mutable {
+				err = d.makeRoomForWrite(nil)
+			}
+			return
 		}
 	}
 
@@ -380,6 +404,20 @@ func (d *DB) Ingest(paths []string) error {
 			return
 		}
 
+		if asFlushable {
+			// The sstables were added to the queue of memtables in prepare, from
+			// which point they may be read and must not be removed. Wait for the
+			// record of the ingestion to be synced to the WAL before the sequence
+			// number is published.
+			syncWG.Wait()
+			if syncErr != nil {
+				// A failure to sync the WAL is handled as it is for a batch (see
+				// commitPipeline.Commit): the pipeline cannot make progress.
+				panic(syncErr)
+			}
+			return
+		}
+
 		// Update the sequence number for all of the sstables, both in the metadata
 		// and the global sequence number property on disk.
 		if err = ingestUpdateSeqNum(d.opts, d.dirname, seqNum, meta); err != nil {
@@ -389,7 +427,9 @@ func (d *DB) Ingest(paths []string) error {
 		// If we flushed the mutable memtable in prepare wait for the flush to
 		// finish.
 		if mem != nil {
-			<-mem.flushed()
+			if err = d.waitFlushed(mem.flushed()); err != nil {
+				return
+			}
 		}
 
 		// Assign the sstables to the correct level in the LSM and apply the
@@ -399,7 +439,7 @@ func (d *DB) Ingest(paths []string) error {
 
 	d.commit.AllocateSeqNum(len(meta), prepare, apply)
 
-	if err != nil {
+	if _, ok := err.(*manifestError); err != nil && !ok && !asFlushable {
 		if err2 := ingestCleanup(d.opts.FS, d.dirname, meta); err2 != nil {
 			d.opts.Logger.Infof("ingest cleanup failed: %v", err2)
 		}
@@ -420,13 +460,65 @@ func (d *DB) Ingest(paths []string) error {
 			info.Tables[i].Level = e.Level
 			info.Tables[i].TableInfo = e.Meta.TableInfo(d.opts.FS, d.dirname)
 		}
+	} else if asFlushable && err == nil {
+		// The sstables are added to L0 when they are flushed.
+		info.Tables = make([]struct {
+			TableInfo
+			Level int
+		}, len(meta))
+		for i := range meta {
+			info.Tables[i].TableInfo = meta[i].TableInfo(d.opts.FS, d.dirname)
+		}
 	}
 	d.opts.EventListener.TableIngested(info)
 
 	return err
 }
 
+// ingestAsFlushable adds the ingested sstables to the queue of memtables,
+// above the memtables they overlap. The ingestion is recorded in the WAL so
+// that the sstables are added to the LSM if the DB is reopened before they are
+// flushed. The record is synced asynchronously, signalling syncWG on
+// completion.
+//
+// Both DB.mu and commitPipeline.mu must be held by the caller. Note that DB.mu
+// may be released and reacquired.
+func (d *DB) ingestAsFlushable(
+	meta []*fileMetadata, seqNum uint64, syncWG *sync.WaitGroup, syncErr *error,
+) error {
+	if err := ingestUpdateSeqNum(d.opts, d.dirname, seqNum, meta); err != nil {
+		return err
+	}
+
+	b := newBatch(nil)
+	defer b.release()
+	for _, m := range meta {
+		b.ingestSST(m.FileNum)
+	}
+	b.setSeqNum(seqNum)
+	repr := b.Repr()
+
+	// The record is written to the WAL of the mutable memtable, which
+	// makeRoomForIngest then rotates, in the same way as for a large batch
+	// (see DB.commitWrite). The LogWriter is protected by commitPipeline.mu.
+	syncWG.Add(1)
+	size, err := d.mu.log.SyncRecord(repr, syncWG, syncErr)
+	if err != nil {
+		panic(err)
+	}
+	d.mu.log.bytesIn += uint64(len(repr))
+	atomic.StoreUint64(&d.mu.log.size, uint64(size))
+
+	return d.makeRoomForIngest(newIngestedFlushable(d.defaultCF, meta))
+}
+
 func (d *DB) ingestApply(jobID int, meta []*fileMetadata) (*versionEdit, error) {
+	files := make([]fileMetadata, len(meta))
+	for i := range meta {
+		files[i] = *meta[i]
+	}
+	hints := d.defaultCF.loadDeletionHints(files)
+
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
@@ -450,8 +542,142 @@ func (d *DB) ingestApply(jobID int, meta []*fileMetadata) (*versionEdit, error)
 		levelMetrics.BytesIngested += m.Size
 	}
 	if err := d.mu.versions.logAndApply(jobID, ve, metrics, d.dataDir); err != nil {
+		d.maybeStopWritesLocked(err)
 		return nil, err
 	}
+	d.defaultCF.versions.deletionHints = append(d.defaultCF.versions.deletionHints, hints...)
 	d.updateReadStateLocked()
 	return ve, nil
 }
+
+// ingestedFlushable is a flushable containing sstables which were ingested
+// while overlapping the memtables (see DB.Ingest). Rather than waiting for the
+// overlapping memtables to be flushed, the sstables are added to the queue of
+// memtables above them, where they are readable as another layer in the LSM.
+// Flushing an ingestedFlushable adds its sstables to L0 without rewriting them
+// (see DB.flushIngested).
+type ingestedFlushable struct {
+	// files are the ingested sstables, sorted by key.
+	files     []fileMetadata
+	cmp       Compare
+	newIters  tableNewIters
+	flushedCh chan struct{}
+	logNum    uint64
+	// readerRefs is the number of readStates which include the flushable, plus
+	// one for the queue of memtables. Readers may continue to read the
+	// sstables after the flushable has been flushed, and the sstables may then
+	// be compacted away. Once flushed, the flushable holds a reference on
+	// version, which contains the sstables, until the last reader is done.
+	readerRefs int32
+	version    *version
+}
+
+var _ flushable = (*ingestedFlushable)(nil)
+
+func newIngestedFlushable(cf *ColumnFamily, meta []*fileMetadata) *ingestedFlushable {
+	f := &ingestedFlushable{
+		files:      make([]fileMetadata, len(meta)),
+		cmp:        cf.cmp,
+		newIters:   cf.newIters,
+		flushedCh:  make(chan struct{}),
+		readerRefs: 1,
+	}
+	for i := range meta {
+		f.files[i] = *meta[i]
+	}
+	return f
+}
+
+func (f *ingestedFlushable) readerRef() {
+	atomic.AddInt32(&f.readerRefs, 1)
+}
+
+// readerUnref removes a reader reference. Requires DB.mu is NOT held as
+// version.Unref() will acquire it.
+func (f *ingestedFlushable) readerUnref() {
+	if atomic.AddInt32(&f.readerRefs, -1) == 0 && f.version != nil {
+		f.version.Unref()
+	}
+}
+
+// readerUnrefLocked removes a reader reference. Requires DB.mu is held as
+// version.UnrefLocked() requires it.
+func (f *ingestedFlushable) readerUnrefLocked() {
+	if atomic.AddInt32(&f.readerRefs, -1) == 0 && f.version != nil {
+		f.version.UnrefLocked()
+	}
+}
+
+func (f *ingestedFlushable) newIter(o *IterOptions) internalIterator {
+	return newLevelIter(o, f.cmp, f.newIters, f.files, nil)
+}
+
+func (f *ingestedFlushable) newFlushIter(o *IterOptions, bytesFlushed *uint64) internalIterator {
+	return newLevelIter(o, f.cmp, f.newIters, f.files, bytesFlushed)
+}
+
+func (f *ingestedFlushable) newRangeDelIter(o *IterOptions) internalIterator {
+	// The range deletions of the sstables are iterated over by a levelIter
+	// which loads the range deletion iterator of each sstable in place of its
+	// point iterator.
+	newRangeDelIter := func(
+		m *fileMetadata, opts *IterOptions, bytesIterated *uint64,
+	) (internalIterator, internalIterator, error) {
+		iter, rangeDelIter, err := f.newIters(m, opts, bytesIterated)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := iter.Close(); err != nil {
+			return nil, nil, err
+		}
+		if rangeDelIter == nil {
+			// A nil iterator would end the iteration of the levelIter.
+			rangeDelIter = emptyIter
+		}
+		return rangeDelIter, nil, nil
+	}
+	return newLevelIter(o, f.cmp, newRangeDelIter, f.files, nil)
+}
+
+func (f *ingestedFlushable) totalBytes() uint64 {
+	// The sstables are already on disk, so there is nothing to write.
+	return 0
+}
+
+func (f *ingestedFlushable) flushed() chan struct{} {
+	return f.flushedCh
+}
+
+func (f *ingestedFlushable) readyForFlush() bool {
+	return true
+}
+
+func (f *ingestedFlushable) logInfo() (uint64, uint64) {
+	return f.logNum, 0 /* logSize */
+}
+
+// ingestedFileNums returns the file numbers of the sstables recorded in a
+// batch read from the WAL by Batch.ingestSST, or nil if the batch does not
+// record an ingestion.
+func ingestedFileNums(b *Batch) ([]uint64, error) {
+	r := b.Reader()
+	if len(r) == 0 || InternalKeyKind(r[0]) != InternalKeyKindIngestSST {
+		return nil, nil
+	}
+	var fileNums []uint64
+	for len(r) > 0 {
+		kind, ukey, _, ok := r.Next()
+		if !ok || kind != InternalKeyKindIngestSST {
+			return nil, errCorruptIngestRecord
+		}
+		fileNum, n := binary.Uvarint(ukey)
+		if n <= 0 || n != len(ukey) {
+			return nil, errCorruptIngestRecord
+		}
+		fileNums = append(fileNums, fileNum)
+	}
+	if len(fileNums) != int(b.Count()) {
+		return nil, errCorruptIngestRecord
+	}
+	return fileNums, nil
+}
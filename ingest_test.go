@@ -567,6 +567,21 @@ func TestIngest(t *testing.T) {
 			}
 			return b.String()
 
+		case "flush":
+			if err := d.Flush(); err != nil {
+				return err.Error()
+			}
+			// Wait for the compactions scheduled by the flush, such as the
+			// delete-only compactions for ingested range tombstones, so that the
+			// LSM is deterministic.
+			d.mu.Lock()
+			d.maybeScheduleCompaction()
+			for d.mu.compact.compactingCount > 0 {
+				d.mu.compact.cond.Wait()
+			}
+			d.mu.Unlock()
+			return ""
+
 		case "lsm":
 			d.mu.Lock()
 			s := d.mu.versions.currentVersion().String()
@@ -578,3 +593,188 @@ func TestIngest(t *testing.T) {
 		}
 	})
 }
+
+func TestIngestFlushable(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &Options{
+		FS:                    mem,
+		L0CompactionThreshold: 100,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Prevent flushes so that the ingested sstable remains in the queue of
+	// memtables.
+	d.mu.Lock()
+	d.mu.compact.flushing = true
+	d.mu.Unlock()
+
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("b"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := mem.Create("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, LevelOptions{})
+	if err := w.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Set([]byte("c"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ingest([]string{"ext"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("c"), []byte("3"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(d *DB) {
+		t.Helper()
+		for _, kv := range []struct{ key, value string }{
+			{"a", "1"}, {"b", "2"}, {"c", "3"},
+		} {
+			v, err := d.Get([]byte(kv.key))
+			if err != nil {
+				t.Fatalf("%s: %v", kv.key, err)
+			}
+			if string(v) != kv.value {
+				t.Fatalf("%s: expected %s, but found %s", kv.key, kv.value, v)
+			}
+		}
+	}
+
+	// The ingested sstable overlapped the memtable, so it was added to the queue
+	// of memtables instead of the LSM.
+	d.mu.Lock()
+	n := len(d.mu.versions.currentVersion().Files[0])
+	var ingested int
+	for _, m := range d.mu.mem.queue {
+		if _, ok := m.(*ingestedFlushable); ok {
+			ingested++
+		}
+	}
+	d.mu.compact.flushing = false
+	d.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected no L0 files, but found %d", n)
+	}
+	if ingested != 1 {
+		t.Fatalf("expected 1 ingested flushable, but found %d", ingested)
+	}
+	expect(d)
+
+	// Close the DB without flushing. The ingestion is replayed from the WAL
+	// when the DB is reopened.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ro := opts.Clone()
+	ro.ReadOnly = true
+	d, err = Open("", ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(d)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(d)
+	d.mu.Lock()
+	n = len(d.mu.versions.currentVersion().Files[0])
+	d.mu.Unlock()
+	if n != 3 {
+		t.Fatalf("expected 3 L0 files, but found %d", n)
+	}
+
+	// The sstables flushed by the replay must not be reused.
+	if err := d.Set([]byte("d"), []byte("4"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(d)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestFlushableIterAfterCompaction(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	d.mu.compact.flushing = true
+	d.mu.Unlock()
+
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	f, err := mem.Create("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, LevelOptions{})
+	if err := w.Set([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ingest([]string{"ext"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An iterator created while the ingested sstable is in the queue of
+	// memtables continues to read it after it has been flushed and compacted
+	// away.
+	iter := d.NewIter(nil)
+	d.mu.Lock()
+	d.mu.compact.flushing = false
+	d.maybeScheduleFlush()
+	d.mu.Unlock()
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	for valid := iter.First(); valid; valid = iter.Next() {
+		fmt.Fprintf(&buf, "%s:%s\n", iter.Key(), iter.Value())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "a:2\n"; expected != buf.String() {
+		t.Fatalf("expected %q, but found %q", expected, buf.String())
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -13,12 +13,22 @@ type InternalKeyKind = base.InternalKeyKind
 
 // These constants are part of the file format, and should not be changed.
 const (
-	InternalKeyKindDelete          = base.InternalKeyKindDelete
-	InternalKeyKindSet             = base.InternalKeyKindSet
-	InternalKeyKindMerge           = base.InternalKeyKindMerge
-	InternalKeyKindLogData         = base.InternalKeyKindLogData
-	InternalKeyKindSingleDelete    = base.InternalKeyKindSingleDelete
-	InternalKeyKindRangeDelete     = base.InternalKeyKindRangeDelete
+	InternalKeyKindDelete       = base.InternalKeyKindDelete
+	InternalKeyKindSet          = base.InternalKeyKindSet
+	InternalKeyKindMerge        = base.InternalKeyKindMerge
+	InternalKeyKindLogData      = base.InternalKeyKindLogData
+	InternalKeyKindSingleDelete = base.InternalKeyKindSingleDelete
+	InternalKeyKindRangeDelete  = base.InternalKeyKindRangeDelete
+	InternalKeyKindSetWithTTL   = base.InternalKeyKindSetWithTTL
+	InternalKeyKindBlobHandle   = base.InternalKeyKindBlobHandle
+	InternalKeyKindIngestSST    = base.InternalKeyKindIngestSST
+
+	InternalKeyKindColumnFamilyDeletion     = base.InternalKeyKindColumnFamilyDeletion
+	InternalKeyKindColumnFamilyValue        = base.InternalKeyKindColumnFamilyValue
+	InternalKeyKindColumnFamilyMerge        = base.InternalKeyKindColumnFamilyMerge
+	InternalKeyKindColumnFamilySingleDelete = base.InternalKeyKindColumnFamilySingleDelete
+	InternalKeyKindColumnFamilyRangeDelete  = base.InternalKeyKindColumnFamilyRangeDelete
+
 	InternalKeyKindMax             = base.InternalKeyKindMax
 	InternalKeyKindInvalid         = base.InternalKeyKindInvalid
 	InternalKeySeqNumBatch         = base.InternalKeySeqNumBatch
@@ -171,6 +171,40 @@ func (s *Skiplist) Arena() *Arena { return s.arena }
 // Size returns the number of bytes that have allocated from the arena.
 func (s *Skiplist) Size() uint32 { return s.arena.Size() }
 
+// EstimateFraction returns an estimate of the fraction of the entries in the
+// skiplist whose user keys lie within [start, end). A nil start or end leaves
+// the range unbounded in that direction. The nodes of each level of the
+// skiplist are a uniform sample of its entries, so the fraction is estimated
+// from the highest level which holds enough nodes, without visiting every
+// entry.
+func (s *Skiplist) EstimateFraction(start, end []byte) float64 {
+	const minSamples = 256
+	level := int(s.Height()) - 1
+	for ; level > 0; level-- {
+		n := 0
+		for nd := s.getNext(s.head, level); nd != s.tail && n < minSamples; nd = s.getNext(nd, level) {
+			n++
+		}
+		if n >= minSamples {
+			break
+		}
+	}
+
+	var total, within int
+	for nd := s.getNext(s.head, level); nd != s.tail; nd = s.getNext(nd, level) {
+		total++
+		key := nd.getKeyBytes(s.arena)
+		ukey := key[:len(key)-8]
+		if (start == nil || s.cmp(ukey, start) >= 0) && (end == nil || s.cmp(ukey, end) < 0) {
+			within++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(within) / float64(total)
+}
+
 // Add adds a new key if it does not yet exist. If the key already exists, then
 // Add returns ErrRecordExists. If there isn't enough room in the arena, then
 // Add returns ErrArenaFull.
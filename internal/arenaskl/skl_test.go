@@ -474,6 +474,36 @@ func TestConcurrentAdd(t *testing.T) {
 }
 
 // TestIteratorNext tests a basic iteration over all nodes from the beginning.
+func TestEstimateFraction(t *testing.T) {
+	l := NewSkiplist(NewArena(arenaSize, 0), bytes.Compare)
+	require.Equal(t, 0.0, l.EstimateFraction(nil, []byte("z")))
+
+	const n = 10000
+	for i := 0; i < n; i++ {
+		require.NoError(t, l.Add(makeIntKey(i), nil))
+	}
+	key := func(i int) []byte {
+		return makeIntKey(i).UserKey
+	}
+	for _, c := range []struct {
+		start, end int
+		expected   float64
+	}{
+		{0, n, 1},
+		{0, n / 2, 0.5},
+		{n / 4, 3 * n / 4, 0.5},
+		{n / 2, n / 2, 0},
+		{n / 2, 0, 0},
+	} {
+		f := l.EstimateFraction(key(c.start), key(c.end))
+		require.InDelta(t, c.expected, f, 0.15, "[%d,%d)", c.start, c.end)
+	}
+	// Keys outside of the skiplist's range.
+	require.Equal(t, 1.0, l.EstimateFraction(nil, nil))
+	require.Equal(t, 1.0, l.EstimateFraction(nil, []byte{0xff}))
+	require.Equal(t, 0.0, l.EstimateFraction([]byte{0xff}, nil))
+}
+
 func TestIteratorNext(t *testing.T) {
 	const n = 100
 	l := NewSkiplist(NewArena(arenaSize, 0), bytes.Compare)
@@ -0,0 +1,59 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package base
+
+// CompactionFilterDecision is the decision returned by a CompactionFilter for
+// a key/value pair.
+type CompactionFilterDecision int
+
+// The CompactionFilterDecision constants.
+const (
+	// CompactionFilterKeep retains the key/value pair unchanged.
+	CompactionFilterKeep CompactionFilterDecision = iota
+	// CompactionFilterRemove removes the key. The key is replaced with a
+	// deletion tombstone so that older values for the key in lower levels
+	// remain shadowed. The tombstone is itself elided when possible.
+	CompactionFilterRemove
+	// CompactionFilterChangeValue replaces the value of the key with the value
+	// returned by the filter.
+	CompactionFilterChangeValue
+)
+
+func (d CompactionFilterDecision) String() string {
+	switch d {
+	case CompactionFilterKeep:
+		return "keep"
+	case CompactionFilterRemove:
+		return "remove"
+	case CompactionFilterChangeValue:
+		return "change-value"
+	}
+	return "unknown"
+}
+
+// CompactionFilter allows the user to remove or rewrite key/value pairs
+// during compaction. This can be used to implement garbage collection of
+// obsolete data (e.g. old MVCC versions) without a separate scan-and-delete
+// pass over the DB.
+//
+// The filter is only consulted for values which are not visible to any open
+// snapshot, so removing or rewriting a value never changes the view of the DB
+// observed by a snapshot. The filter is invoked for point values
+// ({Batch,DB}.Set and {Batch,DB}.SetWithTTL) and for merge results which have
+// been fully resolved into a value. It is not invoked for deletion tombstones,
+// for partial merge results, or during flushes.
+//
+// A CompactionFilter may be invoked concurrently by multiple compactions and
+// must therefore be safe for concurrent use.
+type CompactionFilter interface {
+	// Name is the name of the compaction filter.
+	Name() string
+
+	// Filter is invoked for each key/value pair eligible for filtering. The
+	// level is the output level of the compaction. The filter returns its
+	// decision and, for CompactionFilterChangeValue, the new value. The key and
+	// value must not be modified or retained after Filter returns.
+	Filter(level int, key, value []byte) (CompactionFilterDecision, []byte)
+}
@@ -23,6 +23,7 @@ const (
 	FileTypeManifest
 	FileTypeCurrent
 	FileTypeOptions
+	FileTypeBlob
 )
 
 // MakeFilename builds a filename from components.
@@ -40,6 +41,8 @@ func MakeFilename(fs vfs.FS, dirname string, fileType FileType, fileNum uint64)
 		return fs.PathJoin(dirname, "CURRENT")
 	case FileTypeOptions:
 		return fs.PathJoin(dirname, fmt.Sprintf("OPTIONS-%06d", fileNum))
+	case FileTypeBlob:
+		return fs.PathJoin(dirname, fmt.Sprintf("%06d.blob", fileNum))
 	}
 	panic("unreachable")
 }
@@ -78,6 +81,8 @@ func ParseFilename(fs vfs.FS, filename string) (fileType FileType, fileNum uint6
 			return FileTypeTable, u, true
 		case "log":
 			return FileTypeLog, u, true
+		case "blob":
+			return FileTypeBlob, u, true
 		}
 	}
 	return 0, 0, false
@@ -19,6 +19,8 @@ func TestParseFilename(t *testing.T) {
 		"abcdef.log":          false,
 		"000001ldb":           false,
 		"000001.sst":          true,
+		"000001.blob":         true,
+		"000001.blb":          false,
 		"CURRENT":             true,
 		"CURRaNT":             false,
 		"LOCK":                true,
@@ -22,23 +22,48 @@ const (
 	InternalKeyKindSet                     = 1
 	InternalKeyKindMerge                   = 2
 	InternalKeyKindLogData                 = 3
-	// InternalKeyKindColumnFamilyDeletion                     = 4
-	// InternalKeyKindColumnFamilyValue                        = 5
-	// InternalKeyKindColumnFamilyMerge                        = 6
-	InternalKeyKindSingleDelete = 7
-	// InternalKeyKindColumnFamilySingleDelete                 = 8
+	// The column family kinds are only used in the batch representation where
+	// they are followed by a varint32 column family ID. They never appear in
+	// internal keys.
+	InternalKeyKindColumnFamilyDeletion     = 4
+	InternalKeyKindColumnFamilyValue        = 5
+	InternalKeyKindColumnFamilyMerge        = 6
+	InternalKeyKindSingleDelete             = 7
+	InternalKeyKindColumnFamilySingleDelete = 8
 	// InternalKeyKindBeginPrepareXID                          = 9
 	// InternalKeyKindEndPrepareXID                            = 10
 	// InternalKeyKindCommitXID                                = 11
 	// InternalKeyKindRollbackXID                              = 12
 	// InternalKeyKindNoop                                     = 13
-	// InternalKeyKindColumnFamilyRangeDelete                  = 14
-	InternalKeyKindRangeDelete = 15
+	InternalKeyKindColumnFamilyRangeDelete = 14
+	InternalKeyKindRangeDelete             = 15
 	// InternalKeyKindColumnFamilyBlobIndex                    = 16
 	// InternalKeyKindBlobIndex                                = 17
 
-	// This maximum value isn't part of the file format. It's unlikely,
-	// but future extensions may increase this value.
+	// Kinds up to 0x3F are reserved for compatibility with RocksDB, which
+	// continues to allocate new kinds after InternalKeyKindBlobIndex. Kinds
+	// specific to Pebble are allocated from [0x40, InternalKeyKindMax].
+
+	// InternalKeyKindSetWithTTL is a set whose value is prefixed with the
+	// expiration time of the key (see DB.SetWithTTL). Once expired, the key is
+	// treated as deleted.
+	InternalKeyKindSetWithTTL = 0x40
+
+	// InternalKeyKindBlobHandle is a set whose value is stored in a blob file.
+	// The value stored in the sstable is an encoded handle to the value in the
+	// blob file. Blob handles are only written by flushes (see
+	// Options.ValueSeparationThreshold) and never appear in batches.
+	InternalKeyKindBlobHandle = 0x41
+
+	// InternalKeyKindIngestSST records the ingestion of an sstable which was
+	// added to the queue of memtables (see DB.Ingest). It is only used in the
+	// WAL, where the user key of the record is the file number of the sstable
+	// encoded as a uvarint, and never appears in internal keys.
+	InternalKeyKindIngestSST = 0x42
+
+	// This maximum value isn't part of the file format. It is the end of the
+	// range reserved for Pebble-specific kinds, so it does not change when a
+	// new kind is allocated from that range.
 	//
 	// When constructing an internal key to pass to DB.Seek{GE,LE},
 	// internalKeyComparer sorts decreasing by kind (after sorting increasing by
@@ -46,7 +71,13 @@ const (
 	// which sorts 'less than or equal to' any other valid internalKeyKind, when
 	// searching for any kind of internal key formed by a certain user key and
 	// seqNum.
-	InternalKeyKindMax InternalKeyKind = 17
+	InternalKeyKindMax InternalKeyKind = 0x4F
+
+	// InternalKeyKindSeparator is the kind used for the separator and
+	// successor keys stored in sstable index blocks. Unlike InternalKeyKindMax
+	// it is part of the file format and must not change when new kinds are
+	// added. Any kind produces a valid separator key.
+	InternalKeyKindSeparator InternalKeyKind = 17
 
 	// A marker for an invalid key.
 	InternalKeyKindInvalid InternalKeyKind = 255
@@ -73,8 +104,17 @@ var internalKeyKindNames = []string{
 	InternalKeyKindLogData:      "LOGDATA",
 	InternalKeyKindSingleDelete: "SINGLEDEL",
 	InternalKeyKindRangeDelete:  "RANGEDEL",
-	InternalKeyKindMax:          "MAX",
+	InternalKeyKindSeparator:    "SEPARATOR",
+	InternalKeyKindSetWithTTL:   "SETTTL",
+	InternalKeyKindBlobHandle:   "BLOBHANDLE",
+	InternalKeyKindIngestSST:    "INGESTSST",
 	InternalKeyKindInvalid:      "INVALID",
+
+	InternalKeyKindColumnFamilyDeletion:     "CF-DEL",
+	InternalKeyKindColumnFamilyValue:        "CF-SET",
+	InternalKeyKindColumnFamilyMerge:        "CF-MERGE",
+	InternalKeyKindColumnFamilySingleDelete: "CF-SINGLEDEL",
+	InternalKeyKindColumnFamilyRangeDelete:  "CF-RANGEDEL",
 }
 
 func (k InternalKeyKind) String() string {
@@ -131,13 +171,17 @@ func MakeRangeDeleteSentinelKey(userKey []byte) InternalKey {
 }
 
 var kindsMap = map[string]InternalKeyKind{
-	"DEL":       InternalKeyKindDelete,
-	"SINGLEDEL": InternalKeyKindSingleDelete,
-	"RANGEDEL":  InternalKeyKindRangeDelete,
-	"SET":       InternalKeyKindSet,
-	"MERGE":     InternalKeyKindMerge,
-	"INVALID":   InternalKeyKindInvalid,
-	"MAX":       InternalKeyKindMax,
+	"DEL":        InternalKeyKindDelete,
+	"SINGLEDEL":  InternalKeyKindSingleDelete,
+	"RANGEDEL":   InternalKeyKindRangeDelete,
+	"SET":        InternalKeyKindSet,
+	"MERGE":      InternalKeyKindMerge,
+	"SETTTL":     InternalKeyKindSetWithTTL,
+	"BLOBHANDLE": InternalKeyKindBlobHandle,
+	"INGESTSST":  InternalKeyKindIngestSST,
+	"SEPARATOR":  InternalKeyKindSeparator,
+	"INVALID":    InternalKeyKindInvalid,
+	"MAX":        InternalKeyKindMax,
 }
 
 // ParseInternalKey parses the string representation of an internal key. The
@@ -230,7 +274,7 @@ func (k InternalKey) Separator(
 		// any sequence number and kind here to create a valid separator key. We
 		// use the max sequence number to match the behavior of LevelDB and
 		// RocksDB.
-		return MakeInternalKey(buf, InternalKeySeqNumMax, InternalKeyKindMax)
+		return MakeInternalKey(buf, InternalKeySeqNumMax, InternalKeyKindSeparator)
 	}
 	return k
 }
@@ -247,7 +291,7 @@ func (k InternalKey) Successor(cmp Compare, succ Successor, buf []byte) Internal
 		// any sequence number and kind here to create a valid separator key. We
 		// use the max sequence number to match the behavior of LevelDB and
 		// RocksDB.
-		return MakeInternalKey(buf, InternalKeySeqNumMax, InternalKeyKindMax)
+		return MakeInternalKey(buf, InternalKeySeqNumMax, InternalKeyKindSeparator)
 	}
 	return k
 }
@@ -7,7 +7,9 @@ package base
 import (
 	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cockroachdb/pebble/cache"
 	"github.com/cockroachdb/pebble/vfs"
@@ -21,6 +23,8 @@ const (
 	DefaultCompression Compression = iota
 	NoCompression
 	SnappyCompression
+	ZstdCompression
+	LZ4Compression
 	nCompression
 )
 
@@ -32,6 +36,10 @@ func (c Compression) String() string {
 		return "NoCompression"
 	case SnappyCompression:
 		return "Snappy"
+	case ZstdCompression:
+		return "ZSTD"
+	case LZ4Compression:
+		return "LZ4"
 	default:
 		return "Unknown"
 	}
@@ -43,12 +51,15 @@ type FilterType int
 // The available filter types.
 const (
 	TableFilter FilterType = iota
+	BlockFilter
 )
 
 func (t FilterType) String() string {
 	switch t {
 	case TableFilter:
 		return "table"
+	case BlockFilter:
+		return "block"
 	}
 	return "unknown"
 }
@@ -130,6 +141,66 @@ type TablePropertyCollector interface {
 	Name() string
 }
 
+// BlockPropertyCollector provides a hook for collecting user-defined
+// properties for each data block in an sstable. The properties collected for a
+// data block are stored alongside the block's handle in the index block,
+// which allows an iterator to skip the data block without loading it (see
+// BlockPropertyFilter). The properties of the data blocks referenced by an
+// index block, and of the table as a whole, are collected as well. A new
+// BlockPropertyCollector is created for an sstable when the sstable is being
+// written.
+type BlockPropertyCollector interface {
+	// Name returns the name of the block property collector. The name is used
+	// to match the properties written by the collector with the
+	// BlockPropertyFilter reading them.
+	Name() string
+
+	// Add is called with each new point entry added to the current data block.
+	// The entries are added in increasing key order. Range tombstones are not
+	// stored in data blocks and are not passed to Add.
+	Add(key InternalKey, value []byte) error
+
+	// FinishDataBlock is called when all the entries have been added to the
+	// current data block. The encoded properties of the data block are appended
+	// to buf and returned. An empty result indicates the block has no
+	// properties.
+	FinishDataBlock(buf []byte) ([]byte, error)
+
+	// AddPrevDataBlockToIndexBlock is called after the handle of the data
+	// block most recently passed to FinishDataBlock has been added to the
+	// current index block.
+	AddPrevDataBlockToIndexBlock()
+
+	// FinishIndexBlock is called when the current index block is finished. The
+	// encoded properties of the data blocks referenced by the index block are
+	// appended to buf and returned. It is only called for sstables with a two
+	// level index.
+	FinishIndexBlock(buf []byte) ([]byte, error)
+
+	// FinishTable is called when the sstable is finished. The encoded
+	// properties of all the data blocks in the table are appended to buf and
+	// returned.
+	FinishTable(buf []byte) ([]byte, error)
+}
+
+// BlockPropertyFilter is used by an iterator to skip the data blocks of an
+// sstable whose properties, as collected by the BlockPropertyCollector with
+// the same name, show that the block contains no interesting entries. The
+// filter is also applied to the properties of index blocks and of the table as
+// a whole. A filter for which the sstable has no properties does not exclude
+// any blocks.
+type BlockPropertyFilter interface {
+	// Name returns the name of the block property collector whose properties
+	// the filter reads.
+	Name() string
+
+	// Intersects returns true if the set represented by prop intersects the
+	// set described by the filter, in which case the block (or table) must be
+	// read. The prop is empty if the collector wrote no properties for the
+	// block.
+	Intersects(prop []byte) (bool, error)
+}
+
 // LevelOptions holds the optional per-level parameters.
 type LevelOptions struct {
 	// BlockRestartInterval is the number of keys between restart points
@@ -218,6 +289,17 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 // apply to the DB at large; per-query options are defined by the IterOptions
 // and WriteOptions types.
 type Options struct {
+	// BlobGarbageRatio is the fraction of the bytes of a blob file which must
+	// be garbage, no longer referenced by any table, before compactions rewrite
+	// the remaining live values of the blob file to new blob files. Once none
+	// of its values are referenced the blob file is deleted. See
+	// ValueSeparationThreshold.
+	//
+	// The default value is 0.5. A value of 1 or more disables the rewriting of
+	// blob files, which are then only deleted once all of their values are
+	// garbage.
+	BlobGarbageRatio float64
+
 	// Sync sstables and the WAL periodically in order to smooth out writes to
 	// disk. This option does not provide any persistency guarantee, but is used
 	// to avoid latency spikes if the OS automatically decides to write out a
@@ -231,6 +313,28 @@ type Options struct {
 	// The default cache size is 8 MB.
 	Cache *cache.Cache
 
+	// Clock returns the current time. It determines the expiration time of keys
+	// written with a TTL (see DB.SetWithTTL) and whether such keys have
+	// expired. Tests may supply a fake clock in order to control expiration.
+	//
+	// The default value is time.Now.
+	Clock func() time.Time
+
+	// ColumnFamilies maps the name of each non-default column family to its
+	// options. Every column family present in the DB must have an entry when
+	// the DB is opened, and column families named here which do not exist yet
+	// are created by Open. The DB-wide options (e.g. Cache, FS, Logger and the
+	// WAL related settings) are always taken from the DB's options; the
+	// remaining fields (e.g. Comparer, Merger, Levels and MemTableSize) apply to
+	// the column family. See DB.CreateColumnFamily.
+	ColumnFamilies map[string]*Options
+
+	// CompactionFilter is consulted during compactions to remove or rewrite
+	// key/value pairs. See CompactionFilter for details.
+	//
+	// The default value is nil, which retains all key/value pairs.
+	CompactionFilter CompactionFilter
+
 	// Comparer defines a total ordering over the space of []byte keys: a 'less
 	// than' relationship. The same comparison algorithm must be used for reads
 	// and writes over the lifetime of the DB.
@@ -245,6 +349,17 @@ type Options struct {
 	// TODO(peter): untested
 	DisableWAL bool
 
+	// DiskSpaceReservation is the amount of free disk space, in bytes, which
+	// automatic compactions leave in reserve for flushes. A compaction
+	// temporarily requires disk space for its output before its inputs are
+	// deleted, so a compaction is deferred while the estimated size of its
+	// output, plus that of the in-progress compactions, would reduce the free
+	// space in the DB's directory below the reservation. The free space is
+	// determined using FS.GetDiskUsage.
+	//
+	// The default value of 0 disables the reservation.
+	DiskSpaceReservation int64
+
 	// ErrorIfDBExists is whether it is an error if the database already exists.
 	//
 	// The default value is false.
@@ -265,6 +380,15 @@ type Options struct {
 	// The default value uses the underlying operating system's file system.
 	FS vfs.FS
 
+	// FreeDiskSpaceStopWritesThreshold is the amount of free disk space, in
+	// bytes, below which writes are stopped. Writes stall when the memtable
+	// needs to be rotated while the free space in the DB's directory is below
+	// the threshold, and resume once space has been freed. The free space is
+	// determined using FS.GetDiskUsage.
+	//
+	// The default value of 0 never stops writes due to a lack of disk space.
+	FreeDiskSpaceStopWritesThreshold int64
+
 	// The number of files necessary to trigger an L0 compaction.
 	L0CompactionThreshold int
 
@@ -288,6 +412,24 @@ type Options struct {
 	// The default logger uses the Go standard library log package.
 	Logger Logger
 
+	// MaxConcurrentCompactions specifies the maximum number of concurrent
+	// compactions. Compactions which run concurrently are required to operate
+	// on disjoint sets of input tables and must not write overlapping key
+	// ranges into the same level. Flushes are not counted against this limit.
+	//
+	// The default value is 1.
+	MaxConcurrentCompactions int
+
+	// MaxSubcompactions specifies the maximum number of subcompactions a
+	// compaction is split into. A subcompaction processes a key range of the
+	// compaction inputs, with the boundaries of the key ranges chosen from the
+	// boundaries of the input tables, and runs concurrently with the other
+	// subcompactions of the compaction. Subcompactions are not counted against
+	// MaxConcurrentCompactions. Flushes are never split.
+	//
+	// The default value is 1, which disables subcompactions.
+	MaxSubcompactions int
+
 	// MaxManifestFileSize is the maximum size the MANIFEST file is allowed to
 	// become. When the MANIFEST exceeds this size it is rolled over and a new
 	// MANIFEST is created.
@@ -321,16 +463,40 @@ type Options struct {
 	// default is 4 MB/s.
 	MinCompactionRate int
 
+	// MinDeletionRate sets the rate, in bytes per second, at which obsolete
+	// sstables are deleted. Deleting many large files at once can cause latency
+	// spikes on some SSDs, so when pacing is enabled obsolete sstables are
+	// deleted in the background at this rate. While the obsolete sstables
+	// queued for deletion exceed 20% of the size of the live sstables, the rate
+	// is increased in proportion to the backlog. The default value of 0
+	// disables pacing: obsolete sstables are deleted as soon as they become
+	// obsolete.
+	MinDeletionRate int
+
 	// MinFlushRate sets the minimum rate at which the MemTables are flushed. The
 	// default is 1 MB/s.
 	MinFlushRate int
 
+	// Pacer, if non-nil, rate limits the I/O performed by flushes and
+	// compactions in place of the default pacing. See Pacer for details.
+	Pacer Pacer
+
 	// ReadOnly indicates that the DB should be opened in read-only mode. Writes
 	// to the DB will return an error, background compactions are disabled, and
 	// the flush that normally occurs after replaying the WAL at startup is
 	// disabled.
 	ReadOnly bool
 
+	// RetainWALs causes WAL files to be retained after their contents have
+	// been flushed until the updates they contain have been acknowledged (see
+	// DB.AcknowledgeUpdates). This allows a consumer of DB.GetUpdatesSince to
+	// resume from the last sequence number it acknowledged. The acknowledged
+	// sequence number is not persisted: after the DB is reopened, the WAL files
+	// which existed at startup are retained until all of the updates committed
+	// before the DB was reopened have been acknowledged. Has no effect if
+	// DisableWAL is true.
+	RetainWALs bool
+
 	// TableFormat specifies the format version for writing sstables. The default
 	// is TableFormatRocksDBv2 which creates RocksDB compatible sstables. Use
 	// TableFormatLevelDB to create LevelDB compatible sstable which can be used
@@ -342,6 +508,26 @@ type Options struct {
 	// and lives for the lifetime of the table.
 	TablePropertyCollectors []func() TablePropertyCollector
 
+	// BlockPropertyCollectors is a list of BlockPropertyCollector creation
+	// functions. A new BlockPropertyCollector is created for each sstable
+	// built and lives for the lifetime of the table. At most 256 block property
+	// collectors may be specified.
+	BlockPropertyCollectors []func() BlockPropertyCollector
+
+	// ValueSeparationThreshold enables the separation of large values from
+	// the LSM. Values larger than the threshold are written by flushes to blob
+	// files, and the sstables store a small handle to the value in place of
+	// the value itself. Compactions copy the handles rather than the values,
+	// which reduces write amplification for large values at the cost of an
+	// additional read when the value is retrieved. Blob files are deleted once
+	// none of their values are referenced, and are rewritten by compactions
+	// once the fraction of their bytes which are garbage exceeds
+	// BlobGarbageRatio. Values written with SetWithTTL and
+	// the results of merges are never separated.
+	//
+	// The default value of 0 disables value separation.
+	ValueSeparationThreshold int
+
 	// WALDir specifies the directory to store write-ahead logs (WALs) in. If
 	// empty (the default), WALs will be stored in the same directory as sstables
 	// (i.e. the directory passed to pebble.Open).
@@ -354,12 +540,18 @@ func (o *Options) EnsureDefaults() *Options {
 	if o == nil {
 		o = &Options{}
 	}
+	if o.BlobGarbageRatio <= 0 {
+		o.BlobGarbageRatio = 0.5
+	}
 	if o.BytesPerSync <= 0 {
 		o.BytesPerSync = 512 << 10 // 512 KB
 	}
 	if o.Cache == nil {
 		o.Cache = cache.New(8 << 20) // 8 MB
 	}
+	if o.Clock == nil {
+		o.Clock = time.Now
+	}
 	if o.Comparer == nil {
 		o.Comparer = DefaultComparer
 	}
@@ -395,6 +587,12 @@ func (o *Options) EnsureDefaults() *Options {
 		o.Logger = defaultLogger{}
 	}
 	o.EventListener.EnsureDefaults(o.Logger)
+	if o.MaxConcurrentCompactions <= 0 {
+		o.MaxConcurrentCompactions = 1
+	}
+	if o.MaxSubcompactions <= 0 {
+		o.MaxSubcompactions = 1
+	}
 	if o.MaxManifestFileSize == 0 {
 		o.MaxManifestFileSize = 128 << 20 // 128 MB
 	}
@@ -466,20 +664,37 @@ func (o *Options) String() string {
 	fmt.Fprintf(&buf, "  pebble_version=0.1\n")
 	fmt.Fprintf(&buf, "\n")
 	fmt.Fprintf(&buf, "[Options]\n")
+	fmt.Fprintf(&buf, "  blob_garbage_ratio=%g\n", o.BlobGarbageRatio)
+	fmt.Fprintf(&buf, "  block_property_collectors=[")
+	for i := range o.BlockPropertyCollectors {
+		if i > 0 {
+			fmt.Fprintf(&buf, ",")
+		}
+		// NB: This creates a new BlockPropertyCollector, but Options.String() is
+		// called rarely so the overhead of doing so is not consequential.
+		fmt.Fprintf(&buf, "%s", o.BlockPropertyCollectors[i]().Name())
+	}
+	fmt.Fprintf(&buf, "]\n")
 	fmt.Fprintf(&buf, "  bytes_per_sync=%d\n", o.BytesPerSync)
 	fmt.Fprintf(&buf, "  cache_size=%d\n", o.Cache.MaxSize())
 	fmt.Fprintf(&buf, "  comparer=%s\n", o.Comparer.Name)
 	fmt.Fprintf(&buf, "  disable_wal=%t\n", o.DisableWAL)
+	fmt.Fprintf(&buf, "  disk_space_reservation=%d\n", o.DiskSpaceReservation)
+	fmt.Fprintf(&buf, "  free_disk_space_stop_writes_threshold=%d\n", o.FreeDiskSpaceStopWritesThreshold)
 	fmt.Fprintf(&buf, "  l0_compaction_threshold=%d\n", o.L0CompactionThreshold)
 	fmt.Fprintf(&buf, "  l0_stop_writes_threshold=%d\n", o.L0StopWritesThreshold)
 	fmt.Fprintf(&buf, "  lbase_max_bytes=%d\n", o.LBaseMaxBytes)
+	fmt.Fprintf(&buf, "  max_concurrent_compactions=%d\n", o.MaxConcurrentCompactions)
 	fmt.Fprintf(&buf, "  max_manifest_file_size=%d\n", o.MaxManifestFileSize)
 	fmt.Fprintf(&buf, "  max_open_files=%d\n", o.MaxOpenFiles)
+	fmt.Fprintf(&buf, "  max_subcompactions=%d\n", o.MaxSubcompactions)
 	fmt.Fprintf(&buf, "  mem_table_size=%d\n", o.MemTableSize)
 	fmt.Fprintf(&buf, "  mem_table_stop_writes_threshold=%d\n", o.MemTableStopWritesThreshold)
 	fmt.Fprintf(&buf, "  min_compaction_rate=%d\n", o.MinCompactionRate)
+	fmt.Fprintf(&buf, "  min_deletion_rate=%d\n", o.MinDeletionRate)
 	fmt.Fprintf(&buf, "  min_flush_rate=%d\n", o.MinFlushRate)
 	fmt.Fprintf(&buf, "  merger=%s\n", o.Merger.Name)
+	fmt.Fprintf(&buf, "  retain_wals=%t\n", o.RetainWALs)
 	fmt.Fprintf(&buf, "  table_property_collectors=[")
 	for i := range o.TablePropertyCollectors {
 		if i > 0 {
@@ -490,6 +705,7 @@ func (o *Options) String() string {
 		fmt.Fprintf(&buf, "%s", o.TablePropertyCollectors[i]().Name())
 	}
 	fmt.Fprintf(&buf, "]\n")
+	fmt.Fprintf(&buf, "  value_separation_threshold=%d\n", o.ValueSeparationThreshold)
 	fmt.Fprintf(&buf, "  wal_dir=%s\n", o.WALDir)
 
 	for i := range o.Levels {
@@ -508,10 +724,11 @@ func (o *Options) String() string {
 	return buf.String()
 }
 
-// Check verifies the options are compatible with the previous options
-// serialized by Options.String(). For example, the Comparer and Merger must be
-// the same, or data will not be able to be properly read from the DB.
-func (o *Options) Check(s string) error {
+type parseOptionsFn func(section, key, value string) error
+
+// parseOptions parses the INI-style syntax produced by Options.String(),
+// invoking fn for each key=value pair.
+func parseOptions(s string, fn parseOptionsFn) error {
 	var section string
 	for _, line := range strings.Split(s, "\n") {
 		line = strings.TrimSpace(line)
@@ -537,12 +754,267 @@ func (o *Options) Check(s string) error {
 
 		key := strings.TrimSpace(line[:pos])
 		value := strings.TrimSpace(line[pos+1:])
-		path := section + "." + key
+		if err := fn(section, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseHooks contains callbacks used by Options.Parse to create the options
+// which cannot be described by a string alone, such as the Comparer and
+// Merger. Each hook is passed the name recorded in the options string.
+type ParseHooks struct {
+	// NewCache creates the block cache. If nil, cache.New is used.
+	NewCache func(size int64) *cache.Cache
+	// NewComparer returns the comparer with the specified name. If nil, only
+	// the name of DefaultComparer is recognized.
+	NewComparer func(name string) (*Comparer, error)
+	// NewFilterPolicy returns the filter policy with the specified name. If
+	// nil, only levels without a filter policy can be parsed.
+	NewFilterPolicy func(name string) (FilterPolicy, error)
+	// NewMerger returns the merger with the specified name. If nil, only the
+	// name of DefaultMerger is recognized.
+	NewMerger func(name string) (*Merger, error)
+	// NewTablePropertyCollector returns a function creating the table property
+	// collector with the specified name. If nil, only options without table
+	// property collectors can be parsed.
+	NewTablePropertyCollector func(name string) (func() TablePropertyCollector, error)
+	// NewBlockPropertyCollector returns a function creating the block property
+	// collector with the specified name. If nil, only options without block
+	// property collectors can be parsed.
+	NewBlockPropertyCollector func(name string) (func() BlockPropertyCollector, error)
+	// SkipUnknown returns true if the unknown option with the specified name
+	// (of the form "section.key") should be ignored rather than causing an
+	// error. This can be used to parse options written by a newer version.
+	SkipUnknown func(name string) bool
+}
+
+// Parse parses the options from the specified string, which must be in the
+// format produced by Options.String(). Options which are not present in the
+// string are left unchanged. The hooks are used to create the options which
+// cannot be described by a string alone; a nil hooks is equivalent to an
+// empty ParseHooks.
+func (o *Options) Parse(s string, hooks *ParseHooks) error {
+	if hooks == nil {
+		hooks = &ParseHooks{}
+	}
+	return parseOptions(s, func(section, key, value string) error {
+		// WARNING: DO NOT remove entries from the switches below because doing so
+		// causes a key previously written to the OPTIONS file to be considered
+		// unknown, a backwards incompatible change. Instead, leave in support
+		// for parsing the key but simply don't use the parsed value.
+
+		switch {
+		case section == "Version":
+			switch key {
+			case "pebble_version":
+				return nil
+			}
+
+		case section == "Options":
+			var err error
+			switch key {
+			case "blob_garbage_ratio":
+				o.BlobGarbageRatio, err = strconv.ParseFloat(value, 64)
+			case "block_property_collectors":
+				if len(value) < 2 || value[0] != '[' || value[len(value)-1] != ']' {
+					err = fmt.Errorf("expected [<names>]")
+					break
+				}
+				o.BlockPropertyCollectors = nil
+				if value = value[1 : len(value)-1]; value == "" {
+					break
+				}
+				for _, name := range strings.Split(value, ",") {
+					if hooks.NewBlockPropertyCollector == nil {
+						err = fmt.Errorf("unknown block property collector %q", name)
+						break
+					}
+					var fn func() BlockPropertyCollector
+					if fn, err = hooks.NewBlockPropertyCollector(name); err != nil {
+						break
+					}
+					o.BlockPropertyCollectors = append(o.BlockPropertyCollectors, fn)
+				}
+			case "bytes_per_sync":
+				o.BytesPerSync, err = strconv.Atoi(value)
+			case "cache_size":
+				var n int64
+				n, err = strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					if hooks.NewCache != nil {
+						o.Cache = hooks.NewCache(n)
+					} else {
+						o.Cache = cache.New(n)
+					}
+				}
+			case "comparer":
+				switch {
+				case hooks.NewComparer != nil:
+					o.Comparer, err = hooks.NewComparer(value)
+				case value == DefaultComparer.Name:
+					o.Comparer = DefaultComparer
+				default:
+					err = fmt.Errorf("unknown comparer %q", value)
+				}
+			case "disable_wal":
+				o.DisableWAL, err = strconv.ParseBool(value)
+			case "disk_space_reservation":
+				o.DiskSpaceReservation, err = strconv.ParseInt(value, 10, 64)
+			case "free_disk_space_stop_writes_threshold":
+				o.FreeDiskSpaceStopWritesThreshold, err = strconv.ParseInt(value, 10, 64)
+			case "l0_compaction_threshold":
+				o.L0CompactionThreshold, err = strconv.Atoi(value)
+			case "l0_stop_writes_threshold":
+				o.L0StopWritesThreshold, err = strconv.Atoi(value)
+			case "lbase_max_bytes":
+				o.LBaseMaxBytes, err = strconv.ParseInt(value, 10, 64)
+			case "max_concurrent_compactions":
+				o.MaxConcurrentCompactions, err = strconv.Atoi(value)
+			case "max_manifest_file_size":
+				o.MaxManifestFileSize, err = strconv.ParseInt(value, 10, 64)
+			case "max_open_files":
+				o.MaxOpenFiles, err = strconv.Atoi(value)
+			case "max_subcompactions":
+				o.MaxSubcompactions, err = strconv.Atoi(value)
+			case "mem_table_size":
+				o.MemTableSize, err = strconv.Atoi(value)
+			case "mem_table_stop_writes_threshold":
+				o.MemTableStopWritesThreshold, err = strconv.Atoi(value)
+			case "min_compaction_rate":
+				o.MinCompactionRate, err = strconv.Atoi(value)
+			case "min_deletion_rate":
+				o.MinDeletionRate, err = strconv.Atoi(value)
+			case "min_flush_rate":
+				o.MinFlushRate, err = strconv.Atoi(value)
+			case "merger":
+				switch {
+				case hooks.NewMerger != nil:
+					o.Merger, err = hooks.NewMerger(value)
+				case value == DefaultMerger.Name:
+					o.Merger = DefaultMerger
+				default:
+					err = fmt.Errorf("unknown merger %q", value)
+				}
+			case "retain_wals":
+				o.RetainWALs, err = strconv.ParseBool(value)
+			case "table_property_collectors":
+				if len(value) < 2 || value[0] != '[' || value[len(value)-1] != ']' {
+					err = fmt.Errorf("expected [<names>]")
+					break
+				}
+				o.TablePropertyCollectors = nil
+				if value = value[1 : len(value)-1]; value == "" {
+					break
+				}
+				for _, name := range strings.Split(value, ",") {
+					if hooks.NewTablePropertyCollector == nil {
+						err = fmt.Errorf("unknown table property collector %q", name)
+						break
+					}
+					var fn func() TablePropertyCollector
+					if fn, err = hooks.NewTablePropertyCollector(name); err != nil {
+						break
+					}
+					o.TablePropertyCollectors = append(o.TablePropertyCollectors, fn)
+				}
+			case "value_separation_threshold":
+				o.ValueSeparationThreshold, err = strconv.Atoi(value)
+			case "wal_dir":
+				o.WALDir = value
+			default:
+				return o.parseUnknown(section, key, hooks)
+			}
+			if err != nil {
+				return fmt.Errorf("pebble: error parsing %s.%s=%s: %v", section, key, value, err)
+			}
+			return nil
+
+		case strings.HasPrefix(section, "Level "):
+			index, err := strconv.Unquote(section[len("Level "):])
+			if err != nil {
+				return fmt.Errorf("pebble: invalid section: %s", section)
+			}
+			n, err := strconv.Atoi(index)
+			if err != nil || n < 0 {
+				return fmt.Errorf("pebble: invalid section: %s", section)
+			}
+			for len(o.Levels) <= n {
+				o.Levels = append(o.Levels, LevelOptions{})
+			}
+			l := &o.Levels[n]
+
+			switch key {
+			case "block_restart_interval":
+				l.BlockRestartInterval, err = strconv.Atoi(value)
+			case "block_size":
+				l.BlockSize, err = strconv.Atoi(value)
+			case "compression":
+				l.Compression, err = parseCompression(value)
+			case "filter_policy":
+				switch {
+				case value == "none":
+					l.FilterPolicy = nil
+				case hooks.NewFilterPolicy != nil:
+					l.FilterPolicy, err = hooks.NewFilterPolicy(value)
+				default:
+					err = fmt.Errorf("unknown filter policy %q", value)
+				}
+			case "filter_type":
+				l.FilterType, err = parseFilterType(value)
+			case "index_block_size":
+				l.IndexBlockSize, err = strconv.Atoi(value)
+			case "target_file_size":
+				l.TargetFileSize, err = strconv.ParseInt(value, 10, 64)
+			default:
+				return o.parseUnknown(section, key, hooks)
+			}
+			if err != nil {
+				return fmt.Errorf("pebble: error parsing %s.%s=%s: %v", section, key, value, err)
+			}
+			return nil
+		}
+		return o.parseUnknown(section, key, hooks)
+	})
+}
+
+func (o *Options) parseUnknown(section, key string, hooks *ParseHooks) error {
+	name := section + "." + key
+	if hooks.SkipUnknown != nil && hooks.SkipUnknown(name) {
+		return nil
+	}
+	return fmt.Errorf("pebble: unknown option: %s", name)
+}
+
+func parseCompression(s string) (Compression, error) {
+	for c := DefaultCompression; c < nCompression; c++ {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return DefaultCompression, fmt.Errorf("unknown compression %q", s)
+}
+
+func parseFilterType(s string) (FilterType, error) {
+	switch s {
+	case "table":
+		return TableFilter, nil
+	case "block":
+		return BlockFilter, nil
+	}
+	return TableFilter, fmt.Errorf("unknown filter type %q", s)
+}
 
+// Check verifies the options are compatible with the previous options
+// serialized by Options.String(). For example, the Comparer and Merger must be
+// the same, or data will not be able to be properly read from the DB.
+func (o *Options) Check(s string) error {
+	return parseOptions(s, func(section, key, value string) error {
 		// RocksDB uses a similar (INI-style) syntax for the OPTIONS file, but
 		// different section names and keys. The "CFOptions ..." paths below are
 		// the RocksDB versions.
-		switch path {
+		switch section + "." + key {
 		case "Options.comparer", `CFOptions "default".comparator`:
 			if value != o.Comparer.Name {
 				return fmt.Errorf("pebble: comparer name from file %q != comparer name from options %q",
@@ -556,6 +1028,6 @@ func (o *Options) Check(s string) error {
 					value, o.Merger.Name)
 			}
 		}
-	}
-	return nil
+		return nil
+	})
 }
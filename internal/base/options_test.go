@@ -40,21 +40,30 @@ func TestOptionsString(t *testing.T) {
   pebble_version=0.1
 
 [Options]
+  blob_garbage_ratio=0.5
+  block_property_collectors=[]
   bytes_per_sync=524288
   cache_size=8388608
   comparer=leveldb.BytewiseComparator
   disable_wal=false
+  disk_space_reservation=0
+  free_disk_space_stop_writes_threshold=0
   l0_compaction_threshold=4
   l0_stop_writes_threshold=12
   lbase_max_bytes=67108864
+  max_concurrent_compactions=1
   max_manifest_file_size=134217728
   max_open_files=1000
+  max_subcompactions=1
   mem_table_size=4194304
   mem_table_stop_writes_threshold=2
   min_compaction_rate=4194304
+  min_deletion_rate=0
   min_flush_rate=1048576
   merger=pebble.concatenate
+  retain_wals=false
   table_property_collectors=[]
+  value_separation_threshold=0
   wal_dir=
 
 [Level "0"]
@@ -116,3 +125,101 @@ func TestOptionsCheck(t *testing.T) {
 	tmp = *opts
 	require.NoError(t, tmp.Check(s))
 }
+
+type testFilterPolicy string
+
+func (p testFilterPolicy) Name() string                                         { return string(p) }
+func (p testFilterPolicy) MayContain(ftype FilterType, filter, key []byte) bool { return true }
+func (p testFilterPolicy) NewWriter(ftype FilterType) FilterWriter              { return nil }
+
+type testPropertyCollector struct{}
+
+func (testPropertyCollector) Add(key InternalKey, value []byte) error  { return nil }
+func (testPropertyCollector) Finish(userProps map[string]string) error { return nil }
+func (testPropertyCollector) Name() string                             { return "test-collector" }
+
+type testBlockPropertyCollector struct{}
+
+func (testBlockPropertyCollector) Name() string                            { return "test-block-collector" }
+func (testBlockPropertyCollector) Add(key InternalKey, value []byte) error { return nil }
+func (testBlockPropertyCollector) FinishDataBlock(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+func (testBlockPropertyCollector) AddPrevDataBlockToIndexBlock() {}
+func (testBlockPropertyCollector) FinishIndexBlock(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+func (testBlockPropertyCollector) FinishTable(buf []byte) ([]byte, error) { return buf, nil }
+
+func TestOptionsParse(t *testing.T) {
+	hooks := &ParseHooks{
+		NewComparer: func(name string) (*Comparer, error) {
+			return &Comparer{Name: name}, nil
+		},
+		NewFilterPolicy: func(name string) (FilterPolicy, error) {
+			return testFilterPolicy(name), nil
+		},
+		NewMerger: func(name string) (*Merger, error) {
+			return &Merger{Name: name}, nil
+		},
+		NewTablePropertyCollector: func(name string) (func() TablePropertyCollector, error) {
+			return func() TablePropertyCollector { return testPropertyCollector{} }, nil
+		},
+		NewBlockPropertyCollector: func(name string) (func() BlockPropertyCollector, error) {
+			return func() BlockPropertyCollector { return testBlockPropertyCollector{} }, nil
+		},
+	}
+
+	for _, opts := range []*Options{
+		(*Options)(nil).EnsureDefaults(),
+		(&Options{
+			BlockPropertyCollectors: []func() BlockPropertyCollector{
+				func() BlockPropertyCollector { return testBlockPropertyCollector{} },
+			},
+			BytesPerSync:                     1 << 10,
+			Comparer:                         &Comparer{Name: "test-comparer"},
+			DisableWAL:                       true,
+			DiskSpaceReservation:             1 << 30,
+			FreeDiskSpaceStopWritesThreshold: 1 << 28,
+			LBaseMaxBytes:                    1 << 30,
+			Merger:                           &Merger{Name: "test-merger"},
+			MaxSubcompactions:                4,
+			MinCompactionRate:                1 << 24,
+			MinDeletionRate:                  1 << 20,
+			RetainWALs:                       true,
+			Levels: []LevelOptions{
+				{BlockSize: 1 << 12, Compression: NoCompression},
+				{
+					Compression:    ZstdCompression,
+					FilterPolicy:   testFilterPolicy("test-filter"),
+					FilterType:     BlockFilter,
+					TargetFileSize: 1 << 28,
+				},
+			},
+			TablePropertyCollectors: []func() TablePropertyCollector{
+				func() TablePropertyCollector { return testPropertyCollector{} },
+			},
+			ValueSeparationThreshold: 1 << 10,
+			WALDir:                   "wal",
+		}).EnsureDefaults(),
+	} {
+		s := opts.String()
+		var parsed Options
+		require.NoError(t, parsed.Parse(s, hooks))
+		require.Equal(t, s, parsed.String())
+	}
+
+	var opts Options
+	require.Regexp(t, `unknown comparer "foo"`, opts.Parse("[Options]\n comparer=foo\n", nil))
+	require.NoError(t, opts.Parse("[Options]\n comparer=leveldb.BytewiseComparator\n", nil))
+	require.Equal(t, DefaultComparer, opts.Comparer)
+	require.Regexp(t, `error parsing Options.max_open_files=x`,
+		opts.Parse("[Options]\n max_open_files=x\n", nil))
+	require.Regexp(t, `invalid section: Level "x"`, opts.Parse("[Level \"x\"]\n block_size=1\n", nil))
+
+	const unknown = "[Options]\n foo=bar\n"
+	require.Regexp(t, `unknown option: Options.foo`, opts.Parse(unknown, nil))
+	require.NoError(t, opts.Parse(unknown, &ParseHooks{
+		SkipUnknown: func(name string) bool { return name == "Options.foo" },
+	}))
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package base
+
+// PacerOperation identifies the background operation being paced.
+type PacerOperation int
+
+// The PacerOperation constants.
+const (
+	PacerFlush PacerOperation = iota
+	PacerCompaction
+)
+
+func (o PacerOperation) String() string {
+	switch o {
+	case PacerFlush:
+		return "flush"
+	case PacerCompaction:
+		return "compaction"
+	}
+	return "unknown"
+}
+
+// Pacer rate limits the background I/O performed by flushes and
+// compactions. A Pacer replaces the default pacing, which limits flushes and
+// compactions to Options.MinFlushRate and Options.MinCompactionRate while
+// they are keeping up with incoming writes and lets them run unthrottled
+// otherwise.
+//
+// A Pacer is invoked concurrently by flushes and compactions and must
+// therefore be safe for concurrent use.
+type Pacer interface {
+	// Throttle is invoked after n bytes have been processed by a flush or
+	// compaction. It may block in order to slow the operation down. Returning
+	// an error fails the operation.
+	Throttle(op PacerOperation, n uint64) error
+}
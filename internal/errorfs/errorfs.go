@@ -0,0 +1,325 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package errorfs provides a vfs.FS which injects errors into the operations
+// performed on an underlying vfs.FS, for testing error paths.
+package errorfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// ErrInjected is the error returned by injected failures.
+var ErrInjected = errors.New("injected error")
+
+// OpType enumerates the types of operations into which errors can be
+// injected.
+type OpType int
+
+// The OpType enumeration.
+const (
+	OpCreate OpType = iota
+	OpWrite
+	OpSync
+	OpRename
+	OpLink
+	OpReadAt
+)
+
+var opTypeNames = []string{
+	OpCreate: "create",
+	OpWrite:  "write",
+	OpSync:   "sync",
+	OpRename: "rename",
+	OpLink:   "link",
+	OpReadAt: "readat",
+}
+
+func (t OpType) String() string {
+	if t >= 0 && int(t) < len(opTypeNames) {
+		return opTypeNames[t]
+	}
+	return fmt.Sprintf("OpType(%d)", int(t))
+}
+
+// ParseOpType parses the name of an OpType, as returned by OpType.String.
+func ParseOpType(s string) (OpType, error) {
+	for t, name := range opTypeNames {
+		if name == s {
+			return OpType(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown op type %q", s)
+}
+
+// Op describes a filesystem operation.
+type Op struct {
+	Type OpType
+	// Path is the path of the file operated on. For Rename and Link, Path is
+	// the new path.
+	Path string
+}
+
+func (op Op) String() string {
+	return fmt.Sprintf("%s %s", op.Type, op.Path)
+}
+
+// Injector decides whether to inject an error into an operation.
+type Injector interface {
+	// MaybeError returns the error to inject into the operation, or nil if the
+	// operation should proceed normally.
+	MaybeError(op Op) error
+}
+
+// InjectorFunc implements Injector using a function.
+type InjectorFunc func(op Op) error
+
+// MaybeError implements the Injector interface.
+func (f InjectorFunc) MaybeError(op Op) error {
+	return f(op)
+}
+
+// Predicate selects operations.
+type Predicate func(op Op) bool
+
+// OpTypes returns a predicate matching operations of the specified types.
+func OpTypes(types ...OpType) Predicate {
+	return func(op Op) bool {
+		for _, t := range types {
+			if op.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// FileTypes returns a predicate matching operations on the specified types
+// of DB files, as determined by base.ParseFilename.
+func FileTypes(types ...base.FileType) Predicate {
+	return func(op Op) bool {
+		fileType, _, ok := base.ParseFilename(vfs.Default, op.Path)
+		if !ok {
+			return false
+		}
+		for _, t := range types {
+			if fileType == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// PathMatch returns a predicate matching operations on paths whose last
+// element matches the specified filepath.Match pattern.
+func PathMatch(pattern string) Predicate {
+	return func(op Op) bool {
+		ok, _ := filepath.Match(pattern, filepath.Base(op.Path))
+		return ok
+	}
+}
+
+// And returns a predicate matching operations that match all of the specified
+// predicates.
+func And(preds ...Predicate) Predicate {
+	return func(op Op) bool {
+		for _, pred := range preds {
+			if !pred(op) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// OnMatch returns an Injector which fails every operation matching the
+// predicate.
+func OnMatch(pred Predicate) Injector {
+	return InjectorFunc(func(op Op) error {
+		if pred(op) {
+			return ErrInjected
+		}
+		return nil
+	})
+}
+
+// OnIndex returns an Injector which fails the index'th (zero-based) operation
+// matching the predicate. A nil predicate matches every operation.
+func OnIndex(index int32, pred Predicate) *InjectIndex {
+	return &InjectIndex{index: index, pred: pred}
+}
+
+// InjectIndex implements Injector, failing the operation at a specified
+// index. It is safe for concurrent use.
+type InjectIndex struct {
+	index int32
+	pred  Predicate
+}
+
+// Index returns the index of the operation which will fail, relative to the
+// operations matched so far. A negative index indicates that the failure has
+// already been injected.
+func (ii *InjectIndex) Index() int32 {
+	return atomic.LoadInt32(&ii.index)
+}
+
+// SetIndex sets the index of the next operation to fail, relative to the
+// operations matched so far.
+func (ii *InjectIndex) SetIndex(v int32) {
+	atomic.StoreInt32(&ii.index, v)
+}
+
+// MaybeError implements the Injector interface.
+func (ii *InjectIndex) MaybeError(op Op) error {
+	if ii.pred != nil && !ii.pred(op) {
+		return nil
+	}
+	if atomic.AddInt32(&ii.index, -1) == -1 {
+		return ErrInjected
+	}
+	return nil
+}
+
+// FS implements vfs.FS, injecting errors into the operations performed on an
+// underlying vfs.FS.
+type FS struct {
+	fs  vfs.FS
+	inj Injector
+}
+
+var _ vfs.FS = (*FS)(nil)
+
+// Wrap wraps an existing vfs.FS, injecting errors into its operations as
+// decided by the Injector.
+func Wrap(fs vfs.FS, inj Injector) *FS {
+	return &FS{fs: fs, inj: inj}
+}
+
+// Unwrap returns the underlying vfs.FS.
+func (fs *FS) Unwrap() vfs.FS {
+	return fs.fs
+}
+
+// Create implements vfs.FS.Create.
+func (fs *FS) Create(name string) (vfs.File, error) {
+	if err := fs.inj.MaybeError(Op{Type: OpCreate, Path: name}); err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &file{File: f, name: name, inj: fs.inj}, nil
+}
+
+// Link implements vfs.FS.Link.
+func (fs *FS) Link(oldname, newname string) error {
+	if err := fs.inj.MaybeError(Op{Type: OpLink, Path: newname}); err != nil {
+		return err
+	}
+	return fs.fs.Link(oldname, newname)
+}
+
+// Open implements vfs.FS.Open.
+func (fs *FS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	f, err := fs.fs.Open(name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &file{File: f, name: name, inj: fs.inj}, nil
+}
+
+// OpenDir implements vfs.FS.OpenDir.
+func (fs *FS) OpenDir(name string) (vfs.File, error) {
+	f, err := fs.fs.OpenDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &file{File: f, name: name, inj: fs.inj}, nil
+}
+
+// Remove implements vfs.FS.Remove.
+func (fs *FS) Remove(name string) error {
+	return fs.fs.Remove(name)
+}
+
+// Rename implements vfs.FS.Rename.
+func (fs *FS) Rename(oldname, newname string) error {
+	if err := fs.inj.MaybeError(Op{Type: OpRename, Path: newname}); err != nil {
+		return err
+	}
+	return fs.fs.Rename(oldname, newname)
+}
+
+// MkdirAll implements vfs.FS.MkdirAll.
+func (fs *FS) MkdirAll(dir string, perm os.FileMode) error {
+	return fs.fs.MkdirAll(dir, perm)
+}
+
+// Lock implements vfs.FS.Lock.
+func (fs *FS) Lock(name string) (io.Closer, error) {
+	return fs.fs.Lock(name)
+}
+
+// List implements vfs.FS.List.
+func (fs *FS) List(dir string) ([]string, error) {
+	return fs.fs.List(dir)
+}
+
+// Stat implements vfs.FS.Stat.
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	return fs.fs.Stat(name)
+}
+
+// PathBase implements vfs.FS.PathBase.
+func (fs *FS) PathBase(path string) string {
+	return fs.fs.PathBase(path)
+}
+
+// PathJoin implements vfs.FS.PathJoin.
+func (fs *FS) PathJoin(elem ...string) string {
+	return fs.fs.PathJoin(elem...)
+}
+
+// GetDiskUsage implements vfs.FS.GetDiskUsage.
+func (fs *FS) GetDiskUsage(path string) (vfs.DiskUsage, error) {
+	return fs.fs.GetDiskUsage(path)
+}
+
+// file implements vfs.File, injecting errors into Write, Sync and ReadAt.
+type file struct {
+	vfs.File
+	name string
+	inj  Injector
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if err := f.inj.MaybeError(Op{Type: OpWrite, Path: f.name}); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *file) Sync() error {
+	if err := f.inj.MaybeError(Op{Type: OpSync, Path: f.name}); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.inj.MaybeError(Op{Type: OpReadAt, Path: f.name}); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
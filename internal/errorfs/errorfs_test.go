@@ -0,0 +1,68 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package errorfs
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnIndex(t *testing.T) {
+	inj := OnIndex(1, And(OpTypes(OpWrite, OpSync), FileTypes(base.FileTypeTable)))
+	fs := Wrap(vfs.NewMem(), inj)
+
+	f, err := fs.Create("000001.log")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("a"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	f, err = fs.Create("000002.sst")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, ErrInjected, f.Sync())
+	require.True(t, inj.Index() < 0)
+	require.NoError(t, f.Sync())
+
+	inj.SetIndex(0)
+	_, err = f.Write([]byte("b"))
+	require.Equal(t, ErrInjected, err)
+	require.NoError(t, f.Close())
+
+	f, err = fs.Open("000002.sst")
+	require.NoError(t, err)
+	buf := make([]byte, 2)
+	_, err = f.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "a", string(buf[:1]))
+	require.NoError(t, f.Close())
+}
+
+func TestOnMatch(t *testing.T) {
+	fs := Wrap(vfs.NewMem(), OnMatch(And(OpTypes(OpCreate, OpRename), PathMatch("CURRENT*"))))
+
+	_, err := fs.Create("CURRENT.000001.dbtmp")
+	require.Equal(t, ErrInjected, err)
+	f, err := fs.Create("MANIFEST-000001")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, ErrInjected, fs.Rename("MANIFEST-000001", "CURRENT"))
+	require.NoError(t, fs.Rename("MANIFEST-000001", "MANIFEST-000002"))
+	require.NoError(t, fs.Link("MANIFEST-000002", "CURRENT"))
+}
+
+func TestParseOpType(t *testing.T) {
+	for _, op := range []OpType{OpCreate, OpWrite, OpSync, OpRename, OpLink, OpReadAt} {
+		parsed, err := ParseOpType(op.String())
+		require.NoError(t, err)
+		require.Equal(t, op, parsed)
+	}
+	_, err := ParseOpType("unknown")
+	require.Error(t, err)
+}
@@ -48,6 +48,37 @@ type FileMetadata struct {
 	LargestSeqNum  uint64
 	// true if client asked us nicely to compact this file.
 	MarkedForCompaction bool
+	// BlobRefs records the blob files holding values referenced by the table,
+	// sorted by blob file number.
+	BlobRefs []BlobReference
+}
+
+// BlobReference records the number of bytes of the records in a blob file
+// whose values are referenced by a table. A record's bytes include its
+// trailer, so the references to every record of a blob file sum to the size
+// of the blob file.
+type BlobReference struct {
+	FileNum uint64
+	Bytes   uint64
+}
+
+// BlobFileMetadata holds the metadata for an on-disk blob file.
+type BlobFileMetadata struct {
+	// reference count for the blob file: incremented when the blob file is
+	// added to a version and decremented when the version is unreferenced. The
+	// blob file is obsolete when the reference count falls to zero.
+	refs *int32
+	// FileNum is the file number.
+	FileNum uint64
+	// Size is the size of the file, in bytes.
+	Size uint64
+	// LiveBytes is the number of bytes of the records in the blob file whose
+	// values are referenced by the tables in the version. It is derived from
+	// the BlobRefs of the tables. The remaining Size-LiveBytes bytes are
+	// garbage. A blob file is removed from a version once none of its values
+	// are referenced, and its live values are rewritten by compactions once
+	// the fraction of garbage exceeds Options.BlobGarbageRatio.
+	LiveBytes uint64
 }
 
 func (m *FileMetadata) String() string {
@@ -171,9 +202,14 @@ type Version struct {
 
 	Files [NumLevels][]FileMetadata
 
+	// BlobFiles are the blob files holding values referenced by the tables in
+	// the version, sorted by file number.
+	BlobFiles []BlobFileMetadata
+
 	// The callback to invoke when the last reference to a version is
-	// removed. Will be called with list.mu held.
-	Deleted func(obsolete []uint64)
+	// removed. Will be called with list.mu held. The callback is passed the
+	// file numbers of the tables and blob files which became obsolete.
+	Deleted func(obsoleteTables, obsoleteBlobFiles []uint64)
 
 	// The list the version is linked into.
 	list *VersionList
@@ -237,11 +273,11 @@ func (v *Version) Ref() {
 // locked.
 func (v *Version) Unref() {
 	if atomic.AddInt32(&v.refs, -1) == 0 {
-		obsolete := v.unrefFiles()
+		obsolete, obsoleteBlobFiles := v.unrefFiles()
 		l := v.list
 		l.mu.Lock()
 		l.Remove(v)
-		v.Deleted(obsolete)
+		v.Deleted(obsolete, obsoleteBlobFiles)
 		l.mu.Unlock()
 	}
 }
@@ -257,8 +293,7 @@ func (v *Version) UnrefLocked() {
 	}
 }
 
-func (v *Version) unrefFiles() []uint64 {
-	var obsolete []uint64
+func (v *Version) unrefFiles() (obsolete, obsoleteBlobFiles []uint64) {
 	for _, files := range v.Files {
 		for i := range files {
 			f := &files[i]
@@ -267,7 +302,13 @@ func (v *Version) unrefFiles() []uint64 {
 			}
 		}
 	}
-	return obsolete
+	for i := range v.BlobFiles {
+		f := &v.BlobFiles[i]
+		if atomic.AddInt32(f.refs, -1) == 0 {
+			obsoleteBlobFiles = append(obsoleteBlobFiles, f.FileNum)
+		}
+	}
+	return obsolete, obsoleteBlobFiles
 }
 
 // Next returns the next version in the list of versions.
@@ -11,6 +11,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"sort"
 	"sync/atomic"
 
 	"github.com/cockroachdb/pebble/internal/base"
@@ -48,10 +50,14 @@ const (
 	tagColumnFamilyDrop = 202
 	tagMaxColumnFamily  = 203
 
+	// Pebble tags.
+	tagNewBlobFile = 1000
+
 	// The custom tags sub-format used by tagNewFile4.
 	customTagTerminate         = 1
 	customTagNeedsCompaction   = 2
 	customTagPathID            = 65
+	customTagBlobReferences    = 66
 	customTagNonSafeIgnoreMask = 1 << 6
 )
 
@@ -104,6 +110,29 @@ type VersionEdit struct {
 	// found that there was no overlapping file at the higher level).
 	DeletedFiles map[DeletedFileEntry]bool
 	NewFiles     []NewFileEntry
+
+	// NewBlobFiles are the blob files created by a flush. A blob file is
+	// removed from the version once none of its values are referenced by the
+	// tables in the version (see FileMetadata.BlobRefs), so there is no
+	// corresponding record of deleted blob files.
+	NewBlobFiles []BlobFileMetadata
+
+	// ColumnFamily is the ID of the column family the edit applies to. The
+	// default column family has ID 0. The file additions and deletions, as well
+	// as MinUnflushedLogNum, are scoped to the column family.
+	ColumnFamily uint32
+	// ColumnFamilyAdd is the name of a column family created by this edit. It
+	// is empty unless the edit creates the column family identified by
+	// ColumnFamily.
+	ColumnFamilyAdd string
+	// ColumnFamilyDrop is true if this edit drops the column family identified
+	// by ColumnFamily.
+	ColumnFamilyDrop bool
+	// MaxColumnFamily is the largest column family ID that has been assigned.
+	// Column family IDs are never reused.
+	//
+	// This is an optional field, and 0 represents it is not set.
+	MaxColumnFamily uint32
 }
 
 // Decode decodes an edit from the specified reader.
@@ -214,6 +243,7 @@ func (v *VersionEdit) Decode(r io.Reader) error {
 				}
 			}
 			var markedForCompaction bool
+			var blobRefs []BlobReference
 			if tag == tagNewFile4 {
 				for {
 					customTag, err := d.readUvarint()
@@ -237,6 +267,11 @@ func (v *VersionEdit) Decode(r io.Reader) error {
 					case customTagPathID:
 						return fmt.Errorf("new-file4: path-id field not supported")
 
+					case customTagBlobReferences:
+						if blobRefs, err = decodeBlobRefs(field); err != nil {
+							return err
+						}
+
 					default:
 						if (customTag & customTagNonSafeIgnoreMask) != 0 {
 							return fmt.Errorf("new-file4: custom field not supported: %d", customTag)
@@ -254,9 +289,24 @@ func (v *VersionEdit) Decode(r io.Reader) error {
 					SmallestSeqNum:      smallestSeqNum,
 					LargestSeqNum:       largestSeqNum,
 					MarkedForCompaction: markedForCompaction,
+					BlobRefs:            blobRefs,
 				},
 			})
 
+		case tagNewBlobFile:
+			fileNum, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			size, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			v.NewBlobFiles = append(v.NewBlobFiles, BlobFileMetadata{
+				FileNum: fileNum,
+				Size:    size,
+			})
+
 		case tagPrevLogNumber:
 			n, err := d.readUvarint()
 			if err != nil {
@@ -264,8 +314,35 @@ func (v *VersionEdit) Decode(r io.Reader) error {
 			}
 			v.ObsoletePrevLogNum = n
 
-		case tagColumnFamily, tagColumnFamilyAdd, tagColumnFamilyDrop, tagMaxColumnFamily:
-			return fmt.Errorf("column families are not supported")
+		case tagColumnFamily:
+			n, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			if n > math.MaxUint32 {
+				return errCorruptManifest
+			}
+			v.ColumnFamily = uint32(n)
+
+		case tagColumnFamilyAdd:
+			s, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			v.ColumnFamilyAdd = string(s)
+
+		case tagColumnFamilyDrop:
+			v.ColumnFamilyDrop = true
+
+		case tagMaxColumnFamily:
+			n, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			if n > math.MaxUint32 {
+				return errCorruptManifest
+			}
+			v.MaxColumnFamily = uint32(n)
 
 		default:
 			return errCorruptManifest
@@ -281,6 +358,21 @@ func (v *VersionEdit) Encode(w io.Writer) error {
 		e.writeUvarint(tagComparator)
 		e.writeString(v.ComparerName)
 	}
+	if v.ColumnFamily != 0 {
+		e.writeUvarint(tagColumnFamily)
+		e.writeUvarint(uint64(v.ColumnFamily))
+	}
+	if v.ColumnFamilyAdd != "" {
+		e.writeUvarint(tagColumnFamilyAdd)
+		e.writeString(v.ColumnFamilyAdd)
+	}
+	if v.ColumnFamilyDrop {
+		e.writeUvarint(tagColumnFamilyDrop)
+	}
+	if v.MaxColumnFamily != 0 {
+		e.writeUvarint(tagMaxColumnFamily)
+		e.writeUvarint(uint64(v.MaxColumnFamily))
+	}
 	if v.MinUnflushedLogNum != 0 {
 		e.writeUvarint(tagLogNumber)
 		e.writeUvarint(v.MinUnflushedLogNum)
@@ -305,9 +397,14 @@ func (v *VersionEdit) Encode(w io.Writer) error {
 		e.writeUvarint(uint64(x.Level))
 		e.writeUvarint(x.FileNum)
 	}
+	for _, x := range v.NewBlobFiles {
+		e.writeUvarint(tagNewBlobFile)
+		e.writeUvarint(x.FileNum)
+		e.writeUvarint(x.Size)
+	}
 	for _, x := range v.NewFiles {
 		var customFields bool
-		if x.Meta.MarkedForCompaction {
+		if x.Meta.MarkedForCompaction || len(x.Meta.BlobRefs) > 0 {
 			customFields = true
 			e.writeUvarint(tagNewFile4)
 		} else {
@@ -325,6 +422,13 @@ func (v *VersionEdit) Encode(w io.Writer) error {
 				e.writeUvarint(customTagNeedsCompaction)
 				e.writeBytes([]byte{1})
 			}
+			if len(x.Meta.BlobRefs) > 0 {
+				// NB: customTagBlobReferences has the customTagNonSafeIgnoreMask bit
+				// set. Ignoring the blob references would allow blob files holding
+				// live values to be deleted.
+				e.writeUvarint(customTagBlobReferences)
+				e.writeBytes(encodeBlobRefs(x.Meta.BlobRefs))
+			}
 			e.writeUvarint(customTagTerminate)
 		}
 	}
@@ -332,6 +436,38 @@ func (v *VersionEdit) Encode(w io.Writer) error {
 	return err
 }
 
+func encodeBlobRefs(refs []BlobReference) []byte {
+	var buf []byte
+	var tmp [binary.MaxVarintLen64]byte
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(refs)))]...)
+	for _, ref := range refs {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], ref.FileNum)]...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], ref.Bytes)]...)
+	}
+	return buf
+}
+
+func decodeBlobRefs(field []byte) ([]BlobReference, error) {
+	r := bytes.NewReader(field)
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(len(field)) {
+		return nil, fmt.Errorf("new-file4: invalid blob-references field")
+	}
+	refs := make([]BlobReference, n)
+	for i := range refs {
+		if refs[i].FileNum, err = binary.ReadUvarint(r); err != nil {
+			return nil, fmt.Errorf("new-file4: invalid blob-references field")
+		}
+		if refs[i].Bytes, err = binary.ReadUvarint(r); err != nil {
+			return nil, fmt.Errorf("new-file4: invalid blob-references field")
+		}
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("new-file4: invalid blob-references field")
+	}
+	return refs, nil
+}
+
 type versionEditDecoder struct {
 	byteReader
 }
@@ -406,6 +542,8 @@ func (e versionEditEncoder) writeUvarint(u uint64) {
 type BulkVersionEdit struct {
 	Added   [NumLevels][]FileMetadata
 	Deleted [NumLevels]map[uint64]bool // map[uint64]bool is a set of fileNums
+
+	AddedBlobFiles []BlobFileMetadata
 }
 
 // Accumulate adds the file addition and deletions in the specified version
@@ -430,6 +568,8 @@ func (b *BulkVersionEdit) Accumulate(ve *VersionEdit) {
 		}
 		b.Added[nf.Level] = append(b.Added[nf.Level], nf.Meta)
 	}
+
+	b.AddedBlobFiles = append(b.AddedBlobFiles, ve.NewBlobFiles...)
 }
 
 // Apply applies the delta b to a base version to produce a new version. The
@@ -499,5 +639,53 @@ func (b *BulkVersionEdit) Apply(
 	if err := v.CheckOrdering(cmp, format); err != nil {
 		return nil, fmt.Errorf("pebble: internal error: %v", err)
 	}
+	if err := b.applyBlobFiles(base, v); err != nil {
+		return nil, err
+	}
 	return v, nil
 }
+
+// applyBlobFiles populates the blob files of the new version v: the blob
+// files of the base version and the added blob files which are still
+// referenced by the tables in v.
+func (b *BulkVersionEdit) applyBlobFiles(base *Version, v *Version) error {
+	var candidates [2][]BlobFileMetadata
+	if base != nil {
+		candidates[0] = base.BlobFiles
+	}
+	candidates[1] = b.AddedBlobFiles
+	if len(candidates[0]) == 0 && len(candidates[1]) == 0 {
+		return nil
+	}
+
+	live := make(map[uint64]uint64)
+	for _, files := range v.Files {
+		for i := range files {
+			for _, ref := range files[i].BlobRefs {
+				live[ref.FileNum] += ref.Bytes
+			}
+		}
+	}
+	for _, ff := range candidates {
+		for _, f := range ff {
+			bytes, ok := live[f.FileNum]
+			if !ok {
+				continue
+			}
+			delete(live, f.FileNum)
+			if f.refs == nil {
+				f.refs = new(int32)
+			}
+			atomic.AddInt32(f.refs, 1)
+			f.LiveBytes = bytes
+			v.BlobFiles = append(v.BlobFiles, f)
+		}
+	}
+	for fileNum := range live {
+		return fmt.Errorf("pebble: internal error: reference to unknown blob file %06d", fileNum)
+	}
+	sort.Slice(v.BlobFiles, func(i, j int) bool {
+		return v.BlobFiles[i].FileNum < v.BlobFiles[j].FileNum
+	})
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/cockroachdb/pebble/internal/base"
@@ -79,6 +80,35 @@ func TestVersionEditRoundTrip(t *testing.T) {
 				},
 			},
 		},
+		// Column family edits.
+		{
+			ColumnFamily:       7,
+			ColumnFamilyAdd:    "blobs",
+			MaxColumnFamily:    7,
+			MinUnflushedLogNum: 12,
+		},
+		{
+			ColumnFamily:     7,
+			ColumnFamilyDrop: true,
+		},
+		// Blob files.
+		{
+			NewFiles: []NewFileEntry{
+				{
+					Level: 0,
+					Meta: FileMetadata{
+						FileNum:  9,
+						Size:     90,
+						Smallest: base.DecodeInternalKey([]byte("a\x00\x01\x02\x03\x04\x05\x06\x07")),
+						Largest:  base.DecodeInternalKey([]byte("z\x01\xff\xfe\xfd\xfc\xfb\xfa\xf9")),
+						BlobRefs: []BlobReference{{FileNum: 7, Bytes: 700}, {FileNum: 8, Bytes: 800}},
+					},
+				},
+			},
+			NewBlobFiles: []BlobFileMetadata{
+				{FileNum: 8, Size: 1000},
+			},
+		},
 	}
 	for _, tc := range testCases {
 		if err := checkRoundTrip(tc); err != nil {
@@ -87,6 +117,83 @@ func TestVersionEditRoundTrip(t *testing.T) {
 	}
 }
 
+func TestBulkVersionEditBlobFiles(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	table := func(fileNum uint64, key string, refs ...BlobReference) NewFileEntry {
+		return NewFileEntry{
+			Level: 6,
+			Meta: FileMetadata{
+				FileNum:  fileNum,
+				Smallest: base.MakeInternalKey([]byte(key), 1, base.InternalKeyKindSet),
+				Largest:  base.MakeInternalKey([]byte(key), 1, base.InternalKeyKindSet),
+				BlobRefs: refs,
+			},
+		}
+	}
+	blobFiles := func(v *Version) string {
+		var buf strings.Builder
+		for _, f := range v.BlobFiles {
+			fmt.Fprintf(&buf, "%d:%d/%d ", f.FileNum, f.LiveBytes, f.Size)
+		}
+		return strings.TrimSpace(buf.String())
+	}
+
+	// Tables 3 and 4 reference blob files 1 and 2.
+	var b BulkVersionEdit
+	b.Accumulate(&VersionEdit{
+		NewFiles: []NewFileEntry{
+			table(3, "a", BlobReference{FileNum: 1, Bytes: 10}),
+			table(4, "b", BlobReference{FileNum: 1, Bytes: 20}, BlobReference{FileNum: 2, Bytes: 30}),
+		},
+		NewBlobFiles: []BlobFileMetadata{{FileNum: 1, Size: 100}, {FileNum: 2, Size: 200}},
+	})
+	v1, err := b.Apply(nil, cmp, base.DefaultFormatter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := blobFiles(v1); s != "1:30/100 2:30/200" {
+		t.Fatalf("unexpected blob files: %s", s)
+	}
+
+	// Replacing table 4 with table 5, which only references blob file 1,
+	// removes blob file 2 from the version.
+	b = BulkVersionEdit{}
+	b.Accumulate(&VersionEdit{
+		DeletedFiles: map[DeletedFileEntry]bool{{Level: 6, FileNum: 4}: true},
+		NewFiles:     []NewFileEntry{table(5, "b", BlobReference{FileNum: 1, Bytes: 20})},
+	})
+	v2, err := b.Apply(v1, cmp, base.DefaultFormatter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := blobFiles(v2); s != "1:30/100" {
+		t.Fatalf("unexpected blob files: %s", s)
+	}
+
+	// Blob file 2 becomes obsolete once v1 is unreferenced.
+	var obsoleteTables, obsoleteBlobFiles []uint64
+	v1.Deleted = func(tables, blobFiles []uint64) {
+		obsoleteTables, obsoleteBlobFiles = tables, blobFiles
+	}
+	list := &VersionList{}
+	list.Init(&sync.Mutex{})
+	v1.Ref()
+	list.PushBack(v1)
+	v1.Unref()
+	if fmt.Sprint(obsoleteTables) != "[4]" || fmt.Sprint(obsoleteBlobFiles) != "[2]" {
+		t.Fatalf("unexpected obsolete files: tables=%v blob-files=%v", obsoleteTables, obsoleteBlobFiles)
+	}
+
+	// A reference to an unknown blob file is an error.
+	b = BulkVersionEdit{}
+	b.Accumulate(&VersionEdit{
+		NewFiles: []NewFileEntry{table(6, "c", BlobReference{FileNum: 9, Bytes: 1})},
+	})
+	if _, err := b.Apply(v2, cmp, base.DefaultFormatter); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+}
+
 func TestVersionEditDecode(t *testing.T) {
 	testCases := []struct {
 		filename     string
@@ -261,7 +261,7 @@ func TestOverlaps(t *testing.T) {
 func TestVersionUnref(t *testing.T) {
 	list := &VersionList{}
 	list.Init(&sync.Mutex{})
-	v := &Version{Deleted: func([]uint64) {}}
+	v := &Version{Deleted: func(_, _ []uint64) {}}
 	v.Ref()
 	list.PushBack(v)
 	v.Unref()
@@ -0,0 +1,488 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package metamorphic
+
+import (
+	"bytes"
+	"sort"
+
+	"golang.org/x/exp/rand"
+)
+
+type opType int
+
+const (
+	batchClose opType = iota
+	batchCommit
+	dbCompact
+	dbFlush
+	dbIngest
+	dbNewBatch
+	dbNewSnapshot
+	iterClose
+	iterFirst
+	iterLast
+	iterNext
+	iterPrev
+	iterSeekGE
+	iterSeekLT
+	readerGet
+	readerNewIter
+	snapshotClose
+	writerDelete
+	writerDeleteRange
+	writerMerge
+	writerSet
+	writerSingleDelete
+	numOpTypes
+)
+
+// config holds the relative weights of the op types.
+type config struct {
+	ops [numOpTypes]int
+}
+
+var defaultConfig = config{
+	ops: [numOpTypes]int{
+		batchClose:         5,
+		batchCommit:        5,
+		dbCompact:          1,
+		dbFlush:            2,
+		dbIngest:           2,
+		dbNewBatch:         5,
+		dbNewSnapshot:      5,
+		iterClose:          5,
+		iterFirst:          100,
+		iterLast:           100,
+		iterNext:           100,
+		iterPrev:           100,
+		iterSeekGE:         100,
+		iterSeekLT:         100,
+		readerGet:          100,
+		readerNewIter:      10,
+		snapshotClose:      5,
+		writerDelete:       100,
+		writerDeleteRange:  20,
+		writerMerge:        100,
+		writerSet:          100,
+		writerSingleDelete: 25,
+	},
+}
+
+// generator generates a random sequence of ops. The generator tracks the live
+// objects so that the generated ops only reference objects which exist.
+//
+// SingleDelete has undefined results if a key has been set more than once
+// since it was last deleted, which would cause the results of different
+// configurations to differ. SingleDelete is therefore restricted to a
+// separate set of keys which are only written directly to the DB, and which
+// are set once and then single deleted once. A key is not set again after it
+// has been single deleted: a compaction drops a SingleDelete which is shadowed
+// by a newer Set of the key, so single deleting the newer Set would expose
+// the value the dropped SingleDelete deleted.
+type generator struct {
+	rng *rand.Rand
+	cfg config
+	ops []op
+
+	// The keys which have been generated, and the subset of those keys which
+	// may be single deleted. The value of an entry in singleDelKeys is true if
+	// the key has been set and not yet single deleted.
+	keys          [][]byte
+	keySet        map[string]bool
+	singleDelKeys map[string]bool
+
+	nextBatch uint32
+	nextIter  uint32
+	nextSnap  uint32
+
+	liveBatches   []objID
+	liveIters     []objID
+	liveSnapshots []objID
+	// iterReaders maps a live iterator to the reader it was created from.
+	iterReaders map[objID]objID
+}
+
+func newGenerator(rng *rand.Rand, cfg config) *generator {
+	return &generator{
+		rng:           rng,
+		cfg:           cfg,
+		keySet:        make(map[string]bool),
+		singleDelKeys: make(map[string]bool),
+		iterReaders:   make(map[objID]objID),
+	}
+}
+
+// generate generates a random sequence of approximately count ops, followed
+// by the ops closing the objects which remain open.
+func generate(rng *rand.Rand, count int, cfg config) []op {
+	g := newGenerator(rng, cfg)
+
+	generators := [numOpTypes]func(){
+		batchClose:         g.batchClose,
+		batchCommit:        g.batchCommit,
+		dbCompact:          g.dbCompact,
+		dbFlush:            g.dbFlush,
+		dbIngest:           g.dbIngest,
+		dbNewBatch:         g.dbNewBatch,
+		dbNewSnapshot:      g.dbNewSnapshot,
+		iterClose:          g.iterClose,
+		iterFirst:          g.iterFirst,
+		iterLast:           g.iterLast,
+		iterNext:           g.iterNext,
+		iterPrev:           g.iterPrev,
+		iterSeekGE:         g.iterSeekGE,
+		iterSeekLT:         g.iterSeekLT,
+		readerGet:          g.readerGet,
+		readerNewIter:      g.readerNewIter,
+		snapshotClose:      g.snapshotClose,
+		writerDelete:       g.writerDelete,
+		writerDeleteRange:  g.writerDeleteRange,
+		writerMerge:        g.writerMerge,
+		writerSet:          g.writerSet,
+		writerSingleDelete: g.writerSingleDelete,
+	}
+
+	var total int
+	for _, w := range cfg.ops {
+		total += w
+	}
+	for len(g.ops) < count {
+		n := g.rng.Intn(total)
+		for t, w := range cfg.ops {
+			if n < w {
+				generators[t]()
+				break
+			}
+			n -= w
+		}
+	}
+
+	for len(g.liveIters) > 0 {
+		g.closeIter(g.liveIters[0])
+	}
+	for len(g.liveBatches) > 0 {
+		g.closeBatch(g.liveBatches[0])
+	}
+	for len(g.liveSnapshots) > 0 {
+		g.closeSnapshot(g.liveSnapshots[0])
+	}
+	return g.ops
+}
+
+func (g *generator) add(o op) {
+	g.ops = append(g.ops, o)
+}
+
+const letters = "abcdefghijklmnopqrstuvwxyz"
+
+func (g *generator) randBytes(minLen, maxLen int) []byte {
+	n := minLen + g.rng.Intn(maxLen-minLen+1)
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = letters[g.rng.Intn(len(letters))]
+	}
+	return buf
+}
+
+func (g *generator) newKey() []byte {
+	for {
+		key := g.randBytes(1, 4)
+		if !g.keySet[string(key)] {
+			g.keySet[string(key)] = true
+			return key
+		}
+	}
+}
+
+// randKey returns a key which can be written without restrictions, which is
+// a new key with probability newKey and an existing key otherwise.
+func (g *generator) randKey(newKey float64) []byte {
+	if n := len(g.keys); n > 0 && g.rng.Float64() >= newKey {
+		return g.keys[g.rng.Intn(n)]
+	}
+	key := g.newKey()
+	g.keys = append(g.keys, key)
+	return key
+}
+
+// randReadKey returns a key to read, which may be one of the keys which can
+// be single deleted.
+func (g *generator) randReadKey() []byte {
+	if len(g.singleDelKeys) > 0 && g.rng.Intn(10) == 0 {
+		keys := g.sortedSingleDelKeys(func(bool) bool { return true })
+		return keys[g.rng.Intn(len(keys))]
+	}
+	return g.randKey(0.001)
+}
+
+// sortedSingleDelKeys returns the keys which can be single deleted whose
+// state satisfies the predicate, in sorted order so that the generated ops
+// are determined by the seed.
+func (g *generator) sortedSingleDelKeys(pred func(set bool) bool) [][]byte {
+	var keys [][]byte
+	for key, set := range g.singleDelKeys {
+		if pred(set) {
+			keys = append(keys, []byte(key))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	return keys
+}
+
+func (g *generator) randValue() []byte {
+	return g.randBytes(0, 8)
+}
+
+// randKeyRange returns a pair of distinct keys in increasing order.
+func (g *generator) randKeyRange() ([]byte, []byte) {
+	start := g.randKey(0.001)
+	end := g.randKey(0.01)
+	for bytes.Equal(start, end) {
+		end = g.randKey(0.1)
+	}
+	if bytes.Compare(start, end) > 0 {
+		start, end = end, start
+	}
+	return start, end
+}
+
+func (g *generator) randObj(objs []objID) objID {
+	return objs[g.rng.Intn(len(objs))]
+}
+
+// hasIters returns true if there are live iterators created from the reader.
+func (g *generator) hasIters(readerID objID) bool {
+	for _, r := range g.iterReaders {
+		if r == readerID {
+			return true
+		}
+	}
+	return false
+}
+
+// randWriter returns the DB or a batch which has no live iterators.
+func (g *generator) randWriter() objID {
+	writers := []objID{dbObjID}
+	for _, id := range g.liveBatches {
+		if !g.hasIters(id) {
+			writers = append(writers, id)
+		}
+	}
+	return g.randObj(writers)
+}
+
+func (g *generator) randReader() objID {
+	readers := []objID{dbObjID}
+	readers = append(readers, g.liveBatches...)
+	readers = append(readers, g.liveSnapshots...)
+	return g.randObj(readers)
+}
+
+func removeObj(objs []objID, id objID) []objID {
+	for i := range objs {
+		if objs[i] == id {
+			return append(objs[:i], objs[i+1:]...)
+		}
+	}
+	return objs
+}
+
+// closeReaderIters closes the live iterators created from the reader.
+func (g *generator) closeReaderIters(readerID objID) {
+	var iters []objID
+	for _, id := range g.liveIters {
+		if g.iterReaders[id] == readerID {
+			iters = append(iters, id)
+		}
+	}
+	for _, id := range iters {
+		g.closeIter(id)
+	}
+}
+
+func (g *generator) closeIter(id objID) {
+	g.liveIters = removeObj(g.liveIters, id)
+	delete(g.iterReaders, id)
+	g.add(&closeOp{objID: id})
+}
+
+func (g *generator) closeBatch(id objID) {
+	g.closeReaderIters(id)
+	g.liveBatches = removeObj(g.liveBatches, id)
+	g.add(&closeOp{objID: id})
+}
+
+func (g *generator) closeSnapshot(id objID) {
+	g.closeReaderIters(id)
+	g.liveSnapshots = removeObj(g.liveSnapshots, id)
+	g.add(&closeOp{objID: id})
+}
+
+func (g *generator) batchClose() {
+	if len(g.liveBatches) == 0 {
+		return
+	}
+	g.closeBatch(g.randObj(g.liveBatches))
+}
+
+func (g *generator) batchCommit() {
+	if len(g.liveBatches) == 0 {
+		return
+	}
+	id := g.randObj(g.liveBatches)
+	g.closeReaderIters(id)
+	g.liveBatches = removeObj(g.liveBatches, id)
+	g.add(&batchCommitOp{batchID: id})
+}
+
+func (g *generator) dbCompact() {
+	start, end := g.randKeyRange()
+	g.add(&compactOp{start: start, end: end})
+}
+
+func (g *generator) dbFlush() {
+	g.add(&flushOp{})
+}
+
+func (g *generator) dbIngest() {
+	if len(g.liveBatches) == 0 {
+		return
+	}
+	id := g.randObj(g.liveBatches)
+	g.closeReaderIters(id)
+	g.liveBatches = removeObj(g.liveBatches, id)
+	g.add(&ingestOp{batchID: id})
+}
+
+func (g *generator) dbNewBatch() {
+	id := makeObjID(batchTag, g.nextBatch)
+	g.nextBatch++
+	g.liveBatches = append(g.liveBatches, id)
+	g.add(&newBatchOp{batchID: id})
+}
+
+func (g *generator) dbNewSnapshot() {
+	id := makeObjID(snapTag, g.nextSnap)
+	g.nextSnap++
+	g.liveSnapshots = append(g.liveSnapshots, id)
+	g.add(&newSnapshotOp{snapID: id})
+}
+
+func (g *generator) iterClose() {
+	if len(g.liveIters) == 0 {
+		return
+	}
+	g.closeIter(g.randObj(g.liveIters))
+}
+
+func (g *generator) iterFirst() {
+	if len(g.liveIters) == 0 {
+		return
+	}
+	g.add(&iterFirstOp{iterID: g.randObj(g.liveIters)})
+}
+
+func (g *generator) iterLast() {
+	if len(g.liveIters) == 0 {
+		return
+	}
+	g.add(&iterLastOp{iterID: g.randObj(g.liveIters)})
+}
+
+func (g *generator) iterNext() {
+	if len(g.liveIters) == 0 {
+		return
+	}
+	g.add(&iterNextOp{iterID: g.randObj(g.liveIters)})
+}
+
+func (g *generator) iterPrev() {
+	if len(g.liveIters) == 0 {
+		return
+	}
+	g.add(&iterPrevOp{iterID: g.randObj(g.liveIters)})
+}
+
+func (g *generator) iterSeekGE() {
+	if len(g.liveIters) == 0 {
+		return
+	}
+	g.add(&iterSeekGEOp{iterID: g.randObj(g.liveIters), key: g.randReadKey()})
+}
+
+func (g *generator) iterSeekLT() {
+	if len(g.liveIters) == 0 {
+		return
+	}
+	g.add(&iterSeekLTOp{iterID: g.randObj(g.liveIters), key: g.randReadKey()})
+}
+
+func (g *generator) readerGet() {
+	g.add(&getOp{readerID: g.randReader(), key: g.randReadKey()})
+}
+
+func (g *generator) readerNewIter() {
+	readerID := g.randReader()
+	id := makeObjID(iterTag, g.nextIter)
+	g.nextIter++
+	g.liveIters = append(g.liveIters, id)
+	g.iterReaders[id] = readerID
+
+	var lower, upper []byte
+	switch g.rng.Intn(4) {
+	case 0:
+		lower, upper = g.randKeyRange()
+	case 1:
+		lower = g.randKey(0.001)
+	case 2:
+		upper = g.randKey(0.001)
+	}
+	g.add(&newIterOp{readerID: readerID, iterID: id, lower: lower, upper: upper})
+}
+
+func (g *generator) snapshotClose() {
+	if len(g.liveSnapshots) == 0 {
+		return
+	}
+	g.closeSnapshot(g.randObj(g.liveSnapshots))
+}
+
+func (g *generator) writerDelete() {
+	g.add(&deleteOp{writerID: g.randWriter(), key: g.randKey(0.001)})
+}
+
+func (g *generator) writerDeleteRange() {
+	start, end := g.randKeyRange()
+	g.add(&deleteRangeOp{writerID: g.randWriter(), start: start, end: end})
+}
+
+func (g *generator) writerMerge() {
+	g.add(&mergeOp{writerID: g.randWriter(), key: g.randKey(0.2), value: g.randValue()})
+}
+
+func (g *generator) writerSet() {
+	if g.rng.Intn(10) == 0 {
+		// Set a new key which can be single deleted, which is written directly to
+		// the DB.
+		key := g.newKey()
+		g.singleDelKeys[string(key)] = true
+		g.add(&setOp{writerID: dbObjID, key: key, value: g.randValue()})
+		return
+	}
+	g.add(&setOp{writerID: g.randWriter(), key: g.randKey(0.2), value: g.randValue()})
+}
+
+func (g *generator) writerSingleDelete() {
+	keys := g.sortedSingleDelKeys(func(set bool) bool { return set })
+	if len(keys) == 0 {
+		return
+	}
+	key := keys[g.rng.Intn(len(keys))]
+	g.singleDelKeys[string(key)] = false
+	g.add(&singleDeleteOp{writerID: dbObjID, key: key})
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package metamorphic provides a randomized metamorphic test of Pebble. A
+// random sequence of operations is run against DBs configured with different
+// options. The options do not change the results of the operations, so the
+// histories of the runs are required to be identical. A failing sequence of
+// operations is saved as a script which can be replayed.
+package metamorphic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runResult holds the history of running a sequence of ops against a
+// configuration.
+type runResult struct {
+	name    string
+	history string
+	err     error
+}
+
+// runOps runs the ops against each of the configurations.
+func runOps(ops []op, configs []testOptions) []runResult {
+	results := make([]runResult, len(configs))
+	for i, c := range configs {
+		var h history
+		err := runOne(ops, c, &h)
+		results[i] = runResult{name: c.name, history: h.String(), err: err}
+	}
+	return results
+}
+
+func runOne(ops []op, c testOptions, h *history) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("metamorphic: panic: %v", r)
+		}
+	}()
+	return newTest(ops, c.opts(), "db").run(h)
+}
+
+// compareResults returns an error describing the first difference between
+// the histories of the runs, or the first error encountered by a run.
+func compareResults(results []runResult) error {
+	for _, r := range results {
+		if r.err != nil {
+			return fmt.Errorf("%s: %v", r.name, r.err)
+		}
+	}
+	base := strings.Split(results[0].history, "\n")
+	for _, r := range results[1:] {
+		lines := strings.Split(r.history, "\n")
+		for i := range base {
+			if i >= len(lines) || base[i] != lines[i] {
+				var line string
+				if i < len(lines) {
+					line = lines[i]
+				}
+				return fmt.Errorf("histories of %s and %s differ at op %d:\n  %s\n  %s",
+					results[0].name, r.name, i+1, base[i], line)
+			}
+		}
+		if len(lines) != len(base) {
+			return fmt.Errorf("histories of %s and %s differ in length", results[0].name, r.name)
+		}
+	}
+	return nil
+}
+
+// saveRun saves the ops, and the histories of the runs, to dir. The ops are
+// saved in a file named "ops" which can be replayed.
+func saveRun(dir string, ops []op, results []runResult) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ops"), []byte(formatOps(ops)), 0644); err != nil {
+		return err
+	}
+	for _, r := range results {
+		history := r.history
+		if r.err != nil {
+			history += fmt.Sprintf("# error: %v\n", r.err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, r.name+".history"), []byte(history), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package metamorphic
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/rand"
+)
+
+var (
+	seed = flag.Uint64("seed", 0,
+		"the pseudorandom number generator seed; zero uses the current time")
+	opCount = flag.Int("ops", 2000, "the number of operations to generate")
+	dir     = flag.String("dir", "_meta",
+		"the directory in which the ops and histories of failing runs are saved")
+	replay = flag.String("replay", "",
+		"the path of a saved ops file to run instead of generating ops")
+)
+
+func TestMeta(t *testing.T) {
+	var ops []op
+	var name string
+	if *replay != "" {
+		data, err := ioutil.ReadFile(*replay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ops, err = parse(string(data)); err != nil {
+			t.Fatal(err)
+		}
+		name = "replay"
+	} else {
+		s := *seed
+		if s == 0 {
+			s = uint64(time.Now().UnixNano())
+		}
+		t.Logf("seed: %d", s)
+		ops = generate(rand.New(rand.NewSource(s)), *opCount, defaultConfig)
+		name = fmt.Sprint(s)
+	}
+
+	results := runOps(ops, standardOptions())
+	if err := compareResults(results); err != nil {
+		runDir := filepath.Join(*dir, name)
+		if saveErr := saveRun(runDir, ops, results); saveErr != nil {
+			t.Fatalf("%v\nunable to save run: %v", err, saveErr)
+		}
+		t.Fatalf("%v\nthe run is saved in %s and can be replayed with -replay %s",
+			err, runDir, filepath.Join(runDir, "ops"))
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package metamorphic
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/sstable"
+)
+
+// op defines the interface for a single operation, such as creating a batch,
+// or advancing an iterator.
+type op interface {
+	// run runs the operation, recording its result in the history.
+	run(t *test, h *history)
+	// String returns the operation in the format parsed by parse.
+	String() string
+}
+
+// setOp models a Writer.Set operation.
+type setOp struct {
+	writerID objID
+	key      []byte
+	value    []byte
+}
+
+func (o *setOp) run(t *test, h *history) {
+	w := t.getWriter(o.writerID)
+	err := w.Set(o.key, o.value, t.writeOpts)
+	h.Recordf("%s // %v", o, err)
+}
+
+func (o *setOp) String() string {
+	return fmt.Sprintf("%s.Set(%q, %q)", o.writerID, o.key, o.value)
+}
+
+// deleteOp models a Writer.Delete operation.
+type deleteOp struct {
+	writerID objID
+	key      []byte
+}
+
+func (o *deleteOp) run(t *test, h *history) {
+	w := t.getWriter(o.writerID)
+	err := w.Delete(o.key, t.writeOpts)
+	h.Recordf("%s // %v", o, err)
+}
+
+func (o *deleteOp) String() string {
+	return fmt.Sprintf("%s.Delete(%q)", o.writerID, o.key)
+}
+
+// singleDeleteOp models a Writer.SingleDelete operation.
+type singleDeleteOp struct {
+	writerID objID
+	key      []byte
+}
+
+func (o *singleDeleteOp) run(t *test, h *history) {
+	w := t.getWriter(o.writerID)
+	err := w.SingleDelete(o.key, t.writeOpts)
+	h.Recordf("%s // %v", o, err)
+}
+
+func (o *singleDeleteOp) String() string {
+	return fmt.Sprintf("%s.SingleDelete(%q)", o.writerID, o.key)
+}
+
+// deleteRangeOp models a Writer.DeleteRange operation.
+type deleteRangeOp struct {
+	writerID objID
+	start    []byte
+	end      []byte
+}
+
+func (o *deleteRangeOp) run(t *test, h *history) {
+	w := t.getWriter(o.writerID)
+	err := w.DeleteRange(o.start, o.end, t.writeOpts)
+	h.Recordf("%s // %v", o, err)
+}
+
+func (o *deleteRangeOp) String() string {
+	return fmt.Sprintf("%s.DeleteRange(%q, %q)", o.writerID, o.start, o.end)
+}
+
+// mergeOp models a Writer.Merge operation.
+type mergeOp struct {
+	writerID objID
+	key      []byte
+	value    []byte
+}
+
+func (o *mergeOp) run(t *test, h *history) {
+	w := t.getWriter(o.writerID)
+	err := w.Merge(o.key, o.value, t.writeOpts)
+	h.Recordf("%s // %v", o, err)
+}
+
+func (o *mergeOp) String() string {
+	return fmt.Sprintf("%s.Merge(%q, %q)", o.writerID, o.key, o.value)
+}
+
+// newBatchOp models a DB.NewIndexedBatch operation.
+type newBatchOp struct {
+	batchID objID
+}
+
+func (o *newBatchOp) run(t *test, h *history) {
+	t.setBatch(o.batchID, t.db.NewIndexedBatch())
+	h.Recordf("%s", o)
+}
+
+func (o *newBatchOp) String() string {
+	return fmt.Sprintf("%s = db.NewIndexedBatch()", o.batchID)
+}
+
+// batchCommitOp models a Batch.Commit operation. The batch is closed after it
+// is committed.
+type batchCommitOp struct {
+	batchID objID
+}
+
+func (o *batchCommitOp) run(t *test, h *history) {
+	b := t.getBatch(o.batchID)
+	t.clearObj(o.batchID)
+	err := b.Commit(t.writeOpts)
+	h.Recordf("%s // %v", o, firstError(err, b.Close()))
+}
+
+func (o *batchCommitOp) String() string {
+	return fmt.Sprintf("%s.Commit()", o.batchID)
+}
+
+// ingestOp models a DB.Ingest operation. The contents of the batch are
+// written to an sstable which is ingested, and the batch is closed. A batch
+// can contain several entries for a key, while an sstable cannot, so only the
+// last entry written for each key is retained. Range deletions are dropped.
+type ingestOp struct {
+	batchID objID
+}
+
+func (o *ingestOp) run(t *test, h *history) {
+	b := t.getBatch(o.batchID)
+	t.clearObj(o.batchID)
+	path, err := o.build(t, b)
+	if err == nil {
+		err = t.db.Ingest([]string{path})
+	}
+	h.Recordf("%s // %v", o, firstError(err, b.Close()))
+}
+
+func (o *ingestOp) build(t *test, b *pebble.Batch) (string, error) {
+	type entry struct {
+		kind  pebble.InternalKeyKind
+		value []byte
+	}
+	entries := make(map[string]entry)
+	for r := b.Reader(); ; {
+		kind, ukey, value, ok := r.Next()
+		if !ok {
+			break
+		}
+		switch kind {
+		case base.InternalKeyKindSet, base.InternalKeyKindDelete,
+			base.InternalKeyKindSingleDelete, base.InternalKeyKindMerge:
+			entries[string(ukey)] = entry{kind: kind, value: value}
+		}
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	t.ingestCount++
+	path := t.opts.FS.PathJoin(t.dir, fmt.Sprintf("ext%d", t.ingestCount))
+	f, err := t.opts.FS.Create(path)
+	if err != nil {
+		return "", err
+	}
+	w := sstable.NewWriter(f, t.opts, t.opts.Level(0))
+	for _, key := range keys {
+		e := entries[key]
+		if err := w.Add(base.MakeInternalKey([]byte(key), 0, e.kind), e.value); err != nil {
+			_ = w.Close()
+			return "", err
+		}
+	}
+	return path, w.Close()
+}
+
+func (o *ingestOp) String() string {
+	return fmt.Sprintf("db.Ingest(%s)", o.batchID)
+}
+
+// closeOp models a Batch.Close, Iterator.Close or Snapshot.Close operation.
+type closeOp struct {
+	objID objID
+}
+
+func (o *closeOp) run(t *test, h *history) {
+	c := t.getCloser(o.objID)
+	t.clearObj(o.objID)
+	err := c.Close()
+	h.Recordf("%s // %v", o, err)
+}
+
+func (o *closeOp) String() string {
+	return fmt.Sprintf("%s.Close()", o.objID)
+}
+
+// getOp models a Reader.Get operation.
+type getOp struct {
+	readerID objID
+	key      []byte
+}
+
+func (o *getOp) run(t *test, h *history) {
+	r := t.getReader(o.readerID)
+	val, err := r.Get(o.key)
+	h.Recordf("%s // [%q] %v", o, val, err)
+}
+
+func (o *getOp) String() string {
+	return fmt.Sprintf("%s.Get(%q)", o.readerID, o.key)
+}
+
+// newIterOp models a Reader.NewIter operation. Empty bounds are treated as
+// unset.
+type newIterOp struct {
+	readerID objID
+	iterID   objID
+	lower    []byte
+	upper    []byte
+}
+
+func (o *newIterOp) run(t *test, h *history) {
+	r := t.getReader(o.readerID)
+	opts := &pebble.IterOptions{}
+	if len(o.lower) > 0 {
+		opts.LowerBound = o.lower
+	}
+	if len(o.upper) > 0 {
+		opts.UpperBound = o.upper
+	}
+	i := r.NewIter(opts)
+	t.setIter(o.iterID, i)
+	h.Recordf("%s // %v", o, i.Error())
+}
+
+func (o *newIterOp) String() string {
+	return fmt.Sprintf("%s = %s.NewIter(%q, %q)", o.iterID, o.readerID, o.lower, o.upper)
+}
+
+// iterSeekGEOp models an Iterator.SeekGE operation.
+type iterSeekGEOp struct {
+	iterID objID
+	key    []byte
+}
+
+func (o *iterSeekGEOp) run(t *test, h *history) {
+	i := t.getIter(o.iterID)
+	valid := i.SeekGE(o.key)
+	h.Recordf("%s // %s", o, iterResult(i, valid))
+}
+
+func (o *iterSeekGEOp) String() string {
+	return fmt.Sprintf("%s.SeekGE(%q)", o.iterID, o.key)
+}
+
+// iterSeekLTOp models an Iterator.SeekLT operation.
+type iterSeekLTOp struct {
+	iterID objID
+	key    []byte
+}
+
+func (o *iterSeekLTOp) run(t *test, h *history) {
+	i := t.getIter(o.iterID)
+	valid := i.SeekLT(o.key)
+	h.Recordf("%s // %s", o, iterResult(i, valid))
+}
+
+func (o *iterSeekLTOp) String() string {
+	return fmt.Sprintf("%s.SeekLT(%q)", o.iterID, o.key)
+}
+
+// iterFirstOp models an Iterator.First operation.
+type iterFirstOp struct {
+	iterID objID
+}
+
+func (o *iterFirstOp) run(t *test, h *history) {
+	i := t.getIter(o.iterID)
+	valid := i.First()
+	h.Recordf("%s // %s", o, iterResult(i, valid))
+}
+
+func (o *iterFirstOp) String() string {
+	return fmt.Sprintf("%s.First()", o.iterID)
+}
+
+// iterLastOp models an Iterator.Last operation.
+type iterLastOp struct {
+	iterID objID
+}
+
+func (o *iterLastOp) run(t *test, h *history) {
+	i := t.getIter(o.iterID)
+	valid := i.Last()
+	h.Recordf("%s // %s", o, iterResult(i, valid))
+}
+
+func (o *iterLastOp) String() string {
+	return fmt.Sprintf("%s.Last()", o.iterID)
+}
+
+// iterNextOp models an Iterator.Next operation.
+type iterNextOp struct {
+	iterID objID
+}
+
+func (o *iterNextOp) run(t *test, h *history) {
+	i := t.getIter(o.iterID)
+	valid := i.Next()
+	h.Recordf("%s // %s", o, iterResult(i, valid))
+}
+
+func (o *iterNextOp) String() string {
+	return fmt.Sprintf("%s.Next()", o.iterID)
+}
+
+// iterPrevOp models an Iterator.Prev operation.
+type iterPrevOp struct {
+	iterID objID
+}
+
+func (o *iterPrevOp) run(t *test, h *history) {
+	i := t.getIter(o.iterID)
+	valid := i.Prev()
+	h.Recordf("%s // %s", o, iterResult(i, valid))
+}
+
+func (o *iterPrevOp) String() string {
+	return fmt.Sprintf("%s.Prev()", o.iterID)
+}
+
+func iterResult(i *pebble.Iterator, valid bool) string {
+	if valid {
+		return fmt.Sprintf("[true,%q,%q] %v", i.Key(), i.Value(), i.Error())
+	}
+	return fmt.Sprintf("[false] %v", i.Error())
+}
+
+// newSnapshotOp models a DB.NewSnapshot operation.
+type newSnapshotOp struct {
+	snapID objID
+}
+
+func (o *newSnapshotOp) run(t *test, h *history) {
+	t.setSnapshot(o.snapID, t.db.NewSnapshot())
+	h.Recordf("%s", o)
+}
+
+func (o *newSnapshotOp) String() string {
+	return fmt.Sprintf("%s = db.NewSnapshot()", o.snapID)
+}
+
+// flushOp models a DB.Flush operation.
+type flushOp struct{}
+
+func (o *flushOp) run(t *test, h *history) {
+	err := t.db.Flush()
+	h.Recordf("%s // %v", o, err)
+}
+
+func (o *flushOp) String() string {
+	return "db.Flush()"
+}
+
+// compactOp models a DB.Compact operation.
+type compactOp struct {
+	start []byte
+	end   []byte
+}
+
+func (o *compactOp) run(t *test, h *history) {
+	err := t.db.Compact(o.start, o.end)
+	h.Recordf("%s // %v", o, err)
+}
+
+func (o *compactOp) String() string {
+	return fmt.Sprintf("db.Compact(%q, %q)", o.start, o.end)
+}
+
+func firstError(err0, err1 error) error {
+	if err0 != nil {
+		return err0
+	}
+	return err1
+}
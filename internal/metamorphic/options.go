@@ -0,0 +1,79 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package metamorphic
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// testOptions is a named configuration of the DB which a sequence of ops is
+// run against.
+type testOptions struct {
+	name string
+	// opts returns a new Options for the configuration, using a new in-memory
+	// filesystem.
+	opts func() *pebble.Options
+}
+
+// testMerger is a merge operator which is commutative as well as associative.
+// Pebble does not guarantee the order in which merge operands are combined, so
+// the histories of the configurations are only comparable if any order of
+// combining the operands produces the same result. The merged value is the
+// concatenation of the operands with its bytes sorted.
+var testMerger = &pebble.Merger{
+	Merge: func(key, oldValue, newValue, buf []byte) []byte {
+		buf = append(append(buf, oldValue...), newValue...)
+		sort.Slice(buf, func(i, j int) bool { return buf[i] < buf[j] })
+		return buf
+	},
+	Name: "metamorphic.sorted-concatenate",
+}
+
+func newOptions(fn func(opts *pebble.Options)) func() *pebble.Options {
+	return func() *pebble.Options {
+		opts := &pebble.Options{
+			FS:     vfs.NewMem(),
+			Merger: testMerger,
+		}
+		if fn != nil {
+			fn(opts)
+		}
+		return opts.EnsureDefaults()
+	}
+}
+
+// standardOptions returns the configurations the ops are run against. The
+// first configuration uses the default options.
+func standardOptions() []testOptions {
+	return []testOptions{
+		{"default", newOptions(nil)},
+		{"block-size=1", newOptions(func(opts *pebble.Options) {
+			opts.Levels = []pebble.LevelOptions{{BlockSize: 1, IndexBlockSize: 1}}
+		})},
+		{"l0-compaction-threshold=1", newOptions(func(opts *pebble.Options) {
+			opts.L0CompactionThreshold = 1
+		})},
+		{"table-format=leveldb", newOptions(func(opts *pebble.Options) {
+			opts.TableFormat = pebble.TableFormatLevelDB
+		})},
+		{"mem-table-size=64KB", newOptions(func(opts *pebble.Options) {
+			opts.MemTableSize = 64 << 10
+		})},
+		{"max-subcompactions=4", newOptions(func(opts *pebble.Options) {
+			opts.Levels = []pebble.LevelOptions{{TargetFileSize: 1 << 10}}
+			opts.L0CompactionThreshold = 1
+			opts.MaxSubcompactions = 4
+		})},
+		{"combined", newOptions(func(opts *pebble.Options) {
+			opts.Levels = []pebble.LevelOptions{{BlockSize: 64, IndexBlockSize: 128}}
+			opts.L0CompactionThreshold = 2
+			opts.TableFormat = pebble.TableFormatLevelDB
+			opts.MemTableSize = 64 << 10
+		})},
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package metamorphic
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// opRE matches an op formatted by op.String:
+//
+//	[<result> = ]<receiver>.<method>(<args>)
+var opRE = regexp.MustCompile(`^(?:(\w+) = )?(\w+)\.(\w+)\((.*)\)$`)
+
+// formatOps formats the ops in the format parsed by parse, one op per line.
+func formatOps(ops []op) string {
+	var buf strings.Builder
+	for _, o := range ops {
+		buf.WriteString(o.String())
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// parse parses a sequence of ops formatted by formatOps. Blank lines and
+// lines beginning with "#" are ignored, as are comments following an op
+// (such as the results recorded in a history).
+func parse(data string) ([]op, error) {
+	var ops []op
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		o, err := parseOp(line)
+		if err != nil {
+			return nil, fmt.Errorf("metamorphic: line %d: %v", i+1, err)
+		}
+		ops = append(ops, o)
+	}
+	return ops, nil
+}
+
+func parseOp(line string) (op, error) {
+	line = stripComment(line)
+	m := opRE.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("unable to parse %q", line)
+	}
+	receiver, err := parseObjID(m[2])
+	if err != nil {
+		return nil, err
+	}
+	var result objID
+	if m[1] != "" {
+		if result, err = parseObjID(m[1]); err != nil {
+			return nil, err
+		}
+	}
+	args, err := parseArgs(m[4])
+	if err != nil {
+		return nil, err
+	}
+
+	expect := func(tags []objTag, nargs int, hasResult bool) error {
+		ok := false
+		for _, t := range tags {
+			ok = ok || receiver.tag() == t
+		}
+		if !ok {
+			return fmt.Errorf("%s does not support %s", receiver, m[3])
+		}
+		if len(args) != nargs {
+			return fmt.Errorf("%s expects %d arguments, but found %d", m[3], nargs, len(args))
+		}
+		if hasResult != (m[1] != "") {
+			return fmt.Errorf("%s: unexpected result", m[3])
+		}
+		return nil
+	}
+	writers := []objTag{dbTag, batchTag}
+	readers := []objTag{dbTag, batchTag, snapTag}
+	db := []objTag{dbTag}
+	iter := []objTag{iterTag}
+
+	switch m[3] {
+	case "Set":
+		if err := expect(writers, 2, false); err != nil {
+			return nil, err
+		}
+		return &setOp{writerID: receiver, key: args[0], value: args[1]}, nil
+	case "Delete":
+		if err := expect(writers, 1, false); err != nil {
+			return nil, err
+		}
+		return &deleteOp{writerID: receiver, key: args[0]}, nil
+	case "SingleDelete":
+		if err := expect(writers, 1, false); err != nil {
+			return nil, err
+		}
+		return &singleDeleteOp{writerID: receiver, key: args[0]}, nil
+	case "DeleteRange":
+		if err := expect(writers, 2, false); err != nil {
+			return nil, err
+		}
+		return &deleteRangeOp{writerID: receiver, start: args[0], end: args[1]}, nil
+	case "Merge":
+		if err := expect(writers, 2, false); err != nil {
+			return nil, err
+		}
+		return &mergeOp{writerID: receiver, key: args[0], value: args[1]}, nil
+	case "NewIndexedBatch":
+		if err := expect(db, 0, true); err != nil {
+			return nil, err
+		}
+		return &newBatchOp{batchID: result}, nil
+	case "Commit":
+		if err := expect([]objTag{batchTag}, 0, false); err != nil {
+			return nil, err
+		}
+		return &batchCommitOp{batchID: receiver}, nil
+	case "Ingest":
+		if err := expect(db, 1, false); err != nil {
+			return nil, err
+		}
+		id, err := parseObjID(string(args[0]))
+		if err != nil {
+			return nil, err
+		}
+		return &ingestOp{batchID: id}, nil
+	case "Close":
+		if err := expect([]objTag{batchTag, iterTag, snapTag}, 0, false); err != nil {
+			return nil, err
+		}
+		return &closeOp{objID: receiver}, nil
+	case "Get":
+		if err := expect(readers, 1, false); err != nil {
+			return nil, err
+		}
+		return &getOp{readerID: receiver, key: args[0]}, nil
+	case "NewIter":
+		if err := expect(readers, 2, true); err != nil {
+			return nil, err
+		}
+		return &newIterOp{readerID: receiver, iterID: result, lower: args[0], upper: args[1]}, nil
+	case "SeekGE":
+		if err := expect(iter, 1, false); err != nil {
+			return nil, err
+		}
+		return &iterSeekGEOp{iterID: receiver, key: args[0]}, nil
+	case "SeekLT":
+		if err := expect(iter, 1, false); err != nil {
+			return nil, err
+		}
+		return &iterSeekLTOp{iterID: receiver, key: args[0]}, nil
+	case "First":
+		if err := expect(iter, 0, false); err != nil {
+			return nil, err
+		}
+		return &iterFirstOp{iterID: receiver}, nil
+	case "Last":
+		if err := expect(iter, 0, false); err != nil {
+			return nil, err
+		}
+		return &iterLastOp{iterID: receiver}, nil
+	case "Next":
+		if err := expect(iter, 0, false); err != nil {
+			return nil, err
+		}
+		return &iterNextOp{iterID: receiver}, nil
+	case "Prev":
+		if err := expect(iter, 0, false); err != nil {
+			return nil, err
+		}
+		return &iterPrevOp{iterID: receiver}, nil
+	case "NewSnapshot":
+		if err := expect(db, 0, true); err != nil {
+			return nil, err
+		}
+		return &newSnapshotOp{snapID: result}, nil
+	case "Flush":
+		if err := expect(db, 0, false); err != nil {
+			return nil, err
+		}
+		return &flushOp{}, nil
+	case "Compact":
+		if err := expect(db, 2, false); err != nil {
+			return nil, err
+		}
+		return &compactOp{start: args[0], end: args[1]}, nil
+	default:
+		return nil, fmt.Errorf("unknown op %s", m[3])
+	}
+}
+
+// stripComment removes a trailing "//" comment which is not within a quoted
+// string.
+func stripComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			s, err := strconv.QuotedPrefix(line[i:])
+			if err != nil {
+				return line
+			}
+			i += len(s) - 1
+		case '/':
+			if strings.HasPrefix(line[i:], "//") {
+				return strings.TrimSpace(line[:i])
+			}
+		}
+	}
+	return line
+}
+
+// parseArgs parses a comma separated list of quoted strings and object
+// names. The object names are returned unquoted.
+func parseArgs(s string) ([][]byte, error) {
+	var args [][]byte
+	for s = strings.TrimSpace(s); s != ""; {
+		var arg string
+		if s[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %s", s)
+			}
+			if arg, err = strconv.Unquote(quoted); err != nil {
+				return nil, err
+			}
+			s = s[len(quoted):]
+		} else {
+			i := strings.IndexByte(s, ',')
+			if i < 0 {
+				i = len(s)
+			}
+			arg, s = strings.TrimSpace(s[:i]), s[i:]
+		}
+		args = append(args, []byte(arg))
+
+		s = strings.TrimSpace(s)
+		if s != "" {
+			if s[0] != ',' {
+				return nil, fmt.Errorf("expected ',' but found %s", s)
+			}
+			s = strings.TrimSpace(s[1:])
+		}
+	}
+	return args, nil
+}
+
+func parseObjID(s string) (objID, error) {
+	if s == "db" {
+		return dbObjID, nil
+	}
+	for _, p := range []struct {
+		prefix string
+		tag    objTag
+	}{
+		{"batch", batchTag},
+		{"iter", iterTag},
+		{"snap", snapTag},
+	} {
+		if strings.HasPrefix(s, p.prefix) {
+			slot, err := strconv.ParseUint(s[len(p.prefix):], 10, 32)
+			if err != nil || slot >= 1<<slotBits {
+				break
+			}
+			return makeObjID(p.tag, uint32(slot)), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown object %q", s)
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package metamorphic
+
+import (
+	"testing"
+
+	"golang.org/x/exp/rand"
+)
+
+func TestParserRoundTrip(t *testing.T) {
+	ops := generate(rand.New(rand.NewSource(uint64(1))), 2000, defaultConfig)
+	src := formatOps(ops)
+	parsed, err := parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := formatOps(parsed); src != result {
+		t.Fatalf("expected\n%s\nbut found\n%s", src, result)
+	}
+}
+
+func TestParserHistory(t *testing.T) {
+	// A history can be replayed: the recorded results are comments.
+	const history = `
+# a comment
+db.Set("a", "b // c") // <nil>
+batch0 = db.NewIndexedBatch()
+batch0.Merge("a", "\x00") // <nil>
+iter0 = batch0.NewIter("", "z") // <nil>
+iter0.SeekGE("a") // [true,"a","b // c\x00"] <nil>
+`
+	ops, err := parse(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `db.Set("a", "b // c")
+batch0 = db.NewIndexedBatch()
+batch0.Merge("a", "\x00")
+iter0 = batch0.NewIter("", "z")
+iter0.SeekGE("a")
+`
+	if result := formatOps(ops); expected != result {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, result)
+	}
+
+	for _, line := range []string{
+		`db.Frob("a")`,
+		`iter0.Set("a", "b")`,
+		`db.Set("a")`,
+		`db.NewIter("", "")`,
+		`snap1.Commit()`,
+	} {
+		if _, err := parse(line); err == nil {
+			t.Errorf("expected error parsing %q", line)
+		}
+	}
+}
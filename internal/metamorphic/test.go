@@ -0,0 +1,205 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package metamorphic
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// objTag identifies the type of an object referenced by an op.
+type objTag uint8
+
+const (
+	dbTag objTag = iota + 1
+	batchTag
+	iterTag
+	snapTag
+)
+
+// objID identifies an object (the DB, a batch, an iterator or a snapshot)
+// referenced by an op. The tag is stored in the high 4 bits, and the slot,
+// which distinguishes objects with the same tag, in the remaining bits.
+type objID uint32
+
+const slotBits = 28
+
+var dbObjID = makeObjID(dbTag, 0)
+
+func makeObjID(t objTag, slot uint32) objID {
+	return objID(uint32(t)<<slotBits | slot)
+}
+
+func (i objID) tag() objTag {
+	return objTag(i >> slotBits)
+}
+
+func (i objID) slot() uint32 {
+	return uint32(i) & (1<<slotBits - 1)
+}
+
+func (i objID) String() string {
+	switch i.tag() {
+	case dbTag:
+		return "db"
+	case batchTag:
+		return fmt.Sprintf("batch%d", i.slot())
+	case iterTag:
+		return fmt.Sprintf("iter%d", i.slot())
+	case snapTag:
+		return fmt.Sprintf("snap%d", i.slot())
+	}
+	return fmt.Sprintf("unknown%d", i.slot())
+}
+
+// history records the results of running a sequence of ops. The histories of
+// running the same ops against different configurations are compared.
+type history struct {
+	buf strings.Builder
+}
+
+// Recordf records the result of an op.
+func (h *history) Recordf(format string, args ...interface{}) {
+	fmt.Fprintf(&h.buf, format, args...)
+	h.buf.WriteByte('\n')
+}
+
+func (h *history) String() string {
+	return h.buf.String()
+}
+
+// test runs a sequence of ops against a DB.
+type test struct {
+	ops       []op
+	opts      *pebble.Options
+	dir       string
+	writeOpts *pebble.WriteOptions
+	db        *pebble.DB
+
+	batches   map[objID]*pebble.Batch
+	iters     map[objID]*pebble.Iterator
+	snapshots map[objID]*pebble.Snapshot
+	// The number of sstables created for ingestion, used to generate their
+	// names.
+	ingestCount int
+}
+
+func newTest(ops []op, opts *pebble.Options, dir string) *test {
+	return &test{
+		ops:       ops,
+		opts:      opts,
+		dir:       dir,
+		writeOpts: pebble.NoSync,
+		batches:   make(map[objID]*pebble.Batch),
+		iters:     make(map[objID]*pebble.Iterator),
+		snapshots: make(map[objID]*pebble.Snapshot),
+	}
+}
+
+// run opens the DB, runs the ops, recording their results in the history,
+// and closes the DB.
+func (t *test) run(h *history) error {
+	if err := t.opts.FS.MkdirAll(t.dir, 0755); err != nil {
+		return err
+	}
+	db, err := pebble.Open(t.dir, t.opts)
+	if err != nil {
+		return err
+	}
+	t.db = db
+	for _, o := range t.ops {
+		o.run(t, h)
+	}
+	return t.db.Close()
+}
+
+func (t *test) getBatch(id objID) *pebble.Batch {
+	b := t.batches[id]
+	if b == nil {
+		panic(fmt.Sprintf("metamorphic: unknown batch %s", id))
+	}
+	return b
+}
+
+func (t *test) setBatch(id objID, b *pebble.Batch) {
+	if id.tag() != batchTag {
+		panic(fmt.Sprintf("metamorphic: invalid batch ID %s", id))
+	}
+	t.batches[id] = b
+}
+
+func (t *test) getIter(id objID) *pebble.Iterator {
+	i := t.iters[id]
+	if i == nil {
+		panic(fmt.Sprintf("metamorphic: unknown iterator %s", id))
+	}
+	return i
+}
+
+func (t *test) setIter(id objID, i *pebble.Iterator) {
+	if id.tag() != iterTag {
+		panic(fmt.Sprintf("metamorphic: invalid iterator ID %s", id))
+	}
+	t.iters[id] = i
+}
+
+func (t *test) setSnapshot(id objID, s *pebble.Snapshot) {
+	if id.tag() != snapTag {
+		panic(fmt.Sprintf("metamorphic: invalid snapshot ID %s", id))
+	}
+	t.snapshots[id] = s
+}
+
+func (t *test) getReader(id objID) pebble.Reader {
+	switch id.tag() {
+	case dbTag:
+		return t.db
+	case batchTag:
+		return t.getBatch(id)
+	case snapTag:
+		if s := t.snapshots[id]; s != nil {
+			return s
+		}
+	}
+	panic(fmt.Sprintf("metamorphic: unknown reader %s", id))
+}
+
+func (t *test) getWriter(id objID) pebble.Writer {
+	switch id.tag() {
+	case dbTag:
+		return t.db
+	case batchTag:
+		return t.getBatch(id)
+	}
+	panic(fmt.Sprintf("metamorphic: unknown writer %s", id))
+}
+
+func (t *test) getCloser(id objID) io.Closer {
+	switch id.tag() {
+	case batchTag:
+		return t.getBatch(id)
+	case iterTag:
+		return t.getIter(id)
+	case snapTag:
+		if s := t.snapshots[id]; s != nil {
+			return s
+		}
+	}
+	panic(fmt.Sprintf("metamorphic: unknown closer %s", id))
+}
+
+func (t *test) clearObj(id objID) {
+	switch id.tag() {
+	case batchTag:
+		delete(t.batches, id)
+	case iterTag:
+		delete(t.iters, id)
+	case snapTag:
+		delete(t.snapshots, id)
+	}
+}
@@ -38,9 +38,15 @@ func SeekGE(cmp base.Compare, iter iterator, key []byte, snapshot uint64) Tombst
 		// The current tombstones contains or is past the search key, but SeekLT
 		// returns the oldest entry for a key, so backup until we hit the previous
 		// tombstone or an entry which is not visible.
-		for savedKey := iterKey.UserKey; ; {
+		//
+		// NB: The tombstones are fragmented, so the versions of a tombstone share
+		// an end key and the previous tombstone has a different one. We compare
+		// end keys rather than saving the start key, as the start key is not
+		// necessarily stable across a call to iter.Prev() (a block iterator may
+		// reuse the buffer backing it).
+		for savedEnd := iterValue; ; {
 			iterKey, iterValue = iter.Prev()
-			if iterKey == nil || cmp(savedKey, iterValue) >= 0 || !iterKey.Visible(snapshot) {
+			if iterKey == nil || cmp(savedEnd, iterValue) != 0 || !iterKey.Visible(snapshot) {
 				iterKey, iterValue = iter.Next()
 				break
 			}
@@ -165,8 +171,9 @@ func SeekLE(cmp base.Compare, iter iterator, key []byte, snapshot uint64) Tombst
 	// key and we're positioned at either the oldest of the versions or a visible
 	// version. Walk backwards through the tombstones to find the newest one that
 	// is visible (i.e. has a sequence number less than the snapshot sequence
-	// number).
-	for savedKey := iterKey.UserKey; ; {
+	// number). As in SeekGE, the versions of a tombstone are identified by their
+	// end key which, unlike the start key, is stable across iter.Prev().
+	for savedEnd := iterValue; ; {
 		valid := iterKey.Visible(snapshot)
 		iterKey, iterValue = iter.Prev()
 		if iterKey == nil {
@@ -176,7 +183,7 @@ func SeekLE(cmp base.Compare, iter iterator, key []byte, snapshot uint64) Tombst
 			if !iterKey.Visible(snapshot) {
 				break
 			}
-			if cmp(savedKey, iterKey.UserKey) != 0 {
+			if cmp(savedEnd, iterValue) != 0 {
 				break
 			}
 		}
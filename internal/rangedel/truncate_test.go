@@ -35,8 +35,14 @@ func TestTruncate(t *testing.T) {
 			if len(parts) != 2 {
 				t.Fatalf("malformed arg: %s", d.CmdArgs[0])
 			}
-			lower := []byte(parts[0])
-			upper := []byte(parts[1])
+			// An empty bound is unbounded.
+			var lower, upper []byte
+			if parts[0] != "" {
+				lower = []byte(parts[0])
+			}
+			if parts[1] != "" {
+				upper = []byte(parts[1])
+			}
 
 			truncated := Truncate(cmp, iter, lower, upper)
 			return formatTombstones(truncated.tombstones)
@@ -409,6 +409,21 @@ func (w *LogWriter) SyncRecord(p []byte, wg *sync.WaitGroup, err *error) (int64,
 	return offset, w.err
 }
 
+// Sync asynchronously persists the records written so far to the underlying
+// writer, calling done on the wait group upon completion. A failure to persist
+// the records will populate *err. If an error is returned, done will not be
+// called. Like SyncRecord, Sync must not be called concurrently with the
+// writing of records.
+func (w *LogWriter) Sync(wg *sync.WaitGroup, err *error) error {
+	if w.err != nil {
+		return w.err
+	}
+	f := &w.flusher
+	f.syncQ.push(wg, err)
+	f.ready.Signal()
+	return nil
+}
+
 // Size returns the current size of the file.
 func (w *LogWriter) Size() int64 {
 	return w.blockNum*blockSize + int64(w.block.written)
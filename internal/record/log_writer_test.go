@@ -147,3 +147,39 @@ func TestSyncError(t *testing.T) {
 		t.Fatalf("unexpected %v but found %v", injectedErr, syncErr)
 	}
 }
+
+func TestSync(t *testing.T) {
+	mem := vfs.NewMem()
+	f, err := mem.Create("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewLogWriter(f, 0)
+
+	offset, err := w.WriteRecord([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var syncErr error
+	var syncWG sync.WaitGroup
+	syncWG.Add(1)
+	if err := w.Sync(&syncWG, &syncErr); err != nil {
+		t.Fatal(err)
+	}
+	syncWG.Wait()
+	if syncErr != nil {
+		t.Fatal(syncErr)
+	}
+
+	// The record has been written to the file.
+	fi, err := mem.Stat("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != offset {
+		t.Fatalf("expected size %d, but found %d", offset, fi.Size())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
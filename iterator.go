@@ -8,6 +8,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+
+	"github.com/cockroachdb/pebble/cache"
 )
 
 type iterPos int8
@@ -50,11 +52,72 @@ type Iterator struct {
 	pos       iterPos
 	alloc     *iterAlloc
 	prefix    []byte
+	// now is the Unix time in nanoseconds at which the iterator was created.
+	// Keys written with a TTL which expired at or before now are treated as
+	// deleted.
+	now int64
+	// blobs provides access to the values separated into blob files. If the
+	// value of the current entry is separated, blobHandle holds its blob handle
+	// until the value is retrieved by Value. blobValue holds a reference to the
+	// retrieved value.
+	blobs         *blobFiles
+	blobHandle    []byte
+	blobHandleBuf []byte
+	blobValue     cache.Handle
+}
+
+// setBlobHandle records the blob handle of the current entry, deferring the
+// retrieval of the value until it is needed.
+func (i *Iterator) setBlobHandle(h []byte) {
+	i.blobHandleBuf = append(i.blobHandleBuf[:0], h...)
+	i.blobHandle = i.blobHandleBuf
+	i.value = nil
+}
+
+// resolveBlobValue retrieves the separated value of the current entry, if
+// it has not been retrieved already. Returns false if an error occurred.
+func (i *Iterator) resolveBlobValue() bool {
+	if i.blobHandle == nil {
+		return true
+	}
+	h, err := i.blobs.get(i.blobHandle)
+	i.blobHandle = nil
+	if err != nil {
+		i.err = err
+		i.value = nil
+		return false
+	}
+	i.blobValue.Release()
+	i.blobValue = h
+	i.value = h.Get()
+	return true
+}
+
+// releaseBlobValue releases the separated value of the current entry.
+func (i *Iterator) releaseBlobValue() {
+	i.blobHandle = nil
+	i.blobValue.Release()
+	i.blobValue = cache.Handle{}
+}
+
+// ttlValue decodes the value of an InternalKeyKindSetWithTTL entry, returning
+// false if the entry has expired or is corrupt.
+func (i *Iterator) ttlValue(v []byte) ([]byte, bool) {
+	expiry, value, err := decodeTTLValue(v)
+	if err != nil {
+		i.err = err
+		return nil, false
+	}
+	if ttlExpired(expiry, i.now) {
+		return nil, false
+	}
+	return value, true
 }
 
 func (i *Iterator) findNextEntry() bool {
 	i.valid = false
 	i.pos = iterPosCur
+	i.releaseBlobValue()
 
 	for i.iterKey != nil {
 		key := *i.iterKey
@@ -79,6 +142,35 @@ func (i *Iterator) findNextEntry() bool {
 			i.valid = true
 			return true
 
+		case InternalKeyKindBlobHandle:
+			if i.prefix != nil && !bytes.HasPrefix(key.UserKey, i.prefix) {
+				return false
+			}
+			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
+			i.key = i.keyBuf
+			i.setBlobHandle(i.iterValue)
+			i.valid = true
+			return true
+
+		case InternalKeyKindSetWithTTL:
+			value, ok := i.ttlValue(i.iterValue)
+			if !ok {
+				if i.err != nil {
+					return false
+				}
+				// The key has expired and is treated as deleted.
+				i.nextUserKey()
+				continue
+			}
+			if i.prefix != nil && !bytes.HasPrefix(key.UserKey, i.prefix) {
+				return false
+			}
+			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
+			i.key = i.keyBuf
+			i.value = value
+			i.valid = true
+			return true
+
 		case InternalKeyKindMerge:
 			if i.prefix != nil && !bytes.HasPrefix(key.UserKey, i.prefix) {
 				return false
@@ -115,6 +207,7 @@ func (i *Iterator) nextUserKey() {
 func (i *Iterator) findPrevEntry() bool {
 	i.valid = false
 	i.pos = iterPosCur
+	i.releaseBlobValue()
 
 	for i.iterKey != nil {
 		key := *i.iterKey
@@ -129,6 +222,7 @@ func (i *Iterator) findPrevEntry() bool {
 		switch key.Kind() {
 		case InternalKeyKindDelete, InternalKeyKindSingleDelete:
 			i.value = nil
+			i.blobHandle = nil
 			i.valid = false
 			i.iterKey, i.iterValue = i.iter.Prev()
 			continue
@@ -146,6 +240,42 @@ func (i *Iterator) findPrevEntry() bool {
 			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
 			i.key = i.keyBuf
 			i.value = i.iterValue
+			i.blobHandle = nil
+			i.valid = true
+			i.iterKey, i.iterValue = i.iter.Prev()
+			continue
+
+		case InternalKeyKindBlobHandle:
+			if i.prefix != nil && !bytes.HasPrefix(key.UserKey, i.prefix) {
+				return false
+			}
+			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
+			i.key = i.keyBuf
+			i.setBlobHandle(i.iterValue)
+			i.valid = true
+			i.iterKey, i.iterValue = i.iter.Prev()
+			continue
+
+		case InternalKeyKindSetWithTTL:
+			value, ok := i.ttlValue(i.iterValue)
+			if !ok {
+				if i.err != nil {
+					return false
+				}
+				// The key has expired and is treated as deleted.
+				i.value = nil
+				i.blobHandle = nil
+				i.valid = false
+				i.iterKey, i.iterValue = i.iter.Prev()
+				continue
+			}
+			if i.prefix != nil && !bytes.HasPrefix(key.UserKey, i.prefix) {
+				return false
+			}
+			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
+			i.key = i.keyBuf
+			i.value = value
+			i.blobHandle = nil
 			i.valid = true
 			i.iterKey, i.iterValue = i.iter.Prev()
 			continue
@@ -158,8 +288,15 @@ func (i *Iterator) findPrevEntry() bool {
 				i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
 				i.key = i.keyBuf
 				i.value = i.iterValue
+				i.blobHandle = nil
 				i.valid = true
 			} else {
+				// A separated existing value needs to be retrieved in order to be
+				// merged.
+				if !i.resolveBlobValue() {
+					i.valid = false
+					return false
+				}
 				// The existing value is either stored in valueBuf2 or the underlying
 				// iterators value. We append the new value to valueBuf in order to
 				// merge(valueBuf, valueBuf2). Then we swap valueBuf and valueBuf2 in
@@ -241,6 +378,28 @@ func (i *Iterator) mergeNext(key InternalKey) bool {
 			i.value = i.merge(i.key, i.value, i.iterValue, nil)
 			return true
 
+		case InternalKeyKindBlobHandle:
+			// We've hit a separated Set value. Merge with the value retrieved from
+			// the blob file and return.
+			value, err := i.blobs.value(i.iterValue)
+			if err != nil {
+				i.err = err
+				i.valid = false
+				return false
+			}
+			i.value = i.merge(i.key, i.value, value, nil)
+			return true
+
+		case InternalKeyKindSetWithTTL:
+			// We've hit a Set value with a TTL. If it has expired it is treated as
+			// a deletion tombstone, otherwise it is merged with the existing value.
+			value, ok := i.ttlValue(i.iterValue)
+			if !ok {
+				return i.err == nil
+			}
+			i.value = i.merge(i.key, i.value, value, nil)
+			return true
+
 		case InternalKeyKindMerge:
 			// We've hit another Merge value. Merge with the existing value and
 			// continue looping.
@@ -262,6 +421,9 @@ func (i *Iterator) SeekGE(key []byte) bool {
 	if i.err != nil {
 		return false
 	}
+	if i.opts.PrefixSameAsStart {
+		return i.SeekPrefixGE(key)
+	}
 
 	i.prefix = nil
 	if lowerBound := i.opts.GetLowerBound(); lowerBound != nil && i.cmp(key, lowerBound) < 0 {
@@ -427,8 +589,14 @@ func (i *Iterator) Key() []byte {
 
 // Value returns the value of the current key/value pair, or nil if done. The
 // caller should not modify the contents of the returned slice, and its
-// contents may change on the next call to Next.
+// contents may change on the next call to Next. A value which has been
+// separated into a blob file is retrieved on the first call to Value. If the
+// value cannot be retrieved, nil is returned and the error is available from
+// Error.
 func (i *Iterator) Value() []byte {
+	if i.blobHandle != nil && !i.resolveBlobValue() {
+		return nil
+	}
 	return i.value
 }
 
@@ -448,6 +616,7 @@ func (i *Iterator) Error() error {
 // It is valid to call Close multiple times. Other methods should not be
 // called after the iterator has been closed.
 func (i *Iterator) Close() error {
+	i.releaseBlobValue()
 	if i.readState != nil {
 		i.readState.unref()
 		i.readState = nil
@@ -467,6 +636,7 @@ func (i *Iterator) Close() error {
 // iterator will always be invalidated and must be repositioned with a call to
 // SeekGE, SeekPrefixGE, SeekLT, First, or Last.
 func (i *Iterator) SetBounds(lower, upper []byte) {
+	i.releaseBlobValue()
 	i.prefix = nil
 	i.iterKey = nil
 	i.iterValue = nil
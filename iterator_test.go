@@ -15,6 +15,7 @@ import (
 
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/datadriven"
+	"github.com/cockroachdb/pebble/vfs"
 	"golang.org/x/exp/rand"
 )
 
@@ -369,6 +370,12 @@ func TestIterator(t *testing.T) {
 					opts.LowerBound = []byte(arg.Vals[0])
 				case "upper":
 					opts.UpperBound = []byte(arg.Vals[0])
+				case "prefix-same-as-start":
+					var err error
+					opts.PrefixSameAsStart, err = strconv.ParseBool(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
 				default:
 					return fmt.Sprintf("%s: unknown arg: %s", d.Cmd, arg.Key)
 				}
@@ -471,6 +478,139 @@ func TestIteratorTableFilter(t *testing.T) {
 	})
 }
 
+// valueBytePropertyCollector is a BlockPropertyCollector which records the
+// range of the first byte of the values in each block.
+type valueBytePropertyCollector struct {
+	block, prevBlock, index, table [2]byte
+}
+
+func newValueBytePropertyCollector() BlockPropertyCollector {
+	return &valueBytePropertyCollector{
+		block: [2]byte{0xff, 0},
+		index: [2]byte{0xff, 0},
+		table: [2]byte{0xff, 0},
+	}
+}
+
+func (c *valueBytePropertyCollector) Name() string {
+	return "value-byte"
+}
+
+func (c *valueBytePropertyCollector) Add(key InternalKey, value []byte) error {
+	if len(value) > 0 {
+		c.block = unionValueBytes(c.block, [2]byte{value[0], value[0]})
+	}
+	return nil
+}
+
+func (c *valueBytePropertyCollector) FinishDataBlock(buf []byte) ([]byte, error) {
+	c.table = unionValueBytes(c.table, c.block)
+	c.prevBlock, c.block = c.block, [2]byte{0xff, 0}
+	return append(buf, c.prevBlock[:]...), nil
+}
+
+func (c *valueBytePropertyCollector) AddPrevDataBlockToIndexBlock() {
+	c.index = unionValueBytes(c.index, c.prevBlock)
+}
+
+func (c *valueBytePropertyCollector) FinishIndexBlock(buf []byte) ([]byte, error) {
+	buf = append(buf, c.index[:]...)
+	c.index = [2]byte{0xff, 0}
+	return buf, nil
+}
+
+func (c *valueBytePropertyCollector) FinishTable(buf []byte) ([]byte, error) {
+	return append(buf, c.table[:]...), nil
+}
+
+func unionValueBytes(a, b [2]byte) [2]byte {
+	if b[0] < a[0] {
+		a[0] = b[0]
+	}
+	if b[1] > a[1] {
+		a[1] = b[1]
+	}
+	return a
+}
+
+// valueByteFilter matches the blocks containing a value whose first byte is
+// b.
+type valueByteFilter byte
+
+func (f valueByteFilter) Name() string {
+	return "value-byte"
+}
+
+func (f valueByteFilter) Intersects(prop []byte) (bool, error) {
+	if len(prop) != 2 {
+		return false, fmt.Errorf("unexpected property length %d", len(prop))
+	}
+	return prop[0] <= byte(f) && byte(f) <= prop[1], nil
+}
+
+func TestIteratorBlockPropertyFilters(t *testing.T) {
+	opts := &Options{
+		BlockPropertyCollectors: []func() BlockPropertyCollector{
+			newValueBytePropertyCollector,
+		},
+		FS:     vfs.NewMem(),
+		Levels: []LevelOptions{{BlockSize: 100}},
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	const numKeys = 1000
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := d.Set(key, []byte{byte(i / 100)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := func(filter byte) (n int, matching int) {
+		iter := d.NewIter(&IterOptions{
+			BlockPropertyFilters: []BlockPropertyFilter{valueByteFilter(filter)},
+		})
+		defer iter.Close()
+		for valid := iter.First(); valid; valid = iter.Next() {
+			n++
+			if iter.Value()[0] == filter {
+				matching++
+			}
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return n, matching
+	}
+
+	// Entries in the memtable are never filtered.
+	if n, matching := count(3); n != numKeys || matching != 100 {
+		t.Fatalf("expected %d keys, 100 matching, but found %d, %d matching", numKeys, n, matching)
+	}
+
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After flushing, the data blocks which contain no matching values are
+	// skipped. Every matching value is still visible.
+	if n, matching := count(3); n >= 200 || matching != 100 {
+		t.Fatalf("expected <200 keys, 100 matching, but found %d, %d matching", n, matching)
+	}
+	// The table-level property excludes the whole table.
+	if n, _ := count(20); n != 0 {
+		t.Fatalf("expected 0 keys, but found %d", n)
+	}
+}
+
 func BenchmarkIteratorSeekGE(b *testing.B) {
 	m, keys := buildMemTable(b)
 	iter := &Iterator{
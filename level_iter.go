@@ -5,7 +5,10 @@
 package pebble
 
 import (
+	"bytes"
 	"sort"
+
+	"github.com/cockroachdb/pebble/internal/base"
 )
 
 // tableNewIters creates a new point and range-del iterator for the given file
@@ -36,7 +39,17 @@ type levelIter struct {
 	// The key to return when iterating past an sstable boundary and that
 	// boundary is a range deletion tombstone. Note that if boundary != nil, then
 	// iter == nil, and if iter != nil, then boundary == nil.
-	boundary     *InternalKey
+	boundary *InternalKey
+	// boundaryDir is the direction of iteration in which boundary was reached:
+	// +1 if boundary is the largest key of the current sstable, and -1 if it is
+	// the smallest.
+	boundaryDir int
+	// syntheticBoundary is the boundary returned when iteration within an
+	// sstable is truncated by the iterator bounds. The range tombstones in the
+	// sstable still apply to keys in lower levels up to the bound, so the
+	// sstable is kept loaded until the iterator passes the bound.
+	syntheticBoundary InternalKey
+
 	iter         internalIterator
 	newIters     tableNewIters
 	rangeDelIter *internalIterator
@@ -83,6 +96,7 @@ func (l *levelIter) init(
 	l.opts = opts
 	if l.opts != nil {
 		l.tableOpts.TableFilter = l.opts.TableFilter
+		l.tableOpts.BlockPropertyFilters = l.opts.BlockPropertyFilters
 	}
 	l.cmp = cmp
 	l.index = -1
@@ -127,8 +141,8 @@ func (l *levelIter) findFileLT(key []byte) int {
 
 func (l *levelIter) loadFile(index, dir int) bool {
 	l.boundary = nil
-	if l.index == index {
-		return l.iter != nil
+	if l.index == index && l.iter != nil {
+		return true
 	}
 	if l.iter != nil {
 		l.err = l.iter.Close()
@@ -218,6 +232,14 @@ func (l *levelIter) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
 	if key, val := l.iter.SeekPrefixGE(prefix, key); key != nil {
 		return key, val
 	}
+	// When SeekPrefixGE returns nil, we have not necessarily reached the end of
+	// the sstable: the bloom filter may have excluded the prefix. There is no
+	// need to look at subsequent sstables unless the current sstable's largest
+	// key shares the prefix, as keys sharing a prefix are contiguous.
+	if l.index >= 0 && l.index < len(l.files) &&
+		!bytes.HasPrefix(l.files[l.index].Largest.UserKey, prefix) {
+		return nil, nil
+	}
 	return l.skipEmptyFileForward()
 }
 
@@ -264,8 +286,14 @@ func (l *levelIter) Next() (*InternalKey, []byte) {
 
 	if l.iter == nil {
 		if l.boundary != nil {
-			if l.loadFile(l.index+1, 1) {
-				if key, val := l.iter.First(); key != nil {
+			// A boundary reached by reverse iteration is the start of the current
+			// file, which is the file to resume forward iteration in.
+			index := l.index + 1
+			if l.boundaryDir < 0 {
+				index = l.index
+			}
+			if l.loadFile(index, 1) {
+				if key, val := l.firstInFile(); key != nil {
 					return key, val
 				}
 				return l.skipEmptyFileForward()
@@ -296,8 +324,14 @@ func (l *levelIter) Prev() (*InternalKey, []byte) {
 
 	if l.iter == nil {
 		if l.boundary != nil {
-			if l.loadFile(l.index-1, -1) {
-				if key, val := l.iter.Last(); key != nil {
+			// A boundary reached by forward iteration is the end of the current
+			// file, which is the file to resume reverse iteration in.
+			index := l.index - 1
+			if l.boundaryDir > 0 {
+				index = l.index
+			}
+			if l.loadFile(index, -1) {
+				if key, val := l.lastInFile(); key != nil {
 					return key, val
 				}
 				return l.skipEmptyFileBackward()
@@ -321,6 +355,26 @@ func (l *levelIter) Prev() (*InternalKey, []byte) {
 	return l.skipEmptyFileBackward()
 }
 
+// firstInFile positions the iterator for the current file at its first key
+// that is within the iterator bounds. Unlike SeekGE, First does not check the
+// lower bound of the sstable iterator.
+func (l *levelIter) firstInFile() (*InternalKey, []byte) {
+	if lower := l.tableOpts.LowerBound; lower != nil {
+		return l.iter.SeekGE(lower)
+	}
+	return l.iter.First()
+}
+
+// lastInFile positions the iterator for the current file at its last key that
+// is within the iterator bounds. Unlike SeekLT, Last does not check the upper
+// bound of the sstable iterator.
+func (l *levelIter) lastInFile() (*InternalKey, []byte) {
+	if upper := l.tableOpts.UpperBound; upper != nil {
+		return l.iter.SeekLT(upper)
+	}
+	return l.iter.Last()
+}
+
 func (l *levelIter) skipEmptyFileForward() (*InternalKey, []byte) {
 	var key *InternalKey
 	var val []byte
@@ -332,10 +386,18 @@ func (l *levelIter) skipEmptyFileForward() (*InternalKey, []byte) {
 
 		if l.rangeDelIter != nil {
 			// We're being used as part of an Iterator and we've reached the end of
-			// the sstable. If the boundary is a range deletion tombstone, return
-			// that key.
-			if f := &l.files[l.index]; f.Largest.Kind() == InternalKeyKindRangeDelete {
+			// the sstable. If the sstable was truncated by the upper bound, return
+			// a boundary at the upper bound. Otherwise, if the boundary is a range
+			// deletion tombstone, return that key.
+			if l.tableOpts.UpperBound != nil {
+				l.syntheticBoundary = base.MakeInternalKey(
+					l.tableOpts.UpperBound, InternalKeySeqNumMax, InternalKeyKindRangeDelete)
+				l.boundary = &l.syntheticBoundary
+			} else if f := &l.files[l.index]; f.Largest.Kind() == InternalKeyKindRangeDelete {
 				l.boundary = &f.Largest
+			}
+			if l.boundary != nil {
+				l.boundaryDir = 1
 				return l.boundary, nil
 			}
 			*l.rangeDelIter = nil
@@ -359,11 +421,19 @@ func (l *levelIter) skipEmptyFileBackward() (*InternalKey, []byte) {
 		l.iter = nil
 
 		if l.rangeDelIter != nil {
-			// We're being used as part of an Iterator and we've reached the end of
-			// the sstable. If the boundary is a range deletion tombstone, return
-			// that key.
-			if f := &l.files[l.index]; f.Smallest.Kind() == InternalKeyKindRangeDelete {
+			// We're being used as part of an Iterator and we've reached the start
+			// of the sstable. If the sstable was truncated by the lower bound,
+			// return a boundary at the lower bound. Otherwise, if the boundary is a
+			// range deletion tombstone, return that key.
+			if l.tableOpts.LowerBound != nil {
+				l.syntheticBoundary = base.MakeInternalKey(
+					l.tableOpts.LowerBound, InternalKeySeqNumMax, InternalKeyKindRangeDelete)
+				l.boundary = &l.syntheticBoundary
+			} else if f := &l.files[l.index]; f.Smallest.Kind() == InternalKeyKindRangeDelete {
 				l.boundary = &f.Smallest
+			}
+			if l.boundary != nil {
+				l.boundaryDir = -1
 				return l.boundary, nil
 			}
 			*l.rangeDelIter = nil
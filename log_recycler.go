@@ -55,6 +55,13 @@ func (r *logRecycler) peek() uint64 {
 	return r.mu.logNums[0]
 }
 
+// logNums returns a copy of the log numbers in the recycling queue.
+func (r *logRecycler) logNums() []uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]uint64(nil), r.mu.logNums...)
+}
+
 func (r *logRecycler) count() int {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -11,12 +11,6 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func (r *logRecycler) logNums() []uint64 {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	return append([]uint64(nil), r.mu.logNums...)
-}
-
 func (r *logRecycler) maxLogNum() uint64 {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -56,6 +56,9 @@ type memTable struct {
 	tombstones  rangeTombstoneCache
 	logNum      uint64
 	logSize     uint64
+	// cfID is the ID of the column family the memtable holds records for.
+	// Batch records for other column families are skipped by apply.
+	cfID uint32
 }
 
 // newMemTable returns a new MemTable.
@@ -133,11 +136,12 @@ func (m *memTable) prepare(batch *Batch) error {
 		m.reserved = a.Size()
 	}
 
+	size := batch.columnFamilyMemTableSize(m.cfID)
 	avail := a.Capacity() - m.reserved
-	if batch.memTableSize > avail {
+	if size > avail {
 		return arenaskl.ErrArenaFull
 	}
-	m.reserved += batch.memTableSize
+	m.reserved += size
 
 	m.ref()
 	return nil
@@ -148,10 +152,15 @@ func (m *memTable) apply(batch *Batch, seqNum uint64) error {
 	var tombstoneCount uint32
 	startSeqNum := seqNum
 	for r := batch.Reader(); ; seqNum++ {
-		kind, ukey, value, ok := r.Next()
+		cfID, kind, ukey, value, ok := r.NextColumnFamily()
 		if !ok {
 			break
 		}
+		if cfID != m.cfID {
+			// The record belongs to a different column family. It still consumes
+			// a sequence number.
+			continue
+		}
 		var err error
 		ikey := base.MakeInternalKey(ukey, seqNum, kind)
 		switch kind {
@@ -199,6 +208,13 @@ func (m *memTable) totalBytes() uint64 {
 	return uint64(m.skl.Size() - m.emptySize)
 }
 
+// approximateBytes returns an estimate of the bytes of the memtable used by
+// the keys in the range [start, end): the total bytes scaled by the estimated
+// fraction of the entries within the range.
+func (m *memTable) approximateBytes(start, end []byte) uint64 {
+	return uint64(float64(m.totalBytes()) * m.skl.EstimateFraction(start, end))
+}
+
 func (m *memTable) close() error {
 	return nil
 }
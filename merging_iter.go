@@ -410,6 +410,14 @@ func (m *mergingIter) isNextEntryDeleted(item *mergingIterItem) bool {
 		}
 		if l.tombstone.Contains(m.heap.cmp, item.key.UserKey) {
 			if level < item.index {
+				if item.key.Kind() == InternalKeyKindRangeDelete {
+					// The key is a levelIter boundary rather than a point key.
+					// Seeking the level may return the same boundary (for instance,
+					// if the boundary is the upper bound of the iterator), so step
+					// past it instead.
+					m.nextEntry(item)
+					return true
+				}
 				m.seekGE(l.tombstone.End, item.index)
 				return true
 			}
@@ -474,6 +482,14 @@ func (m *mergingIter) isPrevEntryDeleted(item *mergingIterItem) bool {
 		}
 		if l.tombstone.Contains(m.heap.cmp, item.key.UserKey) {
 			if level < item.index {
+				if item.key.Kind() == InternalKeyKindRangeDelete {
+					// The key is a levelIter boundary rather than a point key.
+					// Seeking the level may return the same boundary (for instance,
+					// if the boundary is the lower bound of the iterator), so step
+					// past it instead.
+					m.prevEntry(item)
+					return true
+				}
 				m.seekLT(l.tombstone.Start.UserKey, item.index)
 				return true
 			}
@@ -7,6 +7,7 @@ package pebble
 import (
 	"bytes"
 	"fmt"
+	"time"
 
 	"github.com/cockroachdb/pebble/internal/humanize"
 )
@@ -69,6 +70,17 @@ func (m *LevelMetrics) format(buf *bytes.Buffer) {
 	)
 }
 
+// PacingMetrics holds the pacing statistics for flushes or compactions.
+type PacingMetrics struct {
+	// The rate, in bytes per second, to which the operations are limited when
+	// they are paced. Zero if a custom Options.Pacer is in use.
+	Rate int64
+	// The number of bytes processed by the operations.
+	Bytes uint64
+	// The total time the operations spent waiting on the pacer.
+	WaitDuration time.Duration
+}
+
 // VersionMetrics holds metrics for each level.
 type VersionMetrics struct {
 	WAL struct {
@@ -84,6 +96,20 @@ type VersionMetrics struct {
 		// Number of bytes written to the WAL.
 		BytesWritten uint64
 	}
+	Pacing struct {
+		// Pacing statistics for flushes.
+		Flush PacingMetrics
+		// Pacing statistics for compactions.
+		Compaction PacingMetrics
+	}
+	Table struct {
+		// The number of obsolete sstables queued for deletion. Obsolete sstables
+		// are only queued when deletion pacing is enabled (see
+		// Options.MinDeletionRate).
+		ObsoleteCount int64
+		// The total size of the obsolete sstables queued for deletion.
+		ObsoleteSize uint64
+	}
 	Levels [numLevels]LevelMetrics
 }
 
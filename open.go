@@ -6,6 +6,7 @@ package pebble
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -35,9 +36,17 @@ func allocDBNum() uint64 {
 
 // Open opens a LevelDB whose files live in the given directory.
 func Open(dirname string, opts *Options) (*DB, error) {
+	return open(dirname, opts, false /* secondary */)
+}
+
+// open implements Open and OpenSecondary.
+func open(dirname string, opts *Options, secondary bool) (*DB, error) {
 	// Make a copy of the options so that we don't mutate the passed in options.
 	opts = opts.Clone()
 	opts = opts.EnsureDefaults()
+	if secondary {
+		opts.ReadOnly = true
+	}
 
 	d := &DB{
 		dbNum:          allocDBNum(),
@@ -54,12 +63,18 @@ func Open(dirname string, opts *Options) (*DB, error) {
 	if d.equal == nil {
 		d.equal = bytes.Equal
 	}
-	tableCacheSize := opts.MaxOpenFiles - numNonTableCacheFiles
-	if tableCacheSize < minTableCacheSize {
-		tableCacheSize = minTableCacheSize
+	if secondary {
+		d.secondary = &secondaryState{}
 	}
-	d.tableCache.init(d.dbNum, dirname, opts.FS, d.opts, tableCacheSize, defaultTableCacheHitBuffer)
+	if _, ok := opts.ColumnFamilies[DefaultColumnFamilyName]; ok {
+		return nil, fmt.Errorf("pebble: options for the %q column family cannot be specified "+
+			"in Options.ColumnFamilies", DefaultColumnFamilyName)
+	}
+	d.tableCache.init(d.dbNum, dirname, opts.FS, d.opts,
+		tableCacheSize(opts.MaxOpenFiles), defaultTableCacheHitBuffer)
 	d.newIters = d.tableCache.newIters
+	d.blobFiles.init(d.dbNum, dirname, opts.FS, d.opts.Cache,
+		tableCacheSize(opts.MaxOpenFiles))
 	d.commit = newCommitPipeline(commitEnv{
 		logSeqNum:     &d.mu.versions.logSeqNum,
 		visibleSeqNum: &d.mu.versions.visibleSeqNum,
@@ -68,15 +83,39 @@ func Open(dirname string, opts *Options) (*DB, error) {
 	})
 	d.compactionLimiter = rate.NewLimiter(rate.Limit(d.opts.MinCompactionRate), d.opts.MinCompactionRate)
 	d.flushLimiter = rate.NewLimiter(rate.Limit(d.opts.MinFlushRate), d.opts.MinFlushRate)
+	if d.opts.MinDeletionRate > 0 {
+		d.deletionLimiter = rate.NewLimiter(rate.Limit(d.opts.MinDeletionRate), d.opts.MinDeletionRate)
+		d.deletionCtx, d.cancelDeletion = context.WithCancel(context.Background())
+	}
 	d.mu.nextJobID = 1
 	d.mu.mem.cond.L = &d.mu.Mutex
 	d.mu.mem.mutable = newMemTable(d.opts)
 	d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
 	d.mu.cleaner.cond.L = &d.mu.Mutex
 	d.mu.compact.cond.L = &d.mu.Mutex
+	d.mu.optionsFile.cond.L = &d.mu.Mutex
+	d.mu.bgError.stopped = make(chan struct{})
 	d.mu.compact.pendingOutputs = make(map[uint64]struct{})
+	d.mu.compact.inProgress = make(map[*compaction]struct{})
 	d.mu.snapshots.init()
 	d.largeBatchThreshold = (d.opts.MemTableSize - int(d.mu.mem.mutable.emptySize)) / 2
+	d.defaultCF = &ColumnFamily{
+		db:                  d,
+		id:                  0,
+		name:                DefaultColumnFamilyName,
+		opts:                d.opts,
+		cmp:                 d.cmp,
+		equal:               d.equal,
+		merge:               d.merge,
+		split:               d.split,
+		abbreviatedKey:      d.abbreviatedKey,
+		tableCache:          &d.tableCache,
+		newIters:            d.newIters,
+		largeBatchThreshold: d.largeBatchThreshold,
+		mem:                 &d.mu.mem.memTables,
+		versions:            &d.mu.versions.columnFamilyVersions,
+	}
+	d.mu.columnFamilies = []*ColumnFamily{d.defaultCF}
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -113,14 +152,18 @@ func Open(dirname string, opts *Options) (*DB, error) {
 		}
 	}
 
-	// Lock the database directory.
-	fileLock, err := opts.FS.Lock(base.MakeFilename(opts.FS, dirname, fileTypeLock, 0))
-	if err != nil {
-		d.dataDir.Close()
-		if d.dataDir != d.walDir {
-			d.walDir.Close()
+	// Lock the database directory. A secondary instance shares the directory
+	// with the primary, which holds the lock.
+	var fileLock io.Closer
+	if !secondary {
+		fileLock, err = opts.FS.Lock(base.MakeFilename(opts.FS, dirname, fileTypeLock, 0))
+		if err != nil {
+			d.dataDir.Close()
+			if d.dataDir != d.walDir {
+				d.walDir.Close()
+			}
+			return nil, err
 		}
-		return nil, err
 	}
 	defer func() {
 		if fileLock != nil {
@@ -148,6 +191,15 @@ func Open(dirname string, opts *Options) (*DB, error) {
 		}
 	}
 
+	// Create the handles for the existing non-default column families. The
+	// mutable memtables are associated with the new WAL below.
+	for _, cfv := range d.mu.versions.columnFamilies {
+		d.mu.columnFamilies = append(d.mu.columnFamilies, d.newColumnFamily(cfv, 0))
+	}
+	sort.Slice(d.mu.columnFamilies, func(i, j int) bool {
+		return d.mu.columnFamilies[i].id < d.mu.columnFamilies[j].id
+	})
+
 	ls, err := opts.FS.List(d.walDirname)
 	if err != nil {
 		return nil, err
@@ -173,11 +225,15 @@ func Open(dirname string, opts *Options) (*DB, error) {
 		}
 		switch ft {
 		case fileTypeLog:
-			if fn >= d.mu.versions.minUnflushedLogNum {
+			if fn >= d.mu.versions.minLogNumToKeep() {
 				logFiles = append(logFiles, fileNumAndName{fn, filename})
 			}
 		case fileTypeOptions:
 			if err := checkOptions(opts, opts.FS.PathJoin(dirname, filename)); err != nil {
+				if secondary && os.IsNotExist(err) {
+					// The primary deleted the obsolete OPTIONS file.
+					continue
+				}
 				return nil, err
 			}
 		}
@@ -186,9 +242,9 @@ func Open(dirname string, opts *Options) (*DB, error) {
 		return logFiles[i].num < logFiles[j].num
 	})
 
-	var ve versionEdit
+	edits := make(map[uint32]*versionEdit)
 	for _, lf := range logFiles {
-		maxSeqNum, err := d.replayWAL(jobID, &ve, opts.FS, opts.FS.PathJoin(d.walDirname, lf.name), lf.num)
+		maxSeqNum, err := d.replayWAL(jobID, edits, opts.FS, opts.FS.PathJoin(d.walDirname, lf.name), lf.num)
 		if err != nil {
 			return nil, err
 		}
@@ -199,6 +255,26 @@ func Open(dirname string, opts *Options) (*DB, error) {
 	}
 	d.mu.versions.visibleSeqNum = d.mu.versions.logSeqNum
 
+	if secondary {
+		d.secondary.manifestFileNum = d.mu.versions.manifestFileNum
+		d.secondary.manifestEdits = d.mu.versions.manifestEdits
+		if len(logFiles) > 0 {
+			d.secondary.logNum = logFiles[len(logFiles)-1].num
+		}
+	}
+
+	// The existing WALs contain the batches with sequence numbers below
+	// logSeqNum. The batches contained in WALs which have already been deleted
+	// are unknown, so only the batches from logSeqNum onwards are guaranteed
+	// to be available. See DB.GetUpdatesSince.
+	d.mu.log.endSeqNums = make(map[uint64]uint64)
+	for _, filename := range ls {
+		if ft, fn, ok := base.ParseFilename(opts.FS, filename); ok && ft == fileTypeLog {
+			d.mu.log.endSeqNums[fn] = d.mu.versions.logSeqNum
+		}
+	}
+	d.mu.log.availableSeqNum = d.mu.versions.logSeqNum
+
 	if !d.opts.ReadOnly {
 		// Create an empty .log file.
 		newLogNum := d.mu.versions.getNextFileNum()
@@ -227,8 +303,34 @@ func Open(dirname string, opts *Options) (*DB, error) {
 		// This logic is slightly different than RocksDB's. Specifically, RocksDB
 		// sets MinUnflushedLogNum to max-recovered-log-num + 1. We set it to the
 		// newLogNum. There should be no difference in using either value.
-		ve.MinUnflushedLogNum = newLogNum
-		if err := d.mu.versions.logAndApply(jobID, &ve, nil, d.dataDir); err != nil {
+		for _, cf := range d.mu.columnFamilies {
+			ve := edits[cf.id]
+			if ve == nil {
+				ve = &versionEdit{}
+			}
+			ve.ColumnFamily = cf.id
+			ve.MinUnflushedLogNum = newLogNum
+			if err := d.mu.versions.logAndApply(jobID, ve, nil, d.dataDir); err != nil {
+				return nil, err
+			}
+			cf.mem.mutable.logNum = newLogNum
+		}
+	}
+
+	// Create the column families named in the options which do not exist yet.
+	var names []string
+	for name := range opts.ColumnFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if d.mu.versions.hasColumnFamily(name) {
+			continue
+		}
+		if d.opts.ReadOnly {
+			return nil, fmt.Errorf("pebble: column family %q does not exist", name)
+		}
+		if _, err := d.createColumnFamilyLocked(jobID, name, opts.ColumnFamilies[name]); err != nil {
 			return nil, err
 		}
 	}
@@ -236,17 +338,7 @@ func Open(dirname string, opts *Options) (*DB, error) {
 
 	if !d.opts.ReadOnly {
 		// Write the current options to disk.
-		d.optionsFileNum = d.mu.versions.getNextFileNum()
-		optionsFile, err := opts.FS.Create(
-			base.MakeFilename(opts.FS, dirname, fileTypeOptions, d.optionsFileNum))
-		if err != nil {
-			return nil, err
-		}
-		if _, err := optionsFile.Write([]byte(opts.String())); err != nil {
-			return nil, err
-		}
-		optionsFile.Close()
-		if err := d.dataDir.Sync(); err != nil {
+		if err := d.writeOptionsFileLocked(); err != nil {
 			return nil, err
 		}
 	}
@@ -255,6 +347,17 @@ func Open(dirname string, opts *Options) (*DB, error) {
 		d.scanObsoleteFiles(ls)
 		d.deleteObsoleteFiles(jobID)
 	}
+	if !d.opts.ReadOnly {
+		// Deletion hints are not persisted, so rebuild them from the range
+		// tombstones in the tables of each column family.
+		for _, cf := range d.mu.columnFamilies {
+			v := cf.versions.currentVersion()
+			for level := range v.Files {
+				cf.versions.deletionHints = append(cf.versions.deletionHints,
+					cf.loadDeletionHints(v.Files[level])...)
+			}
+		}
+	}
 	d.maybeScheduleFlush()
 	d.maybeScheduleCompaction()
 
@@ -262,13 +365,17 @@ func Open(dirname string, opts *Options) (*DB, error) {
 	return d, nil
 }
 
-// replayWAL replays the edits in the specified log file.
+// replayWAL replays the edits in the specified log file. Each column family
+// is replayed into its own memtable, skipping those column families which
+// have already flushed the contents of the log. The tables created by
+// flushing the memtables are added to the column family's version edit in
+// edits.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
 func (d *DB) replayWAL(
 	jobID int,
-	ve *versionEdit,
+	edits map[uint32]*versionEdit,
 	fs vfs.FS,
 	filename string,
 	logNum uint64,
@@ -280,16 +387,120 @@ func (d *DB) replayWAL(
 	defer file.Close()
 
 	var (
-		b   Batch
-		buf bytes.Buffer
-		mem *memTable
-		rr  = record.NewReader(file, logNum)
+		b    Batch
+		buf  bytes.Buffer
+		mems = make([]*memTable, len(d.mu.columnFamilies))
+		rr   = record.NewReader(file, logNum)
 	)
 
-	// In read-only mode, we replay directly into the mutable memtable which will
-	// never be flushed.
+	// In read-only mode, we replay directly into the mutable memtables which
+	// will never be flushed. The memtables are tagged with the number of the
+	// log they are replayed from (see DB.TryCatchUpWithPrimary).
 	if d.opts.ReadOnly {
-		mem = d.mu.mem.mutable
+		for i, cf := range d.mu.columnFamilies {
+			mems[i] = cf.mem.mutable
+			mems[i].logNum = logNum
+		}
+	}
+
+	// flushMem writes the memtable of the i-th column family to L0, adding the
+	// new tables to the version edit of the column family.
+	flushMem := func(i int) error {
+		cf := d.mu.columnFamilies[i]
+		mem := mems[i]
+		if mem == nil || mem.empty() {
+			return nil
+		}
+		// The flush must take into account the L0 tables already added by the
+		// replay, which are above the tables in the current version. Otherwise
+		// the sequence numbers of the flushed keys could be zeroed.
+		v := cf.versions.currentVersion()
+		ve := edits[cf.id]
+		if ve != nil && len(ve.NewFiles) > 0 {
+			v = &version{Files: v.Files, BlobFiles: v.BlobFiles}
+			v.Files[0] = append([]fileMetadata(nil), v.Files[0]...)
+			for i := range ve.NewFiles {
+				v.Files[0] = append(v.Files[0], ve.NewFiles[i].Meta)
+			}
+		}
+		c := newFlush(cf.opts, v, 1 /* base level */, []flushable{mem}, &d.bytesFlushed)
+		c.cfID = cf.id
+		newVE, pendingOutputs, err := d.runCompaction(jobID, c, nilPacer)
+		if err != nil {
+			return err
+		}
+		if ve == nil {
+			ve = &versionEdit{}
+			edits[cf.id] = ve
+		}
+		ve.NewFiles = append(ve.NewFiles, newVE.NewFiles...)
+		// Strictly speaking, it's too early to delete from d.pendingOutputs, but
+		// we are replaying the log file, which happens before Open returns, so
+		// there is no possibility of deleteObsoleteFiles being called concurrently
+		// here.
+		for _, fileNum := range pendingOutputs {
+			delete(d.mu.compact.pendingOutputs, fileNum)
+		}
+		return nil
+	}
+
+	// replayIngest replays the ingestion of sstables which overlapped the
+	// memtables (see DB.ingestAsFlushable). The sstables were ingested into the
+	// default column family, above the mutations which precede them in the
+	// WAL.
+	replayIngest := func(fileNums []uint64, seqNum uint64) error {
+		cf := d.defaultCF
+		// The file numbers of the sstables were allocated after the WAL was
+		// created, and may not have been recorded in the MANIFEST.
+		for _, fileNum := range fileNums {
+			d.mu.versions.markFileNumUsed(fileNum)
+		}
+		if logNum < cf.versions.minUnflushedLogNum {
+			// The sstables have already been added to the LSM.
+			return nil
+		}
+		meta := make([]*fileMetadata, len(fileNums))
+		for i, fileNum := range fileNums {
+			path := base.MakeFilename(fs, d.dirname, fileTypeTable, fileNum)
+			m, err := ingestLoad1(d.opts, path, d.dbNum, fileNum)
+			if err != nil {
+				return err
+			}
+			meta[i] = m
+		}
+		if err := ingestUpdateSeqNum(d.opts, d.dirname, seqNum, meta); err != nil {
+			return err
+		}
+
+		if d.opts.ReadOnly {
+			// The sstables are added to the queue of memtables above the mutable
+			// memtable, which is replaced by a new memtable for the mutations
+			// which follow the ingestion.
+			ingested := newIngestedFlushable(cf, meta)
+			ingested.logNum = logNum
+			cf.mem.queue = append(cf.mem.queue, ingested)
+			cf.mem.mutable = cf.newMemTable(logNum)
+			cf.mem.queue = append(cf.mem.queue, cf.mem.mutable)
+			mems[0] = cf.mem.mutable
+			return nil
+		}
+
+		// The mutations preceding the ingestion are flushed first, so that the
+		// sstables are above them in L0. Note that the default column family is
+		// the first in d.mu.columnFamilies.
+		if err := flushMem(0); err != nil {
+			return err
+		}
+		mems[0] = nil
+		ve := edits[cf.id]
+		if ve == nil {
+			ve = &versionEdit{}
+			edits[cf.id] = ve
+		}
+		for _, m := range meta {
+			ve.NewFiles = append(ve.NewFiles, newFileEntry{Level: 0, Meta: *m})
+		}
+		return nil
 	}
 
 	for {
@@ -305,6 +516,11 @@ func (d *DB) replayWAL(
 			if err == io.EOF || err == record.ErrZeroedChunk || err == record.ErrInvalidChunk {
 				break
 			}
+			if err == io.ErrUnexpectedEOF && d.secondary != nil {
+				// The primary is in the middle of writing the record. It is
+				// replayed by the next catch-up.
+				break
+			}
 			return 0, err
 		}
 
@@ -319,26 +535,49 @@ func (d *DB) replayWAL(
 		seqNum := b.SeqNum()
 		maxSeqNum = seqNum + uint64(b.Count())
 
-		if mem == nil {
-			mem = newMemTable(d.opts)
+		fileNums, err := ingestedFileNums(&b)
+		if err != nil {
+			return 0, err
 		}
-
-		for {
-			err := mem.prepare(&b)
-			if err == arenaskl.ErrArenaFull {
-				// TODO(peter): write the memtable to disk.
-				panic(err)
-			}
-			if err != nil {
+		if fileNums != nil {
+			if err := replayIngest(fileNums, seqNum); err != nil {
 				return 0, err
 			}
-			break
+			buf.Reset()
+			continue
 		}
 
-		if err := mem.apply(&b, seqNum); err != nil {
-			return 0, err
+		for i, cf := range d.mu.columnFamilies {
+			if logNum < cf.versions.minUnflushedLogNum {
+				// The column family has already flushed the contents of this log.
+				continue
+			}
+			if cf.id != 0 && b.columnFamilyMemTableSize(cf.id) == 0 {
+				continue
+			}
+			mem := mems[i]
+			if mem == nil {
+				mem = cf.newMemTable(0 /* logNum */)
+				mems[i] = mem
+			}
+
+			for {
+				err := mem.prepare(&b)
+				if err == arenaskl.ErrArenaFull {
+					// TODO(peter): write the memtable to disk.
+					panic(err)
+				}
+				if err != nil {
+					return 0, err
+				}
+				break
+			}
+
+			if err := mem.apply(&b, seqNum); err != nil {
+				return 0, err
+			}
+			mem.unref()
 		}
-		mem.unref()
 
 		buf.Reset()
 	}
@@ -346,30 +585,87 @@ func (d *DB) replayWAL(
 	if d.opts.ReadOnly {
 		// In read-only mode, each WAL file is replayed into its own memtable. This
 		// is done so that the WAL metrics can be accurately provided.
-		mem.logSize = uint64(rr.Offset())
-		d.mu.mem.mutable = newMemTable(d.opts)
-		d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
+		d.mu.mem.mutable.logSize = uint64(rr.Offset())
+		for _, cf := range d.mu.columnFamilies {
+			cf.mem.mutable = cf.newMemTable(0 /* logNum */)
+			cf.mem.queue = append(cf.mem.queue, cf.mem.mutable)
+		}
 		d.mu.versions.metrics.WAL.Files++
-	} else if mem != nil && !mem.empty() {
-		c := newFlush(d.opts, d.mu.versions.currentVersion(),
-			1 /* base level */, []flushable{mem}, &d.bytesFlushed)
-		newVE, pendingOutputs, err := d.runCompaction(jobID, c, nilPacer)
-		if err != nil {
+		return maxSeqNum, nil
+	}
+
+	for i := range d.mu.columnFamilies {
+		if err := flushMem(i); err != nil {
 			return 0, err
 		}
-		ve.NewFiles = append(ve.NewFiles, newVE.NewFiles...)
-		// Strictly speaking, it's too early to delete from d.pendingOutputs, but
-		// we are replaying the log file, which happens before Open returns, so
-		// there is no possibility of deleteObsoleteFiles being called concurrently
-		// here.
-		for _, fileNum := range pendingOutputs {
-			delete(d.mu.compact.pendingOutputs, fileNum)
-		}
 	}
 
 	return maxSeqNum, nil
 }
 
+// writeOptionsFileLocked writes the current options to a new OPTIONS file.
+// The previous OPTIONS file, if any, becomes obsolete and is deleted by the
+// next call to deleteObsoleteFiles. The options which can be changed while the
+// DB is open (e.g. via SetMinCompactionRate) are written with their current
+// values. Concurrent calls are serialized, so that the last OPTIONS file
+// written reflects the latest changes.
+//
+// d.mu must be held when calling this, but the mutex may be dropped and
+// re-acquired during the course of this method.
+func (d *DB) writeOptionsFileLocked() error {
+	// Wait for any existing writing of an OPTIONS file to complete, then mark
+	// the OPTIONS file as busy.
+	for d.mu.optionsFile.writing {
+		d.mu.optionsFile.cond.Wait()
+	}
+	d.mu.optionsFile.writing = true
+	defer func() {
+		d.mu.optionsFile.writing = false
+		d.mu.optionsFile.cond.Signal()
+	}()
+
+	opts := d.opts.Clone()
+	if d.compactionLimiter != nil {
+		opts.MinCompactionRate = int(d.compactionLimiter.Limit())
+	}
+	if d.flushLimiter != nil {
+		opts.MinFlushRate = int(d.flushLimiter.Limit())
+	}
+	fileNum := d.mu.versions.getNextFileNum()
+
+	// Release the d.mu lock while doing I/O.
+	d.mu.Unlock()
+	err := func() error {
+		optionsFile, err := opts.FS.Create(
+			base.MakeFilename(opts.FS, d.dirname, fileTypeOptions, fileNum))
+		if err != nil {
+			return err
+		}
+		if _, err := optionsFile.Write([]byte(opts.String())); err != nil {
+			optionsFile.Close()
+			return err
+		}
+		if err := optionsFile.Sync(); err != nil {
+			optionsFile.Close()
+			return err
+		}
+		if err := optionsFile.Close(); err != nil {
+			return err
+		}
+		return d.dataDir.Sync()
+	}()
+	d.mu.Lock()
+	if err != nil {
+		return err
+	}
+
+	if d.optionsFileNum != 0 {
+		d.mu.versions.obsoleteOptions = append(d.mu.versions.obsoleteOptions, d.optionsFileNum)
+	}
+	d.optionsFileNum = fileNum
+	return nil
+}
+
 func checkOptions(opts *Options, path string) error {
 	f, err := opts.FS.Open(path)
 	if err != nil {
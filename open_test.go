@@ -11,9 +11,12 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/errorfs"
 	"github.com/cockroachdb/pebble/vfs"
 	"github.com/kr/pretty"
 	"github.com/stretchr/testify/require"
@@ -221,6 +224,121 @@ func TestOpenOptionsCheck(t *testing.T) {
 	require.Regexp(t, `merger name from file.*!=.*`, err)
 }
 
+func TestOptionsFile(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &Options{
+		FS:                    mem,
+		L0CompactionThreshold: 7,
+		Levels: []LevelOptions{
+			{BlockSize: 1 << 10},
+			{Compression: NoCompression},
+		},
+	}
+	d, err := Open("", opts)
+	require.NoError(t, err)
+
+	readOptions := func() *Options {
+		t.Helper()
+		ls, err := mem.List("")
+		require.NoError(t, err)
+		var names []string
+		for _, name := range ls {
+			if ft, _, ok := base.ParseFilename(mem, name); ok && ft == fileTypeOptions {
+				names = append(names, name)
+			}
+		}
+		require.Equal(t, 1, len(names), "OPTIONS files: %s", names)
+		f, err := mem.Open(names[0])
+		require.NoError(t, err)
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		parsed := &Options{}
+		require.NoError(t, parsed.Parse(string(data), nil))
+		return parsed
+	}
+
+	parsed := readOptions()
+	require.Equal(t, opts.Clone().EnsureDefaults().String(), parsed.String())
+	require.Equal(t, 7, parsed.L0CompactionThreshold)
+	require.Equal(t, 2, len(parsed.Levels))
+	require.Equal(t, 1<<10, parsed.Levels[0].BlockSize)
+	require.Equal(t, NoCompression, parsed.Levels[1].Compression)
+
+	// Changing the options while the DB is open replaces the OPTIONS file.
+	require.NoError(t, d.SetMinCompactionRate(5<<20))
+	require.NoError(t, d.SetMinFlushRate(6<<20))
+	parsed = readOptions()
+	require.Equal(t, 5<<20, parsed.MinCompactionRate)
+	require.Equal(t, 6<<20, parsed.MinFlushRate)
+	require.NoError(t, d.Close())
+}
+
+func TestOptionsFileUnlocked(t *testing.T) {
+	mem := vfs.NewMem()
+	var block int32
+	syncing := make(chan struct{})
+	release := make(chan struct{})
+	isOptions := errorfs.FileTypes(fileTypeOptions)
+	fs := errorfs.Wrap(mem, errorfs.InjectorFunc(func(op errorfs.Op) error {
+		if op.Type == errorfs.OpSync && isOptions(op) && atomic.CompareAndSwapInt32(&block, 1, 0) {
+			close(syncing)
+			<-release
+		}
+		return nil
+	}))
+	d, err := Open("", &Options{FS: fs})
+	require.NoError(t, err)
+
+	// Block the sync of the OPTIONS file written by SetMinCompactionRate.
+	atomic.StoreInt32(&block, 1)
+	errs := make(chan error, 2)
+	go func() {
+		errs <- d.SetMinCompactionRate(5 << 20)
+	}()
+	<-syncing
+
+	// The OPTIONS file is written without holding DB.mu.
+	metrics := make(chan *VersionMetrics)
+	go func() {
+		metrics <- d.Metrics()
+	}()
+	select {
+	case <-metrics:
+	case <-time.After(10 * time.Second):
+		t.Fatal("DB.mu is held while writing the OPTIONS file")
+	}
+
+	// A concurrent change waits for the OPTIONS file to be written, and the
+	// OPTIONS file it writes includes both changes.
+	go func() {
+		errs <- d.SetMinFlushRate(6 << 20)
+	}()
+	close(release)
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+
+	ls, err := mem.List("")
+	require.NoError(t, err)
+	var names []string
+	for _, name := range ls {
+		if ft, _, ok := base.ParseFilename(mem, name); ok && ft == fileTypeOptions {
+			names = append(names, name)
+		}
+	}
+	require.Equal(t, 1, len(names), "OPTIONS files: %s", names)
+	f, err := mem.Open(names[0])
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	parsed := &Options{}
+	require.NoError(t, parsed.Parse(string(data), nil))
+	require.Equal(t, 5<<20, parsed.MinCompactionRate)
+	require.Equal(t, 6<<20, parsed.MinFlushRate)
+	require.NoError(t, d.Close())
+}
+
 func TestOpenReadOnly(t *testing.T) {
 	mem := vfs.NewMem()
 
@@ -335,3 +453,44 @@ func TestOpenReadOnly(t *testing.T) {
 		}
 	}
 }
+
+type testKeyManager struct {
+	key vfs.EncryptionKey
+}
+
+func (m *testKeyManager) ActiveKey() (*vfs.EncryptionKey, error) {
+	return &m.key, nil
+}
+
+func (m *testKeyManager) GetKey(id string) (*vfs.EncryptionKey, error) {
+	if id != m.key.ID {
+		return nil, os.ErrNotExist
+	}
+	return &m.key, nil
+}
+
+func TestOpenEncryptedFS(t *testing.T) {
+	mem := vfs.NewMem()
+	km := &testKeyManager{key: vfs.EncryptionKey{ID: "1", Key: []byte("0123456789abcdef")}}
+	fs, err := vfs.NewEncryptedFS(mem, "", km)
+	require.NoError(t, err)
+
+	d, err := Open("", &Options{FS: fs})
+	require.NoError(t, err)
+	require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Set([]byte("b"), []byte("2"), nil))
+	require.NoError(t, d.Close())
+
+	// Reopen the DB, replaying the WAL and reading the sstable.
+	fs, err = vfs.NewEncryptedFS(mem, "", km)
+	require.NoError(t, err)
+	d, err = Open("", &Options{FS: fs})
+	require.NoError(t, err)
+	for k, v := range map[string]string{"a": "1", "b": "2"} {
+		got, err := d.Get([]byte(k))
+		require.NoError(t, err)
+		require.Equal(t, v, string(got))
+	}
+	require.NoError(t, d.Close())
+}
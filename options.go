@@ -6,6 +6,19 @@ package pebble
 
 import "github.com/cockroachdb/pebble/internal/base"
 
+// CompactionFilter exports the base.CompactionFilter type.
+type CompactionFilter = base.CompactionFilter
+
+// CompactionFilterDecision exports the base.CompactionFilterDecision type.
+type CompactionFilterDecision = base.CompactionFilterDecision
+
+// Exported CompactionFilterDecision constants.
+const (
+	CompactionFilterKeep        = base.CompactionFilterKeep
+	CompactionFilterRemove      = base.CompactionFilterRemove
+	CompactionFilterChangeValue = base.CompactionFilterChangeValue
+)
+
 // Compression exports the base.Compression type.
 type Compression = base.Compression
 
@@ -14,14 +27,17 @@ const (
 	DefaultCompression = base.DefaultCompression
 	NoCompression      = base.NoCompression
 	SnappyCompression  = base.SnappyCompression
+	ZstdCompression    = base.ZstdCompression
+	LZ4Compression     = base.LZ4Compression
 )
 
 // FilterType exports the base.FilterType type.
 type FilterType = base.FilterType
 
-// Exported TableFilter constants.
+// Exported FilterType constants.
 const (
 	TableFilter = base.TableFilter
+	BlockFilter = base.BlockFilter
 )
 
 // FilterWriter exports the base.FilterWriter type.
@@ -30,6 +46,18 @@ type FilterWriter = base.FilterWriter
 // FilterPolicy exports the base.FilterPolicy type.
 type FilterPolicy = base.FilterPolicy
 
+// Pacer exports the base.Pacer type.
+type Pacer = base.Pacer
+
+// PacerOperation exports the base.PacerOperation type.
+type PacerOperation = base.PacerOperation
+
+// Exported PacerOperation constants.
+const (
+	PacerFlush      = base.PacerFlush
+	PacerCompaction = base.PacerCompaction
+)
+
 // TableFormat exports the base.TableFormat type.
 type TableFormat = base.TableFormat
 
@@ -42,6 +70,12 @@ const (
 // TablePropertyCollector exports the base.TablePropertyCollector type.
 type TablePropertyCollector = base.TablePropertyCollector
 
+// BlockPropertyCollector exports the base.BlockPropertyCollector type.
+type BlockPropertyCollector = base.BlockPropertyCollector
+
+// BlockPropertyFilter exports the base.BlockPropertyFilter type.
+type BlockPropertyFilter = base.BlockPropertyFilter
+
 // LevelOptions exports the base.LevelOptions type.
 type LevelOptions = base.LevelOptions
 
@@ -67,6 +101,24 @@ type IterOptions struct {
 	// iteration based on the user properties. Return true to scan the table and
 	// false to skip scanning.
 	TableFilter func(userProps map[string]string) bool
+	// BlockPropertyFilters can be used to skip the data blocks of the tables
+	// scanned during iteration based on the properties written for each block
+	// by the BlockPropertyCollector with the same name. A data block is only
+	// scanned if every filter intersects its properties. Tables whose
+	// table-level properties do not intersect every filter are skipped
+	// entirely. Filters are ignored for tables written without the
+	// corresponding collector. Note that block property filters are an
+	// optimization: entries in memtables are never filtered, nor are entries in
+	// blocks whose properties intersect the filters, so the iterator may return
+	// entries which do not match the filters.
+	BlockPropertyFilters []BlockPropertyFilter
+	// PrefixSameAsStart causes SeekGE to behave like SeekPrefixGE: the iterator
+	// will only observe keys which share the prefix of the sought key, as
+	// determined by Comparer.Split. This allows range scans over a prefix to
+	// make use of bloom filters to skip sstables and data blocks which do not
+	// contain the prefix. A Split function must be supplied to the Comparer,
+	// otherwise the iterator is created in an error state.
+	PrefixSameAsStart bool
 }
 
 // GetLowerBound returns the LowerBound or nil if the receiver is nil.
@@ -7,7 +7,11 @@ package pebble
 import (
 	"context"
 	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/cockroachdb/pebble/internal/rate"
 )
 
 var nilPacer = &noopPacer{}
@@ -16,6 +20,8 @@ type limiter interface {
 	WaitN(ctx context.Context, n int) (err error)
 	AllowN(now time.Time, n int) bool
 	Burst() int
+	Limit() rate.Limit
+	SetLimit(newLimit rate.Limit)
 }
 
 // pacer is the interface for flush and compaction rate limiters. The rate limiter
@@ -29,6 +35,9 @@ type pacer interface {
 // flushPacer.
 type internalPacer struct {
 	limiter limiter
+	// ctx is the context used when waiting on the limiter. If nil,
+	// context.Background() is used.
+	ctx context.Context
 
 	iterCount             uint64
 	prevBytesIterated     uint64
@@ -40,27 +49,32 @@ type internalPacer struct {
 // threshold.
 func (p *internalPacer) limit(amount, currentLevel uint64) error {
 	if currentLevel <= p.slowdownThreshold {
-		burst := p.limiter.Burst()
-		for amount > uint64(burst) {
-			err := p.limiter.WaitN(context.Background(), burst)
-			if err != nil {
-				return err
-			}
-			amount -= uint64(burst)
-		}
-		err := p.limiter.WaitN(context.Background(), int(amount))
+		return p.wait(amount)
+	}
+	burst := p.limiter.Burst()
+	for amount > uint64(burst) {
+		p.limiter.AllowN(time.Now(), burst)
+		amount -= uint64(burst)
+	}
+	p.limiter.AllowN(time.Now(), int(amount))
+	return nil
+}
+
+// wait waits on the rate limiter for the specified amount.
+func (p *internalPacer) wait(amount uint64) error {
+	ctx := p.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	burst := p.limiter.Burst()
+	for amount > uint64(burst) {
+		err := p.limiter.WaitN(ctx, burst)
 		if err != nil {
 			return err
 		}
-	} else {
-		burst := p.limiter.Burst()
-		for amount > uint64(burst) {
-			p.limiter.AllowN(time.Now(), burst)
-			amount -= uint64(burst)
-		}
-		p.limiter.AllowN(time.Now(), int(amount))
+		amount -= uint64(burst)
 	}
-	return nil
+	return p.limiter.WaitN(ctx, int(amount))
 }
 
 // compactionPacerInfo contains information necessary for compaction pacing.
@@ -238,6 +252,192 @@ func (p *flushPacer) maybeThrottle(bytesIterated uint64) error {
 	return p.limit(flushAmount, dirtyBytes)
 }
 
+// deletionPacerInfo contains information necessary for deletion pacing.
+type deletionPacerInfo struct {
+	// obsoleteBytes is the total size of the obsolete sstables which are queued
+	// for deletion.
+	obsoleteBytes uint64
+	// liveBytes is the total size of the live sstables.
+	liveBytes uint64
+}
+
+// deletionPacerEnv defines the environment in which the deletion rate limiter
+// is applied.
+type deletionPacerEnv struct {
+	limiter limiter
+	// ctx is cancelled when the DB is closed, which stops any wait on the
+	// limiter.
+	ctx context.Context
+
+	getInfo func() deletionPacerInfo
+}
+
+// deletionPacer rate limits the deletion of obsolete sstables. Deleting a large
+// number of files at once (e.g. after a large compaction) can cause latency
+// spikes on some SSDs due to the resulting discard/trim activity. If the
+// backlog of obsolete bytes grows beyond a fraction of the live bytes, the rate
+// is increased in proportion to the backlog so that the backlog, and the disk
+// space it occupies, does not grow without bound.
+type deletionPacer struct {
+	internalPacer
+	env deletionPacerEnv
+	// obsoleteBytesTargetRatio is the ratio of obsolete bytes to live bytes
+	// above which the rate is increased.
+	obsoleteBytesTargetRatio float64
+}
+
+func newDeletionPacer(env deletionPacerEnv) *deletionPacer {
+	return &deletionPacer{
+		env: env,
+		internalPacer: internalPacer{
+			limiter: env.limiter,
+			ctx:     env.ctx,
+		},
+		obsoleteBytesTargetRatio: 0.20,
+	}
+}
+
+// maybeThrottle slows down the deletion of an obsolete sstable of the
+// specified size. The DB provides the total size of the obsolete sstables
+// queued for deletion and the total size of the live sstables. If the obsolete
+// bytes are below obsoleteBytesTargetRatio of the live bytes, the deletion is
+// paced at the rate of the limiter. Otherwise the rate is scaled by the ratio
+// of the obsolete bytes to the target: a backlog twice the target is deleted
+// at twice the rate of the limiter.
+func (p *deletionPacer) maybeThrottle(bytesToDelete uint64) error {
+	pacerInfo := p.env.getInfo()
+	target := uint64(float64(pacerInfo.liveBytes) * p.obsoleteBytesTargetRatio)
+	if pacerInfo.obsoleteBytes > target {
+		// Only wait for the fraction of the bytes which would be deleted at the
+		// rate of the limiter in the time taken to delete them at the scaled
+		// rate.
+		bytesToDelete = uint64(float64(bytesToDelete) *
+			float64(target) / float64(pacerInfo.obsoleteBytes))
+	}
+	if bytesToDelete == 0 {
+		return nil
+	}
+	return p.wait(bytesToDelete)
+}
+
+// userPacer adapts a Pacer supplied via Options.Pacer to the pacer interface.
+type userPacer struct {
+	pacer             Pacer
+	op                PacerOperation
+	prevBytesIterated uint64
+}
+
+func (p *userPacer) maybeThrottle(bytesIterated uint64) error {
+	n := bytesIterated - p.prevBytesIterated
+	p.prevBytesIterated = bytesIterated
+	return p.pacer.Throttle(p.op, n)
+}
+
+// pacingStats accumulates the statistics for the pacing of either flushes or
+// compactions. The fields are updated atomically.
+type pacingStats struct {
+	bytes     uint64
+	waitNanos int64
+}
+
+// metrics returns the PacingMetrics for the statistics. The limiter is the
+// limiter used by the default pacing, which is unused if a custom Pacer is
+// provided.
+func (s *pacingStats) metrics(l limiter, custom Pacer) PacingMetrics {
+	m := PacingMetrics{
+		Bytes:        atomic.LoadUint64(&s.bytes),
+		WaitDuration: time.Duration(atomic.LoadInt64(&s.waitNanos)),
+	}
+	if custom == nil {
+		m.Rate = int64(l.Limit())
+	}
+	return m
+}
+
+// statsPacer wraps a pacer, recording the number of bytes paced and the time
+// spent in the wrapped pacer.
+type statsPacer struct {
+	pacer             pacer
+	stats             *pacingStats
+	prevBytesIterated uint64
+}
+
+func (p *statsPacer) maybeThrottle(bytesIterated uint64) error {
+	start := time.Now()
+	err := p.pacer.maybeThrottle(bytesIterated)
+	atomic.AddInt64(&p.stats.waitNanos, int64(time.Since(start)))
+	atomic.AddUint64(&p.stats.bytes, bytesIterated-p.prevBytesIterated)
+	p.prevBytesIterated = bytesIterated
+	return err
+}
+
+// sharedPacer allows the pacer of a compaction to be shared by its
+// concurrently running subcompactions. The wrapped pacer expects the
+// cumulative number of bytes iterated by a single compaction, so the bytes
+// iterated by each of the subcompactions are summed. The wrapped pacer is
+// invoked by a subcompaction once it has iterated over
+// subcompactionPacerChunkSize bytes since its previous invocation, and only by
+// one subcompaction at a time.
+type sharedPacer struct {
+	// bytesIterated points to the total number of bytes iterated by the
+	// subcompactions, which is accumulated directly in the compaction's
+	// atomicBytesIterated if it has one (see compaction.atomicBytesIterated).
+	// It is updated atomically.
+	bytesIterated *uint64
+
+	// throttleMu serializes the invocations of pacer, which is not safe for
+	// concurrent use. The subcompactions waiting on throttleMu while pacer is
+	// throttling are throttled as well.
+	throttleMu sync.Mutex
+	pacer      pacer
+}
+
+// newSharedPacer returns a sharedPacer wrapping the pacer of a compaction,
+// accumulating the bytes iterated by its subcompactions in
+// atomicBytesIterated if it is non-nil.
+func newSharedPacer(pacer pacer, atomicBytesIterated *uint64) *sharedPacer {
+	if atomicBytesIterated == nil {
+		atomicBytesIterated = new(uint64)
+	} else {
+		atomic.StoreUint64(atomicBytesIterated, 0)
+	}
+	return &sharedPacer{bytesIterated: atomicBytesIterated, pacer: pacer}
+}
+
+// subcompactionPacerChunkSize is the number of bytes a subcompaction iterates
+// over between invocations of the shared pacer.
+const subcompactionPacerChunkSize = 256 << 10
+
+// newSubcompactionPacer returns the pacer for a single subcompaction.
+func (p *sharedPacer) newSubcompactionPacer() pacer {
+	return &subcompactionPacer{shared: p}
+}
+
+type subcompactionPacer struct {
+	shared            *sharedPacer
+	prevBytesIterated uint64
+	// throttledBytesIterated is the value of bytesIterated when the shared
+	// pacer was last invoked.
+	throttledBytesIterated uint64
+}
+
+func (p *subcompactionPacer) maybeThrottle(bytesIterated uint64) error {
+	s := p.shared
+	atomic.AddUint64(s.bytesIterated, bytesIterated-p.prevBytesIterated)
+	p.prevBytesIterated = bytesIterated
+	if bytesIterated-p.throttledBytesIterated < subcompactionPacerChunkSize {
+		return nil
+	}
+	p.throttledBytesIterated = bytesIterated
+
+	s.throttleMu.Lock()
+	defer s.throttleMu.Unlock()
+	// Reload the total, as other subcompactions may have iterated further
+	// while this one was waiting. The wrapped pacer requires the cumulative
+	// number of bytes to be non-decreasing.
+	return s.pacer.maybeThrottle(atomic.LoadUint64(s.bytesIterated))
+}
+
 type noopPacer struct{}
 
 func (p *noopPacer) maybeThrottle(_ uint64) error {
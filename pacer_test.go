@@ -10,10 +10,14 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/cockroachdb/pebble/internal/datadriven"
+	"github.com/cockroachdb/pebble/internal/rate"
+	"github.com/cockroachdb/pebble/vfs"
 )
 
 type mockCountLimiter struct {
@@ -36,6 +40,12 @@ func (m *mockCountLimiter) Burst() int {
 	return m.burst
 }
 
+func (m *mockCountLimiter) Limit() rate.Limit {
+	return rate.Limit(m.burst)
+}
+
+func (m *mockCountLimiter) SetLimit(newLimit rate.Limit) {}
+
 type mockPrintLimiter struct {
 	buf   bytes.Buffer
 	burst int
@@ -55,6 +65,12 @@ func (m *mockPrintLimiter) Burst() int {
 	return m.burst
 }
 
+func (m *mockPrintLimiter) Limit() rate.Limit {
+	return rate.Limit(m.burst)
+}
+
+func (m *mockPrintLimiter) SetLimit(newLimit rate.Limit) {}
+
 func TestCompactionPacerMaybeThrottle(t *testing.T) {
 	datadriven.RunTest(t, "testdata/compaction_pacer_maybe_throttle",
 		func(d *datadriven.TestData) string {
@@ -68,6 +84,7 @@ func TestCompactionPacerMaybeThrottle(t *testing.T) {
 				dirtyBytes := uint64(1)
 				var bytesIterated uint64
 				var currentTotal uint64
+				var liveBytes uint64
 				var slowdownThreshold uint64
 				if len(d.Input) > 0 {
 					for _, data := range strings.Split(d.Input, "\n") {
@@ -88,6 +105,8 @@ func TestCompactionPacerMaybeThrottle(t *testing.T) {
 							bytesIterated = varValue
 						case "currentTotal":
 							currentTotal = varValue
+						case "liveBytes":
+							liveBytes = varValue
 						case "dirtyBytes":
 							dirtyBytes = varValue
 						case "slowdownThreshold":
@@ -138,6 +157,24 @@ func TestCompactionPacerMaybeThrottle(t *testing.T) {
 						return err.Error()
 					}
 
+					return mockLimiter.buf.String()
+				case "deletion":
+					getInfo := func() deletionPacerInfo {
+						return deletionPacerInfo{
+							obsoleteBytes: currentTotal,
+							liveBytes:     liveBytes,
+						}
+					}
+					deletionPacer := newDeletionPacer(deletionPacerEnv{
+						limiter: &mockLimiter,
+						getInfo: getInfo,
+					})
+
+					err := deletionPacer.maybeThrottle(bytesIterated)
+					if err != nil {
+						return err.Error()
+					}
+
 					return mockLimiter.buf.String()
 				default:
 					return fmt.Sprintf("unknown command: %s", d.Cmd)
@@ -148,3 +185,166 @@ func TestCompactionPacerMaybeThrottle(t *testing.T) {
 			}
 		})
 }
+
+type countingPacer struct {
+	mu    sync.Mutex
+	bytes map[PacerOperation]uint64
+}
+
+func (p *countingPacer) Throttle(op PacerOperation, n uint64) error {
+	p.mu.Lock()
+	p.bytes[op] += n
+	p.mu.Unlock()
+	return nil
+}
+
+func TestCustomPacer(t *testing.T) {
+	p := &countingPacer{bytes: make(map[PacerOperation]uint64)}
+	d, err := Open("", &Options{
+		FS:    vfs.NewMem(),
+		Pacer: p,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 100; j++ {
+			if err := d.Set([]byte(fmt.Sprintf("%03d", j)), []byte("x"), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Compact([]byte("0"), []byte("9")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := d.Metrics()
+	p.mu.Lock()
+	for _, c := range []struct {
+		op      PacerOperation
+		metrics PacingMetrics
+	}{
+		{PacerFlush, m.Pacing.Flush},
+		{PacerCompaction, m.Pacing.Compaction},
+	} {
+		if p.bytes[c.op] == 0 {
+			t.Fatalf("%s: expected the pacer to be invoked", c.op)
+		}
+		if p.bytes[c.op] != c.metrics.Bytes {
+			t.Fatalf("%s: expected %d bytes, but found %d", c.op, p.bytes[c.op], c.metrics.Bytes)
+		}
+		if c.metrics.Rate != 0 {
+			t.Fatalf("%s: expected rate 0, but found %d", c.op, c.metrics.Rate)
+		}
+	}
+	p.mu.Unlock()
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetPacingRates(t *testing.T) {
+	d, err := Open("", &Options{
+		FS:                vfs.NewMem(),
+		MinCompactionRate: 1 << 20,
+		MinFlushRate:      2 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRates := func(compactionRate, flushRate int64) {
+		t.Helper()
+		m := d.Metrics()
+		if m.Pacing.Compaction.Rate != compactionRate {
+			t.Fatalf("expected compaction rate %d, but found %d", compactionRate, m.Pacing.Compaction.Rate)
+		}
+		if m.Pacing.Flush.Rate != flushRate {
+			t.Fatalf("expected flush rate %d, but found %d", flushRate, m.Pacing.Flush.Rate)
+		}
+	}
+
+	checkRates(1<<20, 2<<20)
+	if err := d.SetMinCompactionRate(3 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetMinFlushRate(4 << 20); err != nil {
+		t.Fatal(err)
+	}
+	checkRates(3<<20, 4<<20)
+
+	if err := d.SetMinCompactionRate(0); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	if err := d.SetMinFlushRate(-1); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	checkRates(3<<20, 4<<20)
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordingPacer records the cumulative byte counts it is invoked with, and
+// the maximum number of concurrent invocations.
+type recordingPacer struct {
+	running    int32
+	maxRunning int32
+	calls      []uint64
+}
+
+func (p *recordingPacer) maybeThrottle(bytesIterated uint64) error {
+	n := atomic.AddInt32(&p.running, 1)
+	defer atomic.AddInt32(&p.running, -1)
+	if n > atomic.LoadInt32(&p.maxRunning) {
+		atomic.StoreInt32(&p.maxRunning, n)
+	}
+	p.calls = append(p.calls, bytesIterated)
+	time.Sleep(time.Microsecond)
+	return nil
+}
+
+func TestSharedPacer(t *testing.T) {
+	const subcompactions = 4
+	const steps = 80
+	const stepSize = subcompactionPacerChunkSize / 8
+
+	rp := &recordingPacer{}
+	var bytesIterated uint64
+	shared := newSharedPacer(rp, &bytesIterated)
+	var wg sync.WaitGroup
+	for i := 0; i < subcompactions; i++ {
+		wg.Add(1)
+		go func(p pacer) {
+			defer wg.Done()
+			for j := 1; j <= steps; j++ {
+				if err := p.maybeThrottle(uint64(j * stepSize)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(shared.newSubcompactionPacer())
+	}
+	wg.Wait()
+
+	if rp.maxRunning != 1 {
+		t.Fatalf("expected 1 concurrent invocation, but found %d", rp.maxRunning)
+	}
+	// Each subcompaction invokes the shared pacer once per chunk.
+	if expected := subcompactions * steps / 8; len(rp.calls) != expected {
+		t.Fatalf("expected %d invocations, but found %d", expected, len(rp.calls))
+	}
+	for i := 1; i < len(rp.calls); i++ {
+		if rp.calls[i] < rp.calls[i-1] {
+			t.Fatalf("bytes iterated decreased: %d < %d", rp.calls[i], rp.calls[i-1])
+		}
+	}
+	if expected := uint64(subcompactions * steps * stepSize); bytesIterated != expected {
+		t.Fatalf("expected %d bytes iterated, but found %d", expected, bytesIterated)
+	}
+}
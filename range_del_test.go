@@ -331,3 +331,225 @@ func BenchmarkRangeDelIterate(b *testing.B) {
 		})
 	}
 }
+
+// Verify that a flush does not zero the seqnum of a key covered by an older
+// range tombstone which is retained in the flushed sstable. Doing so would
+// cause the tombstone to delete the key.
+func TestRangeDelFlushZeroSeqNum(t *testing.T) {
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Write "d" to L6 so that it overlaps the range tombstone, but not the
+	// point keys, of the subsequent flush.
+	if err := d.Set([]byte("d"), []byte("d"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteRange([]byte("a"), []byte("d"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("b"), []byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+
+	iter := d.NewIter(nil)
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "b d", strings.Join(keys, " "); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+}
+
+// Verify that the range tombstones in an sstable whose keys are truncated by
+// the iterator bounds continue to delete keys in lower levels.
+func TestRangeDelIterBounds(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{
+		FS: mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Write "g" to L6, and then ingest an sstable containing a range tombstone
+	// which deletes it. The sstable overlaps L6, so it is ingested into L5, and
+	// its smallest and largest keys are point keys.
+	if err := d.Set([]byte("g"), []byte("g"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := mem.Create("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, LevelOptions{})
+	for _, key := range []string{"a", "h", "i", "z"} {
+		if err := w.Set([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.DeleteRange([]byte("b"), []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ingest([]string{"ext"}); err != nil {
+		t.Fatal(err)
+	}
+
+	iter := d.NewIter(&IterOptions{
+		LowerBound: []byte("f"),
+		UpperBound: []byte("h"),
+	})
+	if iter.First() {
+		t.Fatalf("expected no keys, but found %q", iter.Key())
+	}
+	if iter.Last() {
+		t.Fatalf("expected no keys, but found %q", iter.Key())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Switching directions next to a bound must not return keys outside it.
+	iter = d.NewIter(&IterOptions{
+		LowerBound: []byte("f"),
+		UpperBound: []byte("j"),
+	})
+	var keys []string
+	for _, step := range []func() bool{iter.Last, iter.Prev, iter.Next} {
+		if step() {
+			keys = append(keys, string(iter.Key()))
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "i h i", strings.Join(keys, " "); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+}
+
+// Verify that range tombstones are found when seeking the range-del iterator
+// of an sstable requires backing up over a fragment boundary.
+func TestRangeDelSeekFragments(t *testing.T) {
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Flush "f", "h" and "k" to an sstable, and then flush the range
+	// tombstones [e,g), [g,j) and [j,z) to a newer sstable.
+	for _, key := range []string{"f", "h", "k"} {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range [][2]string{{"e", "g"}, {"g", "j"}, {"j", "z"}} {
+		if err := d.DeleteRange([]byte(r[0]), []byte(r[1]), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	iter := d.NewIter(nil)
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "a", strings.Join(keys, " "); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+}
+
+// Verify that switching from reverse to forward iteration does not revisit
+// keys when an sstable whose smallest key is a range tombstone is truncated by
+// the lower bound.
+func TestRangeDelIterBoundsSwitchDirection(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{
+		FS: mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	f, err := mem.Create("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, LevelOptions{})
+	if err := w.DeleteRange([]byte("a"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"l", "r"} {
+		if err := w.Set([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ingest([]string{"ext"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"d", "n"} {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	iter := d.NewIter(&IterOptions{
+		LowerBound: []byte("m"),
+		UpperBound: []byte("o"),
+	})
+	var keys []string
+	for _, step := range []func() bool{iter.Last, iter.Next} {
+		if step() {
+			keys = append(keys, string(iter.Key()))
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "n", strings.Join(keys, " "); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+}
@@ -9,10 +9,10 @@ import (
 )
 
 // readState encapsulates the state needed for reading (the current version and
-// list of memtables). Loading the readState is done without grabbing
-// DB.mu. Instead, a separate DB.readState.RWMutex is used for
-// synchronization. This mutex solely covers the current readState object which
-// means it is rarely or ever contended.
+// list of memtables) of a column family. Loading the readState is done
+// without grabbing DB.mu. Instead, a separate ColumnFamily.readState.RWMutex is
+// used for synchronization. This mutex solely covers the current readState
+// object which means it is rarely or ever contended.
 //
 // Note that various fancy lock-free mechanisms can be imagined for loading the
 // readState, but benchmarking showed the ones considered to purely be
@@ -24,6 +24,10 @@ type readState struct {
 	refcnt    int32
 	current   *version
 	memtables []flushable
+	// ingested are the ingested sstables in memtables. The readState holds a
+	// reader reference on each of them, which keeps their sstables from being
+	// deleted once they have been flushed (see ingestedFlushable).
+	ingested []*ingestedFlushable
 }
 
 // ref adds a reference to the readState.
@@ -38,6 +42,9 @@ func (s *readState) ref() {
 func (s *readState) unref() {
 	if atomic.AddInt32(&s.refcnt, -1) == 0 {
 		s.current.Unref()
+		for _, f := range s.ingested {
+			f.readerUnref()
+		}
 	}
 }
 
@@ -48,33 +55,60 @@ func (s *readState) unref() {
 func (s *readState) unrefLocked() {
 	if atomic.AddInt32(&s.refcnt, -1) == 0 {
 		s.current.UnrefLocked()
+		for _, f := range s.ingested {
+			f.readerUnrefLocked()
+		}
 	}
 }
 
-// loadReadState returns the current readState. The returned readState must be
-// unreferenced when the caller is finished with it.
+// loadReadState returns the current readState of the default column
+// family. The returned readState must be unreferenced when the caller is
+// finished with it.
 func (d *DB) loadReadState() *readState {
-	d.readState.RLock()
-	state := d.readState.val
-	state.ref()
-	d.readState.RUnlock()
+	return d.defaultCF.loadReadState()
+}
+
+// updateReadStateLocked creates a new readState for each live column family
+// from its current version and list of memtables. Requires DB.mu is held.
+func (d *DB) updateReadStateLocked() {
+	for _, cf := range d.mu.columnFamilies {
+		cf.updateReadStateLocked()
+	}
+}
+
+// loadReadState returns the current readState, or nil if the column family
+// has been dropped. The returned readState must be unreferenced when the
+// caller is finished with it.
+func (cf *ColumnFamily) loadReadState() *readState {
+	cf.readState.RLock()
+	state := cf.readState.val
+	if state != nil {
+		state.ref()
+	}
+	cf.readState.RUnlock()
 	return state
 }
 
 // updateReadStateLocked creates a new readState from the current version and
 // list of memtables. Requires DB.mu is held.
-func (d *DB) updateReadStateLocked() {
+func (cf *ColumnFamily) updateReadStateLocked() {
 	s := &readState{
 		refcnt:    1,
-		current:   d.mu.versions.currentVersion(),
-		memtables: d.mu.mem.queue,
+		current:   cf.versions.currentVersion(),
+		memtables: cf.mem.queue,
 	}
 	s.current.Ref()
+	for _, mem := range s.memtables {
+		if f, ok := mem.(*ingestedFlushable); ok {
+			f.readerRef()
+			s.ingested = append(s.ingested, f)
+		}
+	}
 
-	d.readState.Lock()
-	old := d.readState.val
-	d.readState.val = s
-	d.readState.Unlock()
+	cf.readState.Lock()
+	old := cf.readState.val
+	cf.readState.val = s
+	cf.readState.Unlock()
 
 	if old != nil {
 		old.unrefLocked()
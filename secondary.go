@@ -0,0 +1,275 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/record"
+)
+
+// ErrNotSecondary is returned by DB.TryCatchUpWithPrimary if the DB was not
+// opened with OpenSecondary.
+var ErrNotSecondary = errors.New("pebble: not a secondary instance")
+
+// secondaryCatchUpAttempts is the number of times DB.TryCatchUpWithPrimary
+// attempts to catch up when it races with the primary deleting files.
+const secondaryCatchUpAttempts = 3
+
+// secondaryState is the state of a secondary instance of a DB, which tails
+// the MANIFEST and WALs of the primary.
+type secondaryState struct {
+	// manifestFileNum is the file number of the MANIFEST being tailed, and
+	// manifestEdits is the number of version edits read from it so far.
+	manifestFileNum uint64
+	manifestEdits   int
+	// logNum is the number of the newest WAL which has been replayed. The
+	// primary may have appended to the WAL since, so it is replayed again by
+	// the next catch-up, along with any newer WALs.
+	logNum uint64
+}
+
+// OpenSecondary opens a secondary instance of the DB whose files live in the
+// given directory. A secondary instance is a read-only view of a DB which is
+// concurrently being modified by a primary instance in the same directory.
+// It reads the state of the primary as of the time it was opened, and is
+// brought up to date by DB.TryCatchUpWithPrimary.
+//
+// A secondary instance does not lock the directory, and never writes or
+// deletes any files. Options.ReadOnly is implied. The primary may delete
+// files concurrently with OpenSecondary, in which case OpenSecondary returns
+// an error and may be retried.
+func OpenSecondary(dirname string, opts *Options) (*DB, error) {
+	return open(dirname, opts, true /* secondary */)
+}
+
+// TryCatchUpWithPrimary brings a secondary instance of a DB up to date with
+// the primary. The version edits appended to the primary's MANIFEST are
+// applied and the WALs written since the previous catch-up are replayed.
+// Iterators and snapshots created before the call continue to read the state
+// as of when they were created.
+//
+// The primary deletes the sstables which it no longer needs, regardless of the
+// state the secondary is reading. TryCatchUpWithPrimary should be called
+// regularly so that the secondary does not refer to deleted sstables. Column
+// families created or dropped by the primary are not visible until the
+// secondary is reopened.
+func (d *DB) TryCatchUpWithPrimary() error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.secondary == nil {
+		return ErrNotSecondary
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+
+	var err error
+	for i := 0; i < secondaryCatchUpAttempts; i++ {
+		// The primary deletes the MANIFEST and WALs once they are made obsolete
+		// by a newer MANIFEST or version edit. A missing file means that the
+		// primary made progress while catching up, so catching up is retried.
+		if err = d.catchUpManifestLocked(); err == nil {
+			err = d.catchUpWALsLocked(jobID)
+		}
+		if !os.IsNotExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// The secondary never deletes files, but evicts the tables which are no
+	// longer referenced from the caches.
+	for _, fileNum := range d.mu.versions.obsoleteTables {
+		for _, cf := range d.mu.columnFamilies {
+			cf.tableCache.evict(fileNum)
+		}
+	}
+	for _, fileNum := range d.mu.versions.obsoleteBlobFiles {
+		d.blobFiles.evict(fileNum)
+	}
+	d.mu.versions.obsoleteTables = nil
+	d.mu.versions.obsoleteBlobFiles = nil
+
+	d.updateReadStateLocked()
+	return nil
+}
+
+// catchUpManifestLocked applies the version edits appended to the primary's
+// MANIFEST since the previous catch-up. If the primary has started a new
+// MANIFEST, the version of each column family is rebuilt from it.
+//
+// d.mu must be held when calling this.
+func (d *DB) catchUpManifestLocked() error {
+	s := d.secondary
+	vs := &d.mu.versions
+	fs := d.opts.FS
+
+	name, manifestFileNum, err := readCurrentFile(fs, d.dirname)
+	if err != nil {
+		return err
+	}
+	// A new MANIFEST starts with a snapshot of the state of every column
+	// family.
+	rebuild := manifestFileNum != s.manifestFileNum
+	skip := s.manifestEdits
+	if rebuild {
+		skip = 0
+	}
+
+	f, err := fs.Open(fs.PathJoin(d.dirname, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	type columnFamilyEdits struct {
+		bve                bulkVersionEdit
+		minUnflushedLogNum uint64
+	}
+	cfEdits := make(map[uint32]*columnFamilyEdits)
+	var buf bytes.Buffer
+	var n int
+	rr := record.NewReader(f, 0 /* logNum */)
+	for ; ; n++ {
+		r, err := rr.Next()
+		if err == nil {
+			buf.Reset()
+			_, err = io.Copy(&buf, r)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF ||
+			err == record.ErrZeroedChunk || err == record.ErrInvalidChunk {
+			// The primary may be in the middle of writing a version edit. It is
+			// applied by the next catch-up.
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if n < skip {
+			continue
+		}
+
+		var ve versionEdit
+		if err := ve.Decode(&buf); err != nil {
+			return err
+		}
+		if ve.LastSeqNum > atomic.LoadUint64(&vs.logSeqNum) {
+			atomic.StoreUint64(&vs.logSeqNum, ve.LastSeqNum)
+		}
+		if ve.ColumnFamilyDrop || vs.getColumnFamily(ve.ColumnFamily) == nil {
+			continue
+		}
+		cfe := cfEdits[ve.ColumnFamily]
+		if cfe == nil {
+			cfe = &columnFamilyEdits{}
+			cfEdits[ve.ColumnFamily] = cfe
+		}
+		cfe.bve.Accumulate(&ve)
+		if ve.MinUnflushedLogNum != 0 {
+			cfe.minUnflushedLogNum = ve.MinUnflushedLogNum
+		}
+	}
+
+	for id, cfe := range cfEdits {
+		cfv := vs.getColumnFamily(id)
+		cur := cfv.currentVersion()
+		if rebuild {
+			cur = nil
+		}
+		newVersion, err := cfe.bve.Apply(cur, cfv.opts.Comparer.Compare, cfv.opts.Comparer.Format)
+		if err != nil {
+			return err
+		}
+		cfv.append(newVersion)
+		cfv.picker = newCompactionPicker(newVersion, cfv.opts)
+		cfv.updateLevelMetrics(newVersion, nil)
+		if cfe.minUnflushedLogNum != 0 {
+			cfv.minUnflushedLogNum = cfe.minUnflushedLogNum
+		}
+	}
+
+	vs.manifestFileNum = manifestFileNum
+	s.manifestFileNum = manifestFileNum
+	s.manifestEdits = n
+	return nil
+}
+
+// catchUpWALsLocked rebuilds the memtables of the secondary from the
+// primary's WALs. The memtables replayed from WALs older than the newest WAL
+// replayed by the previous catch-up are complete, and are kept unless their
+// contents have since been flushed by the primary. The newest WAL and any
+// WALs created since are replayed.
+//
+// d.mu must be held when calling this.
+func (d *DB) catchUpWALsLocked(jobID int) error {
+	s := d.secondary
+	vs := &d.mu.versions
+	fs := d.opts.FS
+
+	ls, err := fs.List(d.walDirname)
+	if err != nil {
+		return err
+	}
+	minLogNum := vs.minLogNumToKeep()
+	var logNums []uint64
+	for _, filename := range ls {
+		ft, fn, ok := base.ParseFilename(fs, filename)
+		if ok && ft == fileTypeLog && fn >= minLogNum && fn >= s.logNum {
+			logNums = append(logNums, fn)
+		}
+	}
+	sort.Slice(logNums, func(i, j int) bool {
+		return logNums[i] < logNums[j]
+	})
+
+	var walFiles int64
+	for _, cf := range d.mu.columnFamilies {
+		var queue []flushable
+		var lastLogNum uint64
+		for _, m := range cf.mem.queue {
+			logNum, _ := m.logInfo()
+			if logNum == 0 || logNum < cf.versions.minUnflushedLogNum || logNum >= s.logNum {
+				continue
+			}
+			queue = append(queue, m)
+			if cf == d.defaultCF && logNum != lastLogNum {
+				walFiles++
+				lastLogNum = logNum
+			}
+		}
+		cf.mem.mutable = cf.newMemTable(0 /* logNum */)
+		cf.mem.queue = append(queue, cf.mem.mutable)
+	}
+	vs.metrics.WAL.Files = walFiles
+
+	for _, logNum := range logNums {
+		filename := base.MakeFilename(fs, d.walDirname, fileTypeLog, logNum)
+		maxSeqNum, err := d.replayWAL(jobID, nil /* edits */, fs, filename, logNum)
+		if err != nil {
+			return err
+		}
+		if maxSeqNum > atomic.LoadUint64(&vs.logSeqNum) {
+			atomic.StoreUint64(&vs.logSeqNum, maxSeqNum)
+		}
+	}
+	if len(logNums) > 0 {
+		s.logNum = logNums[len(logNums)-1]
+	}
+	atomic.StoreUint64(&vs.visibleSeqNum, atomic.LoadUint64(&vs.logSeqNum))
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenSecondary(t *testing.T) {
+	mem := vfs.NewMem()
+	// A tiny maximum MANIFEST size causes the primary to start a new MANIFEST
+	// for every version edit.
+	for _, maxManifestFileSize := range []int64{1, 128 << 20} {
+		t.Run(fmt.Sprintf("max-manifest-file-size=%d", maxManifestFileSize), func(t *testing.T) {
+			dir := fmt.Sprintf("db%d", maxManifestFileSize)
+			primary, err := Open(dir, &Options{
+				FS:                    mem,
+				L0CompactionThreshold: 100,
+				MaxManifestFileSize:   maxManifestFileSize,
+			})
+			require.NoError(t, err)
+			defer primary.Close()
+
+			require.Equal(t, ErrNotSecondary, primary.TryCatchUpWithPrimary())
+
+			expect := func(d *DB, kvs ...string) {
+				t.Helper()
+				for i := 0; i < len(kvs); i += 2 {
+					v, err := d.Get([]byte(kvs[i]))
+					if kvs[i+1] == "" {
+						require.Equal(t, ErrNotFound, err, "%s", kvs[i])
+						continue
+					}
+					require.NoError(t, err, "%s", kvs[i])
+					require.Equal(t, kvs[i+1], string(v), "%s", kvs[i])
+				}
+			}
+
+			// One key is flushed to an sstable and the other is only in the WAL.
+			require.NoError(t, primary.Set([]byte("a"), []byte("1"), nil))
+			require.NoError(t, primary.Flush())
+			require.NoError(t, primary.Set([]byte("b"), []byte("1"), nil))
+
+			before, err := mem.List(dir)
+			require.NoError(t, err)
+			sort.Strings(before)
+
+			secondary, err := OpenSecondary(dir, &Options{FS: mem})
+			require.NoError(t, err)
+			defer secondary.Close()
+			expect(secondary, "a", "1", "b", "1")
+			require.Equal(t, ErrReadOnly, secondary.Set([]byte("c"), nil, nil))
+
+			// The secondary does not modify the directory.
+			after, err := mem.List(dir)
+			require.NoError(t, err)
+			sort.Strings(after)
+			require.Equal(t, before, after)
+
+			// Mutations of the primary are not visible until the secondary catches
+			// up, and iterators created before catching up continue to read the
+			// state they were created with.
+			require.NoError(t, primary.Set([]byte("c"), []byte("2"), nil))
+			require.NoError(t, primary.Delete([]byte("a"), nil))
+			iter := secondary.NewIter(nil)
+			expect(secondary, "a", "1", "c", "")
+			require.NoError(t, secondary.TryCatchUpWithPrimary())
+			expect(secondary, "a", "", "b", "1", "c", "2")
+			var keys []string
+			for valid := iter.First(); valid; valid = iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+			require.NoError(t, iter.Close())
+			require.Equal(t, []string{"a", "b"}, keys)
+
+			// Flushing and compacting the primary replaces the sstables and deletes
+			// the WALs the secondary has replayed.
+			require.NoError(t, primary.Flush())
+			require.NoError(t, primary.Compact([]byte("a"), []byte("z")))
+			require.NoError(t, primary.Set([]byte("d"), []byte("3"), nil))
+			require.NoError(t, secondary.TryCatchUpWithPrimary())
+			expect(secondary, "a", "", "b", "1", "c", "2", "d", "3")
+			secondary.mu.Lock()
+			require.Equal(t, primary.mu.versions.currentVersion().String(),
+				secondary.mu.versions.currentVersion().String())
+			secondary.mu.Unlock()
+
+			// An ingested sstable which overlaps the primary's memtables is
+			// replayed from the WAL.
+			f, err := mem.Create("ext")
+			require.NoError(t, err)
+			w := sstable.NewWriter(f, nil, LevelOptions{})
+			require.NoError(t, w.Set([]byte("d"), []byte("4")))
+			require.NoError(t, w.Set([]byte("e"), []byte("4")))
+			require.NoError(t, w.Close())
+			require.NoError(t, primary.Ingest([]string{"ext"}))
+			require.NoError(t, primary.Set([]byte("e"), []byte("5"), nil))
+			require.NoError(t, secondary.TryCatchUpWithPrimary())
+			expect(secondary, "b", "1", "c", "2", "d", "4", "e", "5")
+		})
+	}
+}
+
+func TestOpenSecondaryConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pebble-secondary")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	primary, err := Open(dir, &Options{
+		FS:           vfs.Default,
+		MemTableSize: 64 << 10,
+	})
+	require.NoError(t, err)
+	defer primary.Close()
+	require.NoError(t, primary.Set([]byte("key0000"), []byte("0"), nil))
+
+	secondary, err := OpenSecondary(dir, &Options{FS: vfs.Default})
+	require.NoError(t, err)
+	defer secondary.Close()
+
+	// The primary writes increasing keys, flushing and compacting as its
+	// memtables fill, while the secondary catches up. Every key written before
+	// a catch-up begins is visible once it completes.
+	const numKeys = 2000
+	var written int64
+	var mu sync.Mutex
+	done := make(chan error, 1)
+	go func() {
+		value := make([]byte, 100)
+		for i := 1; i < numKeys; i++ {
+			if err := primary.Set([]byte(fmt.Sprintf("key%04d", i)), value, nil); err != nil {
+				done <- err
+				return
+			}
+			mu.Lock()
+			written = int64(i)
+			mu.Unlock()
+		}
+		done <- nil
+	}()
+
+	check := func() {
+		mu.Lock()
+		n := written
+		mu.Unlock()
+		require.NoError(t, secondary.TryCatchUpWithPrimary())
+		for _, i := range []int64{0, n / 2, n} {
+			_, err := secondary.Get([]byte(fmt.Sprintf("key%04d", i)))
+			require.NoError(t, err, "key%04d", i)
+		}
+	}
+	for {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			check()
+			return
+		default:
+			check()
+		}
+	}
+}
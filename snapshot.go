@@ -28,7 +28,7 @@ func (s *Snapshot) Get(key []byte) ([]byte, error) {
 	if s.db == nil {
 		panic(ErrClosed)
 	}
-	return s.db.getInternal(key, nil /* batch */, s)
+	return s.db.getInternal(s.db.defaultCF, key, nil /* batch */, s)
 }
 
 // NewIter returns an iterator that is unpositioned (Iterator.Valid() will
@@ -38,7 +38,25 @@ func (s *Snapshot) NewIter(o *IterOptions) *Iterator {
 	if s.db == nil {
 		panic(ErrClosed)
 	}
-	return s.db.newIterInternal(nil /* batchIter */, nil /* batchRangeDelIter */, s, o)
+	return s.db.newIterInternal(s.db.defaultCF, nil, /* batchIter */
+		nil /* batchRangeDelIter */, s, o)
+}
+
+// GetCF is like Get, but reads the key from the specified column family.
+func (s *Snapshot) GetCF(cf *ColumnFamily, key []byte) ([]byte, error) {
+	if s.db == nil {
+		panic(ErrClosed)
+	}
+	return s.db.getInternal(cf, key, nil /* batch */, s)
+}
+
+// NewIterCF is like NewIter, but iterates over the specified column family.
+func (s *Snapshot) NewIterCF(cf *ColumnFamily, o *IterOptions) *Iterator {
+	if s.db == nil {
+		panic(ErrClosed)
+	}
+	return s.db.newIterInternal(cf, nil, /* batchIter */
+		nil /* batchRangeDelIter */, s, o)
 }
 
 // Close closes the snapshot, releasing its resources. Close must be
@@ -552,6 +552,16 @@ func (i *blockIter) Last() (*InternalKey, []byte) {
 // Next implements internalIterator.Next, as documented in the pebble
 // package.
 func (i *blockIter) Next() (*InternalKey, []byte) {
+	if len(i.cachedBuf) > 0 {
+		// We're switching from reverse iteration to forward iteration. We need to
+		// populate i.fullKey with the current key we're positioned at so that
+		// readEntry() can use i.fullKey for key prefix decompression. Note that
+		// i.key may be backed by either i.cachedBuf or i.fullKey, but copying
+		// into i.fullKey works for both cases.
+		i.fullKey = append(i.fullKey[:0], i.key...)
+		i.clearCache()
+	}
+
 	i.offset = i.nextOffset
 	if !i.Valid() {
 		return nil, nil
@@ -579,11 +589,11 @@ func (i *blockIter) Prev() (*InternalKey, []byte) {
 		e := &i.cached[n-1]
 		i.offset = e.offset
 		i.val = getBytes(unsafe.Pointer(uintptr(i.ptr)+uintptr(e.valStart)), int(e.valSize))
-		// Manually inlined version of i.decodeInternalKey(key).
-		key := i.cachedBuf[e.keyStart:e.keyEnd]
-		if n := len(key) - 8; n >= 0 {
-			i.ikey.Trailer = binary.LittleEndian.Uint64(key[n:])
-			i.ikey.UserKey = key[:n:n]
+		// Manually inlined version of i.decodeInternalKey(i.key).
+		i.key = i.cachedBuf[e.keyStart:e.keyEnd]
+		if n := len(i.key) - 8; n >= 0 {
+			i.ikey.Trailer = binary.LittleEndian.Uint64(i.key[n:])
+			i.ikey.UserKey = i.key[:n:n]
 			if i.globalSeqNum != 0 {
 				i.ikey.SetSeqNum(i.globalSeqNum)
 			}
@@ -0,0 +1,150 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Block properties are an optional user-facing feature that can be used to
+// filter data blocks (and whole sstables) from an iterator before they are
+// loaded. The properties written by each BlockPropertyCollector configured
+// for the table are identified by a short ID, which is the index of the
+// collector in Options.BlockPropertyCollectors. The properties of a data block
+// (or, in a table with a two level index, of an index block) are encoded after
+// the block handle in the index entry for the block as a sequence of:
+//
+//   <shortID (1 byte)><length (uvarint)><property (length bytes)>
+//
+// sorted by short ID. Collectors producing an empty property for a block are
+// omitted. The table-level property of each collector is stored in the
+// table's user properties, keyed by the name of the collector, with the short
+// ID as the first byte of the value.
+
+// maxBlockPropertyCollectors is the maximum number of block property
+// collectors which can be configured for a table, as the short ID of a
+// collector is encoded in a single byte.
+const maxBlockPropertyCollectors = 256
+
+var errCorruptBlockProperties = errors.New("pebble/table: corrupt block properties")
+
+// blockPropertiesEncoder encodes the properties of a block.
+type blockPropertiesEncoder struct {
+	buf []byte
+}
+
+// addProperty adds the property for the collector with the specified short ID.
+// Properties must be added in increasing short ID order.
+func (e *blockPropertiesEncoder) addProperty(id uint8, prop []byte) {
+	if len(prop) == 0 {
+		return
+	}
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(prop)))
+	e.buf = append(e.buf, id)
+	e.buf = append(e.buf, tmp[:n]...)
+	e.buf = append(e.buf, prop...)
+}
+
+// unsafeProperties returns the encoded properties. The returned slice is only
+// valid until the next call to resetProperties.
+func (e *blockPropertiesEncoder) unsafeProperties() []byte {
+	return e.buf
+}
+
+// properties returns a copy of the encoded properties.
+func (e *blockPropertiesEncoder) properties() []byte {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	return append([]byte(nil), e.buf...)
+}
+
+func (e *blockPropertiesEncoder) resetProperties() {
+	e.buf = e.buf[:0]
+}
+
+// findBlockProperty returns the property with the specified short ID in the
+// encoded block properties, or nil if the block has no such property.
+func findBlockProperty(props []byte, id uint8) ([]byte, error) {
+	for len(props) > 0 {
+		propID := props[0]
+		length, n := binary.Uvarint(props[1:])
+		if n <= 0 || uint64(len(props)-1-n) < length {
+			return nil, errCorruptBlockProperties
+		}
+		props = props[1+n:]
+		if propID == id {
+			return props[:length], nil
+		}
+		if propID > id {
+			break
+		}
+		props = props[length:]
+	}
+	return nil, nil
+}
+
+// blockPropertiesFilterer applies a set of BlockPropertyFilters to the
+// properties of the blocks of a single table.
+type blockPropertiesFilterer struct {
+	filters []BlockPropertyFilter
+	// shortIDs[i] is the short ID of the properties read by filters[i] in the
+	// table.
+	shortIDs []uint8
+}
+
+// newBlockPropertiesFilterer returns a filterer for the table with the
+// specified user properties. Filters for which the table has no properties
+// are dropped, since they cannot exclude any blocks. If the table-level
+// properties show that the table contains no blocks passing the filters,
+// intersects is false. A nil filterer is returned if none of the filters
+// apply to the table.
+func newBlockPropertiesFilterer(
+	filters []BlockPropertyFilter, userProps map[string]string,
+) (f *blockPropertiesFilterer, intersects bool, err error) {
+	for i := range filters {
+		prop, ok := userProps[filters[i].Name()]
+		if !ok {
+			continue
+		}
+		if len(prop) == 0 {
+			return nil, false, errCorruptBlockProperties
+		}
+		ok, err := filters[i].Intersects([]byte(prop[1:]))
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			return nil, false, nil
+		}
+		if f == nil {
+			f = &blockPropertiesFilterer{}
+		}
+		f.filters = append(f.filters, filters[i])
+		f.shortIDs = append(f.shortIDs, prop[0])
+	}
+	return f, true, nil
+}
+
+// intersects returns true if the block with the specified encoded properties
+// must be read: that is, if every filter intersects the block's properties.
+func (f *blockPropertiesFilterer) intersects(props []byte) (bool, error) {
+	for i := range f.filters {
+		prop, err := findBlockProperty(props, f.shortIDs[i])
+		if err != nil {
+			return false, err
+		}
+		ok, err := f.filters[i].Intersects(prop)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,287 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/cockroachdb/pebble/cache"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// valueRange tracks the range of the 8-byte big-endian integers stored in the
+// values added to a block.
+type valueRange struct {
+	min, max uint64
+	empty    bool
+}
+
+func (r *valueRange) add(v uint64) {
+	if r.empty || v < r.min {
+		r.min = v
+	}
+	if r.empty || v > r.max {
+		r.max = v
+	}
+	r.empty = false
+}
+
+func (r *valueRange) union(o valueRange) {
+	if !o.empty {
+		r.add(o.min)
+		r.add(o.max)
+	}
+}
+
+func (r *valueRange) encode(buf []byte) []byte {
+	if r.empty {
+		return buf
+	}
+	var tmp [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], r.min)
+	n += binary.PutUvarint(tmp[n:], r.max)
+	return append(buf, tmp[:n]...)
+}
+
+// valueRangeCollector is a BlockPropertyCollector which collects the range of
+// the values in each block.
+type valueRangeCollector struct {
+	name                 string
+	dataBlock, prevBlock valueRange
+	indexBlock, table    valueRange
+}
+
+func newValueRangeCollector(name string) func() BlockPropertyCollector {
+	return func() BlockPropertyCollector {
+		return &valueRangeCollector{
+			name:       name,
+			dataBlock:  valueRange{empty: true},
+			indexBlock: valueRange{empty: true},
+			table:      valueRange{empty: true},
+		}
+	}
+}
+
+func (c *valueRangeCollector) Name() string {
+	return c.name
+}
+
+func (c *valueRangeCollector) Add(key InternalKey, value []byte) error {
+	if len(value) != 8 {
+		return fmt.Errorf("unexpected value length %d", len(value))
+	}
+	c.dataBlock.add(binary.BigEndian.Uint64(value))
+	return nil
+}
+
+func (c *valueRangeCollector) FinishDataBlock(buf []byte) ([]byte, error) {
+	buf = c.dataBlock.encode(buf)
+	c.table.union(c.dataBlock)
+	c.prevBlock = c.dataBlock
+	c.dataBlock = valueRange{empty: true}
+	return buf, nil
+}
+
+func (c *valueRangeCollector) AddPrevDataBlockToIndexBlock() {
+	c.indexBlock.union(c.prevBlock)
+}
+
+func (c *valueRangeCollector) FinishIndexBlock(buf []byte) ([]byte, error) {
+	buf = c.indexBlock.encode(buf)
+	c.indexBlock = valueRange{empty: true}
+	return buf, nil
+}
+
+func (c *valueRangeCollector) FinishTable(buf []byte) ([]byte, error) {
+	return c.table.encode(buf), nil
+}
+
+// valueRangeFilter is a BlockPropertyFilter which matches blocks containing
+// values in the range [min, max).
+type valueRangeFilter struct {
+	name     string
+	min, max uint64
+}
+
+func (f valueRangeFilter) Name() string {
+	return f.name
+}
+
+func (f valueRangeFilter) Intersects(prop []byte) (bool, error) {
+	if len(prop) == 0 {
+		return false, nil
+	}
+	min, n := binary.Uvarint(prop)
+	max, m := binary.Uvarint(prop[n:])
+	if n <= 0 || m <= 0 {
+		return false, fmt.Errorf("corrupt value range")
+	}
+	return min < f.max && f.min <= max, nil
+}
+
+func TestBlockPropertyFilters(t *testing.T) {
+	const numEntries = 2000
+	const entriesPerValue = 100
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%06d", i))
+	}
+
+	for _, indexBlockSize := range []int{100, math.MaxInt32} {
+		t.Run(fmt.Sprintf("index-block-size=%d", indexBlockSize), func(t *testing.T) {
+			mem := vfs.NewMem()
+			f0, err := mem.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f0, &Options{
+				BlockPropertyCollectors: []func() BlockPropertyCollector{
+					newValueRangeCollector("other"),
+					newValueRangeCollector("value-range"),
+				},
+			}, TableOptions{
+				BlockSize:      100,
+				IndexBlockSize: indexBlockSize,
+			})
+			for i := 0; i < numEntries; i++ {
+				var value [8]byte
+				binary.BigEndian.PutUint64(value[:], uint64(i/entriesPerValue))
+				if err := w.Set(key(i), value[:]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f1, err := mem.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewReader(f1, 0, 0, &Options{Cache: cache.New(128 << 20)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if twoLevel := r.Properties.IndexPartitions > 0; twoLevel != (indexBlockSize == 100) {
+				t.Fatalf("unexpected index partitions: %d", r.Properties.IndexPartitions)
+			}
+
+			newIter := func(filters ...BlockPropertyFilter) Iterator {
+				iter, err := r.NewIterWithBlockPropertyFilters(nil, nil, filters)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return iter
+			}
+			scan := func(iter Iterator, forward bool) []int {
+				var res []int
+				var k *InternalKey
+				if forward {
+					k, _ = iter.First()
+				} else {
+					k, _ = iter.Last()
+				}
+				for ; k != nil; k = nextKey(iter, forward) {
+					var i int
+					fmt.Sscanf(string(k.UserKey), "%d", &i)
+					res = append(res, i)
+				}
+				if err := iter.Error(); err != nil {
+					t.Fatal(err)
+				}
+				return res
+			}
+
+			// Filters for which the table has no properties do not exclude any
+			// blocks.
+			iter := newIter(valueRangeFilter{name: "unknown", min: 3, max: 5})
+			if n := len(scan(iter, true)); n != numEntries {
+				t.Fatalf("expected %d keys, but found %d", numEntries, n)
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// A filter which does not intersect the table-level property
+			// excludes the whole table.
+			if iter := newIter(valueRangeFilter{name: "value-range", min: 100, max: 200}); iter != nil {
+				t.Fatalf("expected the table to be excluded")
+			}
+
+			// The filter excludes all of the blocks which do not contain any of
+			// the values [3,5), so only the keys [300,500), plus those keys in the
+			// first and last blocks which share a block with them, are visible.
+			filter := valueRangeFilter{name: "value-range", min: 3, max: 5}
+			iter = newIter(filter)
+			defer iter.Close()
+			forward := scan(iter, true)
+			if len(forward) == 0 {
+				t.Fatal("expected keys")
+			}
+			lo, hi := forward[0], forward[len(forward)-1]+1
+			if lo > 3*entriesPerValue || lo < 2*entriesPerValue+entriesPerValue/2 ||
+				hi < 5*entriesPerValue || hi > 5*entriesPerValue+entriesPerValue/2 {
+				t.Fatalf("unexpected visible keys [%d,%d)", lo, hi)
+			}
+			for j, i := range forward {
+				if i != lo+j {
+					t.Fatalf("expected %d, but found %d", lo+j, i)
+				}
+			}
+			backward := scan(iter, false)
+			if len(backward) != len(forward) {
+				t.Fatalf("expected %d keys backward, but found %d", len(forward), len(backward))
+			}
+			for j, i := range backward {
+				if i != hi-1-j {
+					t.Fatalf("expected %d, but found %d", hi-1-j, i)
+				}
+			}
+
+			seekGE := func(i int) string {
+				if k, _ := iter.SeekGE(key(i)); k != nil {
+					return string(k.UserKey)
+				}
+				return "."
+			}
+			seekLT := func(i int) string {
+				if k, _ := iter.SeekLT(key(i)); k != nil {
+					return string(k.UserKey)
+				}
+				return "."
+			}
+			for _, c := range []struct {
+				seek     func(int) string
+				i        int
+				expected string
+			}{
+				{seekGE, 0, string(key(lo))},
+				{seekGE, 400, string(key(400))},
+				{seekGE, hi, "."},
+				{seekGE, numEntries, "."},
+				{seekLT, numEntries, string(key(hi - 1))},
+				{seekLT, 400, string(key(399))},
+				{seekLT, lo, "."},
+				{seekLT, 0, "."},
+			} {
+				if s := c.seek(c.i); s != c.expected {
+					t.Fatalf("seek(%d): expected %s, but found %s", c.i, c.expected, s)
+				}
+			}
+		})
+	}
+}
+
+func nextKey(iter Iterator, forward bool) *InternalKey {
+	if forward {
+		k, _ := iter.Next()
+		return k
+	}
+	k, _ := iter.Prev()
+	return k
+}
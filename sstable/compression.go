@@ -0,0 +1,178 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// The zstd encoder and decoder are safe for concurrent use via EncodeAll and
+// DecodeAll, and are expensive to construct, so a single instance of each is
+// shared by all readers and writers.
+var zstdState struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func zstdInit() error {
+	zstdState.once.Do(func() {
+		zstdState.encoder, zstdState.err = zstd.NewWriter(nil)
+		if zstdState.err != nil {
+			return
+		}
+		// Bound the decoded length of a frame as decodedLen bounds the length
+		// prefixing it.
+		zstdState.decoder, zstdState.err = zstd.NewReader(
+			nil, zstd.WithDecoderMaxMemory(math.MaxUint32))
+	})
+	return zstdState.err
+}
+
+// compressor holds the scratch state used to compress blocks. It is not safe
+// for concurrent use.
+type compressor struct {
+	// buf is the destination buffer for compression. It is re-used over the
+	// lifetime of the compressor, avoiding the allocation of a temporary buffer
+	// for each block.
+	buf []byte
+	// lz4HashTable is the scratch hash table used by lz4.CompressBlock.
+	lz4HashTable []int
+}
+
+// compress compresses b using the specified compression, returning the block
+// type and the compressed bytes. If the compressed block does not improve on
+// the uncompressed block by at least 12.5%, b is returned unmodified along
+// with noCompressionBlockType. The returned slice is only valid until the next
+// call to compress.
+func (c *compressor) compress(b []byte, compression Compression) (byte, []byte, error) {
+	var blockType byte
+	var compressed []byte
+
+	switch compression {
+	case SnappyCompression:
+		compressed = snappy.Encode(c.buf, b)
+		c.buf = compressed[:cap(compressed)]
+		blockType = snappyCompressionBlockType
+
+	case LZ4Compression:
+		// The RocksDB LZ4 format prefixes the compressed data with the varint32
+		// encoded decompressed length.
+		n := binary.MaxVarintLen32 + lz4.CompressBlockBound(len(b))
+		if cap(c.buf) < n {
+			c.buf = make([]byte, n)
+		}
+		c.buf = c.buf[:cap(c.buf)]
+		if c.lz4HashTable == nil {
+			c.lz4HashTable = make([]int, 1<<16)
+		}
+		varIntLen := binary.PutUvarint(c.buf, uint64(len(b)))
+		m, err := lz4.CompressBlock(b, c.buf[varIntLen:], c.lz4HashTable)
+		if err != nil {
+			return 0, nil, err
+		}
+		if m == 0 {
+			// The data is incompressible.
+			return noCompressionBlockType, b, nil
+		}
+		compressed = c.buf[:varIntLen+m]
+		blockType = lz4CompressionBlockType
+
+	case ZstdCompression:
+		if err := zstdInit(); err != nil {
+			return 0, nil, err
+		}
+		// The RocksDB ZSTD format prefixes the compressed data with the varint32
+		// encoded decompressed length.
+		if cap(c.buf) < binary.MaxVarintLen32 {
+			c.buf = make([]byte, binary.MaxVarintLen32)
+		}
+		varIntLen := binary.PutUvarint(c.buf[:binary.MaxVarintLen32], uint64(len(b)))
+		compressed = zstdState.encoder.EncodeAll(b, c.buf[:varIntLen])
+		c.buf = compressed[:cap(compressed)]
+		blockType = zstdCompressionBlockType
+
+	default:
+		return noCompressionBlockType, b, nil
+	}
+
+	// Discard the compressed result if the improvement isn't at least 12.5%.
+	if len(compressed) >= len(b)-len(b)/8 {
+		return noCompressionBlockType, b, nil
+	}
+	return blockType, compressed, nil
+}
+
+// decodedLen returns the length of the decompressed form of the block b,
+// which was compressed with the specified block type. As with Snappy, whose
+// format limits the decoded length to 2^32-1 bytes, a length which exceeds
+// math.MaxUint32 is rejected. The length is otherwise trusted, and is checked
+// against the actual decompressed length by decompress.
+func decodedLen(blockType byte, b []byte) (int, error) {
+	switch blockType {
+	case noCompressionBlockType:
+		return len(b), nil
+	case snappyCompressionBlockType:
+		return snappy.DecodedLen(b)
+	case lz4CompressionBlockType, zstdCompressionBlockType:
+		n, varIntLen := binary.Uvarint(b)
+		if varIntLen <= 0 || varIntLen > binary.MaxVarintLen32 || n > math.MaxUint32 {
+			return 0, errors.New("pebble/table: invalid table (corrupt decompressed length)")
+		}
+		return int(n), nil
+	default:
+		return 0, fmt.Errorf("pebble/table: unknown block compression: %d", blockType)
+	}
+}
+
+// decompress decompresses b, which was compressed with the specified block
+// type, into buf. The length of buf must be equal to the length returned by
+// decodedLen.
+func decompress(blockType byte, b, buf []byte) ([]byte, error) {
+	switch blockType {
+	case noCompressionBlockType:
+		return b, nil
+
+	case snappyCompressionBlockType:
+		return snappy.Decode(buf, b)
+
+	case lz4CompressionBlockType:
+		_, varIntLen := binary.Uvarint(b)
+		n, err := lz4.UncompressBlock(b[varIntLen:], buf)
+		if err != nil {
+			return nil, err
+		}
+		if n != len(buf) {
+			return nil, errors.New("pebble/table: invalid table (decompressed length mismatch)")
+		}
+		return buf, nil
+
+	case zstdCompressionBlockType:
+		if err := zstdInit(); err != nil {
+			return nil, err
+		}
+		_, varIntLen := binary.Uvarint(b)
+		decoded, err := zstdState.decoder.DecodeAll(b[varIntLen:], buf[:0])
+		if err != nil {
+			return nil, err
+		}
+		if len(decoded) != len(buf) {
+			return nil, errors.New("pebble/table: invalid table (decompressed length mismatch)")
+		}
+		return decoded, nil
+
+	default:
+		return nil, fmt.Errorf("pebble/table: unknown block compression: %d", blockType)
+	}
+}
@@ -4,6 +4,8 @@
 
 package sstable
 
+import "encoding/binary"
+
 type filterWriter interface {
 	addKey(key []byte)
 	finishBlock(blockOffset uint64) error
@@ -64,3 +66,131 @@ func (f *tableFilterWriter) metaName() string {
 func (f *tableFilterWriter) policyName() string {
 	return f.policy.Name()
 }
+
+// blockFilterReader reads the LevelDB filter block format, which contains a
+// filter for each filterBase bytes of data block offsets.
+type blockFilterReader struct {
+	policy FilterPolicy
+}
+
+func newBlockFilterReader(policy FilterPolicy) *blockFilterReader {
+	return &blockFilterReader{
+		policy: policy,
+	}
+}
+
+// mayContain returns whether the filter for the data block at blockOffset may
+// contain the key.
+func (f *blockFilterReader) mayContain(data []byte, blockOffset uint64, key []byte) bool {
+	// The filter block is laid out as:
+	//
+	//   [filter 0] ... [filter N-1]
+	//   [offset of filter 0: 4 bytes] ... [offset of filter N-1: 4 bytes]
+	//   [offset of the offsets array: 4 bytes]
+	//   [filter base log: 1 byte]
+	n := len(data)
+	if n < 5 {
+		// Treat a corrupt filter block as a potential match.
+		return true
+	}
+	baseLg := uint(data[n-1])
+	offsets := binary.LittleEndian.Uint32(data[n-5:])
+	if uint64(offsets) > uint64(n-5) {
+		return true
+	}
+	num := (uint64(n-5) - uint64(offsets)) / 4
+	index := blockOffset >> baseLg
+	if index >= num {
+		// Errors are treated as potential matches.
+		return true
+	}
+	i := uint64(offsets) + 4*index
+	start := binary.LittleEndian.Uint32(data[i:])
+	limit := binary.LittleEndian.Uint32(data[i+4:])
+	if start > limit || limit > offsets {
+		return true
+	}
+	if start == limit {
+		// Empty filters do not match any keys.
+		return false
+	}
+	return f.policy.MayContain(BlockFilter, data[start:limit], key)
+}
+
+// blockFilterWriter writes the LevelDB filter block format. A new filter is
+// generated for each filterBase bytes of data block offsets, covering the keys
+// of the data blocks which start within that range.
+type blockFilterWriter struct {
+	policy FilterPolicy
+	writer FilterWriter
+	// count is the count of the number of keys added to the filter since the
+	// last filter was generated.
+	count int
+	// data holds the encoded filters.
+	data []byte
+	// offsets holds the offset within data of each filter.
+	offsets  []uint32
+	finished bool
+}
+
+func newBlockFilterWriter(policy FilterPolicy) *blockFilterWriter {
+	return &blockFilterWriter{
+		policy: policy,
+		writer: policy.NewWriter(BlockFilter),
+	}
+}
+
+func (f *blockFilterWriter) addKey(key []byte) {
+	f.count++
+	f.writer.AddKey(key)
+}
+
+func (f *blockFilterWriter) finishBlock(blockOffset uint64) error {
+	if f.finished {
+		// Blocks written after the filter block (e.g. index blocks) are not
+		// covered by the filter.
+		return nil
+	}
+	// NB: blockOffset is the offset of the next data block. Generate filters
+	// for any filterBase ranges that precede it.
+	for index := blockOffset >> blockFilterBaseLg; index > uint64(len(f.offsets)); {
+		f.emit()
+	}
+	return nil
+}
+
+// emit generates a filter for the keys added since the previous filter was
+// generated. If no keys have been added, an empty filter is generated.
+func (f *blockFilterWriter) emit() {
+	f.offsets = append(f.offsets, uint32(len(f.data)))
+	if f.count == 0 {
+		return
+	}
+	f.data = f.writer.Finish(f.data)
+	f.count = 0
+}
+
+func (f *blockFilterWriter) finish() ([]byte, error) {
+	if f.count > 0 {
+		f.emit()
+	}
+	f.finished = true
+	offsets := uint32(len(f.data))
+	var tmp [4]byte
+	for _, o := range f.offsets {
+		binary.LittleEndian.PutUint32(tmp[:], o)
+		f.data = append(f.data, tmp[:]...)
+	}
+	binary.LittleEndian.PutUint32(tmp[:], offsets)
+	f.data = append(f.data, tmp[:]...)
+	f.data = append(f.data, blockFilterBaseLg)
+	return f.data, nil
+}
+
+func (f *blockFilterWriter) metaName() string {
+	return "filter." + f.policy.Name()
+}
+
+func (f *blockFilterWriter) policyName() string {
+	return f.policy.Name()
+}
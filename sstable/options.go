@@ -14,14 +14,17 @@ const (
 	DefaultCompression = base.DefaultCompression
 	NoCompression      = base.NoCompression
 	SnappyCompression  = base.SnappyCompression
+	ZstdCompression    = base.ZstdCompression
+	LZ4Compression     = base.LZ4Compression
 )
 
 // FilterType exports the base.FilterType type.
 type FilterType = base.FilterType
 
-// Exported TableFilter constants.
+// Exported FilterType constants.
 const (
 	TableFilter = base.TableFilter
+	BlockFilter = base.BlockFilter
 )
 
 // FilterWriter exports the base.FilterWriter type.
@@ -42,6 +45,12 @@ const (
 // TablePropertyCollector exports the base.TablePropertyCollector type.
 type TablePropertyCollector = base.TablePropertyCollector
 
+// BlockPropertyCollector exports the base.BlockPropertyCollector type.
+type BlockPropertyCollector = base.BlockPropertyCollector
+
+// BlockPropertyFilter exports the base.BlockPropertyFilter type.
+type BlockPropertyFilter = base.BlockPropertyFilter
+
 // TableOptions exports the base.LevelOptions type.
 type TableOptions = base.LevelOptions
 
@@ -19,7 +19,6 @@ import (
 	"github.com/cockroachdb/pebble/internal/crc"
 	"github.com/cockroachdb/pebble/internal/rangedel"
 	"github.com/cockroachdb/pebble/vfs"
-	"github.com/golang/snappy"
 )
 
 // BlockHandle is the file offset and length of a block.
@@ -29,7 +28,8 @@ type BlockHandle struct {
 
 // decodeBlockHandle returns the block handle encoded at the start of src, as
 // well as the number of bytes it occupies. It returns zero if given invalid
-// input.
+// input. Note that the block handle in an index entry may be followed by the
+// encoded block properties of the block (see block_property.go).
 func decodeBlockHandle(src []byte) (BlockHandle, int) {
 	offset, n := binary.Uvarint(src)
 	length, m := binary.Uvarint(src[n:])
@@ -75,6 +75,9 @@ type singleLevelIterator struct {
 	dataBH     BlockHandle
 	err        error
 	closeHook  func(i Iterator) error
+	// bpfs, if non-nil, is used to skip the blocks whose properties do not
+	// intersect the block property filters.
+	bpfs *blockPropertiesFilterer
 }
 
 var singleLevelIterPool = sync.Pool{
@@ -137,6 +140,40 @@ func (i *singleLevelIterator) initBounds() {
 	}
 }
 
+// skipFiltered steps iter, an index iterator positioned at key, past the
+// entries for blocks whose properties do not intersect the block property
+// filters. It returns the key of the first entry which was not skipped, or
+// nil if iter was exhausted or an error was encountered.
+func (i *singleLevelIterator) skipFiltered(
+	iter *blockIter, key *InternalKey, forward bool,
+) *InternalKey {
+	if i.bpfs == nil {
+		return key
+	}
+	for key != nil {
+		v := iter.Value()
+		_, n := decodeBlockHandle(v)
+		if n == 0 {
+			// Let the caller report the corrupt index entry.
+			return key
+		}
+		intersects, err := i.bpfs.intersects(v[n:])
+		if err != nil {
+			i.err = err
+			return nil
+		}
+		if intersects {
+			return key
+		}
+		if forward {
+			key, _ = iter.Next()
+		} else {
+			key, _ = iter.Prev()
+		}
+	}
+	return nil
+}
+
 // loadBlock loads the block at the current index position and leaves i.data
 // unpositioned. If unsuccessful, it sets i.err to any error encountered, which
 // may be nil if we have simply exhausted the entire table.
@@ -153,7 +190,7 @@ func (i *singleLevelIterator) loadBlock() bool {
 	v := i.index.Value()
 	var n int
 	i.dataBH, n = decodeBlockHandle(v)
-	if n == 0 || n != len(v) {
+	if n == 0 {
 		i.err = errors.New("pebble/table: corrupt index entry")
 		return false
 	}
@@ -183,7 +220,7 @@ func (i *singleLevelIterator) seekBlock(key []byte) bool {
 	// Load the next block.
 	v := i.index.Value()
 	h, n := decodeBlockHandle(v)
-	if n == 0 || n != len(v) {
+	if n == 0 {
 		i.err = errors.New("pebble/table: corrupt index entry")
 		return false
 	}
@@ -211,7 +248,8 @@ func (i *singleLevelIterator) SeekGE(key []byte) (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if ikey, _ := i.index.SeekGE(key); ikey == nil {
+	ikey, _ := i.index.SeekGE(key)
+	if ikey = i.skipFiltered(&i.index, ikey, true /* forward */); ikey == nil {
 		return nil, nil
 	}
 	if !i.loadBlock() {
@@ -219,7 +257,19 @@ func (i *singleLevelIterator) SeekGE(key []byte) (*InternalKey, []byte) {
 	}
 	ikey, val := i.data.SeekGE(key)
 	if ikey == nil {
-		return nil, nil
+		// The index contains separator keys which may lie between user-keys.
+		// Consider the user-keys:
+		//
+		//   complete
+		// ---- new block ---
+		//   complexion
+		//
+		// If these two keys end one block and start the next, the index key may
+		// be chosen as "compleu". A SeekGE for "compleo" will then point us to
+		// the block containing "complete", which does not contain any key >=
+		// "compleo". If this happens, we want the first key from the next data
+		// block.
+		return i.skipForward()
 	}
 	if i.blockUpper != nil && i.cmp(ikey.UserKey, i.blockUpper) >= 0 {
 		return nil, nil
@@ -234,27 +284,83 @@ func (i *singleLevelIterator) SeekPrefixGE(prefix, key []byte) (*InternalKey, []
 	if i.err != nil {
 		return nil, nil
 	}
+	if !i.tableMayContain(prefix) {
+		return nil, nil
+	}
+	return i.seekPrefixGE(prefix, key)
+}
+
+// tableMayContain checks the table-level prefix bloom filter, returning false
+// if the table definitely does not contain the prefix.
+func (i *singleLevelIterator) tableMayContain(prefix []byte) bool {
+	if i.reader.tableFilter == nil {
+		return true
+	}
+	data, err := i.reader.readFilter()
+	if err != nil {
+		i.err = err
+		return false
+	}
+	return i.reader.tableFilter.mayContain(data, prefix)
+}
+
+// hasPrefix returns true if the prefix of key, as determined by the reader's
+// Split function, is equal to prefix.
+func (i *singleLevelIterator) hasPrefix(key, prefix []byte) bool {
+	n := len(key)
+	if i.reader.split != nil {
+		n = i.reader.split(key)
+	}
+	return bytes.Equal(key[:n], prefix)
+}
+
+// seekPrefixGE is the implementation of SeekPrefixGE after the table-level
+// filter has been checked.
+func (i *singleLevelIterator) seekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
+	sep, _ := i.index.SeekGE(key)
+	if sep == nil {
+		return nil, nil
+	}
+	filtered := i.skipFiltered(&i.index, sep, true /* forward */)
+	if filtered == nil {
+		return nil, nil
+	}
 
-	// Check prefix bloom filter.
-	if i.reader.tableFilter != nil {
+	// Check the block-based bloom filter for the data block which would
+	// contain the key. Keys sharing a prefix are contiguous, so if the prefix
+	// is not present in this block it is not present in any subsequent block.
+	// The exception is a shortened separator key which has the prefix: the
+	// separator lies between the last key in this block and the first key in
+	// the next block, so the next block may begin with a key having the prefix.
+	// The bloom filter is not consulted if the block property filters skipped
+	// the block which would contain the key.
+	if i.reader.blockFilter != nil && filtered == sep &&
+		(sep.Kind() != base.InternalKeyKindSeparator || !i.hasPrefix(sep.UserKey, prefix)) {
 		data, err := i.reader.readFilter()
 		if err != nil {
+			i.err = err
 			return nil, nil
 		}
-		if !i.reader.tableFilter.mayContain(data, prefix) {
+		v := i.index.Value()
+		bh, n := decodeBlockHandle(v)
+		if n == 0 {
+			i.err = errors.New("pebble/table: corrupt index entry")
+			return nil, nil
+		}
+		if !i.reader.blockFilter.mayContain(data, bh.Offset, prefix) {
 			return nil, nil
 		}
 	}
 
-	if ikey, _ := i.index.SeekGE(key); ikey == nil {
-		return nil, nil
-	}
 	if !i.loadBlock() {
 		return nil, nil
 	}
 	ikey, val := i.data.SeekGE(key)
 	if ikey == nil {
-		return nil, nil
+		// The key is greater than every key in the block, but less than or equal
+		// to the separator, which must then lie between this block and the
+		// next. The first key in the next block may have the prefix.
+		return i.skipForward()
 	}
 	if i.blockUpper != nil && i.cmp(ikey.UserKey, i.blockUpper) >= 0 {
 		return nil, nil
@@ -270,8 +376,12 @@ func (i *singleLevelIterator) SeekLT(key []byte) (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if ikey, _ := i.index.SeekGE(key); ikey == nil {
-		i.index.Last()
+	ikey, _ := i.index.SeekGE(key)
+	if ikey == nil {
+		ikey, _ = i.index.Last()
+	}
+	if ikey = i.skipFiltered(&i.index, ikey, false /* forward */); ikey == nil {
+		return nil, nil
 	}
 	if !i.loadBlock() {
 		return nil, nil
@@ -289,7 +399,8 @@ func (i *singleLevelIterator) SeekLT(key []byte) (*InternalKey, []byte) {
 		// be chosen as "compleu". The SeekGE in the index block will then point
 		// us to the block containing "complexion". If this happens, we want the
 		// last key from the previous data block.
-		if ikey, _ = i.index.Prev(); ikey == nil {
+		ikey, _ = i.index.Prev()
+		if ikey = i.skipFiltered(&i.index, ikey, false /* forward */); ikey == nil {
 			return nil, nil
 		}
 		if !i.loadBlock() {
@@ -314,7 +425,8 @@ func (i *singleLevelIterator) First() (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if ikey, _ := i.index.First(); ikey == nil {
+	ikey, _ := i.index.First()
+	if ikey = i.skipFiltered(&i.index, ikey, true /* forward */); ikey == nil {
 		return nil, nil
 	}
 	if !i.loadBlock() {
@@ -339,7 +451,8 @@ func (i *singleLevelIterator) Last() (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if ikey, _ := i.index.Last(); ikey == nil {
+	ikey, _ := i.index.Last()
+	if ikey = i.skipFiltered(&i.index, ikey, false /* forward */); ikey == nil {
 		return nil, nil
 	}
 	if !i.loadBlock() {
@@ -373,7 +486,8 @@ func (i *singleLevelIterator) Next() (*InternalKey, []byte) {
 			i.err = i.data.err
 			break
 		}
-		if key, _ := i.index.Next(); key == nil {
+		key, _ := i.index.Next()
+		if key = i.skipFiltered(&i.index, key, true /* forward */); key == nil {
 			break
 		}
 		if i.loadBlock() {
@@ -407,7 +521,8 @@ func (i *singleLevelIterator) Prev() (*InternalKey, []byte) {
 			i.err = i.data.err
 			break
 		}
-		if key, _ := i.index.Prev(); key == nil {
+		key, _ := i.index.Prev()
+		if key = i.skipFiltered(&i.index, key, false /* forward */); key == nil {
 			break
 		}
 		if i.loadBlock() {
@@ -424,6 +539,36 @@ func (i *singleLevelIterator) Prev() (*InternalKey, []byte) {
 	return nil, nil
 }
 
+// skipForward advances to the first key of the next non-empty data block. It
+// is used when the iterator is positioned past the last key of the current
+// data block.
+func (i *singleLevelIterator) skipForward() (*InternalKey, []byte) {
+	for {
+		if i.data.err != nil {
+			i.err = i.data.err
+			break
+		}
+		key, _ := i.index.Next()
+		if key = i.skipFiltered(&i.index, key, true /* forward */); key == nil {
+			break
+		}
+		if i.loadBlock() {
+			key, val := i.data.First()
+			if key == nil {
+				continue
+			}
+			if i.blockUpper != nil && i.cmp(key.UserKey, i.blockUpper) >= 0 {
+				return nil, nil
+			}
+			return key, val
+		}
+		if i.err != nil {
+			break
+		}
+	}
+	return nil, nil
+}
+
 // Error implements internalIterator.Error, as documented in the pebble
 // package.
 func (i *singleLevelIterator) Error() error {
@@ -463,6 +608,29 @@ func (i *singleLevelIterator) SetBounds(lower, upper []byte) {
 	i.upper = upper
 }
 
+// curOffset returns the offset in the sstable of the end of the current entry,
+// which is used by the compaction iterators to track the number of bytes
+// iterated.
+func (i *singleLevelIterator) curOffset() uint64 {
+	// i.dataBH.Length/len(i.data.data) is the compression ratio. If uncompressed, this is 1.
+	// i.data.nextOffset is the uncompressed position of the current record in the block.
+	// i.dataBH.Offset is the offset of the block in the sstable before decompression.
+	recordOffset := (uint64(i.data.nextOffset) * i.dataBH.Length) / uint64(len(i.data.data))
+	curOffset := i.dataBH.Offset + recordOffset
+	// Last entry in the block must increment bytes iterated by the size of the block trailer
+	// and restart points.
+	if i.data.nextOffset+(4*(i.data.numRestarts+1)) == int32(len(i.data.data)) {
+		curOffset = i.dataBH.Offset + i.dataBH.Length + blockTrailerLen
+	}
+	return curOffset
+}
+
+// entryOffset returns the offset in the sstable of the start of the current
+// entry. See curOffset.
+func (i *singleLevelIterator) entryOffset() uint64 {
+	return i.dataBH.Offset + (uint64(i.data.offset)*i.dataBH.Length)/uint64(len(i.data.data))
+}
+
 // compactionIterator is similar to Iterator but it increments the number of
 // bytes that have been iterated through.
 type compactionIterator struct {
@@ -471,8 +639,18 @@ type compactionIterator struct {
 	prevOffset    uint64
 }
 
+// SeekGE implements internalIterator.SeekGE, as documented in the pebble
+// package. It is used to position the iterator at the start of the key range
+// of a subcompaction. The bytes preceding the sought position are not counted
+// as iterated.
 func (i *compactionIterator) SeekGE(key []byte) (*InternalKey, []byte) {
-	panic("pebble: SeekGE unimplemented")
+	ikey, val := i.singleLevelIterator.SeekGE(key)
+	if ikey != nil {
+		// Only the bytes of the current entry are counted as iterated.
+		i.prevOffset = i.curOffset()
+		*i.bytesIterated += i.prevOffset - i.entryOffset()
+	}
+	return ikey, val
 }
 
 func (i *compactionIterator) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
@@ -538,16 +716,7 @@ func (i *compactionIterator) Next() (*InternalKey, []byte) {
 		}
 	}
 
-	// i.dataBH.Length/len(i.data.data) is the compression ratio. If uncompressed, this is 1.
-	// i.data.nextOffset is the uncompressed position of the current record in the block.
-	// i.dataBH.Offset is the offset of the block in the sstable before decompression.
-	recordOffset := (uint64(i.data.nextOffset) * i.dataBH.Length) / uint64(len(i.data.data))
-	curOffset := i.dataBH.Offset + recordOffset
-	// Last entry in the block must increment bytes iterated by the size of the block trailer
-	// and restart points.
-	if i.data.nextOffset+(4*(i.data.numRestarts+1)) == int32(len(i.data.data)) {
-		curOffset = i.dataBH.Offset + i.dataBH.Length + blockTrailerLen
-	}
+	curOffset := i.curOffset()
 	*i.bytesIterated += uint64(curOffset - i.prevOffset)
 	i.prevOffset = curOffset
 	return key, val
@@ -574,7 +743,7 @@ func (i *twoLevelIterator) loadIndex() bool {
 		return false
 	}
 	h, n := decodeBlockHandle(i.topLevelIndex.Value())
-	if n == 0 || n != len(i.topLevelIndex.Value()) {
+	if n == 0 {
 		i.err = errors.New("pebble/table: corrupt top level index entry")
 		return false
 	}
@@ -620,7 +789,8 @@ func (i *twoLevelIterator) SeekGE(key []byte) (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if ikey, _ := i.topLevelIndex.SeekGE(key); ikey == nil {
+	ikey, _ := i.topLevelIndex.SeekGE(key)
+	if ikey = i.skipFiltered(&i.topLevelIndex, ikey, true /* forward */); ikey == nil {
 		return nil, nil
 	}
 
@@ -628,7 +798,13 @@ func (i *twoLevelIterator) SeekGE(key []byte) (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	return i.singleLevelIterator.SeekGE(key)
+	// The top level index contains separator keys which may lie between
+	// user-keys. See singleLevelIterator.SeekGE. If the index block is
+	// exhausted, we want the first key from the next index block.
+	if ikey, val := i.singleLevelIterator.SeekGE(key); ikey != nil || i.index.Valid() {
+		return ikey, val
+	}
+	return i.skipForward()
 }
 
 // SeekPrefixGE implements internalIterator.SeekPrefixGE, as documented in the
@@ -638,8 +814,12 @@ func (i *twoLevelIterator) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byt
 	if i.err != nil {
 		return nil, nil
 	}
+	if !i.tableMayContain(prefix) {
+		return nil, nil
+	}
 
-	if ikey, _ := i.topLevelIndex.SeekGE(key); ikey == nil {
+	ikey, _ := i.topLevelIndex.SeekGE(key)
+	if ikey = i.skipFiltered(&i.topLevelIndex, ikey, true /* forward */); ikey == nil {
 		return nil, nil
 	}
 
@@ -647,7 +827,15 @@ func (i *twoLevelIterator) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byt
 		return nil, nil
 	}
 
-	return i.singleLevelIterator.SeekPrefixGE(prefix, key)
+	// The top level index contains separator keys which may lie between the
+	// last key of an index block and the first key of the next, like the
+	// separators in the index blocks (see singleLevelIterator.seekPrefixGE). If
+	// the index block is exhausted, we want the first key from the next index
+	// block.
+	if ikey, val := i.singleLevelIterator.seekPrefixGE(prefix, key); ikey != nil || i.index.Valid() {
+		return ikey, val
+	}
+	return i.skipForward()
 }
 
 // SeekLT implements internalIterator.SeekLT, as documented in the pebble
@@ -658,36 +846,25 @@ func (i *twoLevelIterator) SeekLT(key []byte) (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if ikey, _ := i.topLevelIndex.SeekGE(key); ikey == nil {
-		if ikey, _ := i.topLevelIndex.Last(); ikey == nil {
-			return nil, nil
-		}
-
-		if !i.loadIndex() {
-			return nil, nil
-		}
-
-		return i.singleLevelIterator.Last()
+	ikey, _ := i.topLevelIndex.SeekGE(key)
+	if ikey == nil {
+		ikey, _ = i.topLevelIndex.Last()
+	}
+	if ikey = i.skipFiltered(&i.topLevelIndex, ikey, false /* forward */); ikey == nil {
+		return nil, nil
 	}
 
 	if !i.loadIndex() {
 		return nil, nil
 	}
 
-	ikey, val := i.singleLevelIterator.SeekLT(key)
-	if ikey == nil {
-		if ikey, val = i.topLevelIndex.Prev(); ikey == nil {
-			return nil, nil
-		}
-		if !i.loadIndex() {
-			return nil, nil
-		}
-		if ikey, val = i.singleLevelIterator.Last(); ikey == nil {
-			return nil, nil
-		}
+	// The top level index contains separator keys which may lie between
+	// user-keys. See singleLevelIterator.SeekLT. If the index block is
+	// exhausted, we want the last key from the previous index block.
+	if ikey, val := i.singleLevelIterator.SeekLT(key); ikey != nil || i.index.Valid() {
+		return ikey, val
 	}
-
-	return ikey, val
+	return i.skipBackward()
 }
 
 // First implements internalIterator.First, as documented in the pebble
@@ -699,7 +876,8 @@ func (i *twoLevelIterator) First() (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if ikey, _ := i.topLevelIndex.First(); ikey == nil {
+	ikey, _ := i.topLevelIndex.First()
+	if ikey = i.skipFiltered(&i.topLevelIndex, ikey, true /* forward */); ikey == nil {
 		return nil, nil
 	}
 
@@ -707,7 +885,13 @@ func (i *twoLevelIterator) First() (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	return i.singleLevelIterator.First()
+	// Every data block referenced by the index block may have been skipped by
+	// the block property filters, in which case we want the first key from the
+	// next index block.
+	if ikey, val := i.singleLevelIterator.First(); ikey != nil || i.index.Valid() {
+		return ikey, val
+	}
+	return i.skipForward()
 }
 
 // Last implements internalIterator.Last, as documented in the pebble
@@ -719,7 +903,8 @@ func (i *twoLevelIterator) Last() (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if ikey, _ := i.topLevelIndex.Last(); ikey == nil {
+	ikey, _ := i.topLevelIndex.Last()
+	if ikey = i.skipFiltered(&i.topLevelIndex, ikey, false /* forward */); ikey == nil {
 		return nil, nil
 	}
 
@@ -727,7 +912,10 @@ func (i *twoLevelIterator) Last() (*InternalKey, []byte) {
 		return nil, nil
 	}
 
-	return i.singleLevelIterator.Last()
+	if ikey, val := i.singleLevelIterator.Last(); ikey != nil || i.index.Valid() {
+		return ikey, val
+	}
+	return i.skipBackward()
 }
 
 // Next implements internalIterator.Next, as documented in the pebble
@@ -741,20 +929,7 @@ func (i *twoLevelIterator) Next() (*InternalKey, []byte) {
 	if key, val := i.singleLevelIterator.Next(); key != nil {
 		return key, val
 	}
-	for {
-		if i.index.err != nil {
-			i.err = i.index.err
-			break
-		}
-		if ikey, _ := i.topLevelIndex.Next(); ikey == nil {
-			return nil, nil
-		}
-		if !i.loadIndex() {
-			return nil, nil
-		}
-		return i.singleLevelIterator.First()
-	}
-	return nil, nil
+	return i.skipForward()
 }
 
 // Prev implements internalIterator.Prev, as documented in the pebble
@@ -766,18 +941,51 @@ func (i *twoLevelIterator) Prev() (*InternalKey, []byte) {
 	if key, val := i.singleLevelIterator.Prev(); key != nil {
 		return key, val
 	}
-	for {
+	return i.skipBackward()
+}
+
+// skipForward advances to the first key of the next non-empty index block. It
+// is used when the iterator is positioned past the last key of the current
+// index block.
+func (i *twoLevelIterator) skipForward() (*InternalKey, []byte) {
+	for i.err == nil {
 		if i.index.err != nil {
 			i.err = i.index.err
 			break
 		}
-		if ikey, _ := i.topLevelIndex.Prev(); ikey == nil {
-			return nil, nil
+		ikey, _ := i.topLevelIndex.Next()
+		if ikey = i.skipFiltered(&i.topLevelIndex, ikey, true /* forward */); ikey == nil {
+			break
 		}
 		if !i.loadIndex() {
-			return nil, nil
+			break
+		}
+		if ikey, val := i.singleLevelIterator.First(); ikey != nil || i.index.Valid() {
+			return ikey, val
+		}
+	}
+	return nil, nil
+}
+
+// skipBackward moves to the last key of the previous non-empty index block.
+// It is used when the iterator is positioned before the first key of the
+// current index block.
+func (i *twoLevelIterator) skipBackward() (*InternalKey, []byte) {
+	for i.err == nil {
+		if i.index.err != nil {
+			i.err = i.index.err
+			break
+		}
+		ikey, _ := i.topLevelIndex.Prev()
+		if ikey = i.skipFiltered(&i.topLevelIndex, ikey, false /* forward */); ikey == nil {
+			break
+		}
+		if !i.loadIndex() {
+			break
+		}
+		if ikey, val := i.singleLevelIterator.Last(); ikey != nil || i.index.Valid() {
+			return ikey, val
 		}
-		return i.singleLevelIterator.Last()
 	}
 	return nil, nil
 }
@@ -807,8 +1015,16 @@ type twoLevelCompactionIterator struct {
 	prevOffset    uint64
 }
 
+// SeekGE implements internalIterator.SeekGE, as documented in the pebble
+// package. See compactionIterator.SeekGE.
 func (i *twoLevelCompactionIterator) SeekGE(key []byte) (*InternalKey, []byte) {
-	panic("pebble: SeekGE unimplemented")
+	ikey, val := i.twoLevelIterator.SeekGE(key)
+	if ikey != nil {
+		// Only the bytes of the current entry are counted as iterated.
+		i.prevOffset = i.curOffset()
+		*i.bytesIterated += i.prevOffset - i.entryOffset()
+	}
+	return ikey, val
 }
 
 func (i *twoLevelCompactionIterator) SeekPrefixGE(prefix, key []byte) (*InternalKey, []byte) {
@@ -874,16 +1090,7 @@ func (i *twoLevelCompactionIterator) Next() (*InternalKey, []byte) {
 		}
 	}
 
-	// i.dataBH.Length/len(i.data.data) is the compression ratio. If uncompressed, this is 1.
-	// i.data.nextOffset is the uncompressed position of the current record in the block.
-	// i.dataBH.Offset is the offset of the block in the sstable before decompression.
-	recordOffset := (uint64(i.data.nextOffset) * i.dataBH.Length) / uint64(len(i.data.data))
-	curOffset := i.dataBH.Offset + recordOffset
-	// Last entry in the block must increment bytes iterated by the size of the block trailer
-	// and restart points.
-	if i.data.nextOffset+(4*(i.data.numRestarts+1)) == int32(len(i.data.data)) {
-		curOffset = i.dataBH.Offset + i.dataBH.Length + blockTrailerLen
-	}
+	curOffset := i.curOffset()
 	*i.bytesIterated += uint64(curOffset - i.prevOffset)
 	i.prevOffset = curOffset
 	return key, val
@@ -958,6 +1165,7 @@ type Reader struct {
 	split             Split
 	mergerOK          bool
 	tableFilter       *tableFilterReader
+	blockFilter       *blockFilterReader
 	Properties        Properties
 }
 
@@ -982,31 +1190,23 @@ func (r *Reader) Close() error {
 	return nil
 }
 
-// get is a testing helper that simulates a read and helps verify bloom filters
-// until they are available through iterators.
+// get is a testing helper that simulates a read and helps verify bloom
+// filters.
 func (r *Reader) get(key []byte) (value []byte, err error) {
 	if r.err != nil {
 		return nil, r.err
 	}
 
-	if r.tableFilter != nil {
-		data, err := r.readFilter()
-		if err != nil {
-			return nil, err
-		}
-		var lookupKey []byte
-		if r.split != nil {
-			lookupKey = key[:r.split(key)]
-		} else {
-			lookupKey = key
-		}
-		if !r.tableFilter.mayContain(data, lookupKey) {
-			return nil, base.ErrNotFound
-		}
+	var lookupKey []byte
+	if r.split != nil {
+		lookupKey = key[:r.split(key)]
+	} else {
+		lookupKey = key
 	}
 
+	// NB: SeekPrefixGE consults the table and block filters.
 	i := r.NewIter(nil /* lower */, nil /* upper */)
-	ikey, value := i.SeekGE(key)
+	ikey, value := i.SeekPrefixGE(lookupKey, key)
 
 	if ikey == nil || r.Compare(key, ikey.UserKey) != 0 {
 		err := i.Close()
@@ -1033,6 +1233,40 @@ func (r *Reader) NewIter(lower, upper []byte) Iterator {
 	return i
 }
 
+// NewIterWithBlockPropertyFilters returns an iterator for the contents of the
+// table, like NewIter, which skips the data blocks whose properties do not
+// intersect every one of the block property filters. Filters for which the
+// table has no properties are ignored. If the table-level properties show that
+// the table contains no blocks passing the filters, a nil iterator is
+// returned.
+func (r *Reader) NewIterWithBlockPropertyFilters(
+	lower, upper []byte, filters []BlockPropertyFilter,
+) (Iterator, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	bpfs, intersects, err := newBlockPropertiesFilterer(filters, r.Properties.UserProperties)
+	if err != nil {
+		return nil, err
+	}
+	if !intersects {
+		return nil, nil
+	}
+	// NB: pebble.tableCache wraps the returned iterator with one which performs
+	// reference counting on the Reader, preventing the Reader from being closed
+	// until the final iterator closes.
+	if r.Properties.IndexType == twoLevelIndex {
+		i := twoLevelIterPool.Get().(*twoLevelIterator)
+		_ = i.Init(r, lower, upper)
+		i.bpfs = bpfs
+		return i, nil
+	}
+	i := singleLevelIterPool.Get().(*singleLevelIterator)
+	_ = i.Init(r, lower, upper)
+	i.bpfs = bpfs
+	return i, nil
+}
+
 // NewCompactionIter returns an iterator similar to NewIter but it also increments
 // the number of bytes iterated.
 func (r *Reader) NewCompactionIter(bytesIterated *uint64) Iterator {
@@ -1135,23 +1369,17 @@ func (r *Reader) readBlock(
 	typ := b[bh.Length]
 	b = b[:bh.Length]
 
-	switch typ {
-	case noCompressionBlockType:
-		break
-	case snappyCompressionBlockType:
-		decodedLen, err := snappy.DecodedLen(b)
+	if typ != noCompressionBlockType {
+		n, err := decodedLen(typ, b)
 		if err != nil {
 			return cache.Handle{}, err
 		}
-		decoded := r.cache.Alloc(decodedLen)
-		decoded, err = snappy.Decode(decoded, b)
+		decoded, err := decompress(typ, b, r.cache.Alloc(n))
 		if err != nil {
 			return cache.Handle{}, err
 		}
 		r.cache.Free(b)
 		b = decoded
-	default:
-		return cache.Handle{}, fmt.Errorf("pebble/table: unknown block compression: %d", typ)
 	}
 
 	if transform != nil {
@@ -1259,6 +1487,7 @@ func (r *Reader) readMetaindex(metaindexBH BlockHandle, o *Options) error {
 			prefix string
 		}{
 			{TableFilter, "fullfilter."},
+			{BlockFilter, "filter."},
 		}
 		var done bool
 		for _, t := range types {
@@ -1268,6 +1497,8 @@ func (r *Reader) readMetaindex(metaindexBH BlockHandle, o *Options) error {
 				switch t.ftype {
 				case TableFilter:
 					r.tableFilter = newTableFilterReader(fp)
+				case BlockFilter:
+					r.blockFilter = newBlockFilterReader(fp)
 				default:
 					return fmt.Errorf("unknown filter type: %v", t.ftype)
 				}
@@ -1308,7 +1539,7 @@ func (r *Reader) Layout() (*Layout, error) {
 		iter, _ := newBlockIter(r.Compare, index)
 		for key, value := iter.First(); key != nil; key, value = iter.Next() {
 			dataBH, n := decodeBlockHandle(value)
-			if n == 0 || n != len(value) {
+			if n == 0 {
 				return nil, errors.New("pebble/table: corrupt index entry")
 			}
 			l.Data = append(l.Data, dataBH)
@@ -1318,7 +1549,7 @@ func (r *Reader) Layout() (*Layout, error) {
 		topIter, _ := newBlockIter(r.Compare, index)
 		for key, value := topIter.First(); key != nil; key, value = topIter.Next() {
 			indexBH, n := decodeBlockHandle(value)
-			if n == 0 || n != len(value) {
+			if n == 0 {
 				return nil, errors.New("pebble/table: corrupt index entry")
 			}
 			l.Index = append(l.Index, indexBH)
@@ -1330,7 +1561,7 @@ func (r *Reader) Layout() (*Layout, error) {
 			iter, _ := newBlockIter(r.Compare, subIndex.Get())
 			for key, value := iter.First(); key != nil; key, value = iter.Next() {
 				dataBH, n := decodeBlockHandle(value)
-				if n == 0 || n != len(value) {
+				if n == 0 {
 					return nil, errors.New("pebble/table: corrupt index entry")
 				}
 				l.Data = append(l.Data, dataBH)
@@ -1342,6 +1573,190 @@ func (r *Reader) Layout() (*Layout, error) {
 	return l, nil
 }
 
+// EstimateDiskUsage returns the total size of the data blocks overlapping the
+// range [start, end]. The estimate is computed from the index block and only
+// includes the data blocks: the sizes of the index, filter and other meta
+// blocks are not included.
+func (r *Reader) EstimateDiskUsage(start, end []byte) (uint64, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	index, err := r.readIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	// Iterators over the bottom level index blocks containing start and end.
+	// These may be different with a two-level index, but are the same iterator
+	// over the single index block otherwise.
+	var startIdxIter, endIdxIter *blockIter
+	if r.Properties.IndexPartitions == 0 {
+		iter, err := newBlockIter(r.Compare, index)
+		if err != nil {
+			return 0, err
+		}
+		startIdxIter = iter
+		endIdxIter = iter
+	} else {
+		topIter, err := newBlockIter(r.Compare, index)
+		if err != nil {
+			return 0, err
+		}
+		readSubIndex := func(value []byte) (*blockIter, error) {
+			bh, n := decodeBlockHandle(value)
+			if n == 0 {
+				return nil, errors.New("pebble/table: corrupt top level index entry")
+			}
+			subIndex, err := r.readBlock(bh, nil /* transform */)
+			if err != nil {
+				return nil, err
+			}
+			iter := &blockIter{}
+			iter.setCacheHandle(subIndex)
+			if err := iter.init(r.Compare, subIndex.Get(), r.Properties.GlobalSeqNum); err != nil {
+				iter.Close()
+				return nil, err
+			}
+			return iter, nil
+		}
+
+		key, value := topIter.SeekGE(start)
+		if key == nil {
+			// The range lies after the end of the table.
+			return 0, topIter.Error()
+		}
+		if startIdxIter, err = readSubIndex(value); err != nil {
+			return 0, err
+		}
+		defer startIdxIter.Close()
+
+		if key, value = topIter.SeekGE(end); key != nil {
+			if endIdxIter, err = readSubIndex(value); err != nil {
+				return 0, err
+			}
+			defer endIdxIter.Close()
+		} else if err := topIter.Error(); err != nil {
+			return 0, err
+		}
+	}
+
+	key, value := startIdxIter.SeekGE(start)
+	if key == nil {
+		// The range lies after the end of the table.
+		return 0, startIdxIter.Error()
+	}
+	startBH, n := decodeBlockHandle(value)
+	if n == 0 {
+		return 0, errors.New("pebble/table: corrupt index entry")
+	}
+
+	if endIdxIter != nil {
+		if key, value = endIdxIter.SeekGE(end); key != nil {
+			endBH, n := decodeBlockHandle(value)
+			if n == 0 {
+				return 0, errors.New("pebble/table: corrupt index entry")
+			}
+			return endBH.Offset + endBH.Length + blockTrailerLen - startBH.Offset, nil
+		} else if err := endIdxIter.Error(); err != nil {
+			return 0, err
+		}
+	}
+	// The range extends beyond the end of the table, so it includes all of the
+	// data blocks from the block containing start.
+	dataSize := r.Properties.DataSize
+	if dataSize == 0 {
+		// Tables in the LevelDB format do not have a properties block, so the
+		// end of the data blocks is found from the layout of the table.
+		l, err := r.Layout()
+		if err != nil {
+			return 0, err
+		}
+		if n := len(l.Data); n > 0 {
+			dataSize = l.Data[n-1].Offset + l.Data[n-1].Length + blockTrailerLen
+		}
+	}
+	if dataSize < startBH.Offset {
+		return 0, nil
+	}
+	return dataSize - startBH.Offset, nil
+}
+
+// DataBlockSizes calls fn with the separator key and size of each of the
+// data blocks overlapping the range [start, end], in order. The separator key
+// of a block is greater than or equal to the keys in the block, and less than
+// the keys in the following block.
+func (r *Reader) DataBlockSizes(start, end []byte, fn func(separator []byte, size uint64)) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	index, err := r.readIndex()
+	if err != nil {
+		return err
+	}
+
+	// visit calls fn for the blocks of an index block from the block containing
+	// start, returning false once a block containing end has been visited.
+	first := true
+	visit := func(iter *blockIter) (bool, error) {
+		var key *InternalKey
+		var value []byte
+		if first {
+			key, value = iter.SeekGE(start)
+			first = false
+		} else {
+			key, value = iter.First()
+		}
+		for ; key != nil; key, value = iter.Next() {
+			bh, n := decodeBlockHandle(value)
+			if n == 0 {
+				return false, errors.New("pebble/table: corrupt index entry")
+			}
+			fn(key.UserKey, bh.Length+blockTrailerLen)
+			if r.Compare(key.UserKey, end) >= 0 {
+				return false, nil
+			}
+		}
+		return true, iter.Error()
+	}
+
+	if r.Properties.IndexPartitions == 0 {
+		iter, err := newBlockIter(r.Compare, index)
+		if err != nil {
+			return err
+		}
+		_, err = visit(iter)
+		return err
+	}
+
+	topIter, err := newBlockIter(r.Compare, index)
+	if err != nil {
+		return err
+	}
+	for key, value := topIter.SeekGE(start); key != nil; key, value = topIter.Next() {
+		bh, n := decodeBlockHandle(value)
+		if n == 0 {
+			return errors.New("pebble/table: corrupt top level index entry")
+		}
+		subIndex, err := r.readBlock(bh, nil /* transform */)
+		if err != nil {
+			return err
+		}
+		iter := &blockIter{}
+		iter.setCacheHandle(subIndex)
+		more, err := false, iter.init(r.Compare, subIndex.Get(), r.Properties.GlobalSeqNum)
+		if err == nil {
+			more, err = visit(iter)
+		}
+		iter.Close()
+		if err != nil || !more {
+			return err
+		}
+	}
+	return topIter.Error()
+}
+
 // NewReader returns a new table reader for the file. Closing the reader will
 // close the file.
 func NewReader(
@@ -1540,7 +1955,7 @@ func (l *Layout) Describe(
 			iter, _ := newBlockIter(r.Compare, h.Get())
 			for key, value := iter.First(); key != nil; key, value = iter.Next() {
 				bh, n := decodeBlockHandle(value)
-				if n == 0 || n != len(value) {
+				if n == 0 {
 					fmt.Fprintf(w, "%10d    [err: %s]\n", b.Offset+uint64(iter.offset), err)
 					continue
 				}
@@ -457,6 +457,106 @@ func TestBytesIteratedUncompressed(t *testing.T) {
 	}
 }
 
+func TestBytesIteratedSeekGE(t *testing.T) {
+	const numEntries = 1e5
+	key := func(i uint64) []byte {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, i)
+		return k
+	}
+	for _, indexBlockSize := range []int{100, math.MaxInt32} {
+		r := buildTestTable(t, numEntries, 100, indexBlockSize, NoCompression)
+
+		// Iterating over the two halves of the table, the second of which is
+		// positioned using SeekGE, iterates over the entire table.
+		var first, second uint64
+		citer := r.NewCompactionIter(&first)
+		for key, _ := citer.First(); key != nil; key, _ = citer.Next() {
+			if binary.BigEndian.Uint64(key.UserKey) == numEntries/2-1 {
+				break
+			}
+		}
+		citer = r.NewCompactionIter(&second)
+		for key, _ := citer.SeekGE(key(numEntries / 2)); key != nil; key, _ = citer.Next() {
+		}
+
+		expected := r.Properties.DataSize
+		if first+second != expected {
+			t.Fatalf("bytesIterated: got %d+%d, want %d", first, second, expected)
+		}
+		if second < expected*45/100 || second > expected*55/100 {
+			t.Fatalf("bytesIterated: got %d, want approximately %d", second, expected/2)
+		}
+	}
+}
+
+func TestReaderEstimateDiskUsage(t *testing.T) {
+	const numEntries = 1e4
+	key := func(i uint64) []byte {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, i)
+		return k
+	}
+	for _, indexBlockSize := range []int{100, math.MaxInt32} {
+		t.Run(fmt.Sprintf("index-block-size=%d", indexBlockSize), func(t *testing.T) {
+			r := buildTestTable(t, numEntries, 100, indexBlockSize, NoCompression)
+			defer r.Close()
+			estimate := func(start, end []byte) uint64 {
+				size, err := r.EstimateDiskUsage(start, end)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return size
+			}
+
+			dataSize := r.Properties.DataSize
+			if size := estimate(key(0), key(numEntries)); size != dataSize {
+				t.Fatalf("expected %d, but found %d", dataSize, size)
+			}
+			if size := estimate([]byte{0xff}, []byte{0xff, 0xff}); size != 0 {
+				t.Fatalf("expected 0, but found %d", size)
+			}
+
+			// The estimates of adjacent ranges overlap by at most the block
+			// containing their shared boundary.
+			lo := estimate(key(0), key(numEntries/2))
+			hi := estimate(key(numEntries/2), key(numEntries))
+			if lo+hi < dataSize || lo+hi > dataSize+dataSize/100 {
+				t.Fatalf("expected %d+%d to be approximately %d", lo, hi, dataSize)
+			}
+
+			var prev uint64
+			for i := uint64(0); i <= numEntries; i += numEntries / 10 {
+				size := estimate(key(0), key(i))
+				if size < prev {
+					t.Fatalf("estimate decreased from %d to %d", prev, size)
+				}
+				prev = size
+			}
+
+			// The sizes of the data blocks overlapping a range sum to the
+			// estimate for the range.
+			for _, bounds := range [][2]uint64{{0, numEntries}, {100, 200}, {5000, 9000}} {
+				var sum uint64
+				var lastSep []byte
+				err := r.DataBlockSizes(key(bounds[0]), key(bounds[1]), func(sep []byte, size uint64) {
+					if lastSep != nil && bytes.Compare(lastSep, sep) >= 0 {
+						t.Fatalf("separators out of order: %x >= %x", lastSep, sep)
+					}
+					lastSep = append(lastSep[:0], sep...)
+					sum += size
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if size := estimate(key(bounds[0]), key(bounds[1])); sum != size {
+					t.Fatalf("%d-%d: expected %d, but found %d", bounds[0], bounds[1], size, sum)
+				}
+			}
+		})
+	}
+}
+
 func buildTestTable(
 	t *testing.T,
 	numEntries uint64,
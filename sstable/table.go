@@ -152,6 +152,13 @@ const (
 	// use the default compression (which is snappy).
 	noCompressionBlockType     byte = 0
 	snappyCompressionBlockType byte = 1
+	lz4CompressionBlockType    byte = 4
+	zstdCompressionBlockType   byte = 7
+
+	// blockFilterBaseLg is the log base 2 of the number of bytes of data block
+	// offsets covered by each filter in a block-based filter block. A new
+	// filter is generated every 2KB.
+	blockFilterBaseLg = 11
 
 	metaPropertiesName = "rocksdb.properties"
 	metaRangeDelName   = "rocksdb.range_del"
@@ -166,10 +173,10 @@ const (
 	twoLevelIndex = 2
 	// binarySearchWithFirstKeyIndex = 3
 
-	// RocksDB always includes this in the properties block. Since Pebble
-	// doesn't use zstd compression, the string will always be the same.
-	// This should be removed if we ever decide to diverge from the RocksDB
-	// properties block.
+	// RocksDB always includes this in the properties block. Pebble doesn't
+	// expose any zstd compression options, so the string will always be the
+	// same. This should be removed if we ever decide to diverge from the
+	// RocksDB properties block.
 	rocksDBCompressionOptions = "window_bits=-14; level=32767; strategy=0; max_dict_bytes=0; zstd_max_train_bytes=0; enabled=0; "
 )
 
@@ -441,6 +441,7 @@ func TestReaderBloomUsed(t *testing.T) {
 		path     string
 		comparer *Comparer
 	}{
+		{"h.block-bloom.no-compression.sst", nil},
 		{"h.table-bloom.no-compression.sst", nil},
 		{"h.table-bloom.no-compression.prefix_extractor.no_whole_key_filter.sst", fixtureComparer},
 	}
@@ -481,6 +482,89 @@ func TestReaderBloomUsed(t *testing.T) {
 	}
 }
 
+func TestReaderBlockFilterSeparatorPrefix(t *testing.T) {
+	// The separator between "ab@1" and "ac@3" is "ac", which has the same
+	// prefix as the first key in the second block. The block filter for the
+	// first block does not contain "ac", but SeekPrefixGE must not stop there.
+	comparer := *base.DefaultComparer
+	comparer.Name = "prefix-comparer"
+	comparer.Split = func(k []byte) int {
+		if i := bytes.IndexByte(k, '@'); i >= 0 {
+			return i
+		}
+		return len(k)
+	}
+
+	for _, indexBlockSize := range []int{1, math.MaxInt32} {
+		t.Run(fmt.Sprintf("index-block-size=%d", indexBlockSize), func(t *testing.T) {
+			mem := vfs.NewMem()
+			f0, err := mem.Create("test")
+			require.NoError(t, err)
+			opts := &Options{Comparer: &comparer}
+			w := NewWriter(f0, opts, TableOptions{
+				BlockSize:      1,
+				IndexBlockSize: indexBlockSize,
+				FilterPolicy:   bloom.FilterPolicy(10),
+				FilterType:     BlockFilter,
+			})
+			for _, k := range []string{"ab@1", "ac@3"} {
+				require.NoError(t, w.Add(base.MakeInternalKey([]byte(k), 0, InternalKeyKindSet), []byte(k)))
+			}
+			require.NoError(t, w.Close())
+
+			f1, err := mem.Open("test")
+			require.NoError(t, err)
+			r, err := NewReader(f1, 0, 0, opts)
+			require.NoError(t, err)
+			defer r.Close()
+
+			iter := r.NewIter(nil /* lower */, nil /* upper */)
+			defer iter.Close()
+			key, _ := iter.SeekPrefixGE([]byte("ac"), []byte("ac"))
+			if key == nil || string(key.UserKey) != "ac@3" {
+				t.Fatalf("expected ac@3, but found %v", key)
+			}
+		})
+	}
+}
+
+func TestReaderTwoLevelTableFilterCheckedOnce(t *testing.T) {
+	mem := vfs.NewMem()
+	f0, err := mem.Create("test")
+	require.NoError(t, err)
+	c := &countingFilterPolicy{FilterPolicy: bloom.FilterPolicy(10)}
+	w := NewWriter(f0, nil, TableOptions{
+		BlockSize:      1,
+		IndexBlockSize: 1,
+		FilterPolicy:   c,
+		FilterType:     TableFilter,
+	})
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, w.Add(base.MakeInternalKey([]byte(k), 0, InternalKeyKindSet), []byte(k)))
+	}
+	require.NoError(t, w.Close())
+
+	f1, err := mem.Open("test")
+	require.NoError(t, err)
+	r, err := NewReader(f1, 0, 0, &Options{
+		Levels: []TableOptions{{FilterPolicy: c}},
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	iter := r.NewIter(nil /* lower */, nil /* upper */)
+	defer iter.Close()
+	if _, ok := iter.(*twoLevelIterator); !ok {
+		t.Fatalf("expected two-level iterator, but found %T", iter)
+	}
+	if key, _ := iter.SeekPrefixGE([]byte("b"), []byte("b")); key == nil || string(key.UserKey) != "b" {
+		t.Fatalf("expected b, but found %v", key)
+	}
+	if n := c.truePositives + c.falsePositives + c.falseNegatives + c.trueNegatives; n != 1 {
+		t.Fatalf("expected 1 filter check, but found %d", n)
+	}
+}
+
 func TestBloomFilterFalsePositiveRate(t *testing.T) {
 	f, err := os.Open(filepath.FromSlash("testdata/h.table-bloom.no-compression.sst"))
 	if err != nil {
@@ -574,24 +658,172 @@ func TestWriterRoundTrip(t *testing.T) {
 				"none":       nil,
 				"bloom10bit": bloom.FilterPolicy(10),
 			} {
-				t.Run(fmt.Sprintf("bloom=%s", name), func(t *testing.T) {
-					f, err := build(base.DefaultCompression, fp, TableFilter,
-						nil, nil, blockSize, indexBlockSize)
-					if err != nil {
-						t.Fatal(err)
-					}
-					// Check that we can read a freshly made table.
+				for _, ftype := range []FilterType{TableFilter, BlockFilter} {
+					t.Run(fmt.Sprintf("bloom=%s,type=%s", name, ftype), func(t *testing.T) {
+						f, err := build(base.DefaultCompression, fp, ftype,
+							nil, nil, blockSize, indexBlockSize)
+						if err != nil {
+							t.Fatal(err)
+						}
+						// Check that we can read a freshly made table.
 
-					err = check(f, nil, nil)
-					if err != nil {
-						t.Fatal(err)
-					}
-				})
+						err = check(f, nil, fp)
+						if err != nil {
+							t.Fatal(err)
+						}
+					})
+				}
 			}
 		}
 	}
 }
 
+func TestWriterRoundTripCompression(t *testing.T) {
+	for _, compression := range []Compression{
+		NoCompression, SnappyCompression, ZstdCompression, LZ4Compression,
+	} {
+		t.Run(compression.String(), func(t *testing.T) {
+			for _, blockSize := range []int{100, 4096} {
+				f, err := build(compression, nil, TableFilter, nil, nil, blockSize, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := check(f, nil, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressionBlockType(t *testing.T) {
+	b := bytes.Repeat([]byte("hamlet"), 1000)
+	testCases := []struct {
+		compression Compression
+		blockType   byte
+	}{
+		{NoCompression, noCompressionBlockType},
+		{SnappyCompression, snappyCompressionBlockType},
+		{ZstdCompression, zstdCompressionBlockType},
+		{LZ4Compression, lz4CompressionBlockType},
+	}
+	var c compressor
+	for _, tc := range testCases {
+		t.Run(tc.compression.String(), func(t *testing.T) {
+			blockType, compressed, err := c.compress(b, tc.compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if blockType != tc.blockType {
+				t.Fatalf("expected block type %d, but found %d", tc.blockType, blockType)
+			}
+			n, err := decodedLen(blockType, compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(b) {
+				t.Fatalf("expected decoded length %d, but found %d", len(b), n)
+			}
+			decoded, err := decompress(blockType, compressed, make([]byte, n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, decoded) {
+				t.Fatalf("round-trip mismatch")
+			}
+		})
+	}
+
+	// Incompressible data is stored uncompressed.
+	rnd := rand.New(rand.NewSource(0))
+	random := make([]byte, 1000)
+	rnd.Read(random)
+	for _, tc := range testCases {
+		blockType, _, err := c.compress(random, tc.compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blockType != noCompressionBlockType {
+			t.Fatalf("%s: expected block type %d, but found %d",
+				tc.compression, noCompressionBlockType, blockType)
+		}
+	}
+}
+
+func TestDecodedLenCorrupt(t *testing.T) {
+	for _, blockType := range []byte{
+		snappyCompressionBlockType, lz4CompressionBlockType, zstdCompressionBlockType,
+	} {
+		for _, tc := range []struct {
+			n  uint64
+			ok bool
+		}{
+			{1 << 31, true},
+			{math.MaxUint32, true},
+			{math.MaxUint32 + 1, false},
+			{1 << 33, false},
+		} {
+			b := make([]byte, binary.MaxVarintLen64+16)
+			b = b[:binary.PutUvarint(b, tc.n)+16]
+			n, err := decodedLen(blockType, b)
+			if tc.ok {
+				if err != nil {
+					t.Fatalf("%d: %d: %v", blockType, tc.n, err)
+				}
+				if uint64(n) != tc.n {
+					t.Fatalf("%d: expected decoded length %d, but found %d", blockType, tc.n, n)
+				}
+			} else if err == nil {
+				t.Fatalf("%d: %d: expected error, but found decoded length %d", blockType, tc.n, n)
+			}
+		}
+	}
+}
+
+func TestLargeCompressibleValue(t *testing.T) {
+	// A single value much larger than the block size which compresses well
+	// produces a block with a very high compression ratio.
+	value := bytes.Repeat([]byte("a"), 10<<20)
+	for _, compression := range []Compression{
+		NoCompression, SnappyCompression, ZstdCompression, LZ4Compression,
+	} {
+		t.Run(compression.String(), func(t *testing.T) {
+			mem := vfs.NewMem()
+			f0, err := mem.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f0, nil, TableOptions{Compression: compression})
+			if err := w.Set([]byte("a"), value); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Set([]byte("b"), []byte("b")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f1, err := mem.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewReader(f1, 0, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			v, err := r.get([]byte("a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(value, v) {
+				t.Fatalf("expected %d byte value, but found %d bytes", len(value), len(v))
+			}
+		})
+	}
+}
+
 func TestFinalBlockIsWritten(t *testing.T) {
 	keys := []string{"A", "B", "C", "D", "E", "F", "G", "H", "I", "J"}
 	valueLengths := []int{0, 1, 22, 28, 33, 40, 50, 61, 87, 100, 143, 200}
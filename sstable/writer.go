@@ -16,7 +16,6 @@ import (
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/crc"
 	"github.com/cockroachdb/pebble/internal/rangedel"
-	"github.com/golang/snappy"
 )
 
 // WriterMetadata holds info about a finished sstable.
@@ -133,10 +132,21 @@ type Writer struct {
 	rangeDelBlock  blockWriter
 	props          Properties
 	propCollectors []TablePropertyCollector
-	// compressedBuf is the destination buffer for snappy compression. It is
-	// re-used over the lifetime of the writer, avoiding the allocation of a
-	// temporary buffer for each block.
-	compressedBuf []byte
+	// blockPropCollectors collect the properties of each data block, which are
+	// stored alongside the block handle in the block's index entry.
+	blockPropCollectors []BlockPropertyCollector
+	// dataBlockProps holds the encoded properties of the data block referenced
+	// by pendingBH.
+	dataBlockProps blockPropertiesEncoder
+	// blockPropsScratch is a scratch buffer passed to the block property
+	// collectors.
+	blockPropsScratch []byte
+	// indexValue is a scratch buffer used to encode index entries.
+	indexValue []byte
+	// compressor holds the scratch buffers used for block compression. They
+	// are re-used over the lifetime of the writer, avoiding the allocation of
+	// temporary buffers for each block.
+	compressor compressor
 	// filter accumulates the filter block. If populated, the filter ingests
 	// either the output of w.split (i.e. a prefix extractor) if w.split is not
 	// nil, or the full keys otherwise.
@@ -146,7 +156,14 @@ type Writer struct {
 	tmp [rocksDBFooterLen]byte
 
 	topLevelIndexBlock blockWriter
-	indexPartitions    []blockWriter
+	indexPartitions    []indexBlockAndBlockProperties
+}
+
+type indexBlockAndBlockProperties struct {
+	block blockWriter
+	// properties holds the encoded block properties of the data blocks
+	// referenced by the index block.
+	properties []byte
 }
 
 // Set sets the value for the given key. The sequence number is set to
@@ -217,7 +234,10 @@ func (w *Writer) Add(key InternalKey, value []byte) error {
 }
 
 func (w *Writer) addPoint(key InternalKey, value []byte) error {
-	if base.InternalCompare(w.compare, w.meta.LargestPoint, key) >= 0 {
+	// NB: a nil LargestPoint.UserKey indicates no point keys have been added.
+	// The zero key is not necessarily the smallest key for the comparer.
+	if w.meta.LargestPoint.UserKey != nil &&
+		base.InternalCompare(w.compare, w.meta.LargestPoint, key) >= 0 {
 		w.err = fmt.Errorf("pebble: keys must be added in order: %s, %s",
 			w.meta.LargestPoint.Pretty(w.formatter), key.Pretty(w.formatter))
 		return w.err
@@ -232,6 +252,11 @@ func (w *Writer) addPoint(key InternalKey, value []byte) error {
 			return err
 		}
 	}
+	for i := range w.blockPropCollectors {
+		if err := w.blockPropCollectors[i].Add(key, value); err != nil {
+			return err
+		}
+	}
 
 	w.meta.updateSeqNum(key.SeqNum())
 	w.meta.updateLargestPoint(key)
@@ -334,21 +359,42 @@ func (w *Writer) maybeFlush(key InternalKey, value []byte) error {
 	}
 
 	bh, err := w.finishBlock(&w.block)
+	if err == nil {
+		err = w.finishDataBlockProps()
+	}
 	if err != nil {
 		w.err = err
 		return w.err
 	}
 	w.pendingBH = bh
-	w.flushPendingBH(key)
+	if err := w.flushPendingBH(key); err != nil {
+		w.err = err
+		return w.err
+	}
+	return nil
+}
+
+// finishDataBlockProps collects the properties of the data block which was
+// just finished from the block property collectors.
+func (w *Writer) finishDataBlockProps() error {
+	w.dataBlockProps.resetProperties()
+	for i := range w.blockPropCollectors {
+		scratch, err := w.blockPropCollectors[i].FinishDataBlock(w.blockPropsScratch[:0])
+		if err != nil {
+			return err
+		}
+		w.dataBlockProps.addProperty(uint8(i), scratch)
+		w.blockPropsScratch = scratch
+	}
 	return nil
 }
 
 // flushPendingBH adds any pending block handle to the index entries.
-func (w *Writer) flushPendingBH(key InternalKey) {
+func (w *Writer) flushPendingBH(key InternalKey) error {
 	if w.pendingBH.Length == 0 {
 		// A valid blockHandle must be non-zero.
 		// In particular, it must have a non-zero length.
-		return
+		return nil
 	}
 	prevKey := base.DecodeInternalKey(w.block.curKey)
 	var sep InternalKey
@@ -358,20 +404,34 @@ func (w *Writer) flushPendingBH(key InternalKey) {
 		sep = prevKey.Separator(w.compare, w.separator, nil, key)
 	}
 	n := encodeBlockHandle(w.tmp[:], w.pendingBH)
+	w.indexValue = append(w.indexValue[:0], w.tmp[:n]...)
+	w.indexValue = append(w.indexValue, w.dataBlockProps.unsafeProperties()...)
 
 	if supportsTwoLevelIndex(w.tableFormat) &&
-		shouldFlush(sep, w.tmp[:n], w.indexBlock, w.indexBlockSize, w.indexBlockSizeThreshold) {
+		shouldFlush(sep, w.indexValue, w.indexBlock, w.indexBlockSize, w.indexBlockSizeThreshold) {
 		// Enable two level indexes if there is more than one index block.
 		w.twoLevelIndex = true
-		w.finishIndexBlock()
+		if err := w.finishIndexBlock(); err != nil {
+			return err
+		}
 	}
 
-	w.indexBlock.add(sep, w.tmp[:n])
+	w.indexBlock.add(sep, w.indexValue)
+	for i := range w.blockPropCollectors {
+		w.blockPropCollectors[i].AddPrevDataBlockToIndexBlock()
+	}
 
 	w.pendingBH = BlockHandle{}
+	return nil
 }
 
 func shouldFlush(key InternalKey, value []byte, block blockWriter, blockSize, sizeThreshold int) bool {
+	if block.nEntries == 0 {
+		// Never flush an empty block. An empty block is possible when the
+		// target block size is smaller than the overhead of an empty block, and
+		// an iterator positioned on it would appear to be exhausted.
+		return false
+	}
 	if size := block.estimatedSize(); size < blockSize {
 		// The block is currently smaller than the target size.
 		if size <= sizeThreshold {
@@ -412,18 +472,34 @@ func (w *Writer) finishBlock(block *blockWriter) (BlockHandle, error) {
 
 // finishIndexBlock finishes the current index block and adds it to the top
 // level index block. This is only used when two level indexes are enabled.
-func (w *Writer) finishIndexBlock() {
-	w.indexPartitions = append(w.indexPartitions, w.indexBlock)
+func (w *Writer) finishIndexBlock() error {
+	var props blockPropertiesEncoder
+	for i := range w.blockPropCollectors {
+		scratch, err := w.blockPropCollectors[i].FinishIndexBlock(w.blockPropsScratch[:0])
+		if err != nil {
+			return err
+		}
+		props.addProperty(uint8(i), scratch)
+		w.blockPropsScratch = scratch
+	}
+	w.indexPartitions = append(w.indexPartitions, indexBlockAndBlockProperties{
+		block:      w.indexBlock,
+		properties: props.properties(),
+	})
 	w.indexBlock = blockWriter{
 		restartInterval: 1,
 	}
+	return nil
 }
 
 func (w *Writer) writeTwoLevelIndex() (BlockHandle, error) {
 	// Add the final unfinished index.
-	w.finishIndexBlock()
+	if err := w.finishIndexBlock(); err != nil {
+		return BlockHandle{}, err
+	}
 
-	for _, b := range w.indexPartitions {
+	for i := range w.indexPartitions {
+		b := &w.indexPartitions[i].block
 		sep := base.DecodeInternalKey(b.curKey)
 		bh, _ := w.writeRawBlock(b.finish(), w.compression)
 
@@ -432,7 +508,9 @@ func (w *Writer) writeTwoLevelIndex() (BlockHandle, error) {
 		}
 
 		n := encodeBlockHandle(w.tmp[:], bh)
-		w.topLevelIndexBlock.add(sep, w.tmp[:n])
+		w.indexValue = append(w.indexValue[:0], w.tmp[:n]...)
+		w.indexValue = append(w.indexValue, w.indexPartitions[i].properties...)
+		w.topLevelIndexBlock.add(sep, w.indexValue)
 
 		w.props.IndexSize += uint64(len(b.buf))
 		w.props.NumDataBlocks += uint64(b.nEntries)
@@ -449,16 +527,9 @@ func (w *Writer) writeTwoLevelIndex() (BlockHandle, error) {
 }
 
 func (w *Writer) writeRawBlock(b []byte, compression Compression) (BlockHandle, error) {
-	blockType := noCompressionBlockType
-	if compression == SnappyCompression {
-		// Compress the buffer, discarding the result if the improvement isn't at
-		// least 12.5%.
-		compressed := snappy.Encode(w.compressedBuf, b)
-		w.compressedBuf = compressed[:cap(compressed)]
-		if len(compressed) < len(b)-len(b)/8 {
-			blockType = snappyCompressionBlockType
-			b = compressed
-		}
+	blockType, b, err := w.compressor.compress(b, compression)
+	if err != nil {
+		return BlockHandle{}, err
 	}
 	w.tmp[0] = blockType
 
@@ -501,15 +572,24 @@ func (w *Writer) Close() (err error) {
 
 	// Finish the last data block, or force an empty data block if there
 	// aren't any data blocks at all.
-	w.flushPendingBH(InternalKey{})
+	if err := w.flushPendingBH(InternalKey{}); err != nil {
+		w.err = err
+		return w.err
+	}
 	if w.block.nEntries > 0 || w.indexBlock.nEntries == 0 {
 		bh, err := w.finishBlock(&w.block)
+		if err == nil {
+			err = w.finishDataBlockProps()
+		}
 		if err != nil {
 			w.err = err
 			return w.err
 		}
 		w.pendingBH = bh
-		w.flushPendingBH(InternalKey{})
+		if err := w.flushPendingBH(InternalKey{}); err != nil {
+			w.err = err
+			return w.err
+		}
 	}
 	w.props.DataSize = w.meta.Size
 
@@ -586,6 +666,18 @@ func (w *Writer) Close() (err error) {
 				return err
 			}
 		}
+		for i := range w.blockPropCollectors {
+			// The short ID of the collector is stored as the first byte of the
+			// table-level property so that the properties in the index entries
+			// can be matched with their collector by a reader.
+			buf := append(w.blockPropsScratch[:0], uint8(i))
+			buf, err := w.blockPropCollectors[i].FinishTable(buf)
+			if err != nil {
+				return err
+			}
+			userProps[w.blockPropCollectors[i].Name()] = string(buf)
+			w.blockPropsScratch = buf
+		}
 		if len(userProps) > 0 {
 			w.props.UserProperties = userProps
 		}
@@ -721,15 +813,17 @@ func NewWriter(f writeCloseSyncer, o *Options, lo TableOptions) *Writer {
 		switch lo.FilterType {
 		case TableFilter:
 			w.filter = newTableFilterWriter(lo.FilterPolicy)
-			if w.split != nil {
-				w.props.PrefixExtractorName = o.Comparer.Name
-				w.props.PrefixFiltering = true
-			} else {
-				w.props.WholeKeyFiltering = true
-			}
+		case BlockFilter:
+			w.filter = newBlockFilterWriter(lo.FilterPolicy)
 		default:
 			panic(fmt.Sprintf("unknown filter type: %v", lo.FilterType))
 		}
+		if w.split != nil {
+			w.props.PrefixExtractorName = o.Comparer.Name
+			w.props.PrefixFiltering = true
+		} else {
+			w.props.WholeKeyFiltering = true
+		}
 	}
 
 	w.props.ColumnFamilyID = math.MaxInt32
@@ -754,6 +848,18 @@ func NewWriter(f writeCloseSyncer, o *Options, lo TableOptions) *Writer {
 		w.props.PropertyCollectorNames = buf.String()
 	}
 
+	if len(o.BlockPropertyCollectors) > 0 {
+		if len(o.BlockPropertyCollectors) > maxBlockPropertyCollectors {
+			w.err = fmt.Errorf("pebble: too many block property collectors: %d > %d",
+				len(o.BlockPropertyCollectors), maxBlockPropertyCollectors)
+			return w
+		}
+		w.blockPropCollectors = make([]BlockPropertyCollector, len(o.BlockPropertyCollectors))
+		for i := range o.BlockPropertyCollectors {
+			w.blockPropCollectors[i] = o.BlockPropertyCollectors[i]()
+		}
+	}
+
 	// If f does not have a Flush method, do our own buffering.
 	if _, ok := f.(flusher); ok {
 		w.writer = f
@@ -43,6 +43,15 @@ func TestWriter(t *testing.T) {
 						return fmt.Sprintf("%s: arg %s expects 0 values", td.Cmd, arg.Key)
 					}
 					opts.TableFormat = TableFormatLevelDB
+				case "block-size":
+					if len(arg.Vals) != 1 {
+						return fmt.Sprintf("%s: arg %s expects 1 value", td.Cmd, arg.Key)
+					}
+					var err error
+					tableOpts.BlockSize, err = strconv.Atoi(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
 				case "index-block-size":
 					if len(arg.Vals) != 1 {
 						return fmt.Sprintf("%s: arg %s expects 1 value", td.Cmd, arg.Key)
@@ -204,3 +213,27 @@ func TestWriter(t *testing.T) {
 		}
 	})
 }
+
+func TestWriterReverseComparer(t *testing.T) {
+	// With a reverse comparer the empty key sorts after every other key, so
+	// the first key added must not be compared against the zero key.
+	comparer := *base.DefaultComparer
+	comparer.Name = "reverse"
+	comparer.Compare = func(a, b []byte) int {
+		return base.DefaultComparer.Compare(b, a)
+	}
+
+	f, err := vfs.NewMem().Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, &Options{Comparer: &comparer}, TableOptions{})
+	for _, k := range []string{"c", "b", "a"} {
+		if err := w.Set([]byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -45,6 +45,10 @@ func (c *tableCache) newIters(
 	return c.getShard(meta.FileNum).newIters(meta, opts, bytesIterated)
 }
 
+func (c *tableCache) withReader(meta *fileMetadata, fn func(*sstable.Reader) error) error {
+	return c.getShard(meta.FileNum).withReader(meta, fn)
+}
+
 func (c *tableCache) evict(fileNum uint64) {
 	c.getShard(fileNum).evict(fileNum)
 }
@@ -114,6 +118,13 @@ func (c *tableCacheShard) newIters(
 	n := c.findNode(meta)
 	<-n.loaded
 	if n.err != nil {
+		// Don't cache the error. The error may be transient, so remove the node
+		// from the cache in order for the next caller to retry opening the table.
+		c.mu.Lock()
+		if c.mu.nodes[meta.FileNum] == n {
+			c.releaseNode(n)
+		}
+		c.mu.Unlock()
 		c.unrefNode(n)
 		return nil, nil, n.err
 	}
@@ -128,6 +139,20 @@ func (c *tableCacheShard) newIters(
 	var iter sstable.Iterator
 	if bytesIterated != nil {
 		iter = n.reader.NewCompactionIter(bytesIterated)
+	} else if opts != nil && len(opts.BlockPropertyFilters) > 0 {
+		var err error
+		iter, err = n.reader.NewIterWithBlockPropertyFilters(
+			opts.GetLowerBound(), opts.GetUpperBound(), opts.BlockPropertyFilters)
+		if err != nil {
+			c.unrefNode(n)
+			return nil, nil, err
+		}
+		if iter == nil {
+			// None of the blocks in the table can pass the filters. As with
+			// TableFilter, return the empty iterator.
+			c.unrefNode(n)
+			return emptyIter, nil, nil
+		}
 	} else {
 		iter = n.reader.NewIter(opts.GetLowerBound(), opts.GetUpperBound())
 	}
@@ -148,6 +173,24 @@ func (c *tableCacheShard) newIters(
 	return iter, nil, nil
 }
 
+// withReader calls fn with the reader for the table, which is kept open for
+// the duration of the call.
+func (c *tableCacheShard) withReader(meta *fileMetadata, fn func(*sstable.Reader) error) error {
+	n := c.findNode(meta)
+	<-n.loaded
+	defer c.unrefNode(n)
+	if n.err != nil {
+		// Don't cache the error. See newIters.
+		c.mu.Lock()
+		if c.mu.nodes[meta.FileNum] == n {
+			c.releaseNode(n)
+		}
+		c.mu.Unlock()
+		return n.err
+	}
+	return fn(n.reader)
+}
+
 // releaseNode releases a node from the tableCacheShard.
 //
 // c.mu must be held when calling this.
@@ -330,3 +330,32 @@ func TestTableCacheIterLeak(t *testing.T) {
 		t.Log(err.Error())
 	}
 }
+
+func TestTableCacheRetryAfterFailure(t *testing.T) {
+	// Test that a table open failure does not get cached.
+	c, fs, err := newTableCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := base.MakeFilename(fs, "", fileTypeTable, 0)
+	if err := fs.Rename(filename, filename+".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.newIters(&fileMetadata{FileNum: 0}, nil /* iter options */, nil /* bytes iterated */); err == nil {
+		t.Fatalf("expected failure, but found success")
+	}
+
+	if err := fs.Rename(filename+".tmp", filename); err != nil {
+		t.Fatal(err)
+	}
+	iter, _, err := c.newIters(&fileMetadata{FileNum: 0}, nil /* iter options */, nil /* bytes iterated */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,8 +6,11 @@ package tool
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/cache"
 	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/sstable"
 	"github.com/spf13/cobra"
@@ -101,7 +104,101 @@ by another process.
 	return d
 }
 
+// loadOptions loads the Comparer and Merger from the most recent OPTIONS file
+// in the specified directory, allowing the DB to be opened without the names
+// being specified on the command line. Options which are not known (e.g.
+// those in an OPTIONS file written by RocksDB) are ignored.
+func (d *dbT) loadOptions(dir string) error {
+	fs := d.opts.FS
+	ls, err := fs.List(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Leave the error to be reported by pebble.Open.
+			return nil
+		}
+		return err
+	}
+	var path string
+	var maxFileNum uint64
+	for _, filename := range ls {
+		ft, fileNum, ok := base.ParseFilename(fs, filename)
+		if ok && ft == base.FileTypeOptions && (path == "" || fileNum > maxFileNum) {
+			path = fs.PathJoin(dir, filename)
+			maxFileNum = fileNum
+		}
+	}
+	if path == "" {
+		return nil
+	}
+
+	f, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	// Only the Comparer and Merger are taken from the parsed options. The
+	// remaining options are parsed, but ignored.
+	var parsed base.Options
+	hooks := &base.ParseHooks{
+		NewCache: func(size int64) *cache.Cache {
+			return nil
+		},
+		NewComparer: func(name string) (*base.Comparer, error) {
+			if d.comparerName != "" {
+				// The comparer specified on the command line takes precedence.
+				return nil, nil
+			}
+			if c := d.comparers[name]; c != nil {
+				return c, nil
+			}
+			return nil, fmt.Errorf("unknown comparer %q", name)
+		},
+		NewFilterPolicy: func(name string) (base.FilterPolicy, error) {
+			return d.opts.Filters[name], nil
+		},
+		NewMerger: func(name string) (*base.Merger, error) {
+			if d.mergerName != "" {
+				// The merger specified on the command line takes precedence.
+				return nil, nil
+			}
+			if m := d.mergers[name]; m != nil {
+				return m, nil
+			}
+			return nil, fmt.Errorf("unknown merger %q", name)
+		},
+		NewTablePropertyCollector: func(name string) (func() base.TablePropertyCollector, error) {
+			return nil, nil
+		},
+		NewBlockPropertyCollector: func(name string) (func() base.BlockPropertyCollector, error) {
+			return nil, nil
+		},
+		SkipUnknown: func(name string) bool {
+			return true
+		},
+	}
+	if err := parsed.Parse(string(data), hooks); err != nil {
+		return err
+	}
+	if parsed.Comparer != nil {
+		d.opts.Comparer = parsed.Comparer
+	}
+	if parsed.Merger != nil {
+		d.opts.Merger = parsed.Merger
+	}
+	return nil
+}
+
 func (d *dbT) openDB(dir string) (*pebble.DB, error) {
+	if d.comparerName == "" || d.mergerName == "" {
+		if err := d.loadOptions(dir); err != nil {
+			return nil, err
+		}
+	}
 	if d.comparerName != "" {
 		d.opts.Comparer = d.comparers[d.comparerName]
 		if d.opts.Comparer == nil {
@@ -5,9 +5,106 @@
 package tool
 
 import (
+	"bytes"
+	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/spf13/cobra"
 )
 
 func TestDB(t *testing.T) {
 	runTests(t, "testdata/db_*")
 }
+
+// testBlockPropertyCollector is a block property collector which collects no
+// properties.
+type testBlockPropertyCollector struct{}
+
+func (testBlockPropertyCollector) Name() string {
+	return "test-collector"
+}
+
+func (testBlockPropertyCollector) Add(key base.InternalKey, value []byte) error {
+	return nil
+}
+
+func (testBlockPropertyCollector) FinishDataBlock(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+func (testBlockPropertyCollector) AddPrevDataBlockToIndexBlock() {}
+
+func (testBlockPropertyCollector) FinishIndexBlock(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+func (testBlockPropertyCollector) FinishTable(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+func TestDBOptionsFile(t *testing.T) {
+	comparer := *base.DefaultComparer
+	comparer.Name = "test-comparer"
+	merger := *base.DefaultMerger
+	merger.Name = "test-merger"
+
+	mem := vfs.NewMem()
+	d, err := pebble.Open("db", &pebble.Options{
+		// The tool does not know about the block property collector, which is
+		// ignored when the OPTIONS file is loaded.
+		BlockPropertyCollectors: []func() pebble.BlockPropertyCollector{
+			func() pebble.BlockPropertyCollector { return testBlockPropertyCollector{} },
+		},
+		Comparer: &comparer,
+		FS:       mem,
+		Merger:   &merger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	stdout = &buf
+	timeNow = func() time.Time { return time.Unix(0, 0) }
+	defer func() {
+		stdout = os.Stdout
+		timeNow = time.Now
+	}()
+
+	run := func(args ...string) string {
+		buf.Reset()
+		tool := New()
+		tool.setFS(mem)
+		tool.RegisterComparer(&comparer)
+		tool.RegisterMerger(&merger)
+		c := &cobra.Command{}
+		c.AddCommand(tool.Commands...)
+		c.SetArgs(args)
+		c.SetOutput(&buf)
+		if err := c.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	// The comparer and merger are loaded from the OPTIONS file.
+	const expected = "a b\nscanned 1 record in 0.0s\n"
+	if got := run("db", "scan", "db", "--value=%s"); got != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, got)
+	}
+	// The comparer specified on the command line takes precedence.
+	if got := run("db", "scan", "db", "--comparer=leveldb.BytewiseComparator"); !strings.Contains(got, "comparer name from file") {
+		t.Fatalf("expected comparer mismatch, but found\n%s", got)
+	}
+}
@@ -6,6 +6,7 @@ package tool
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 
@@ -116,11 +117,14 @@ func (w *walT) runDump(cmd *cobra.Command, args []string) {
 				fmt.Fprintf(stdout, "%d(%d) seq=%d count=%d\n",
 					offset, len(b.Repr()), b.SeqNum(), b.Count())
 				for r := b.Reader(); ; {
-					kind, ukey, value, ok := r.Next()
+					cfID, kind, ukey, value, ok := r.NextColumnFamily()
 					if !ok {
 						break
 					}
 					fmt.Fprintf(stdout, "    %s(", kind)
+					if cfID != 0 {
+						fmt.Fprintf(stdout, "cf=%d,", cfID)
+					}
 					switch kind {
 					case base.InternalKeyKindDelete:
 						fmt.Fprintf(stdout, "%s", w.fmtKey.fn(ukey))
@@ -134,6 +138,23 @@ func (w *walT) runDump(cmd *cobra.Command, args []string) {
 						fmt.Fprintf(stdout, "%s", w.fmtKey.fn(ukey))
 					case base.InternalKeyKindRangeDelete:
 						fmt.Fprintf(stdout, "%s,%s", w.fmtKey.fn(ukey), w.fmtKey.fn(value))
+					case base.InternalKeyKindSetWithTTL:
+						// The value is prefixed with the expiration time, encoded as
+						// a little-endian uint64 holding Unix nanoseconds.
+						if len(value) < 8 {
+							fmt.Fprintf(stdout, "%s,<corrupt>", w.fmtKey.fn(ukey))
+							break
+						}
+						fmt.Fprintf(stdout, "%s,%d,%s", w.fmtKey.fn(ukey),
+							int64(binary.LittleEndian.Uint64(value)), w.fmtValue.fn(value[8:]))
+					case base.InternalKeyKindIngestSST:
+						// The key is the file number of the ingested sstable.
+						fileNum, n := binary.Uvarint(ukey)
+						if n <= 0 {
+							fmt.Fprintf(stdout, "<corrupt>")
+							break
+						}
+						fmt.Fprintf(stdout, "%06d", fileNum)
 					}
 					fmt.Fprintf(stdout, ")\n")
 				}
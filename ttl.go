@@ -0,0 +1,41 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ttlExpiryLen is the length of the expiration time which prefixes the value
+// of an InternalKeyKindSetWithTTL entry. The expiration time is encoded as a
+// little-endian uint64 holding the Unix time in nanoseconds.
+const ttlExpiryLen = 8
+
+var errCorruptTTLValue = errors.New("pebble: corrupt TTL value")
+
+// encodeTTLValue appends the encoding of the expiration time and value of an
+// InternalKeyKindSetWithTTL entry to dst.
+func encodeTTLValue(dst []byte, expiry int64, value []byte) []byte {
+	var buf [ttlExpiryLen]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(expiry))
+	dst = append(dst, buf[:]...)
+	return append(dst, value...)
+}
+
+// decodeTTLValue decodes the value of an InternalKeyKindSetWithTTL entry into
+// the expiration time and the user value.
+func decodeTTLValue(v []byte) (expiry int64, value []byte, err error) {
+	if len(v) < ttlExpiryLen {
+		return 0, nil, errCorruptTTLValue
+	}
+	return int64(binary.LittleEndian.Uint64(v)), v[ttlExpiryLen:], nil
+}
+
+// ttlExpired returns true if a key with the specified expiration time has
+// expired at time now. Both times are Unix times in nanoseconds.
+func ttlExpired(expiry, now int64) bool {
+	return expiry <= now
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestSetWithTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	opts := &Options{
+		Clock: clock.Now,
+		FS:    vfs.NewMem(),
+	}
+	d, err := Open("", opts)
+	require.NoError(t, err)
+
+	require.Regexp(t, `invalid TTL`, d.SetWithTTL([]byte("a"), []byte("1"), 0, nil))
+
+	require.NoError(t, d.Set([]byte("a"), []byte("0"), nil))
+	require.NoError(t, d.SetWithTTL([]byte("a"), []byte("1"), 10*time.Second, nil))
+	require.NoError(t, d.Set([]byte("b"), []byte("2"), nil))
+	require.NoError(t, d.SetWithTTL([]byte("c"), []byte("3"), time.Hour, nil))
+	require.NoError(t, d.SetWithTTL([]byte("d"), []byte("4"), 10*time.Second, nil))
+	require.NoError(t, d.Merge([]byte("d"), []byte("5"), nil))
+
+	scan := func(reverse bool) string {
+		t.Helper()
+		iter := d.NewIter(nil)
+		var keys []string
+		if reverse {
+			for valid := iter.Last(); valid; valid = iter.Prev() {
+				keys = append(keys, string(iter.Key())+":"+string(iter.Value()))
+			}
+		} else {
+			for valid := iter.First(); valid; valid = iter.Next() {
+				keys = append(keys, string(iter.Key())+":"+string(iter.Value()))
+			}
+		}
+		require.NoError(t, iter.Close())
+		return strings.Join(keys, " ")
+	}
+
+	get := func(r Reader, key string) string {
+		t.Helper()
+		v, err := r.Get([]byte(key))
+		if err == ErrNotFound {
+			return "<not found>"
+		}
+		require.NoError(t, err)
+		return string(v)
+	}
+
+	snap := d.NewSnapshot()
+	require.Equal(t, "1", get(d, "a"))
+	require.Equal(t, "54", get(d, "d"))
+	require.Equal(t, "a:1 b:2 c:3 d:54", scan(false))
+	require.Equal(t, "d:54 c:3 b:2 a:1", scan(true))
+
+	// Once the TTL has elapsed the keys are no longer visible, including via
+	// a snapshot that was created before they expired. The expired key
+	// shadows the older value of the key.
+	verifyExpired := func() {
+		t.Helper()
+		require.Equal(t, "<not found>", get(d, "a"))
+		require.Equal(t, "5", get(d, "d"))
+		require.Equal(t, "b:2 c:3 d:5", scan(false))
+		require.Equal(t, "d:5 c:3 b:2", scan(true))
+	}
+	clock.Advance(10 * time.Second)
+	verifyExpired()
+	require.Equal(t, "<not found>", get(snap, "a"))
+
+	// Expiration is also enforced for keys in an indexed batch.
+	b := d.NewIndexedBatch()
+	require.NoError(t, b.SetWithTTL([]byte("e"), []byte("6"), time.Second, nil))
+	require.Equal(t, "6", get(b, "e"))
+	clock.Advance(time.Second)
+	require.Equal(t, "<not found>", get(b, "e"))
+	require.NoError(t, b.Close())
+	require.NoError(t, snap.Close())
+
+	// The expiration time survives replaying the WAL.
+	require.NoError(t, d.Close())
+	d, err = Open("", opts)
+	require.NoError(t, err)
+	verifyExpired()
+	require.NoError(t, d.Close())
+}
+
+func TestSetWithTTLCompaction(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	d, err := Open("", &Options{
+		Clock: clock.Now,
+		FS:    vfs.NewMem(),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, d.Set([]byte("a"), []byte("0"), nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.SetWithTTL([]byte("a"), []byte("1"), 10*time.Second, nil))
+	require.NoError(t, d.SetWithTTL([]byte("b"), []byte("2"), 10*time.Second, nil))
+	require.NoError(t, d.SetWithTTL([]byte("c"), []byte("3"), time.Hour, nil))
+	require.NoError(t, d.Flush())
+
+	// Compact after the keys have expired, and then rewind the clock. The
+	// expired keys must have been dropped by the compaction rather than merely
+	// hidden, while the older value of "a" remains shadowed.
+	clock.Advance(10 * time.Second)
+	require.NoError(t, d.Compact([]byte("a"), []byte("z")))
+	clock.Advance(-10 * time.Second)
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := d.Get([]byte(key)); err != ErrNotFound {
+			t.Fatalf("%s: expected not found, but found %v", key, err)
+		}
+	}
+	v, err := d.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, "3", string(v))
+	require.NoError(t, d.Close())
+}
@@ -0,0 +1,289 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrConflict is returned by Txn.Commit when a key read or written by the
+// transaction was written by another commit after the transaction's snapshot
+// was taken.
+var ErrConflict = errors.New("pebble: transaction conflict")
+
+// errTxnRecheck is returned by the commit-time conflict check of a Txn when
+// the check cannot be completed without reading sstables. The commit is then
+// retried, starting with a full conflict check.
+var errTxnRecheck = errors.New("pebble: transaction conflicts must be rechecked")
+
+// Txn is an optimistic transaction on the default column family. Reads observe
+// the state of the DB as of the transaction's snapshot, along with the
+// transaction's own writes, which are buffered in an indexed batch until the
+// transaction is committed.
+//
+// The keys read with Get and the keys written by the transaction are
+// tracked. When the transaction is committed, the commit fails with
+// ErrConflict if any of the tracked keys was written after the snapshot was
+// taken. Otherwise the transaction's writes are committed atomically. Keys
+// read using an iterator are not tracked.
+//
+// A Txn is not goroutine-safe.
+type Txn struct {
+	db       *DB
+	batch    *Batch
+	snapshot *Snapshot
+	// The user keys read or written by the transaction.
+	keys map[string]struct{}
+}
+
+var _ Reader = (*Txn)(nil)
+
+// NewTxn returns a new optimistic transaction. The transaction must be either
+// committed or closed.
+func (d *DB) NewTxn() *Txn {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	return &Txn{
+		db:       d,
+		batch:    d.NewIndexedBatch(),
+		snapshot: d.NewSnapshot(),
+		keys:     make(map[string]struct{}),
+	}
+}
+
+// Get gets the value for the given key. It returns ErrNotFound if the key
+// does not exist. The key is added to the transaction's read set.
+//
+// The caller should not modify the contents of the returned slice, but it is
+// safe to modify the contents of the argument after Get returns.
+func (t *Txn) Get(key []byte) ([]byte, error) {
+	if t.db == nil {
+		panic(ErrClosed)
+	}
+	t.track(key)
+	return t.db.getInternal(t.db.defaultCF, key, t.batch, t.snapshot)
+}
+
+// NewIter returns an iterator over the transaction's snapshot and its own
+// writes. The keys returned by the iterator are not added to the
+// transaction's read set.
+func (t *Txn) NewIter(o *IterOptions) *Iterator {
+	if t.db == nil {
+		panic(ErrClosed)
+	}
+	return t.db.newIterInternal(t.db.defaultCF, t.batch.newInternalIter(o),
+		t.batch.newRangeDelIter(o), t.snapshot, o)
+}
+
+// Set adds an action to the transaction which sets the key to map to the
+// value.
+//
+// It is safe to modify the contents of the arguments after Set returns.
+func (t *Txn) Set(key, value []byte) error {
+	if t.db == nil {
+		panic(ErrClosed)
+	}
+	t.track(key)
+	return t.batch.Set(key, value, nil)
+}
+
+// Merge adds an action to the transaction which merges the value with the
+// existing value of the key.
+//
+// It is safe to modify the contents of the arguments after Merge returns.
+func (t *Txn) Merge(key, value []byte) error {
+	if t.db == nil {
+		panic(ErrClosed)
+	}
+	t.track(key)
+	return t.batch.Merge(key, value, nil)
+}
+
+// Delete adds an action to the transaction which deletes the key.
+//
+// It is safe to modify the contents of the arguments after Delete returns.
+func (t *Txn) Delete(key []byte) error {
+	if t.db == nil {
+		panic(ErrClosed)
+	}
+	t.track(key)
+	return t.batch.Delete(key, nil)
+}
+
+func (t *Txn) track(key []byte) {
+	if _, ok := t.keys[string(key)]; !ok {
+		t.keys[string(key)] = struct{}{}
+	}
+}
+
+// Commit commits the transaction's writes if none of the keys read or written
+// by the transaction have been written since the transaction's snapshot was
+// taken, and returns ErrConflict otherwise. The transaction is closed
+// regardless of the outcome.
+func (t *Txn) Commit(opts *WriteOptions) error {
+	if t.db == nil {
+		panic(ErrClosed)
+	}
+	d := t.db
+	var err error
+	for {
+		// Check for conflicts before entering the commit pipeline, as doing so
+		// may require reading sstables. Only the writes published after
+		// checkedSeqNum need to be checked while holding commitPipeline.mu,
+		// which is done without I/O by checkRecentConflicts.
+		checkedSeqNum := atomic.LoadUint64(&d.mu.versions.visibleSeqNum)
+		if err = t.checkConflicts(); err != nil {
+			break
+		}
+		err = d.applyInternal(t.batch, opts, func() error {
+			return t.checkRecentConflicts(checkedSeqNum)
+		})
+		if err != errTxnRecheck {
+			break
+		}
+	}
+	return firstError(err, t.Close())
+}
+
+// checkConflicts returns ErrConflict if any of the keys tracked by the
+// transaction has been written since the transaction's snapshot was taken.
+func (t *Txn) checkConflicts() error {
+	d := t.db
+	for key := range t.keys {
+		latest, ok, err := d.latestSeqNum(d.defaultCF, []byte(key))
+		if err != nil {
+			return err
+		}
+		if ok && latest >= t.snapshot.seqNum {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// checkRecentConflicts is like checkConflicts, but only considers the writes
+// with sequence numbers greater than or equal to checkedSeqNum, which were
+// not observed by a prior call to checkConflicts. It is called with
+// commitPipeline.mu held, and therefore only examines the memtables. If one
+// of the keys may have been written to an sstable since checkConflicts was
+// called (e.g. the memtable holding the write was flushed, or an sstable
+// containing the key was ingested), errTxnRecheck is returned.
+func (t *Txn) checkRecentConflicts(checkedSeqNum uint64) error {
+	cf := t.db.defaultCF
+	readState := cf.loadReadState()
+	if readState == nil {
+		return ErrColumnFamilyDropped
+	}
+	defer readState.unref()
+
+	// Gather the sstables which may contain writes that were not observed by
+	// checkConflicts. Only their bounds are examined.
+	var recent []*fileMetadata
+	for level := range readState.current.Files {
+		files := readState.current.Files[level]
+		for i := range files {
+			if files[i].LargestSeqNum >= checkedSeqNum {
+				recent = append(recent, &files[i])
+			}
+		}
+	}
+	mem := make([]flushable, 0, len(readState.memtables))
+	for _, m := range readState.memtables {
+		if f, ok := m.(*ingestedFlushable); ok {
+			for i := range f.files {
+				if f.files[i].LargestSeqNum >= checkedSeqNum {
+					recent = append(recent, &f.files[i])
+				}
+			}
+			continue
+		}
+		mem = append(mem, m)
+	}
+
+	for key := range t.keys {
+		ukey := []byte(key)
+		for _, f := range recent {
+			if cf.cmp(ukey, f.Smallest.UserKey) >= 0 && cf.cmp(ukey, f.Largest.UserKey) <= 0 {
+				return errTxnRecheck
+			}
+		}
+
+		get := &getIter{
+			cmp:      cf.cmp,
+			equal:    cf.equal,
+			snapshot: InternalKeySeqNumMax,
+			key:      ukey,
+			mem:      mem,
+			version:  &version{},
+		}
+		latest, ok, err := latestSeqNumFromIter(get)
+		if err != nil {
+			return err
+		}
+		if ok && latest >= t.snapshot.seqNum {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// Close closes the transaction, discarding its writes if it was not
+// committed.
+func (t *Txn) Close() error {
+	if t.db == nil {
+		return nil
+	}
+	t.batch.release()
+	err := t.snapshot.Close()
+	t.db, t.batch, t.snapshot, t.keys = nil, nil, nil, nil
+	return err
+}
+
+// latestSeqNum returns the sequence number of the most recent write to the key
+// in the specified column family, including range deletions covering the key.
+// False is returned if the key has not been written. Note that the sequence
+// number of the most recent write may have been zeroed by a compaction, which
+// can only happen if the write precedes every open snapshot.
+func (d *DB) latestSeqNum(cf *ColumnFamily, key []byte) (uint64, bool, error) {
+	readState := cf.loadReadState()
+	if readState == nil {
+		return 0, false, ErrColumnFamilyDropped
+	}
+	defer readState.unref()
+
+	get := &getIter{
+		cmp:      cf.cmp,
+		equal:    cf.equal,
+		newIters: cf.newIters,
+		snapshot: InternalKeySeqNumMax,
+		key:      key,
+		prefix:   key,
+		mem:      readState.memtables,
+		l0:       readState.current.Files[0],
+		version:  readState.current,
+	}
+	if cf.split != nil {
+		get.prefix = key[:cf.split(key)]
+	}
+
+	return latestSeqNumFromIter(get)
+}
+
+// latestSeqNumFromIter returns the sequence number of the most recent write
+// to the key of the specified getIter, and closes the iterator.
+func latestSeqNumFromIter(get *getIter) (seqNum uint64, ok bool, err error) {
+	if ikey, _ := get.First(); ikey != nil {
+		seqNum, ok = ikey.SeqNum(), true
+	} else if !get.tombstone.Empty() {
+		// The key is deleted by a range tombstone.
+		seqNum, ok = get.tombstone.Start.SeqNum(), true
+	}
+	if err := get.Close(); err != nil {
+		return 0, false, err
+	}
+	return seqNum, ok, nil
+}
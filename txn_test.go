@@ -0,0 +1,138 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxn(t *testing.T) {
+	d, err := Open("", &Options{
+		FS:       vfs.NewMem(),
+		Comparer: DefaultComparer,
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+
+	get := func(r Reader, key string) string {
+		t.Helper()
+		v, err := r.Get([]byte(key))
+		if err == ErrNotFound {
+			return "<not found>"
+		}
+		require.NoError(t, err)
+		return string(v)
+	}
+
+	require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+	require.NoError(t, d.Set([]byte("b"), []byte("2"), nil))
+
+	// The transaction reads its own writes, and its writes are not visible
+	// until it commits.
+	txn := d.NewTxn()
+	require.Equal(t, "1", get(txn, "a"))
+	require.NoError(t, txn.Set([]byte("a"), []byte("3")))
+	require.NoError(t, txn.Delete([]byte("b")))
+	require.NoError(t, txn.Set([]byte("c"), []byte("4")))
+	require.Equal(t, "3", get(txn, "a"))
+	require.Equal(t, "<not found>", get(txn, "b"))
+	require.Equal(t, "1", get(d, "a"))
+
+	iter := txn.NewIter(nil)
+	var keys []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		keys = append(keys, string(iter.Key())+":"+string(iter.Value()))
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, "a:3 c:4", strings.Join(keys, " "))
+
+	// A write to an unrelated key does not conflict.
+	require.NoError(t, d.Set([]byte("d"), []byte("5"), nil))
+	require.NoError(t, txn.Commit(nil))
+	require.Equal(t, "3", get(d, "a"))
+	require.Equal(t, "<not found>", get(d, "b"))
+	require.Equal(t, "4", get(d, "c"))
+
+	// A write to a key written by the transaction conflicts.
+	txn = d.NewTxn()
+	require.NoError(t, txn.Set([]byte("a"), []byte("6")))
+	require.NoError(t, d.Set([]byte("a"), []byte("7"), nil))
+	require.Equal(t, ErrConflict, txn.Commit(nil))
+	require.Equal(t, "7", get(d, "a"))
+
+	// A write to a key read by the transaction conflicts, even once it has
+	// been flushed.
+	txn = d.NewTxn()
+	require.Equal(t, "4", get(txn, "c"))
+	require.NoError(t, txn.Set([]byte("e"), []byte("8")))
+	require.NoError(t, d.Merge([]byte("c"), []byte("9"), nil))
+	require.NoError(t, d.Flush())
+	require.Equal(t, ErrConflict, txn.Commit(nil))
+	require.Equal(t, "<not found>", get(d, "e"))
+
+	// A range deletion covering a key read by the transaction conflicts.
+	txn = d.NewTxn()
+	require.Equal(t, "<not found>", get(txn, "f"))
+	require.NoError(t, txn.Set([]byte("g"), []byte("10")))
+	require.NoError(t, d.DeleteRange([]byte("a"), []byte("z"), nil))
+	require.Equal(t, ErrConflict, txn.Commit(nil))
+
+	// Writes committed before the transaction's snapshot do not conflict.
+	require.NoError(t, d.Set([]byte("h"), []byte("11"), nil))
+	txn = d.NewTxn()
+	require.Equal(t, "11", get(txn, "h"))
+	require.NoError(t, txn.Set([]byte("h"), []byte("12")))
+	require.NoError(t, txn.Commit(nil))
+	require.Equal(t, "12", get(d, "h"))
+
+	// A closed transaction has no effect.
+	txn = d.NewTxn()
+	require.NoError(t, txn.Set([]byte("i"), []byte("13")))
+	require.NoError(t, txn.Close())
+	require.Equal(t, "<not found>", get(d, "i"))
+}
+
+func TestTxnCheckRecentConflicts(t *testing.T) {
+	d, err := Open("", &Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, d.Close())
+	}()
+
+	visibleSeqNum := func() uint64 {
+		return atomic.LoadUint64(&d.mu.versions.visibleSeqNum)
+	}
+
+	txn := d.NewTxn()
+	_, err = txn.Get([]byte("b"))
+	require.Equal(t, ErrNotFound, err)
+
+	// Writes to other keys in the memtables do not conflict.
+	checkedSeqNum := visibleSeqNum()
+	require.NoError(t, d.Set([]byte("a"), nil, nil))
+	require.NoError(t, d.Set([]byte("c"), nil, nil))
+	require.NoError(t, txn.checkRecentConflicts(checkedSeqNum))
+
+	// Once flushed, the bounds of the sstable overlap the key, which requires
+	// the conflicts to be rechecked.
+	require.NoError(t, d.Flush())
+	require.Equal(t, errTxnRecheck, txn.checkRecentConflicts(checkedSeqNum))
+	require.NoError(t, txn.checkRecentConflicts(visibleSeqNum()))
+
+	// A write to the key in the memtables conflicts.
+	checkedSeqNum = visibleSeqNum()
+	require.NoError(t, d.Set([]byte("b"), nil, nil))
+	require.Equal(t, ErrConflict, txn.checkRecentConflicts(checkedSeqNum))
+	require.Equal(t, ErrConflict, txn.Commit(nil))
+}
@@ -0,0 +1,249 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/record"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// ErrUpdatesUnavailable is returned by an UpdatesIterator when the WAL files
+// containing the requested updates are no longer available.
+var ErrUpdatesUnavailable = errors.New("pebble: updates are no longer available")
+
+// GetUpdatesSince returns an iterator over the batches committed to the DB,
+// in sequence number order, starting with the batch containing seqNum. The
+// batches are read from the WAL files which have not yet been deleted,
+// including those awaiting recycling. Ingested sstables are not returned,
+// even when their ingestion is recorded in the WAL.
+//
+// The iterator returns the batches committed before GetUpdatesSince was
+// called. A batch which has been committed but not yet written to the WAL
+// file may not be returned, so a consumer should resume from the sequence
+// number following the last batch it received.
+//
+// The WAL files are deleted (or recycled) once their contents have been
+// flushed, unless Options.RetainWALs is enabled in which case they are
+// retained until their updates are acknowledged with AcknowledgeUpdates. If
+// the updates starting at seqNum are no longer available the iterator
+// returns ErrUpdatesUnavailable.
+func (d *DB) GetUpdatesSince(seqNum uint64) (*UpdatesIterator, error) {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.opts.DisableWAL {
+		return nil, fmt.Errorf("pebble: GetUpdatesSince requires the WAL")
+	}
+
+	d.mu.Lock()
+	logNums := merge(d.logRecycler.logNums(), d.mu.log.queue)
+	availableSeqNum := d.mu.log.availableSeqNum
+	d.mu.Unlock()
+
+	return &UpdatesIterator{
+		fs:         d.opts.FS,
+		dirname:    d.walDirname,
+		logNums:    logNums,
+		seqNum:     seqNum,
+		endSeqNum:  atomic.LoadUint64(&d.mu.versions.visibleSeqNum),
+		maybeStale: seqNum < availableSeqNum,
+	}, nil
+}
+
+// AcknowledgeUpdates indicates that the updates with sequence numbers less
+// than seqNum have been consumed. When Options.RetainWALs is enabled, the
+// WAL files containing only acknowledged updates become eligible for
+// deletion once their contents have been flushed.
+func (d *DB) AcknowledgeUpdates(seqNum uint64) {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		panic(ErrClosed)
+	}
+	if d.opts.ReadOnly {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if seqNum <= d.mu.log.ackedSeqNum {
+		return
+	}
+	d.mu.log.ackedSeqNum = seqNum
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	d.deleteObsoleteFiles(jobID)
+}
+
+// UpdatesIterator iterates over the batches committed to a DB. See
+// DB.GetUpdatesSince.
+//
+// An UpdatesIterator must be closed after use. It is not goroutine-safe.
+type UpdatesIterator struct {
+	fs      vfs.FS
+	dirname string
+	// The WAL files to read, in increasing order.
+	logNums []uint64
+	// The sequence number of the next update to return.
+	seqNum uint64
+	// The visible sequence number when the iterator was created. Batches with
+	// larger sequence numbers are not returned.
+	endSeqNum uint64
+	// maybeStale is true if the updates starting at seqNum may have been
+	// deleted. It is cleared once a batch with a sequence number less than or
+	// equal to seqNum is encountered, which shows that the WAL files read from
+	// that point on contain every update following seqNum.
+	maybeStale bool
+	file       vfs.File
+	rr         *record.Reader
+	buf        bytes.Buffer
+	batch      Batch
+	err        error
+}
+
+// Next moves the iterator to the next batch, returning false if there are no
+// more batches or an error occurred.
+func (i *UpdatesIterator) Next() bool {
+	if i.err != nil {
+		return false
+	}
+	for {
+		if i.rr == nil {
+			if len(i.logNums) == 0 {
+				if i.maybeStale {
+					i.err = ErrUpdatesUnavailable
+				}
+				return false
+			}
+			if !i.openLog() {
+				if i.err != nil {
+					return false
+				}
+				continue
+			}
+		}
+
+		r, err := i.rr.Next()
+		if err == nil {
+			i.buf.Reset()
+			_, err = io.Copy(&i.buf, r)
+		}
+		if err != nil {
+			// The tail of a WAL file may contain a zeroed or invalid chunk due to WAL
+			// preallocation and recycling, or a partially written record if the WAL
+			// is being written concurrently.
+			switch err {
+			case io.EOF, io.ErrUnexpectedEOF, record.ErrZeroedChunk, record.ErrInvalidChunk:
+				if i.closeLog(); i.err != nil {
+					return false
+				}
+				continue
+			}
+			i.err = err
+			return false
+		}
+		if i.buf.Len() < batchHeaderLen {
+			i.err = fmt.Errorf("pebble: corrupt log file %06d", i.logNums[0])
+			return false
+		}
+
+		i.batch = Batch{}
+		_ = i.batch.SetRepr(i.buf.Bytes())
+		seqNum, count := i.batch.SeqNum(), uint64(i.batch.Count())
+		if seqNum > i.seqNum && i.maybeStale {
+			i.err = ErrUpdatesUnavailable
+			return false
+		}
+		i.maybeStale = false
+		if seqNum >= i.endSeqNum {
+			i.closeLog()
+			i.logNums = nil
+			return false
+		}
+		if seqNum < i.seqNum && seqNum+count <= i.seqNum {
+			// The batch precedes the requested updates.
+			continue
+		}
+		i.seqNum = seqNum + count
+		fileNums, err := ingestedFileNums(&i.batch)
+		if err != nil {
+			i.err = err
+			return false
+		}
+		if fileNums != nil {
+			// The record of sstables ingested into the memtable queue is not an
+			// update committed by a batch.
+			continue
+		}
+		return true
+	}
+}
+
+// openLog opens the next WAL file. Returns false if the WAL file no longer
+// exists or an error occurred.
+func (i *UpdatesIterator) openLog() bool {
+	logNum := i.logNums[0]
+	file, err := i.fs.Open(base.MakeFilename(i.fs, i.dirname, fileTypeLog, logNum))
+	if err != nil {
+		i.logNums = i.logNums[1:]
+		if os.IsNotExist(err) {
+			// The WAL file was deleted or recycled after the iterator was created.
+			// The updates it contained may be required.
+			i.maybeStale = true
+			return false
+		}
+		i.err = err
+		return false
+	}
+	i.file = file
+	i.rr = record.NewReader(file, logNum)
+	return true
+}
+
+func (i *UpdatesIterator) closeLog() {
+	if i.file != nil {
+		i.err = firstError(i.err, i.file.Close())
+		i.file = nil
+	}
+	i.rr = nil
+	if len(i.logNums) > 0 {
+		i.logNums = i.logNums[1:]
+	}
+}
+
+// Batch returns the current batch. The batch is only valid until the next
+// call to Next, and must not be committed. Its contents can be read using
+// Batch.Reader.
+func (i *UpdatesIterator) Batch() *Batch {
+	return &i.batch
+}
+
+// SeqNum returns the sequence number of the first update in the current
+// batch.
+func (i *UpdatesIterator) SeqNum() uint64 {
+	return i.batch.SeqNum()
+}
+
+// Error returns any accumulated error.
+func (i *UpdatesIterator) Error() error {
+	return i.err
+}
+
+// Close closes the iterator and returns any accumulated error.
+func (i *UpdatesIterator) Close() error {
+	if i.file != nil {
+		i.err = firstError(i.err, i.file.Close())
+		i.file = nil
+	}
+	i.rr = nil
+	i.logNums = nil
+	return i.err
+}
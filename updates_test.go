@@ -0,0 +1,165 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetUpdatesSince(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &Options{
+		FS:         mem,
+		RetainWALs: true,
+	}
+	d, err := Open("", opts)
+	require.NoError(t, err)
+
+	updates := func(seqNum uint64) (string, error) {
+		t.Helper()
+		iter, err := d.GetUpdatesSince(seqNum)
+		require.NoError(t, err)
+		var batches []string
+		for iter.Next() {
+			var ops []string
+			for r := iter.Batch().Reader(); ; {
+				kind, ukey, value, ok := r.Next()
+				if !ok {
+					break
+				}
+				ops = append(ops, fmt.Sprintf("%s.%s:%s", ukey, kind, value))
+			}
+			batches = append(batches, fmt.Sprintf("%d:%s", iter.SeqNum(), strings.Join(ops, ",")))
+		}
+		return strings.Join(batches, " "), iter.Close()
+	}
+
+	require.NoError(t, d.Set([]byte("a"), []byte("1"), nil))
+	b := d.NewBatch()
+	require.NoError(t, b.Set([]byte("b"), []byte("2"), nil))
+	require.NoError(t, b.Delete([]byte("c"), nil))
+	require.NoError(t, d.Apply(b, nil))
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.Merge([]byte("d"), []byte("3"), nil))
+	require.NoError(t, d.Flush())
+
+	const all = "0:a.SET:1 1:b.SET:2,c.DEL: 3:d.MERGE:3"
+	for _, c := range []struct {
+		seqNum   uint64
+		expected string
+	}{
+		{0, all},
+		{1, "1:b.SET:2,c.DEL: 3:d.MERGE:3"},
+		{2, "1:b.SET:2,c.DEL: 3:d.MERGE:3"},
+		{3, "3:d.MERGE:3"},
+		{4, ""},
+	} {
+		s, err := updates(c.seqNum)
+		require.NoError(t, err)
+		require.Equal(t, c.expected, s, "seqNum=%d", c.seqNum)
+	}
+
+	// The WALs are retained after reopening the DB.
+	require.NoError(t, d.Close())
+	d, err = Open("", opts)
+	require.NoError(t, err)
+	s, err := updates(0)
+	require.NoError(t, err)
+	require.Equal(t, all, s)
+
+	// The WALs which existed when the DB was opened are retained until all of
+	// the updates committed before it was opened have been acknowledged.
+	require.NoError(t, d.Set([]byte("e"), []byte("4"), nil))
+	require.NoError(t, d.Flush())
+	d.AcknowledgeUpdates(3)
+	s, err = updates(0)
+	require.NoError(t, err)
+	require.Equal(t, all+" 4:e.SET:4", s)
+
+	// Once the updates are acknowledged the WALs containing them are no longer
+	// retained. Their updates remain available until the WALs are reused by
+	// the log recycler.
+	d.AcknowledgeUpdates(4)
+	s, err = updates(0)
+	require.NoError(t, err)
+	require.Equal(t, all+" 4:e.SET:4", s)
+
+	var expected []string
+	for i := 5; i < 10; i++ {
+		require.NoError(t, d.Set([]byte("f"), []byte(fmt.Sprint(i)), nil))
+		require.NoError(t, d.Flush())
+		expected = append(expected, fmt.Sprintf("%d:f.SET:%d", i, i))
+	}
+	_, err = updates(0)
+	require.Equal(t, ErrUpdatesUnavailable, err)
+	s, err = updates(4)
+	require.NoError(t, err)
+	require.Equal(t, "4:e.SET:4 "+strings.Join(expected, " "), s)
+	require.NoError(t, d.Close())
+
+	// The WAL is required.
+	d, err = Open("", &Options{
+		FS:         mem,
+		DisableWAL: true,
+	})
+	require.NoError(t, err)
+	_, err = d.GetUpdatesSince(0)
+	require.Regexp(t, `requires the WAL`, err)
+	require.NoError(t, d.Close())
+}
+
+func TestGetUpdatesSinceIngest(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &Options{
+		FS:         mem,
+		RetainWALs: true,
+	})
+	require.NoError(t, err)
+
+	// An sstable ingested over an overlapping memtable is recorded in the WAL,
+	// but is not returned as an update.
+	require.NoError(t, d.Set([]byte("b"), []byte("1"), nil))
+	f, err := mem.Create("ext")
+	require.NoError(t, err)
+	w := sstable.NewWriter(f, nil, LevelOptions{})
+	require.NoError(t, w.Set([]byte("b"), []byte("2")))
+	require.NoError(t, w.Close())
+	require.NoError(t, d.Ingest([]string{"ext"}))
+	require.NoError(t, d.Set([]byte("c"), []byte("3"), nil))
+
+	for _, c := range []struct {
+		seqNum   uint64
+		expected string
+	}{
+		{0, "0:b.SET:1 2:c.SET:3"},
+		{1, "2:c.SET:3"},
+		{2, "2:c.SET:3"},
+		{3, ""},
+	} {
+		iter, err := d.GetUpdatesSince(c.seqNum)
+		require.NoError(t, err)
+		var batches []string
+		for iter.Next() {
+			var ops []string
+			for r := iter.Batch().Reader(); ; {
+				kind, ukey, value, ok := r.Next()
+				if !ok {
+					break
+				}
+				ops = append(ops, fmt.Sprintf("%s.%s:%s", ukey, kind, value))
+			}
+			batches = append(batches, fmt.Sprintf("%d:%s", iter.SeqNum(), strings.Join(ops, ",")))
+		}
+		require.NoError(t, iter.Close())
+		require.Equal(t, c.expected, strings.Join(batches, " "), "seqNum=%d", c.seqNum)
+	}
+	require.NoError(t, d.Close())
+}
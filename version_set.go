@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sort"
 	"sync"
 	"sync/atomic"
 
@@ -20,6 +21,7 @@ import (
 const numLevels = manifest.NumLevels
 
 // Provide type aliases for the various manifest structs.
+type blobFileMetadata = manifest.BlobFileMetadata
 type bulkVersionEdit = manifest.BulkVersionEdit
 type deletedFileEntry = manifest.DeletedFileEntry
 type fileMetadata = manifest.FileMetadata
@@ -28,11 +30,110 @@ type version = manifest.Version
 type versionEdit = manifest.VersionEdit
 type versionList = manifest.VersionList
 
+// columnFamilyVersions holds the versionSet state for a single column family:
+// the collection of versions making up the column family's LSM, the compaction
+// picker for its current version, and the smallest WAL containing mutations
+// for the column family that have not been flushed. The state for the default
+// column family is embedded in versionSet.
+type columnFamilyVersions struct {
+	id   uint32
+	name string
+	opts *Options
+
+	versions versionList
+	picker   *compactionPicker
+
+	// deletionHints are the hints for the range tombstones written by flushes
+	// and compactions, or ingested, used to pick delete-only compactions. The
+	// hints are not persisted: they are rebuilt from the tables when the DB is
+	// opened (see ColumnFamily.loadDeletionHints).
+	deletionHints []deletionHint
+
+	// levelMetrics points to the per-level metrics for the column family. For
+	// the default column family these are the DB's metrics.
+	levelMetrics *[numLevels]LevelMetrics
+
+	// minUnflushedLogNum is the smallest WAL log file number corresponding to
+	// mutations for the column family that have not been flushed to an
+	// sstable.
+	minUnflushedLogNum uint64
+
+	// A pointer to versionSet.addObsoleteLocked. Avoids allocating a new closure
+	// on the creation of every version.
+	obsoleteFn func(obsoleteTables, obsoleteBlobFiles []uint64)
+}
+
+func (cfv *columnFamilyVersions) init(
+	id uint32, name string, opts *Options, mu *sync.Mutex,
+	obsoleteFn func(obsoleteTables, obsoleteBlobFiles []uint64),
+) {
+	cfv.id = id
+	cfv.name = name
+	cfv.opts = opts
+	cfv.versions.Init(mu)
+	cfv.obsoleteFn = obsoleteFn
+	if cfv.levelMetrics == nil {
+		cfv.levelMetrics = new([numLevels]LevelMetrics)
+	}
+}
+
+func (cfv *columnFamilyVersions) append(v *version) {
+	if v.Refs() != 0 {
+		panic("pebble: version should be unreferenced")
+	}
+	if !cfv.versions.Empty() {
+		cfv.versions.Back().UnrefLocked()
+	}
+	v.Deleted = cfv.obsoleteFn
+	v.Ref()
+	cfv.versions.PushBack(v)
+}
+
+func (cfv *columnFamilyVersions) currentVersion() *version {
+	return cfv.versions.Back()
+}
+
+// updateLevelMetrics adds the metrics updates to the column family's level
+// metrics, and refreshes the file counts and sizes from the specified
+// version.
+func (cfv *columnFamilyVersions) updateLevelMetrics(v *version, updates map[int]*LevelMetrics) {
+	for level, update := range updates {
+		cfv.levelMetrics[level].Add(update)
+	}
+	for i := range cfv.levelMetrics {
+		l := &cfv.levelMetrics[i]
+		l.NumFiles = int64(len(v.Files[i]))
+		l.Size = uint64(totalSize(v.Files[i]))
+	}
+}
+
+func (cfv *columnFamilyVersions) addLiveFileNums(m map[uint64]struct{}) {
+	current := cfv.currentVersion()
+	for v := cfv.versions.Front(); true; v = v.Next() {
+		for _, ff := range v.Files {
+			for _, f := range ff {
+				m[f.FileNum] = struct{}{}
+			}
+		}
+		for _, b := range v.BlobFiles {
+			m[b.FileNum] = struct{}{}
+		}
+		if v == current {
+			break
+		}
+	}
+}
+
 // versionSet manages a collection of immutable versions, and manages the
 // creation of a new version from the most recent version. A new versions is
 // created from an existing version by applying a version edit which is just
 // like it sounds: a delta from the previous version. Version edits are logged
 // to the manifest file, which is replayed at startup.
+//
+// Each column family has its own collection of versions. Version edits are
+// scoped to a single column family (see versionEdit.ColumnFamily), while the
+// manifest, file numbers and sequence numbers are shared by all column
+// families.
 type versionSet struct {
 	// Immutable fields.
 	dirname string
@@ -46,22 +147,22 @@ type versionSet struct {
 	dynamicBaseLevel bool
 
 	// Mutable fields.
-	versions versionList
-	picker   *compactionPicker
+
+	// The state for the default column family.
+	columnFamilyVersions
+	// The state for the non-default column families, indexed by ID.
+	columnFamilies map[uint32]*columnFamilyVersions
+	// The largest column family ID assigned so far. Column family IDs are never
+	// reused.
+	maxColumnFamily uint32
 
 	metrics VersionMetrics
 
-	// A pointer to versionSet.addObsoleteLocked. Avoids allocating a new closure
-	// on the creation of every version.
-	obsoleteFn        func(obsolete []uint64)
 	obsoleteTables    []uint64
+	obsoleteBlobFiles []uint64
 	obsoleteManifests []uint64
 	obsoleteOptions   []uint64
 
-	// minUnflushedLogNum is the smallest WAL log file number corresponding to
-	// mutations that have not been flushed to an sstable.
-	minUnflushedLogNum uint64
-
 	// The next file number. A single counter is used to assign file numbers
 	// for the WAL, MANIFEST, sstable, and OPTIONS files.
 	nextFileNum uint64
@@ -75,12 +176,32 @@ type versionSet struct {
 
 	// The current manifest file number.
 	manifestFileNum uint64
+	// manifestEdits is the number of version edits read from the manifest by
+	// load. A secondary instance resumes reading the manifest from there (see
+	// DB.TryCatchUpWithPrimary).
+	manifestEdits int
 
 	manifestFile vfs.File
 	manifest     *record.Writer
 
 	writing    bool
 	writerCond sync.Cond
+	// manifestErr is the manifestError encountered by a failed write to the
+	// MANIFEST, after which no further version edits are logged.
+	manifestErr error
+}
+
+// manifestError is returned when a write to the MANIFEST fails. The MANIFEST
+// may or may not contain the version edit being logged, so the in-memory
+// state of the versionSet can no longer be reconciled with it. See
+// BackgroundErrorFatal.
+type manifestError struct {
+	op  string
+	err error
+}
+
+func (e *manifestError) Error() string {
+	return fmt.Sprintf("pebble: MANIFEST %s failed: %v", e.op, e.err)
 }
 
 func (vs *versionSet) init(dirname string, opts *Options, mu *sync.Mutex) {
@@ -92,11 +213,48 @@ func (vs *versionSet) init(dirname string, opts *Options, mu *sync.Mutex) {
 	vs.cmp = opts.Comparer.Compare
 	vs.cmpName = opts.Comparer.Name
 	vs.dynamicBaseLevel = true
-	vs.versions.Init(mu)
-	vs.obsoleteFn = vs.addObsoleteLocked
+	vs.levelMetrics = &vs.metrics.Levels
+	vs.columnFamilyVersions.init(0, DefaultColumnFamilyName, opts, mu, vs.addObsoleteLocked)
+	vs.columnFamilies = make(map[uint32]*columnFamilyVersions)
 	vs.nextFileNum = 1
 }
 
+// getColumnFamily returns the state for the column family with the specified
+// ID, or nil if the column family does not exist.
+func (vs *versionSet) getColumnFamily(id uint32) *columnFamilyVersions {
+	if id == 0 {
+		return &vs.columnFamilyVersions
+	}
+	return vs.columnFamilies[id]
+}
+
+// hasColumnFamily returns true if a column family with the specified name
+// exists.
+func (vs *versionSet) hasColumnFamily(name string) bool {
+	if name == DefaultColumnFamilyName {
+		return true
+	}
+	for _, cfv := range vs.columnFamilies {
+		if cfv.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// minLogNumToKeep returns the smallest WAL log file number containing
+// mutations that have not been flushed for any column family. Logs with
+// smaller numbers are no longer needed for recovery.
+func (vs *versionSet) minLogNumToKeep() uint64 {
+	n := vs.minUnflushedLogNum
+	for _, cfv := range vs.columnFamilies {
+		if cfv.minUnflushedLogNum < n {
+			n = cfv.minUnflushedLogNum
+		}
+	}
+	return n
+}
+
 // create creates a version set for a fresh DB.
 func (vs *versionSet) create(
 	jobID int, dirname string, dir vfs.File, opts *Options, mu *sync.Mutex,
@@ -148,39 +306,23 @@ func (vs *versionSet) load(dirname string, opts *Options, mu *sync.Mutex) error
 	vs.init(dirname, opts, mu)
 
 	// Read the CURRENT file to find the current manifest file.
-	current, err := vs.fs.Open(base.MakeFilename(vs.fs, dirname, fileTypeCurrent, 0))
-	if err != nil {
-		return fmt.Errorf("pebble: could not open CURRENT file for DB %q: %v", dirname, err)
-	}
-	defer current.Close()
-	stat, err := current.Stat()
-	if err != nil {
-		return err
-	}
-	n := stat.Size()
-	if n == 0 {
-		return fmt.Errorf("pebble: CURRENT file for DB %q is empty", dirname)
-	}
-	if n > 4096 {
-		return fmt.Errorf("pebble: CURRENT file for DB %q is too large", dirname)
-	}
-	b := make([]byte, n)
-	_, err = current.ReadAt(b, 0)
+	b, manifestFileNum, err := readCurrentFile(vs.fs, dirname)
 	if err != nil {
 		return err
 	}
-	if b[n-1] != '\n' {
-		return fmt.Errorf("pebble: CURRENT file for DB %q is malformed", dirname)
-	}
-	b = bytes.TrimSpace(b)
+	vs.manifestFileNum = manifestFileNum
 
-	var ok bool
-	if _, vs.manifestFileNum, ok = base.ParseFilename(vs.fs, string(b)); !ok {
-		return fmt.Errorf("pebble: MANIFEST name %q is malformed", b)
+	// Read the versionEdits in the manifest file. The edits are accumulated
+	// separately for each column family.
+	type columnFamilyEdits struct {
+		name               string
+		comparerName       string
+		bve                bulkVersionEdit
+		minUnflushedLogNum uint64
+	}
+	cfEdits := map[uint32]*columnFamilyEdits{
+		0: {name: DefaultColumnFamilyName},
 	}
-
-	// Read the versionEdits in the manifest file.
-	var bve bulkVersionEdit
 	manifest, err := vs.fs.Open(vs.fs.PathJoin(dirname, string(b)))
 	if err != nil {
 		return fmt.Errorf("pebble: could not open manifest file %q for DB %q: %v", b, dirname, err)
@@ -200,16 +342,39 @@ func (vs *versionSet) load(dirname string, opts *Options, mu *sync.Mutex) error
 		if err != nil {
 			return err
 		}
-		if ve.ComparerName != "" {
-			if ve.ComparerName != vs.cmpName {
-				return fmt.Errorf("pebble: manifest file %q for DB %q: "+
-					"comparer name from file %q != comparer name from Options %q",
-					b, dirname, ve.ComparerName, vs.cmpName)
+		vs.manifestEdits++
+		if ve.ColumnFamilyAdd != "" {
+			if _, ok := cfEdits[ve.ColumnFamily]; ok || ve.ColumnFamily == 0 {
+				return fmt.Errorf("pebble: manifest file %q for DB %q: column family %d already exists",
+					b, dirname, ve.ColumnFamily)
 			}
+			cfEdits[ve.ColumnFamily] = &columnFamilyEdits{name: ve.ColumnFamilyAdd}
 		}
-		bve.Accumulate(&ve)
-		if ve.MinUnflushedLogNum != 0 {
-			vs.minUnflushedLogNum = ve.MinUnflushedLogNum
+		cfe := cfEdits[ve.ColumnFamily]
+		if cfe == nil {
+			return fmt.Errorf("pebble: manifest file %q for DB %q: unknown column family %d",
+				b, dirname, ve.ColumnFamily)
+		}
+		if ve.ColumnFamilyDrop {
+			if ve.ColumnFamily == 0 {
+				return fmt.Errorf("pebble: manifest file %q for DB %q: cannot drop default column family",
+					b, dirname)
+			}
+			delete(cfEdits, ve.ColumnFamily)
+		} else {
+			if ve.ComparerName != "" {
+				cfe.comparerName = ve.ComparerName
+			}
+			cfe.bve.Accumulate(&ve)
+			if ve.MinUnflushedLogNum != 0 {
+				cfe.minUnflushedLogNum = ve.MinUnflushedLogNum
+			}
+		}
+		if ve.MaxColumnFamily > vs.maxColumnFamily {
+			vs.maxColumnFamily = ve.MaxColumnFamily
+		}
+		if ve.ColumnFamily > vs.maxColumnFamily {
+			vs.maxColumnFamily = ve.ColumnFamily
 		}
 		if ve.NextFileNum != 0 {
 			vs.nextFileNum = ve.NextFileNum
@@ -218,6 +383,13 @@ func (vs *versionSet) load(dirname string, opts *Options, mu *sync.Mutex) error
 			vs.logSeqNum = ve.LastSeqNum
 		}
 	}
+	if name := cfEdits[0].comparerName; name != "" && name != vs.cmpName {
+		return fmt.Errorf("pebble: manifest file %q for DB %q: "+
+			"comparer name from file %q != comparer name from Options %q",
+			b, dirname, name, vs.cmpName)
+	}
+	vs.minUnflushedLogNum = cfEdits[0].minUnflushedLogNum
+
 	// We have already set vs.nextFileNum = 2 at the beginning of the
 	// function and could have only updated it to some other non-zero value,
 	// so it cannot be 0 here.
@@ -230,20 +402,71 @@ func (vs *versionSet) load(dirname string, opts *Options, mu *sync.Mutex) error
 	}
 	vs.markFileNumUsed(vs.minUnflushedLogNum)
 
-	newVersion, err := bve.Apply(nil, vs.cmp, opts.Comparer.Format)
-	if err != nil {
-		return err
+	for id, cfe := range cfEdits {
+		cfv := &vs.columnFamilyVersions
+		if id != 0 {
+			cfOpts := opts.ColumnFamilies[cfe.name]
+			if cfOpts == nil {
+				return fmt.Errorf("pebble: DB %q: no options specified for column family %q "+
+					"(see Options.ColumnFamilies)", dirname, cfe.name)
+			}
+			cfOpts = columnFamilyOptions(opts, cfOpts)
+			if cfe.comparerName != "" && cfe.comparerName != cfOpts.Comparer.Name {
+				return fmt.Errorf("pebble: manifest file %q for DB %q: column family %q: "+
+					"comparer name from file %q != comparer name from Options %q",
+					b, dirname, cfe.name, cfe.comparerName, cfOpts.Comparer.Name)
+			}
+			cfv = &columnFamilyVersions{}
+			cfv.init(id, cfe.name, cfOpts, mu, vs.addObsoleteLocked)
+			cfv.minUnflushedLogNum = cfe.minUnflushedLogNum
+			vs.columnFamilies[id] = cfv
+		}
+
+		newVersion, err := cfe.bve.Apply(nil, cfv.opts.Comparer.Compare, cfv.opts.Comparer.Format)
+		if err != nil {
+			return err
+		}
+		cfv.append(newVersion)
+		cfv.picker = newCompactionPicker(newVersion, cfv.opts)
+		cfv.updateLevelMetrics(newVersion, nil)
 	}
-	vs.append(newVersion)
+	return nil
+}
 
-	vs.picker = newCompactionPicker(newVersion, vs.opts)
+// readCurrentFile reads the CURRENT file of the DB in dirname, returning the
+// name and file number of the current manifest.
+func readCurrentFile(fs vfs.FS, dirname string) (string, uint64, error) {
+	current, err := fs.Open(base.MakeFilename(fs, dirname, fileTypeCurrent, 0))
+	if err != nil {
+		return "", 0, fmt.Errorf("pebble: could not open CURRENT file for DB %q: %v", dirname, err)
+	}
+	defer current.Close()
+	stat, err := current.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	n := stat.Size()
+	if n == 0 {
+		return "", 0, fmt.Errorf("pebble: CURRENT file for DB %q is empty", dirname)
+	}
+	if n > 4096 {
+		return "", 0, fmt.Errorf("pebble: CURRENT file for DB %q is too large", dirname)
+	}
+	b := make([]byte, n)
+	_, err = current.ReadAt(b, 0)
+	if err != nil {
+		return "", 0, err
+	}
+	if b[n-1] != '\n' {
+		return "", 0, fmt.Errorf("pebble: CURRENT file for DB %q is malformed", dirname)
+	}
+	b = bytes.TrimSpace(b)
 
-	for i := range vs.metrics.Levels {
-		l := &vs.metrics.Levels[i]
-		l.NumFiles = int64(len(newVersion.Files[i]))
-		l.Size = uint64(totalSize(newVersion.Files[i]))
+	_, fileNum, ok := base.ParseFilename(fs, string(b))
+	if !ok {
+		return "", 0, fmt.Errorf("pebble: MANIFEST name %q is malformed", b)
 	}
-	return nil
+	return string(b), fileNum, nil
 }
 
 // logAndApply logs the version edit to the manifest, applies the version edit
@@ -267,8 +490,70 @@ func (vs *versionSet) logAndApply(
 		vs.writerCond.Signal()
 	}()
 
+	cfv := vs.getColumnFamily(ve.ColumnFamily)
+	if cfv == nil {
+		return ErrColumnFamilyDropped
+	}
+	return vs.writeAndApply(jobID, cfv, ve, metrics, dir)
+}
+
+// createColumnFamily creates a new column family, logging its creation to the
+// manifest. The mutations for the column family will be written to WALs
+// numbered minUnflushedLogNum or higher. DB.mu must be held when calling this
+// method and will be released temporarily while performing file I/O.
+func (vs *versionSet) createColumnFamily(
+	jobID int, name string, opts *Options, minUnflushedLogNum uint64, dir vfs.File,
+) (*columnFamilyVersions, error) {
+	for vs.writing {
+		vs.writerCond.Wait()
+	}
+	vs.writing = true
+	defer func() {
+		vs.writing = false
+		vs.writerCond.Signal()
+	}()
+
+	if name == vs.name {
+		return nil, fmt.Errorf("pebble: column family %q already exists", name)
+	}
+	for _, cfv := range vs.columnFamilies {
+		if cfv.name == name {
+			return nil, fmt.Errorf("pebble: column family %q already exists", name)
+		}
+	}
+
+	id := vs.maxColumnFamily + 1
+	cfv := &columnFamilyVersions{}
+	cfv.init(id, name, opts, vs.mu, vs.addObsoleteLocked)
+	ve := &versionEdit{
+		ComparerName:       opts.Comparer.Name,
+		MinUnflushedLogNum: minUnflushedLogNum,
+		ColumnFamily:       id,
+		ColumnFamilyAdd:    name,
+		MaxColumnFamily:    id,
+	}
+	if err := vs.writeAndApply(jobID, cfv, ve, nil, dir); err != nil {
+		return nil, err
+	}
+	vs.maxColumnFamily = id
+	vs.columnFamilies[id] = cfv
+	return cfv, nil
+}
+
+// writeAndApply implements logAndApply for the specified column family. The
+// caller must have marked the manifest as busy (versionSet.writing).
+func (vs *versionSet) writeAndApply(
+	jobID int,
+	cfv *columnFamilyVersions,
+	ve *versionEdit,
+	metrics map[int]*LevelMetrics,
+	dir vfs.File,
+) error {
+	if vs.manifestErr != nil {
+		return vs.manifestErr
+	}
 	if ve.MinUnflushedLogNum != 0 {
-		if ve.MinUnflushedLogNum < vs.minUnflushedLogNum ||
+		if ve.MinUnflushedLogNum < cfv.minUnflushedLogNum ||
 			vs.nextFileNum <= ve.MinUnflushedLogNum {
 			panic(fmt.Sprintf("pebble: inconsistent versionEdit minUnflushedLogNum %d",
 				ve.MinUnflushedLogNum))
@@ -284,7 +569,10 @@ func (vs *versionSet) logAndApply(
 	// LastSeqNum is set to the current upper bound on the assigned sequence
 	// numbers.
 	ve.LastSeqNum = atomic.LoadUint64(&vs.logSeqNum)
-	currentVersion := vs.currentVersion()
+	var currentVersion *version
+	if !cfv.versions.Empty() {
+		currentVersion = cfv.currentVersion()
+	}
 	var newVersion *version
 
 	// Generate a new manifest if we don't currently have one, or the current one
@@ -299,13 +587,15 @@ func (vs *versionSet) logAndApply(
 		vs.mu.Unlock()
 		defer vs.mu.Lock()
 
-		var bve bulkVersionEdit
-		bve.Accumulate(ve)
+		if !ve.ColumnFamilyDrop {
+			var bve bulkVersionEdit
+			bve.Accumulate(ve)
 
-		var err error
-		newVersion, err = bve.Apply(currentVersion, vs.cmp, vs.opts.Comparer.Format)
-		if err != nil {
-			return err
+			var err error
+			newVersion, err = bve.Apply(currentVersion, cfv.opts.Comparer.Compare, cfv.opts.Comparer.Format)
+			if err != nil {
+				return err
+			}
 		}
 
 		if newManifestFileNum != 0 {
@@ -330,25 +620,20 @@ func (vs *versionSet) logAndApply(
 		// database is open. In particular, that mechanism generates a new MANIFEST
 		// and ensures it is synced.
 		if err := ve.Encode(w); err != nil {
-			vs.opts.Logger.Fatalf("MANIFEST write failed: %v", err)
-			return err
+			return &manifestError{op: "write", err: err}
 		}
 		if err := vs.manifest.Flush(); err != nil {
-			vs.opts.Logger.Fatalf("MANIFEST flush failed: %v", err)
-			return err
+			return &manifestError{op: "flush", err: err}
 		}
 		if err := vs.manifestFile.Sync(); err != nil {
-			vs.opts.Logger.Fatalf("MANIFEST sync failed: %v", err)
-			return err
+			return &manifestError{op: "sync", err: err}
 		}
 		if newManifestFileNum != 0 {
 			if err := setCurrentFile(vs.dirname, vs.fs, newManifestFileNum); err != nil {
-				vs.opts.Logger.Fatalf("MANIFEST set current failed: %v", err)
-				return err
+				return &manifestError{op: "set current", err: err}
 			}
 			if err := dir.Sync(); err != nil {
-				vs.opts.Logger.Fatalf("MANIFEST dirsync failed: %v", err)
-				return err
+				return &manifestError{op: "dirsync", err: err}
 			}
 			vs.opts.EventListener.ManifestCreated(ManifestCreateInfo{
 				JobID:   jobID,
@@ -356,38 +641,45 @@ func (vs *versionSet) logAndApply(
 				FileNum: newManifestFileNum,
 			})
 		}
-		picker = newCompactionPicker(newVersion, vs.opts)
-		if !vs.dynamicBaseLevel {
-			picker.baseLevel = 1
+		if newVersion != nil {
+			picker = newCompactionPicker(newVersion, cfv.opts)
+			if !vs.dynamicBaseLevel {
+				picker.baseLevel = 1
+			}
 		}
 		return nil
 	}(); err != nil {
+		if _, ok := err.(*manifestError); ok {
+			vs.manifestErr = err
+		}
 		return err
 	}
 
-	// Install the new version.
-	vs.append(newVersion)
-	if ve.MinUnflushedLogNum != 0 {
-		vs.minUnflushedLogNum = ve.MinUnflushedLogNum
-	}
 	if newManifestFileNum != 0 {
 		if vs.manifestFileNum != 0 {
 			vs.obsoleteManifests = append(vs.obsoleteManifests, vs.manifestFileNum)
 		}
 		vs.manifestFileNum = newManifestFileNum
 	}
-	vs.picker = picker
 
-	if metrics != nil {
-		for level, update := range metrics {
-			vs.metrics.Levels[level].Add(update)
+	if ve.ColumnFamilyDrop {
+		// Release the reference the versionSet holds on the current version of
+		// the dropped column family. Its files become obsolete once the
+		// remaining readers release their references.
+		delete(vs.columnFamilies, cfv.id)
+		if currentVersion != nil {
+			currentVersion.UnrefLocked()
 		}
+		return nil
 	}
-	for i := range vs.metrics.Levels {
-		l := &vs.metrics.Levels[i]
-		l.NumFiles = int64(len(newVersion.Files[i]))
-		l.Size = uint64(totalSize(newVersion.Files[i]))
+
+	// Install the new version.
+	cfv.append(newVersion)
+	if ve.MinUnflushedLogNum != 0 {
+		cfv.minUnflushedLogNum = ve.MinUnflushedLogNum
 	}
+	cfv.picker = picker
+	cfv.updateLevelMetrics(newVersion, metrics)
 	return nil
 }
 
@@ -415,24 +707,57 @@ func (vs *versionSet) createManifest(dirname string, fileNum uint64) (err error)
 	}
 	manifest = record.NewWriter(manifestFile)
 
-	snapshot := versionEdit{
-		ComparerName: vs.cmpName,
-	}
-	for level, fileMetadata := range vs.currentVersion().Files {
-		for _, meta := range fileMetadata {
-			snapshot.NewFiles = append(snapshot.NewFiles, newFileEntry{
-				Level: level,
-				Meta:  meta,
+	snapshots := []versionEdit{{
+		ComparerName:       vs.cmpName,
+		MinUnflushedLogNum: vs.minUnflushedLogNum,
+		MaxColumnFamily:    vs.maxColumnFamily,
+	}}
+	addFiles := func(snapshot *versionEdit, v *version) {
+		for level, fileMetadata := range v.Files {
+			for _, meta := range fileMetadata {
+				snapshot.NewFiles = append(snapshot.NewFiles, newFileEntry{
+					Level: level,
+					Meta:  meta,
+				})
+			}
+		}
+		for _, b := range v.BlobFiles {
+			snapshot.NewBlobFiles = append(snapshot.NewBlobFiles, blobFileMetadata{
+				FileNum: b.FileNum,
+				Size:    b.Size,
 			})
 		}
 	}
+	addFiles(&snapshots[0], vs.currentVersion())
 
-	w, err1 := manifest.Next()
-	if err1 != nil {
-		return err1
+	// Each non-default column family is recorded with an edit that recreates
+	// it, in increasing order of column family ID.
+	ids := make([]uint32, 0, len(vs.columnFamilies))
+	for id := range vs.columnFamilies {
+		ids = append(ids, id)
 	}
-	if err := snapshot.Encode(w); err != nil {
-		return err
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	for _, id := range ids {
+		cfv := vs.columnFamilies[id]
+		snapshots = append(snapshots, versionEdit{
+			ComparerName:       cfv.opts.Comparer.Name,
+			MinUnflushedLogNum: cfv.minUnflushedLogNum,
+			ColumnFamily:       id,
+			ColumnFamilyAdd:    cfv.name,
+		})
+		addFiles(&snapshots[len(snapshots)-1], cfv.currentVersion())
+	}
+
+	for i := range snapshots {
+		w, err1 := manifest.Next()
+		if err1 != nil {
+			return err1
+		}
+		if err := snapshots[i].Encode(w); err != nil {
+			return err
+		}
 	}
 
 	vs.manifest, manifest = manifest, nil
@@ -452,36 +777,14 @@ func (vs *versionSet) getNextFileNum() uint64 {
 	return x
 }
 
-func (vs *versionSet) append(v *version) {
-	if v.Refs() != 0 {
-		panic("pebble: version should be unreferenced")
-	}
-	if !vs.versions.Empty() {
-		vs.versions.Back().UnrefLocked()
-	}
-	v.Deleted = vs.obsoleteFn
-	v.Ref()
-	vs.versions.PushBack(v)
-}
-
-func (vs *versionSet) currentVersion() *version {
-	return vs.versions.Back()
-}
-
 func (vs *versionSet) addLiveFileNums(m map[uint64]struct{}) {
-	current := vs.currentVersion()
-	for v := vs.versions.Front(); true; v = v.Next() {
-		for _, ff := range v.Files {
-			for _, f := range ff {
-				m[f.FileNum] = struct{}{}
-			}
-		}
-		if v == current {
-			break
-		}
+	vs.columnFamilyVersions.addLiveFileNums(m)
+	for _, cfv := range vs.columnFamilies {
+		cfv.addLiveFileNums(m)
 	}
 }
 
-func (vs *versionSet) addObsoleteLocked(obsolete []uint64) {
-	vs.obsoleteTables = append(vs.obsoleteTables, obsolete...)
+func (vs *versionSet) addObsoleteLocked(obsoleteTables, obsoleteBlobFiles []uint64) {
+	vs.obsoleteTables = append(vs.obsoleteTables, obsoleteTables...)
+	vs.obsoleteBlobFiles = append(vs.obsoleteBlobFiles, obsoleteBlobFiles...)
 }
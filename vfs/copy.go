@@ -0,0 +1,62 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+// Copy copies the contents of oldname to newname. If newname exists, it will
+// be overwritten.
+func Copy(fs FS, oldname, newname string) error {
+	return LimitedCopy(fs, oldname, newname, -1)
+}
+
+// LimitedCopy copies up to maxBytes from oldname to newname. If maxBytes is
+// negative the entire file is copied. If newname exists, it will be
+// overwritten.
+func LimitedCopy(fs FS, oldname, newname string, maxBytes int64) error {
+	src, err := fs.Open(oldname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := fs.Create(newname)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = src
+	if maxBytes >= 0 {
+		r = io.LimitReader(src, maxBytes)
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// LinkOrCopy creates newname as a hard link to the oldname file. If creating
+// the hard link fails, LinkOrCopy falls back to copying the file (which may
+// also fail if oldname doesn't exist or newname already exists).
+func LinkOrCopy(fs FS, oldname, newname string) error {
+	err := fs.Link(oldname, newname)
+	if err == nil {
+		return nil
+	}
+	// Permit a handful of errors which we know won't be fixed by copying the
+	// file. Note that we don't check for the specifics of the error code as it
+	// isn't easy to do so in a portable manner.
+	if os.IsNotExist(err) || os.IsExist(err) {
+		return err
+	}
+	return Copy(fs, oldname, newname)
+}
@@ -0,0 +1,17 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// +build !darwin,!freebsd,!linux
+
+package vfs
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func (defaultFS) GetDiskUsage(path string) (DiskUsage, error) {
+	return DiskUsage{}, fmt.Errorf("pebble: disk usage is not implemented on %s/%s",
+		runtime.GOOS, runtime.GOARCH)
+}
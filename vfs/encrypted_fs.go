@@ -0,0 +1,623 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package vfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// EncryptionRegistryFilename is the name of the file, within the directory
+// passed to NewEncryptedFS, which holds the per-file keys of an encrypted FS.
+const EncryptionRegistryFilename = "ENCRYPTION-REGISTRY"
+
+const (
+	registryVersion = 1
+	ivLen           = aes.BlockSize
+)
+
+var errCorruptRegistry = errors.New("pebble: corrupt encryption registry")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// EncryptionKey is a key used by an encrypted FS to protect the per-file keys
+// stored in its registry.
+type EncryptionKey struct {
+	// ID uniquely identifies the key. The ID is stored in the registry
+	// alongside the per-file keys protected by the key, allowing the key to be
+	// retrieved with KeyManager.GetKey.
+	ID string
+	// Key is the AES key, which must be 16, 24 or 32 bytes long in order to
+	// select AES-128, AES-192 or AES-256.
+	Key []byte
+}
+
+// KeyManager provides the keys used by an encrypted FS.
+//
+// Each file is encrypted with its own randomly generated key (of the same
+// length as the active key). The per-file keys are in turn encrypted with
+// the active key before being stored in the registry. Keys are rotated by
+// changing the active key: new files are protected by the new active key, and
+// the per-file keys of existing files are re-encrypted with the new active key
+// the next time the registry is written (i.e. when a file is created,
+// removed, renamed or linked, or when the encrypted FS is opened). A key that
+// is no longer active must remain available via GetKey until that has
+// happened.
+type KeyManager interface {
+	// ActiveKey returns the key to use for protecting per-file keys.
+	ActiveKey() (*EncryptionKey, error)
+
+	// GetKey returns the key with the specified ID.
+	GetKey(id string) (*EncryptionKey, error)
+}
+
+// fileCipher encrypts and decrypts the contents of a file using AES in
+// counter (CTR) mode. CTR mode allows any offset within the file to be
+// encrypted or decrypted independently, which is required to support
+// File.ReadAt.
+type fileCipher struct {
+	key   []byte
+	iv    []byte
+	block cipher.Block
+}
+
+func newFileCipher(key, iv []byte) (*fileCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != ivLen {
+		return nil, fmt.Errorf("pebble: invalid IV length %d", len(iv))
+	}
+	return &fileCipher{key: key, iv: iv, block: block}, nil
+}
+
+// xorAt encrypts (or decrypts) src, which is located at the specified offset
+// within the file, into dst. Dst and src must overlap entirely or not at all.
+func (c *fileCipher) xorAt(dst, src []byte, offset int64) {
+	if len(src) == 0 {
+		return
+	}
+	// The counter for the block containing offset is the IV plus the block
+	// number, treating both as 128-bit big-endian integers.
+	var counter [ivLen]byte
+	copy(counter[:], c.iv)
+	carry := uint64(offset / ivLen)
+	for i := ivLen - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(c.block, counter[:])
+	if skip := offset % ivLen; skip > 0 {
+		var discard [ivLen]byte
+		stream.XORKeyStream(discard[:skip], discard[:skip])
+	}
+	stream.XORKeyStream(dst, src)
+}
+
+// encryptedFile is a File whose contents are encrypted with a fileCipher.
+type encryptedFile struct {
+	File
+	cipher *fileCipher
+	// offset is the offset of the next Read or Write. As with *os.File, Read
+	// and Write share the offset.
+	offset int64
+	// buf holds the encrypted data for Write, which must not modify its
+	// argument.
+	buf []byte
+}
+
+func (f *encryptedFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.cipher.xorAt(p[:n], p[:n], f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	f.cipher.xorAt(p[:n], p[:n], off)
+	return n, err
+}
+
+func (f *encryptedFile) Write(p []byte) (int, error) {
+	f.buf = append(f.buf[:0], p...)
+	f.cipher.xorAt(f.buf, f.buf, f.offset)
+	n, err := f.File.Write(f.buf)
+	f.offset += int64(n)
+	return n, err
+}
+
+// encryptedFS is an FS which encrypts the contents of the files it creates.
+// See NewEncryptedFS.
+type encryptedFS struct {
+	FS
+	keyManager   KeyManager
+	dir          string
+	registryPath string
+
+	mu sync.Mutex
+	// files maps the name of each encrypted file to its cipher. Files which
+	// are not present in the map are not encrypted.
+	files map[string]*fileCipher
+	// registryFile is the registry file, to which a record is appended for
+	// each change to files.
+	registryFile File
+	// registryKeyID is the ID of the key which protects the per-file keys
+	// recorded in the registry file, and registryRecords is the number of
+	// records in the registry file. Once either the active key changes or the
+	// records greatly outnumber the files, the registry is rewritten.
+	registryKeyID   string
+	registryRecords int
+}
+
+// NewEncryptedFS returns an FS which encrypts the contents of files created
+// through it, using AES in counter mode, before writing them to the
+// underlying FS. Each file is encrypted with its own randomly generated key
+// and IV, which are recorded in a registry stored in the specified directory
+// (see EncryptionRegistryFilename). The per-file keys are protected by the
+// keys provided by the KeyManager.
+//
+// Encryption does not change the size of a file or the offsets within it, so
+// files support random reads (File.ReadAt) as well as sequential reads and
+// appends. Files which were not created through the encrypted FS (e.g. files
+// that were present before encryption was enabled) are read unencrypted.
+func NewEncryptedFS(fs FS, dir string, keyManager KeyManager) (FS, error) {
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	e := &encryptedFS{
+		FS:           fs,
+		keyManager:   keyManager,
+		dir:          dir,
+		registryPath: fs.PathJoin(dir, EncryptionRegistryFilename),
+		files:        make(map[string]*fileCipher),
+	}
+	if err := e.loadRegistry(); err != nil {
+		return nil, err
+	}
+	// The registry is rewritten in order to discard the records which are no
+	// longer needed, along with a record which may have been torn by a crash.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.writeRegistryLocked(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *encryptedFS) Create(name string) (File, error) {
+	active, err := e.keyManager.ActiveKey()
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, len(active.Key))
+	iv := make([]byte, ivLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	c, err := newFileCipher(key, iv)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := e.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key is registered once the file has been created. The file is empty
+	// until Create returns, so it is readable if a crash occurs before the key
+	// is registered.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	prev, existed := e.files[name]
+	e.files[name] = c
+	if err := e.logLocked(name); err != nil {
+		if existed {
+			e.files[name] = prev
+		} else {
+			delete(e.files, name)
+		}
+		f.Close()
+		return nil, err
+	}
+	return &encryptedFile{File: f, cipher: c}, nil
+}
+
+func (e *encryptedFS) Link(oldname, newname string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// The new name is registered before the link is created so that the file is
+	// readable under either name if a crash occurs.
+	prev, err := e.registerLocked(oldname, newname)
+	if err != nil {
+		return err
+	}
+	if err := e.FS.Link(oldname, newname); err != nil {
+		e.unregisterLocked(newname, prev)
+		return err
+	}
+	return nil
+}
+
+func (e *encryptedFS) Open(name string, opts ...OpenOption) (File, error) {
+	f, err := e.FS.Open(name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	c, ok := e.files[name]
+	e.mu.Unlock()
+	if !ok {
+		return f, nil
+	}
+	return &encryptedFile{File: f, cipher: c}, nil
+}
+
+func (e *encryptedFS) Remove(name string) error {
+	if err := e.FS.Remove(name); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.files[name]; !ok {
+		return nil
+	}
+	delete(e.files, name)
+	return e.logLocked(name)
+}
+
+func (e *encryptedFS) Rename(oldname, newname string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// The new name is registered before the rename is performed so that the
+	// file is readable whether or not the rename occurred if a crash occurs.
+	// The old name is unregistered afterwards.
+	prev, err := e.registerLocked(oldname, newname)
+	if err != nil {
+		return err
+	}
+	if err := e.FS.Rename(oldname, newname); err != nil {
+		e.unregisterLocked(newname, prev)
+		return err
+	}
+	if _, ok := e.files[oldname]; !ok {
+		return nil
+	}
+	delete(e.files, oldname)
+	return e.logLocked(oldname)
+}
+
+// registerLocked registers newname as having the same encryption as oldname
+// (which may be unencrypted), in preparation for oldname being renamed or
+// linked to newname. The previous cipher of newname, if any, is returned so
+// that the registration can be undone with unregisterLocked if the rename or
+// link fails. e.mu must be held.
+func (e *encryptedFS) registerLocked(oldname, newname string) (*fileCipher, error) {
+	c, ok := e.files[oldname]
+	prev, existed := e.files[newname]
+	if !ok && !existed {
+		return nil, nil
+	}
+	if ok {
+		e.files[newname] = c
+	} else {
+		delete(e.files, newname)
+	}
+	if err := e.logLocked(newname); err != nil {
+		if existed {
+			e.files[newname] = prev
+		} else {
+			delete(e.files, newname)
+		}
+		return nil, err
+	}
+	return prev, nil
+}
+
+// unregisterLocked restores the previous cipher of newname, undoing
+// registerLocked. Failing to record the restored cipher is not reported, as
+// the rename or link has already failed. e.mu must be held.
+func (e *encryptedFS) unregisterLocked(newname string, prev *fileCipher) {
+	if c := e.files[newname]; c == prev {
+		return
+	}
+	if prev != nil {
+		e.files[newname] = prev
+	} else {
+		delete(e.files, newname)
+	}
+	_ = e.logLocked(newname)
+}
+
+// Registry records. The registry file begins with a byte holding the registry
+// version, followed by a record for each change to the registered files (see
+// appendRecord). A set record registers the cipher of a file and a delete
+// record unregisters a file.
+const (
+	registryRecordSet    = 1
+	registryRecordDelete = 2
+)
+
+// registryRewriteSlack is the number of records by which the records in the
+// registry file may exceed twice the number of registered files before the
+// registry is rewritten.
+const registryRewriteSlack = 1000
+
+// loadRegistry reads the registry, if it exists, decrypting the per-file keys
+// it contains.
+func (e *encryptedFS) loadRegistry() error {
+	f, err := e.FS.Open(e.registryPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(data) < 1 {
+		return errCorruptRegistry
+	}
+	if data[0] != registryVersion {
+		return fmt.Errorf("pebble: unknown encryption registry version %d", data[0])
+	}
+	for b := data[1:]; len(b) > 0; {
+		n, varIntLen := binary.Uvarint(b)
+		if varIntLen <= 0 || n > uint64(len(b)-varIntLen) || uint64(len(b)-varIntLen)-n < 4 {
+			// A record which was torn by a crash is treated as the end of the
+			// registry. The change it recorded was not acknowledged.
+			if varIntLen < 0 {
+				return errCorruptRegistry
+			}
+			return nil
+		}
+		rec := b[varIntLen : varIntLen+int(n)]
+		b = b[varIntLen+int(n):]
+		if crc32.Checksum(rec, crcTable) != binary.LittleEndian.Uint32(b) {
+			if len(b) == 4 {
+				// The final record was torn by a crash.
+				return nil
+			}
+			return errCorruptRegistry
+		}
+		b = b[4:]
+		if err := e.decodeRecord(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendRecord appends the framing of the specified record to dst: the
+// varint-encoded length of the record, the record and its checksum.
+func appendRecord(dst, rec []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(rec)))
+	dst = append(dst, tmp[:n]...)
+	dst = append(dst, rec...)
+	binary.LittleEndian.PutUint32(tmp[:4], crc32.Checksum(rec, crcTable))
+	return append(dst, tmp[:4]...)
+}
+
+// decodeRecord applies the specified registry record to files.
+func (e *encryptedFS) decodeRecord(data []byte) error {
+	if len(data) == 0 {
+		return errCorruptRegistry
+	}
+	r := bytes.NewReader(data[1:])
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errCorruptRegistry
+		}
+		if n > uint64(r.Len()) {
+			return nil, errCorruptRegistry
+		}
+		b := make([]byte, n)
+		_, _ = io.ReadFull(r, b)
+		return b, nil
+	}
+
+	switch data[0] {
+	case registryRecordSet:
+		var fields [5][]byte
+		for j := range fields {
+			var err error
+			if fields[j], err = readBytes(); err != nil {
+				return err
+			}
+		}
+		if r.Len() != 0 {
+			return errCorruptRegistry
+		}
+		name, keyID, wrapIV, wrappedKey, iv := fields[0], fields[1], fields[2], fields[3], fields[4]
+
+		k, err := e.keyManager.GetKey(string(keyID))
+		if err != nil {
+			return err
+		}
+		wrap, err := newFileCipher(k.Key, wrapIV)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, len(wrappedKey))
+		wrap.xorAt(key, wrappedKey, 0)
+		c, err := newFileCipher(key, iv)
+		if err != nil {
+			return err
+		}
+		e.files[string(name)] = c
+
+	case registryRecordDelete:
+		name, err := readBytes()
+		if err != nil {
+			return err
+		}
+		if r.Len() != 0 {
+			return errCorruptRegistry
+		}
+		delete(e.files, string(name))
+
+	default:
+		return errCorruptRegistry
+	}
+	return nil
+}
+
+// encodeRecordLocked encodes a record registering the current cipher of the
+// specified file, or unregistering the file if it is not encrypted. The
+// per-file key is encrypted with the specified key. e.mu must be held.
+func (e *encryptedFS) encodeRecordLocked(name string, key *EncryptionKey) ([]byte, error) {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	writeBytes := func(b []byte) {
+		n := binary.PutUvarint(tmp[:], uint64(len(b)))
+		buf.Write(tmp[:n])
+		buf.Write(b)
+	}
+
+	c, ok := e.files[name]
+	if !ok {
+		buf.WriteByte(registryRecordDelete)
+		writeBytes([]byte(name))
+		return buf.Bytes(), nil
+	}
+
+	wrapIV := make([]byte, ivLen)
+	if _, err := rand.Read(wrapIV); err != nil {
+		return nil, err
+	}
+	wrap, err := newFileCipher(key.Key, wrapIV)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey := make([]byte, len(c.key))
+	wrap.xorAt(wrappedKey, c.key, 0)
+
+	buf.WriteByte(registryRecordSet)
+	writeBytes([]byte(name))
+	writeBytes([]byte(key.ID))
+	writeBytes(wrapIV)
+	writeBytes(wrappedKey)
+	writeBytes(c.iv)
+	return buf.Bytes(), nil
+}
+
+// logLocked appends a record of the current registration of the specified
+// file to the registry and syncs it. If the active key has changed, or the
+// registry contains many records which are no longer needed, the registry is
+// rewritten instead. e.mu must be held.
+func (e *encryptedFS) logLocked(name string) error {
+	active, err := e.keyManager.ActiveKey()
+	if err != nil {
+		return err
+	}
+	if active.ID != e.registryKeyID ||
+		e.registryRecords >= 2*len(e.files)+registryRewriteSlack {
+		return e.writeRegistryLocked()
+	}
+
+	rec, err := e.encodeRecordLocked(name, active)
+	if err != nil {
+		return err
+	}
+	if _, err := e.registryFile.Write(appendRecord(nil, rec)); err != nil {
+		return err
+	}
+	if err := e.registryFile.Sync(); err != nil {
+		return err
+	}
+	e.registryRecords++
+	return nil
+}
+
+// writeRegistryLocked rewrites the registry, encrypting the per-file keys with
+// the active key. The registry is written to a temporary file which is then
+// atomically renamed over the existing registry. Subsequent records are
+// appended to the new registry. e.mu must be held.
+func (e *encryptedFS) writeRegistryLocked() (err error) {
+	active, err := e.keyManager.ActiveKey()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(e.files))
+	for name := range e.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := []byte{registryVersion}
+	for _, name := range names {
+		rec, err := e.encodeRecordLocked(name, active)
+		if err != nil {
+			return err
+		}
+		buf = appendRecord(buf, rec)
+	}
+
+	tmpPath := e.registryPath + ".tmp"
+	// Create does not necessarily truncate an existing file.
+	_ = e.FS.Remove(tmpPath)
+	f, err := e.FS.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := e.FS.Rename(tmpPath, e.registryPath); err != nil {
+		return err
+	}
+	dir, err := e.FS.OpenDir(e.dir)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	if err := dir.Close(); err != nil {
+		return err
+	}
+
+	if e.registryFile != nil {
+		e.registryFile.Close()
+	}
+	e.registryFile = f
+	e.registryKeyID = active.ID
+	e.registryRecords = len(names)
+	return nil
+}
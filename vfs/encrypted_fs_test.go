@@ -0,0 +1,272 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+type testKeyManager struct {
+	active string
+	keys   map[string]*EncryptionKey
+}
+
+func newTestKeyManager(ids ...string) *testKeyManager {
+	m := &testKeyManager{keys: make(map[string]*EncryptionKey)}
+	for _, id := range ids {
+		m.addKey(id)
+	}
+	return m
+}
+
+func (m *testKeyManager) addKey(id string) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	m.keys[id] = &EncryptionKey{ID: id, Key: key}
+	m.active = id
+}
+
+func (m *testKeyManager) ActiveKey() (*EncryptionKey, error) {
+	return m.GetKey(m.active)
+}
+
+func (m *testKeyManager) GetKey(id string) (*EncryptionKey, error) {
+	k, ok := m.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return k, nil
+}
+
+func writeFile(t *testing.T, fs FS, name string, data []byte) {
+	t.Helper()
+	f, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write the data in randomly sized pieces in order to exercise encrypting
+	// at offsets which are not aligned to the AES block size.
+	for b := data; len(b) > 0; {
+		n := 1 + rand.Intn(len(b))
+		if _, err := f.Write(b[:n]); err != nil {
+			t.Fatal(err)
+		}
+		b = b[n:]
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs FS, name string) []byte {
+	t.Helper()
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncryptedFS(t *testing.T) {
+	mem := NewMem()
+	km := newTestKeyManager("key1")
+	fs, err := NewEncryptedFS(mem, "/", km)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 10000)
+	rand.Read(data)
+	writeFile(t, fs, "/foo", data)
+
+	if got := readFile(t, fs, "/foo"); !bytes.Equal(data, got) {
+		t.Fatalf("contents of /foo do not match")
+	}
+	raw := readFile(t, mem, "/foo")
+	if len(raw) != len(data) {
+		t.Fatalf("expected %d bytes on disk, but found %d", len(data), len(raw))
+	}
+	if bytes.Equal(data, raw) {
+		t.Fatalf("/foo is not encrypted")
+	}
+
+	f, err := fs.Open("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		off := rand.Intn(len(data))
+		buf := make([]byte, rand.Intn(len(data)-off)+1)
+		if _, err := f.ReadAt(buf, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[off:off+len(buf)], buf) {
+			t.Fatalf("ReadAt(%d, %d): contents do not match", off, len(buf))
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files created directly in the underlying FS are not encrypted.
+	writeFile(t, mem, "/plain", []byte("hello"))
+	if got := readFile(t, fs, "/plain"); string(got) != "hello" {
+		t.Fatalf("expected hello, but found %q", got)
+	}
+
+	if err := fs.Rename("/foo", "/bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Link("/bar", "/baz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/bar"); err != nil {
+		t.Fatal(err)
+	}
+	// Renaming an unencrypted file over an encrypted one.
+	writeFile(t, fs, "/qux", data)
+	if err := fs.Rename("/plain", "/qux"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the encrypted FS in order to verify that the registry was
+	// persisted.
+	fs, err = NewEncryptedFS(mem, "/", km)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "/baz"); !bytes.Equal(data, got) {
+		t.Fatalf("contents of /baz do not match")
+	}
+	if got := readFile(t, fs, "/qux"); string(got) != "hello" {
+		t.Fatalf("expected hello, but found %q", got)
+	}
+}
+
+func TestEncryptedFSKeyRotation(t *testing.T) {
+	mem := NewMem()
+	km := newTestKeyManager("key1")
+	fs, err := NewEncryptedFS(mem, "/", km)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/a", []byte("a"))
+
+	// Rotate the active key. Existing files remain readable, and are
+	// re-protected with the new key when the registry is next written.
+	km.addKey("key2")
+	writeFile(t, fs, "/b", []byte("b"))
+	delete(km.keys, "key1")
+
+	fs, err = NewEncryptedFS(mem, "/", km)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if got := readFile(t, fs, "/"+name); string(got) != name {
+			t.Fatalf("expected %s, but found %q", name, got)
+		}
+	}
+
+	// The registry cannot be loaded without the key protecting it.
+	if _, err := NewEncryptedFS(mem, "/", newTestKeyManager("key3")); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+}
+
+// registryFS wraps an FS, counting the rewrites of the encryption registry and
+// failing the creation of the file named failCreate.
+type registryFS struct {
+	FS
+	rewrites   int
+	failCreate string
+}
+
+func (fs *registryFS) Create(name string) (File, error) {
+	if name == fs.failCreate {
+		return nil, fmt.Errorf("injected error")
+	}
+	return fs.FS.Create(name)
+}
+
+func (fs *registryFS) Rename(oldname, newname string) error {
+	if fs.PathBase(newname) == EncryptionRegistryFilename {
+		fs.rewrites++
+	}
+	return fs.FS.Rename(oldname, newname)
+}
+
+func TestEncryptedFSRegistry(t *testing.T) {
+	mem := &registryFS{FS: NewMem()}
+	km := newTestKeyManager("key1")
+	fs, err := NewEncryptedFS(mem, "/", km)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes are appended to the registry rather than rewriting it.
+	mem.rewrites = 0
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("/%d", i)
+		writeFile(t, fs, name, []byte(name))
+		if err := fs.Rename(name, name+".renamed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Remove("/0.renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if mem.rewrites != 0 {
+		t.Fatalf("expected no registry rewrites, but found %d", mem.rewrites)
+	}
+
+	// A file whose creation fails is not registered.
+	mem.failCreate = "/failed"
+	if _, err := fs.Create("/failed"); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	mem.failCreate = ""
+	writeFile(t, mem, "/failed", []byte("plain"))
+
+	// A record torn by a crash is ignored.
+	f, err := mem.Open("/" + EncryptionRegistryFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, mem, "/"+EncryptionRegistryFilename, append(registry, 1, 2, 3))
+
+	fs, err = NewEncryptedFS(mem, "/", km)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 10; i++ {
+		name := fmt.Sprintf("/%d", i)
+		if got := readFile(t, fs, name+".renamed"); string(got) != name {
+			t.Fatalf("expected %s, but found %q", name, got)
+		}
+	}
+	if got := readFile(t, fs, "/failed"); string(got) != "plain" {
+		t.Fatalf("expected plain, but found %q", got)
+	}
+}
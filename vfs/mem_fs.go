@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path"
 	"sort"
@@ -21,23 +22,48 @@ const sep = "/"
 
 // NewMem returns a new memory-backed FS implementation.
 func NewMem() FS {
-	return &memFS{
+	return newMem(false /* strict */)
+}
+
+// NewStrictMem returns a new memory-backed FS implementation which tracks the
+// data and directory entries which have been synced, allowing a crash to be
+// simulated with MemFS.ResetToSyncedState.
+func NewStrictMem() *MemFS {
+	return newMem(true /* strict */)
+}
+
+func newMem(strict bool) *MemFS {
+	return &MemFS{
 		root: &memNode{
-			children: make(map[string]*memNode),
-			isDir:    true,
+			children:       make(map[string]*memNode),
+			syncedChildren: make(map[string]*memNode),
+			isDir:          true,
 		},
+		strict: strict,
 	}
 }
 
-// memFS implements FS.
-type memFS struct {
+// MemFS implements FS.
+//
+// A strict MemFS (see NewStrictMem) tracks which data has been synced. The
+// data written to a file is synced by File.Sync, and the entries of a
+// directory (created, removed, renamed and linked files) are synced by
+// calling Sync on the directory opened with OpenDir. The directories created
+// by MkdirAll are considered to be synced immediately.
+type MemFS struct {
 	mu   sync.Mutex
 	root *memNode
+
+	strict      bool
+	ignoreSyncs bool
+	// capacity is the capacity reported by GetDiskUsage. Zero is reported as
+	// unlimited.
+	capacity uint64
 }
 
-var _ FS = &memFS{}
+var _ FS = &MemFS{}
 
-func (y *memFS) String() string {
+func (y *MemFS) String() string {
 	y.mu.Lock()
 	defer y.mu.Unlock()
 
@@ -62,7 +88,7 @@ func (y *memFS) String() string {
 //   - "/", "y", false
 //   - "/y/", "z", false
 //   - "/y/z/", "", true
-func (y *memFS) walk(fullname string, f func(dir *memNode, frag string, final bool) error) error {
+func (y *MemFS) walk(fullname string, f func(dir *memNode, frag string, final bool) error) error {
 	y.mu.Lock()
 	defer y.mu.Unlock()
 
@@ -110,7 +136,8 @@ func (y *memFS) walk(fullname string, f func(dir *memNode, frag string, final bo
 	return nil
 }
 
-func (y *memFS) Create(fullname string) (File, error) {
+// Create implements FS.Create.
+func (y *MemFS) Create(fullname string) (File, error) {
 	var ret *memFile
 	err := y.walk(fullname, func(dir *memNode, frag string, final bool) error {
 		if final {
@@ -120,6 +147,7 @@ func (y *memFS) Create(fullname string) (File, error) {
 			n := &memNode{name: frag}
 			dir.children[frag] = n
 			ret = &memFile{
+				fs:    y,
 				n:     n,
 				write: true,
 			}
@@ -132,7 +160,8 @@ func (y *memFS) Create(fullname string) (File, error) {
 	return ret, nil
 }
 
-func (y *memFS) Link(oldname, newname string) error {
+// Link implements FS.Link.
+func (y *MemFS) Link(oldname, newname string) error {
 	var n *memNode
 	err := y.walk(oldname, func(dir *memNode, frag string, final bool) error {
 		if final {
@@ -164,7 +193,7 @@ func (y *memFS) Link(oldname, newname string) error {
 	})
 }
 
-func (y *memFS) open(fullname string, allowEmptyName bool) (File, error) {
+func (y *MemFS) open(fullname string, allowEmptyName bool) (File, error) {
 	var ret *memFile
 	err := y.walk(fullname, func(dir *memNode, frag string, final bool) error {
 		if final {
@@ -173,12 +202,14 @@ func (y *memFS) open(fullname string, allowEmptyName bool) (File, error) {
 					return errors.New("pebble/vfs: empty file name")
 				}
 				ret = &memFile{
-					n: dir,
+					fs: y,
+					n:  dir,
 				}
 				return nil
 			}
 			if n := dir.children[frag]; n != nil {
 				ret = &memFile{
+					fs:   y,
 					n:    n,
 					read: true,
 				}
@@ -199,15 +230,18 @@ func (y *memFS) open(fullname string, allowEmptyName bool) (File, error) {
 	return ret, nil
 }
 
-func (y *memFS) Open(fullname string, opts ...OpenOption) (File, error) {
+// Open implements FS.Open.
+func (y *MemFS) Open(fullname string, opts ...OpenOption) (File, error) {
 	return y.open(fullname, false /* allowEmptyName */)
 }
 
-func (y *memFS) OpenDir(fullname string) (File, error) {
+// OpenDir implements FS.OpenDir.
+func (y *MemFS) OpenDir(fullname string) (File, error) {
 	return y.open(fullname, true /* allowEmptyName */)
 }
 
-func (y *memFS) Remove(fullname string) error {
+// Remove implements FS.Remove.
+func (y *MemFS) Remove(fullname string) error {
 	return y.walk(fullname, func(dir *memNode, frag string, final bool) error {
 		if final {
 			if frag == "" {
@@ -223,7 +257,8 @@ func (y *memFS) Remove(fullname string) error {
 	})
 }
 
-func (y *memFS) Rename(oldname, newname string) error {
+// Rename implements FS.Rename.
+func (y *MemFS) Rename(oldname, newname string) error {
 	var n *memNode
 	err := y.walk(oldname, func(dir *memNode, frag string, final bool) error {
 		if final {
@@ -256,7 +291,8 @@ func (y *memFS) Rename(oldname, newname string) error {
 	})
 }
 
-func (y *memFS) MkdirAll(dirname string, perm os.FileMode) error {
+// MkdirAll implements FS.MkdirAll.
+func (y *MemFS) MkdirAll(dirname string, perm os.FileMode) error {
 	return y.walk(dirname, func(dir *memNode, frag string, final bool) error {
 		if frag == "" {
 			if final {
@@ -266,11 +302,14 @@ func (y *memFS) MkdirAll(dirname string, perm os.FileMode) error {
 		}
 		child := dir.children[frag]
 		if child == nil {
-			dir.children[frag] = &memNode{
-				name:     frag,
-				children: make(map[string]*memNode),
-				isDir:    true,
+			child = &memNode{
+				name:           frag,
+				children:       make(map[string]*memNode),
+				syncedChildren: make(map[string]*memNode),
+				isDir:          true,
 			}
+			dir.children[frag] = child
+			dir.syncedChildren[frag] = child
 			return nil
 		}
 		if !child.isDir {
@@ -284,14 +323,16 @@ func (y *memFS) MkdirAll(dirname string, perm os.FileMode) error {
 	})
 }
 
-func (y *memFS) Lock(fullname string) (io.Closer, error) {
+// Lock implements FS.Lock.
+func (y *MemFS) Lock(fullname string) (io.Closer, error) {
 	// FS.Lock excludes other processes, but other processes cannot see this
 	// process' memory. We translate Lock into Create so that have the normal
 	// detection of non-existent directory paths.
 	return y.Create(fullname)
 }
 
-func (y *memFS) List(dirname string) ([]string, error) {
+// List implements FS.List.
+func (y *MemFS) List(dirname string) ([]string, error) {
 	if !strings.HasSuffix(dirname, sep) {
 		dirname += sep
 	}
@@ -311,7 +352,8 @@ func (y *memFS) List(dirname string) ([]string, error) {
 	return ret, err
 }
 
-func (y *memFS) Stat(name string) (os.FileInfo, error) {
+// Stat implements FS.Stat.
+func (y *MemFS) Stat(name string) (os.FileInfo, error) {
 	f, err := y.Open(name)
 	if err != nil {
 		if pe, ok := err.(*os.PathError); ok {
@@ -323,18 +365,91 @@ func (y *memFS) Stat(name string) (os.FileInfo, error) {
 	return f.Stat()
 }
 
-func (*memFS) PathBase(p string) string {
-	// Note that memFS uses forward slashes for its separator, hence the use of
+// PathBase implements FS.PathBase.
+func (*MemFS) PathBase(p string) string {
+	// Note that MemFS uses forward slashes for its separator, hence the use of
 	// path.Base, not filepath.Base.
 	return path.Base(p)
 }
 
-func (*memFS) PathJoin(elem ...string) string {
-	// Note that memFS uses forward slashes for its separator, hence the use of
+// PathJoin implements FS.PathJoin.
+func (*MemFS) PathJoin(elem ...string) string {
+	// Note that MemFS uses forward slashes for its separator, hence the use of
 	// path.Join, not filepath.Join.
 	return path.Join(elem...)
 }
 
+// GetDiskUsage implements FS.GetDiskUsage. The bytes used are the total size
+// of the files in the MemFS, and the bytes available are the remainder of the
+// capacity set by SetDiskCapacity.
+func (y *MemFS) GetDiskUsage(string) (DiskUsage, error) {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+
+	// Hard links share a node, which is only counted once.
+	seen := make(map[*memNode]struct{})
+	var used uint64
+	var walk func(n *memNode)
+	walk = func(n *memNode) {
+		if _, ok := seen[n]; ok {
+			return
+		}
+		seen[n] = struct{}{}
+		used += uint64(len(n.data))
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(y.root)
+
+	total := y.capacity
+	if total == 0 {
+		total = math.MaxUint64
+	}
+	var avail uint64
+	if used < total {
+		avail = total - used
+	}
+	return DiskUsage{
+		AvailBytes: avail,
+		TotalBytes: total,
+		UsedBytes:  used,
+	}, nil
+}
+
+// SetDiskCapacity sets the capacity, in bytes, reported by GetDiskUsage. A
+// capacity of zero, the default, is unlimited. The capacity is not enforced:
+// writes succeed regardless of the space available.
+func (y *MemFS) SetDiskCapacity(capacity uint64) {
+	y.mu.Lock()
+	y.capacity = capacity
+	y.mu.Unlock()
+}
+
+// SetIgnoreSyncs sets whether calls to Sync are ignored, which is useful for
+// preventing data written after a simulated crash point (such as while closing
+// a DB) from being synced. The MemFS must be strict.
+func (y *MemFS) SetIgnoreSyncs(ignoreSyncs bool) {
+	if !y.strict {
+		panic("pebble/vfs: SetIgnoreSyncs requires a strict MemFS")
+	}
+	y.mu.Lock()
+	y.ignoreSyncs = ignoreSyncs
+	y.mu.Unlock()
+}
+
+// ResetToSyncedState discards the data and directory entries which have not
+// been synced, simulating a crash. The MemFS must be strict. Files which are
+// open when ResetToSyncedState is called must not be used afterwards.
+func (y *MemFS) ResetToSyncedState() {
+	if !y.strict {
+		panic("pebble/vfs: ResetToSyncedState requires a strict MemFS")
+	}
+	y.mu.Lock()
+	y.root.resetToSyncedState()
+	y.mu.Unlock()
+}
+
 // memNode holds a file's data or a directory's children, and implements os.FileInfo.
 type memNode struct {
 	name     string
@@ -342,6 +457,26 @@ type memNode struct {
 	modTime  time.Time
 	children map[string]*memNode
 	isDir    bool
+
+	// The state of the node as of the last sync, which is only tracked by a
+	// strict MemFS. Files are only ever appended to, so the synced data is the
+	// prefix of the data of length syncedLen.
+	syncedLen      int
+	syncedChildren map[string]*memNode
+}
+
+func (f *memNode) resetToSyncedState() {
+	if !f.isDir {
+		f.data = f.data[:f.syncedLen:f.syncedLen]
+		return
+	}
+	f.children = make(map[string]*memNode, len(f.syncedChildren))
+	for name, n := range f.syncedChildren {
+		f.children[name] = n
+	}
+	for _, n := range f.children {
+		n.resetToSyncedState()
+	}
 }
 
 func (f *memNode) IsDir() bool {
@@ -399,6 +534,7 @@ func (f *memNode) dump(w *bytes.Buffer, level int) {
 
 // memFile is a reader or writer of a node's data, and implements File.
 type memFile struct {
+	fs          *MemFS
 	n           *memNode
 	rpos        int
 	read, write bool
@@ -443,6 +579,8 @@ func (f *memFile) Write(p []byte) (int, error) {
 	if f.n.isDir {
 		return 0, errors.New("pebble/vfs: cannot write a directory")
 	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
 	f.n.modTime = time.Now()
 	f.n.data = append(f.n.data, p...)
 	return len(p), nil
@@ -453,5 +591,21 @@ func (f *memFile) Stat() (os.FileInfo, error) {
 }
 
 func (f *memFile) Sync() error {
+	if !f.fs.strict {
+		return nil
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.ignoreSyncs {
+		return nil
+	}
+	if f.n.isDir {
+		f.n.syncedChildren = make(map[string]*memNode, len(f.n.children))
+		for name, n := range f.n.children {
+			f.n.syncedChildren[name] = n
+		}
+	} else {
+		f.n.syncedLen = len(f.n.data)
+	}
 	return nil
 }
@@ -6,6 +6,8 @@ package vfs
 
 import (
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"sort"
 	"strconv"
@@ -186,7 +188,7 @@ func TestList(t *testing.T) {
 	}
 
 	{
-		got := fs.(*memFS).String()
+		got := fs.(*MemFS).String()
 		const want = `          /
        0    a
             bar/
@@ -231,3 +233,168 @@ func TestList(t *testing.T) {
 		}
 	}
 }
+
+func TestStrictFS(t *testing.T) {
+	fs := NewStrictMem()
+	if err := fs.MkdirAll("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.OpenDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name, data string, sync bool) {
+		t.Helper()
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if sync {
+			if err := f.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := f.Write([]byte("-unsynced")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read := func(name string) string {
+		t.Helper()
+		f, err := fs.Open(name)
+		if err != nil {
+			return err.Error()
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	list := func() string {
+		t.Helper()
+		names, err := fs.List("dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+
+	write("dir/a", "a", true)
+	write("dir/b", "b", false)
+	if err := dir.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	write("dir/c", "c", true)
+	if err := fs.Rename("dir/a", "dir/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Link("dir/b", "dir/e"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := list(), "b c d e"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// The unsynced data and directory entries are discarded.
+	fs.ResetToSyncedState()
+	if got, want := list(), "a b"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got, want := read("dir/a"), "a"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got, want := read("dir/b"), ""; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// Syncs are ignored while SetIgnoreSyncs is enabled.
+	fs.SetIgnoreSyncs(true)
+	write("dir/f", "f", true)
+	if err := dir.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetIgnoreSyncs(false)
+	fs.ResetToSyncedState()
+	if got, want := list(), "a b"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// Once synced, the renames and links survive.
+	if err := fs.Rename("dir/a", "dir/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("dir/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	fs.ResetToSyncedState()
+	if got, want := list(), "d"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got, want := read("dir/d"), "a"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestMemFSDiskUsage(t *testing.T) {
+	fs := NewMem().(*MemFS)
+	create := func(name string, size int) {
+		t.Helper()
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(expected DiskUsage) {
+		t.Helper()
+		usage, err := fs.GetDiskUsage("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected != usage {
+			t.Fatalf("expected %+v, but found %+v", expected, usage)
+		}
+	}
+
+	if err := fs.MkdirAll("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	create("a", 10)
+	create("dir/b", 20)
+	check(DiskUsage{AvailBytes: math.MaxUint64 - 30, TotalBytes: math.MaxUint64, UsedBytes: 30})
+
+	// A hard link does not use any more space.
+	if err := fs.Link("dir/b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetDiskCapacity(100)
+	check(DiskUsage{AvailBytes: 70, TotalBytes: 100, UsedBytes: 30})
+
+	if err := fs.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	check(DiskUsage{AvailBytes: 80, TotalBytes: 100, UsedBytes: 20})
+
+	// The capacity is not enforced.
+	create("d", 90)
+	check(DiskUsage{AvailBytes: 0, TotalBytes: 100, UsedBytes: 110})
+}
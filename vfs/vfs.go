@@ -97,6 +97,23 @@ type FS interface {
 	// PathJoin joins any number of path elements into a single path, adding a
 	// separator if necessary.
 	PathJoin(elem ...string) string
+
+	// GetDiskUsage returns disk space statistics for the filesystem where
+	// path is any file or directory within that filesystem.
+	GetDiskUsage(path string) (DiskUsage, error)
+}
+
+// DiskUsage summarizes disk space usage on a filesystem.
+type DiskUsage struct {
+	// AvailBytes is the total number of free bytes available to a
+	// non-privileged user.
+	AvailBytes uint64
+	// TotalBytes is the total number of bytes on the filesystem.
+	TotalBytes uint64
+	// UsedBytes is the total number of bytes in use on the filesystem. Note
+	// that UsedBytes + AvailBytes may be less than TotalBytes, as a portion of
+	// the free space may be reserved for privileged users.
+	UsedBytes uint64
 }
 
 // Default is a FS implementation backed by the underlying operating system's